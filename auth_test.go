@@ -0,0 +1,62 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secrets := filepath.Join(tmp, "secrets")
+	if err := ioutil.WriteFile(secrets, []byte("alice:s3cret\nalice:ignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modules := []rsyncd.Module{
+		{
+			Name:        "interop",
+			Path:        source,
+			AuthUsers:   []string{"alice"},
+			SecretsFile: secrets,
+		},
+	}
+	loaded, err := rsyncd.LoadSecrets(modules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The loaded secrets must be used even once the file is unreachable, as
+	// is the case after changing the root directory.
+	if err := os.Remove(secrets); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, modules,
+		rsynctest.ServerOptions(rsyncd.WithSecrets(loaded)))
+
+	os.Setenv("RSYNC_PASSWORD", "s3cret")
+	defer os.Unsetenv("RSYNC_PASSWORD")
+	dest := t.TempDir()
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://alice@localhost:" + srv.Port + "/interop/",
+		dest + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "hello")); err != nil {
+		t.Fatal(err)
+	}
+}
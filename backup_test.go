@@ -0,0 +1,156 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBackupInfo(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	for fn, content := range map[string]string{
+		"changed":     "new content",
+		"sub/changed": "new content",
+		"unchanged":   "same",
+		"added":       "added",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// populate creates a destination with old versions of the files.
+	populate := func(t *testing.T) string {
+		dest := filepath.Join(t.TempDir(), "dest")
+		old := time.Now().Add(-1 * time.Hour)
+		for fn, content := range map[string]string{
+			"changed":     "old content",
+			"sub/changed": "old content",
+			"unchanged":   "same",
+			"extra":       "extra",
+		} {
+			fn = filepath.Join(dest, fn)
+			if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, fn := range []string{"changed", "sub/changed"} {
+			if err := os.Chtimes(filepath.Join(dest, fn), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// make “unchanged” match the source, so that it is skipped
+		st, err := os.Stat(filepath.Join(source, "unchanged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dest, "unchanged"), st.ModTime(), st.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		return dest
+	}
+
+	run := func(t *testing.T, dest string, extra ...string) []string {
+		args := append([]string{"gokr-rsync", "-a", "--delete", "--info=backup"}, extra...)
+		args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+		var stdout bytes.Buffer
+		if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if strings.HasPrefix(line, "backed up ") {
+				lines = append(lines, line)
+			}
+		}
+		sort.Strings(lines)
+		return lines
+	}
+
+	readFile := func(t *testing.T, fn string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("Suffix", func(t *testing.T) {
+		dest := populate(t)
+		got := run(t, dest, "-b")
+		want := []string{
+			"backed up changed to changed~",
+			"backed up extra to extra~",
+			"backed up sub/changed to sub/changed~",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected backup report: diff (-want +got):\n%s", diff)
+		}
+		if got, want := readFile(t, filepath.Join(dest, "changed~")), "old content"; got != want {
+			t.Errorf("backup content: got %q, want %q", got, want)
+		}
+		if got, want := readFile(t, filepath.Join(dest, "changed")), "new content"; got != want {
+			t.Errorf("updated content: got %q, want %q", got, want)
+		}
+
+		// A second run must neither delete nor back up the backups.
+		if got := run(t, dest, "-b"); len(got) != 0 {
+			t.Errorf("unexpected backups in second run: %q", got)
+		}
+		if got, want := readFile(t, filepath.Join(dest, "extra~")), "extra"; got != want {
+			t.Errorf("backup of deleted file: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("BackupDir", func(t *testing.T) {
+		dest := populate(t)
+		got := run(t, dest, "--backup-dir=backups")
+		want := []string{
+			"backed up changed to backups/changed",
+			"backed up extra to backups/extra",
+			"backed up sub/changed to backups/sub/changed",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected backup report: diff (-want +got):\n%s", diff)
+		}
+		if got, want := readFile(t, filepath.Join(dest, "backups", "sub", "changed")), "old content"; got != want {
+			t.Errorf("backup content: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("NoInfo", func(t *testing.T) {
+		dest := populate(t)
+		args := []string{"gokr-rsync", "-a", "-b", "rsync://localhost:" + srv.Port + "/interop/", dest}
+		var stdout bytes.Buffer
+		if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(stdout.String(), "backed up") {
+			t.Errorf("backups reported without --info=backup: %q", stdout.String())
+		}
+		if got, want := readFile(t, filepath.Join(dest, "changed~")), "old content"; got != want {
+			t.Errorf("backup content: got %q, want %q", got, want)
+		}
+	})
+}
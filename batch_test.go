@@ -0,0 +1,90 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBatch(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	write := func(fn string, content []byte) {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := bytes.Repeat([]byte("batch data "), 10000)
+	write(filepath.Join(source, "new"), []byte("new file"))
+	write(filepath.Join(source, "sub", "changed"), append(append([]byte{}, large...), "appended"...))
+	write(filepath.Join(source, "sub", "unchanged"), []byte("unchanged"))
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range []struct {
+		name  string
+		batch string
+		gzip  bool
+	}{
+		{name: "Plain", batch: "batch"},
+		{name: "Gzip", batch: "batch.gz", gzip: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			batch := filepath.Join(tmp, tt.batch)
+			// Both destinations start out with the same (partially up to
+			// date) contents.
+			dests := []string{filepath.Join(tmp, "dest1"), filepath.Join(tmp, "dest2")}
+			for _, dest := range dests {
+				write(filepath.Join(dest, "sub", "changed"), large)
+				write(filepath.Join(dest, "sub", "unchanged"), []byte("unchanged"))
+			}
+
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				"-z",
+				"--write-batch=" + batch,
+				"rsync://localhost:" + srv.Port + "/interop/",
+				dests[0],
+			}
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ioutil.ReadFile(batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.HasPrefix(b, []byte{0x1f, 0x8b}); got != tt.gzip {
+				t.Errorf("batch file gzip-compressed = %v, want %v", got, tt.gzip)
+			}
+
+			// Apply the batch without a connection.
+			args = []string{
+				"gokr-rsync",
+				"--read-batch=" + batch,
+				dests[1],
+			}
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dest := range dests {
+				if diff := cmp.Diff(treeContents(t, source), treeContents(t, dest)); diff != "" {
+					t.Errorf("%s: unexpected contents: diff (-source +dest):\n%s", dest, diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestBlockSize(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range []struct {
+		blockSize string
+		wantDelta bool // whether unchanged blocks of the basis file are used
+	}{
+		{blockSize: "1024", wantDelta: true},
+		{blockSize: "536870912", wantDelta: false}, // one block for the whole file
+	} {
+		t.Run(tt.blockSize, func(t *testing.T) {
+			// The destination contains an older version of the file, which
+			// differs in its first few bytes.
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			basis := append([]byte(nil), content...)
+			copy(basis, "changed")
+			if err := ioutil.WriteFile(filepath.Join(dest, "file"), basis, 0644); err != nil {
+				t.Fatal(err)
+			}
+			old := time.Now().Add(-1 * time.Hour)
+			if err := os.Chtimes(filepath.Join(dest, "file"), old, old); err != nil {
+				t.Fatal(err)
+			}
+
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				"--block-size=" + tt.blockSize,
+				"rsync://localhost:" + srv.Port + "/interop/",
+				dest + "/",
+			}
+			stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dest, "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("file differs from the source after the transfer")
+			}
+			// Written is reported by the sender, i.e. what the client received.
+			if delta := stats.Written < int64(len(content)/2); delta != tt.wantDelta {
+				t.Errorf("received %d bytes on the wire for a %d byte file: delta transfer = %v, want %v", stats.Written, len(content), delta, tt.wantDelta)
+			}
+		})
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"--block-size=536870913",
+			"rsync://localhost:" + srv.Port + "/interop/",
+			filepath.Join(t.TempDir(), "dest") + "/",
+		}
+		_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+		if err == nil || !strings.Contains(err.Error(), "--block-size=536870913 is too large") {
+			t.Fatalf("Main: err = %v, want --block-size is too large error", err)
+		}
+	})
+}
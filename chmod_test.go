@@ -0,0 +1,123 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestChmodPrecedence(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := filepath.Join(source, "hello")
+	if err := ioutil.WriteFile(hello, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The umask might have prevented the permission bits we want:
+	if err := os.Chmod(hello, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The module removes read permission for others from all files, the client
+	// then grants read permission for others and removes it for the group.
+	// Because the client’s --chmod is applied on top of what the module sends,
+	// the resulting mode is 0604. If the order was reversed, the module would
+	// remove the permission the client granted, resulting in 0600.
+	modules := rsynctest.InteropModule(source)
+	modules[0].OutgoingChmod = "Fo-r"
+	srv := rsynctest.New(t, modules)
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--chmod=Fo+r,Fg-r",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(filepath.Join(dest, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0604); got != want {
+		t.Errorf("unexpected file mode: got %v, want %v", got, want)
+	}
+
+	// Neither chmod setting applies to directories (F prefix):
+	st, err = os.Stat(filepath.Join(dest, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0755); got != want {
+		t.Errorf("unexpected directory mode: got %v, want %v", got, want)
+	}
+}
+
+func TestInteropUploadChmodPrecedence(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := filepath.Join(source, "hello")
+	if err := ioutil.WriteFile(hello, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(hello, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client grants execute permission for the user and removes read
+	// permission for others, the module then grants read permission for
+	// others. Because the module’s incoming chmod is applied after the
+	// client’s --chmod, the resulting mode is 0744. If the order was
+	// reversed, the client would remove the permission the module granted,
+	// resulting in 0740.
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:          "interop",
+			Path:          dest,
+			Writable:      true,
+			IncomingChmod: "Fo+r",
+		},
+	})
+
+	rsync := exec.Command("rsync",
+		"--archive",
+		"--chmod=Fu+x,Fo-r",
+		"--port="+srv.Port,
+		source+"/",
+		"rsync://localhost/interop/")
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+
+	st, err := os.Stat(filepath.Join(dest, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), os.FileMode(0744); got != want {
+		t.Errorf("unexpected file mode: got %v, want %v", got, want)
+	}
+}
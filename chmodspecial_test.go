@@ -0,0 +1,105 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"golang.org/x/sys/unix"
+)
+
+func TestChmodSymlinksSpecials(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := filepath.Join(source, "hello")
+	if err := ioutil.WriteFile(hello, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(hello, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(source, "fifo")
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello", filepath.Join(source, "hello.link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir", filepath.Join(source, "dir.link")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// Like in rsync, “X” looks at the mode before applying any specification,
+	// so “a+X” does not grant execute permission to non-executable files even
+	// though “u+x” ran before it. The specification is not idempotent: applying
+	// it twice would result in 0755 instead of 0744.
+	args := []string{
+		"gokr-rsync",
+		"-aD",
+		"--chmod=Fu+x,Fa+X,Do-rx",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want os.FileMode
+	}{
+		{"hello", 0744},
+		{"fifo", os.ModeNamedPipe | 0744},
+		{"dir", os.ModeDir | 0750},
+	} {
+		st, err := os.Lstat(filepath.Join(dest, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode(); got != tt.want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The symbolic links are transferred as-is, and neither the D nor the F
+	// prefix modify the files they point to once more.
+	for name, target := range map[string]string{
+		"hello.link": "hello",
+		"dir.link":   "dir",
+	} {
+		fn := filepath.Join(dest, name)
+		st, err := os.Lstat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s: unexpectedly not a symlink: %v", name, st.Mode())
+			continue
+		}
+		got, err := os.Readlink(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != target {
+			t.Errorf("%s: unexpected target: got %q, want %q", name, got, target)
+		}
+	}
+}
@@ -2,14 +2,21 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 
+	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/receivermaincmd"
 )
 
 func main() {
 	if _, err := receivermaincmd.Main(os.Args, os.Stdin, os.Stdout, os.Stderr); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		var ee *rsync.ExitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.Code)
+		}
+		os.Exit(1)
 	}
 }
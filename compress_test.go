@@ -0,0 +1,221 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// compressibleData returns n bytes of text which compresses well, but not
+// trivially so (about 5:1 with the default level).
+func compressibleData(seed int64, n int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor incididunt ut labore et dolore magna aliqua")
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		if rnd.Intn(12) == 0 {
+			buf.WriteString(".\n")
+		} else {
+			buf.WriteByte(' ')
+		}
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestCompress(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	large := compressibleData(1, 1<<20)
+	if err := ioutil.WriteFile(filepath.Join(source, "large"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "small"), []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	sync := func(t *testing.T) {
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"-z",
+			"rsync://localhost:" + srv.Port + "/interop/",
+			dest,
+		}
+		if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+			t.Fatal(err)
+		}
+		for _, fn := range []string{"large", "small"} {
+			want, err := ioutil.ReadFile(filepath.Join(source, fn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dest, fn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: content mismatch after compressed transfer", fn)
+			}
+		}
+	}
+
+	t.Run("WholeFile", sync)
+
+	// Modify the source so that the next transfer consists of both matched
+	// blocks and (compressed) literal data.
+	modified := append([]byte{}, large[:300<<10]...)
+	modified = append(modified, compressibleData(2, 50<<10)...)
+	modified = append(modified, large[400<<10:]...)
+	if err := ioutil.WriteFile(filepath.Join(source, "large"), modified, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Ensure the modification time differs from the destination file.
+	mtime := time.Now().Add(-1 * time.Hour)
+	if err := os.Chtimes(filepath.Join(source, "large"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Delta", sync)
+}
+
+func TestCompressBwLimit(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const size = 512 << 10
+	if err := ioutil.WriteFile(filepath.Join(source, "data"), compressibleData(1, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	const limit = 100 // KiB/s
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"-z",
+		"--bwlimit=100",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	start := time.Now()
+	stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	// The limit applies to the compressed bytes on the wire, so the file
+	// data arrives considerably faster than the limit, while the on-wire
+	// rate matches the limit.
+	wireRate := float64(stats.Written) / 1024 / elapsed.Seconds()
+	dataRate := float64(size) / 1024 / elapsed.Seconds()
+	t.Logf("received %d bytes on the wire (%d bytes of data) in %v: %.1f KiB/s on the wire, %.1f KiB/s of data",
+		stats.Written, size, elapsed, wireRate, dataRate)
+	if stats.Written >= size/2 {
+		t.Fatalf("data not compressed: received %d bytes on the wire for %d bytes of data", stats.Written, size)
+	}
+	if wireRate > limit*1.15 {
+		t.Errorf("on-wire rate %.1f KiB/s exceeds --bwlimit=%d", wireRate, limit)
+	}
+	if wireRate < limit*0.6 {
+		t.Errorf("on-wire rate %.1f KiB/s unexpectedly far below --bwlimit=%d", wireRate, limit)
+	}
+	if dataRate < limit*1.5 {
+		t.Errorf("data rate %.1f KiB/s not above --bwlimit=%d: limit applied to uncompressed bytes?", dataRate, limit)
+	}
+}
+
+func TestCompressStats(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const size = 1 << 20
+	if err := ioutil.WriteFile(filepath.Join(source, "data"), compressibleData(1, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	var stdout bytes.Buffer
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"-z",
+		"--stats",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	stats, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := stdout.String()
+
+	// value returns the value of the --stats line with the specified label.
+	value := func(label string) string {
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, label+": ") {
+				return strings.TrimSuffix(strings.TrimPrefix(line, label+": "), " bytes")
+			}
+		}
+		t.Fatalf("--stats output does not contain %q:\n%s", label, output)
+		return ""
+	}
+	number := func(label string) int64 {
+		n, err := strconv.ParseInt(strings.ReplaceAll(value(label), ",", ""), 0, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	uncompressed := number("Uncompressed data")
+	compressed := number("Compressed data")
+	ratio, err := strconv.ParseFloat(value("Compression ratio"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("uncompressed=%d, compressed=%d, ratio=%.2f, on the wire=%d", uncompressed, compressed, ratio, stats.Written)
+
+	// The whole file is transferred as literal data.
+	if uncompressed != size {
+		t.Errorf("uncompressed data: got %d bytes, want %d", uncompressed, size)
+	}
+	if uncompressed != stats.UncompressedData || compressed != stats.CompressedData {
+		t.Errorf("--stats output (%d/%d) does not match Stats (%d/%d)",
+			uncompressed, compressed, stats.UncompressedData, stats.CompressedData)
+	}
+	// The compressed data is part of what the server sent.
+	if compressed >= stats.Written {
+		t.Errorf("compressed data (%d bytes) not less than the bytes on the wire (%d)", compressed, stats.Written)
+	}
+	if ratio <= 1 {
+		t.Errorf("compression ratio %.2f, want > 1", ratio)
+	}
+	if want := float64(uncompressed) / float64(compressed); math.Abs(ratio-want) > 0.01 {
+		t.Errorf("compression ratio %.2f does not match the byte counts (%.2f)", ratio, want)
+	}
+}
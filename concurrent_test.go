@@ -0,0 +1,83 @@
+package rsync_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// TestConcurrentReads pulls the same large file from multiple clients at
+// once. Run with -race to detect read state shared between the connections.
+func TestConcurrentReads(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile(filepath.Join(source, "large"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	const clients = 8
+	var wg sync.WaitGroup
+	errs := make([]error, clients)
+	dests := make([]string, clients)
+	for i := 0; i < clients; i++ {
+		dest := filepath.Join(tmp, fmt.Sprintf("dest%d", i))
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		dests[i] = dest
+		args := []string{"gokr-rsync", "-a"}
+		switch i % 3 {
+		case 1:
+			// An outdated destination file makes the sender search for
+			// matching blocks (delta transfer).
+			basis := append([]byte(nil), content...)
+			copy(basis[len(basis)/2:], "outdated")
+			fn := filepath.Join(dest, "large")
+			if err := ioutil.WriteFile(fn, basis, 0644); err != nil {
+				t.Fatal(err)
+			}
+			past := time.Now().Add(-1 * time.Hour)
+			if err := os.Chtimes(fn, past, past); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			args = append(args, "-z")
+		}
+		args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest+"/")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, dest := range dests {
+		if errs[i] != nil {
+			t.Errorf("client %d: %v", i, errs[i])
+			continue
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("client %d: %s differs from the source", i, dest)
+		}
+	}
+}
@@ -17,6 +17,13 @@ const (
 	XMIT_RDEV_MINOR_IS_SMALL = (1 << 11)
 )
 
+// rsync.h: bits of the i/o error flag which the sender transmits after the
+// file list. The receiver skips deletions if any bit is set.
+const (
+	IOERR_GENERAL  = (1 << 0) // For backward compatibility, this must == 1
+	IOERR_VANISHED = (1 << 1)
+)
+
 // as per /usr/include/bits/stat.h:
 const (
 	S_IFMT   = 0o0170000 // bits determining the file type
@@ -0,0 +1,103 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestCopyDest(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	basis := filepath.Join(tmp, "basis")
+	dest := filepath.Join(tmp, "dest")
+
+	mtime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	write := func(fn string, content []byte, perm fs.FileMode, mtime time.Time) {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fn, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := bytes.Repeat([]byte("basis data "), 10000)
+	changed := append(append([]byte{}, large...), "appended in source"...)
+
+	// The unchanged file only differs in its permissions, the changed file
+	// differs in its content (the basis is still useful for the transfer).
+	write(filepath.Join(source, "unchanged"), []byte("same content"), 0755, mtime)
+	write(filepath.Join(basis, "unchanged"), []byte("same content"), 0600, mtime)
+	write(filepath.Join(source, "sub", "changed"), changed, 0644, mtime)
+	write(filepath.Join(basis, "sub", "changed"), large, 0644, mtime.Add(-1*time.Hour))
+	write(filepath.Join(source, "new"), []byte("not in basis"), 0644, mtime)
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// A relative --copy-dest is relative to the destination.
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--copy-dest=../basis",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for fn, want := range map[string][]byte{
+		"unchanged":   []byte("same content"),
+		"sub/changed": changed,
+		"new":         []byte("not in basis"),
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: unexpected content (%d bytes, want %d bytes)", fn, len(got), len(want))
+		}
+	}
+
+	// The local copy has the metadata of the source, not of the basis file.
+	st, err := os.Stat(filepath.Join(dest, "unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), fs.FileMode(0755); got != want {
+		t.Errorf("unchanged: unexpected permissions: got %v, want %v", got, want)
+	}
+	if got, want := st.ModTime(), mtime; !got.Equal(want) {
+		t.Errorf("unchanged: unexpected modification time: got %v, want %v", got, want)
+	}
+
+	// The basis files are left alone.
+	st, err = os.Stat(filepath.Join(basis, "unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.Mode().Perm(), fs.FileMode(0600); got != want {
+		t.Errorf("basis unchanged: unexpected permissions: got %v, want %v", got, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(basis, "sub", "changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, large) {
+		t.Errorf("basis sub/changed was modified")
+	}
+}
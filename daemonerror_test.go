@@ -0,0 +1,85 @@
+package rsync_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestDaemonError(t *testing.T) {
+	modules := rsynctest.InteropModule(t.TempDir())
+	modules[0].ACL = []string{"deny all"}
+	srv := rsynctest.New(t, modules)
+
+	// refusing rejects every connection with an @ERROR line instead of the
+	// server greeting.
+	refusing, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refusing.Close()
+	go func() {
+		for {
+			conn, err := refusing.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "@ERROR: too many connections\n")
+			conn.Close()
+		}
+	}()
+
+	for _, tt := range []struct {
+		desc string
+		url  string
+		want string
+	}{
+		{
+			desc: "UnknownModule",
+			url:  "rsync://localhost:" + srv.Port + "/nonexistent/",
+			want: `daemon error: Unknown module "nonexistent"`,
+		},
+		{
+			desc: "AccessDenied",
+			url:  "rsync://localhost:" + srv.Port + "/interop/",
+			want: "daemon error: access denied",
+		},
+		{
+			desc: "BeforeGreeting",
+			url:  "rsync://" + refusing.Addr().String() + "/interop/",
+			want: "daemon error: too many connections",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				tt.url,
+				dest,
+			}
+			_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+			if err == nil {
+				t.Fatal("transfer unexpectedly succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not contain %q", err, tt.want)
+			}
+			var ee *rsync.ExitError
+			if !errors.As(err, &ee) {
+				t.Fatalf("error %v (%T) is not an *rsync.ExitError", err, err)
+			}
+			if got, want := ee.Code, rsync.RERR_STARTCLIENT; got != want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, want)
+			}
+		})
+	}
+}
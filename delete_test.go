@@ -0,0 +1,185 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeleteDryRun(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for _, fn := range []string{
+		filepath.Join(source, "keep"),
+		filepath.Join(source, "sub", "keep"),
+		filepath.Join(dest, "keep"),
+		filepath.Join(dest, "extra"),
+		filepath.Join(dest, "sub", "keep"),
+		filepath.Join(dest, "sub", "extra"),
+		filepath.Join(dest, "gone", "deeper", "extra"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	run := func(t *testing.T, extra ...string) (*receivermaincmd.Stats, []string, string) {
+		args := append([]string{"gokr-rsync", "-a", "--delete", "-i", "--stats"}, extra...)
+		args = append(args,
+			"rsync://localhost:"+srv.Port+"/interop/",
+			dest)
+		var stdout bytes.Buffer
+		stats, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var deleted []string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if strings.HasPrefix(line, "*deleting   ") {
+				deleted = append(deleted, strings.TrimPrefix(line, "*deleting   "))
+			}
+		}
+		return stats, deleted, stdout.String()
+	}
+
+	// Directory contents are deleted before the directory itself.
+	want := []string{
+		"extra",
+		"gone/deeper/extra",
+		"gone/deeper/",
+		"gone/",
+		"sub/extra",
+	}
+
+	dryStats, dryDeleted, dryOutput := run(t, "--dry-run")
+	if diff := cmp.Diff(want, dryDeleted); diff != "" {
+		t.Errorf("dry-run: unexpected deletions: diff (-want +got):\n%s", diff)
+	}
+	if got, want := dryStats.Deleted, len(want); got != want {
+		t.Errorf("dry-run: unexpected deleted count: got %d, want %d", got, want)
+	}
+	if !strings.Contains(dryOutput, "Number of deleted files: 5\n") {
+		t.Errorf("dry-run: deleted count missing from --stats output:\n%s", dryOutput)
+	}
+	// A dry run must not delete anything:
+	if _, err := os.Stat(filepath.Join(dest, "gone", "deeper", "extra")); err != nil {
+		t.Fatalf("dry-run deleted files: %v", err)
+	}
+
+	stats, deleted, _ := run(t)
+	if diff := cmp.Diff(dryDeleted, deleted); diff != "" {
+		t.Errorf("real run deleted different files than the dry run: diff (-dry +real):\n%s", diff)
+	}
+	if got, want := stats.Deleted, dryStats.Deleted; got != want {
+		t.Errorf("unexpected deleted count: got %d, dry-run predicted %d", got, want)
+	}
+	for _, name := range want {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("%s unexpectedly still exists (err=%v)", name, err)
+		}
+	}
+	for _, name := range []string{"keep", "sub/keep"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("%s unexpectedly deleted: %v", name, err)
+		}
+	}
+}
+
+func TestDeletePopulatedTree(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	outside := filepath.Join(tmp, "outside")
+
+	for _, fn := range []string{
+		filepath.Join(source, "keep"),
+		filepath.Join(dest, "keep"),
+		filepath.Join(dest, "tree", "a"),
+		filepath.Join(dest, "tree", "b", "c"),
+		filepath.Join(dest, "tree", "b", "d", "e"),
+		filepath.Join(dest, "tree", "b", "d", "f"),
+		filepath.Join(dest, "tree", "readonly", "g"),
+		filepath.Join(outside, "precious"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("content"), 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A symlink to a directory must be deleted, not followed.
+	if err := os.Symlink(outside, filepath.Join(dest, "tree", "b", "link")); err != nil {
+		t.Fatal(err)
+	}
+	// Directories without write permission need to be made writable to
+	// delete their contents (unless running as root).
+	if err := os.Chmod(filepath.Join(dest, "tree", "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--delete",
+		"-i",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	var stdout bytes.Buffer
+	stats, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, "*deleting   ") {
+			deleted = append(deleted, strings.TrimPrefix(line, "*deleting   "))
+		}
+	}
+	// Every entry is deleted after all entries within it.
+	for idx, name := range deleted {
+		if !strings.HasSuffix(name, "/") {
+			continue
+		}
+		for _, later := range deleted[idx+1:] {
+			if strings.HasPrefix(later, name) {
+				t.Errorf("%q deleted after its parent directory %q", later, name)
+			}
+		}
+	}
+	const entries = 10 // tree, 3 directories within, 5 files and the symlink
+	if got, want := len(deleted), entries; got != want {
+		t.Errorf("unexpected number of itemized deletions: got %d, want %d: %q", got, want, deleted)
+	}
+	if got, want := stats.Deleted, entries; got != want {
+		t.Errorf("unexpected deleted count: got %d, want %d", got, want)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dest, "tree")); !os.IsNotExist(err) {
+		t.Errorf("tree not deleted: Lstat = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "keep")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "precious")); err != nil {
+		t.Errorf("symlink target deleted: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestDirectoryModTimes(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	dirs := []string{
+		"",
+		"a",
+		"a/b",
+		"a/b/c",
+		"readonly",
+	}
+	for _, dir := range dirs {
+		fn := filepath.Join(source, dir, "file")
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	// Set directory modification times to distinct points in the past, after
+	// the directory contents were created.
+	mtime := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	for idx, dir := range dirs {
+		mtime := mtime.Add(time.Duration(idx) * time.Hour)
+		if err := os.Chtimes(filepath.Join(source, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range dirs {
+		sourcest, err := os.Stat(filepath.Join(source, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		destst, err := os.Stat(filepath.Join(dest, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := destst.ModTime(), sourcest.ModTime(); !got.Equal(want) {
+			t.Errorf("directory %q: unexpected modification time: got %v, want %v", dir, got, want)
+		}
+		if got, want := destst.Mode(), sourcest.Mode(); got != want {
+			t.Errorf("directory %q: unexpected mode: got %v, want %v", dir, got, want)
+		}
+	}
+}
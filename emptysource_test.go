@@ -0,0 +1,107 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestEmptySource(t *testing.T) {
+	for _, tt := range []struct {
+		desc   string
+		source []string // files in the source directory
+		flags  []string
+	}{
+		{desc: "Empty"},
+		{
+			desc:   "FilteredToEmpty",
+			source: []string{"a.log", "b.log"},
+			flags:  []string{"--exclude=*.log"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			if err := os.MkdirAll(source, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, fn := range tt.source {
+				fn = filepath.Join(source, fn)
+				if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fn, []byte("source"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, fn := range []string{"extra", "sub/extra"} {
+				fn = filepath.Join(dest, fn)
+				if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fn, []byte("extra"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			args := append([]string{"gokr-rsync", "-a", "--delete", "--stats"}, tt.flags...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := stats.Deleted, 3; got != want {
+				t.Errorf("unexpected number of deleted entries: got %d, want %d", got, want)
+			}
+			entries, err := os.ReadDir(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("destination not emptied: %v", entries)
+			}
+		})
+	}
+}
+
+func TestEmptyFileList(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "file.log"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	for _, tt := range []struct {
+		desc string
+		args []string
+	}{
+		{"FilesFrom", []string{"--files-from=/dev/null", "rsync://localhost:" + srv.Port + "/interop/"}},
+		{"ExcludedFile", []string{"--exclude=*.log", "rsync://localhost:" + srv.Port + "/interop/file.log"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append(append([]string{"gokr-rsync", "-a"}, tt.args...), dest+"/")
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			// Nothing was transferred, i.e. dest is missing or empty.
+			entries, err := os.ReadDir(dest)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("unexpected destination contents: %v", entries)
+			}
+		})
+	}
+}
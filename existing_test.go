@@ -0,0 +1,100 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExistingDelete(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	write := func(fn, content string) {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fn := range []string{
+		"changed",
+		"sub/changed",
+		"new",
+		"sub/new",
+		"newdir/deeper/new",
+	} {
+		write(filepath.Join(source, fn), "new content")
+	}
+	old := time.Now().Add(-1 * time.Hour)
+	for _, fn := range []string{
+		"changed",
+		"sub/changed",
+		"extra",
+		"sub/extra",
+		"extradir/deeper/extra",
+	} {
+		fn = filepath.Join(dest, fn)
+		write(fn, "old content")
+		if err := os.Chtimes(fn, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--existing",
+		"--delete",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dest, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			got = append(got, rel+"/")
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		got = append(got, rel+": "+string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The changed files were updated, the extra files deleted, and none of
+	// the new files or directories were created.
+	want := []string{
+		"./",
+		"changed: new content",
+		"sub/",
+		"sub/changed: new content",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected destination contents: diff (-want +got):\n%s", diff)
+	}
+}
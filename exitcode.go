@@ -0,0 +1,27 @@
+package rsync
+
+// rsync/errcode.h
+const (
+	RERR_OK          = 0
+	RERR_SYNTAX      = 1  // syntax or usage error
+	RERR_PROTOCOL    = 2  // protocol incompatibility
+	RERR_FILESELECT  = 3  // errors selecting input/output files, dirs
+	RERR_UNSUPPORTED = 4  // requested action not supported
+	RERR_STARTCLIENT = 5  // error starting client-server protocol
+	RERR_SOCKETIO    = 10 // error in socket IO
+	RERR_FILEIO      = 11 // error in file IO
+	RERR_STREAMIO    = 12 // error in rsync protocol data stream
+	RERR_PARTIAL     = 23 // partial transfer
+	RERR_TIMEOUT     = 30 // timeout in data send/receive
+)
+
+// ExitError is an error which determines the exit code of the rsync process,
+// like rsync’s exit_cleanup(code).
+type ExitError struct {
+	Code int // one of the RERR_* constants
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+
+func (e *ExitError) Unwrap() error { return e.Err }
@@ -0,0 +1,181 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+const statXattr = "user.rsync.%stat"
+
+func createFakeSuperSource(t *testing.T, source string) {
+	t.Helper()
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range map[string]os.FileMode{
+		"regular": 0644,
+		"setuid":  0755 | os.ModeSetuid,
+	} {
+		fn := filepath.Join(source, name)
+		if err := ioutil.WriteFile(fn, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The umask might have prevented the permission bits we want:
+		if err := os.Chmod(fn, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fifo := filepath.Join(source, "fifo")
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// statXattrs returns the raw %stat extended attribute of all files in dir.
+func statXattrs(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	xattrs := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		buf := make([]byte, 256)
+		n, err := unix.Lgetxattr(filepath.Join(dir, e.Name()), statXattr, buf)
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		xattrs[e.Name()] = string(buf[:n])
+	}
+	return xattrs
+}
+
+func TestFakeSuper(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	createFakeSuperSource(t, source)
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--fake-super",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fifo and the setuid bit cannot (or must not) be created without
+	// root privileges, so they are only recorded in the extended attribute.
+	// The ownership matches, so it needs no extended attribute by itself.
+	uid, gid := os.Getuid(), os.Getgid()
+	want := map[string]string{
+		"fifo":   fmt.Sprintf("10644 0,0 %d:%d", uid, gid),
+		"setuid": fmt.Sprintf("104755 0,0 %d:%d", uid, gid),
+	}
+	if diff := cmp.Diff(want, statXattrs(t, dest)); diff != "" {
+		t.Fatalf("unexpected %s xattrs: diff (-want +got):\n%s", statXattr, diff)
+	}
+	for name, wantMode := range map[string]os.FileMode{
+		"fifo":    0644,
+		"setuid":  0755,
+		"regular": 0644,
+	} {
+		st, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode(); got != wantMode {
+			t.Errorf("%s: unexpected mode: got %v, want %v", name, got, wantMode)
+		}
+	}
+
+	// Serving dest from a fake super module sends the stored attributes, so
+	// a second --fake-super transfer results in the same extended attributes.
+	modules := rsynctest.InteropModule(dest)
+	modules[0].FakeSuper = true
+	srv = rsynctest.New(t, modules)
+	dest2 := filepath.Join(tmp, "dest2")
+	args = []string{
+		"gokr-rsync",
+		"-a",
+		"--fake-super",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest2,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, statXattrs(t, dest2)); diff != "" {
+		t.Fatalf("unexpected %s xattrs after round trip: diff (-want +got):\n%s", statXattr, diff)
+	}
+}
+
+func TestInteropFakeSuper(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	createFakeSuperSource(t, source)
+
+	// stock rsync writes the reference fake super metadata
+	reference := filepath.Join(tmp, "reference")
+	rsync := exec.Command("rsync", "-a", "--fake-super", source+"/", reference)
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+	want := statXattrs(t, reference)
+
+	// the Go side reads the metadata written by rsync, and writes the same
+	modules := rsynctest.InteropModule(reference)
+	modules[0].FakeSuper = true
+	srv := rsynctest.New(t, modules)
+	dest := filepath.Join(tmp, "dest")
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--fake-super",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, statXattrs(t, dest)); diff != "" {
+		t.Fatalf("unexpected %s xattrs written by gokr-rsync: diff (-want +got):\n%s", statXattr, diff)
+	}
+
+	// stock rsync reads the metadata written by the Go side
+	dest2 := filepath.Join(tmp, "dest2")
+	rsync = exec.Command("rsync", "-a", "--fake-super", dest+"/", dest2)
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+	if diff := cmp.Diff(want, statXattrs(t, dest2)); diff != "" {
+		t.Fatalf("unexpected %s xattrs written by rsync: diff (-want +got):\n%s", statXattr, diff)
+	}
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/fileflags"
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestFileflags(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting the immutable flag requires root")
+	}
+
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Immutable files cannot be removed by t.TempDir’s cleanup.
+	t.Cleanup(func() {
+		filepath.Walk(tmp, func(path string, info os.FileInfo, err error) error {
+			if err == nil && (info.Mode().IsRegular() || info.IsDir()) {
+				fileflags.Set(path, 0, fileflags.Supported)
+			}
+			return nil
+		})
+	})
+
+	nodump := filepath.Join(source, "nodump")
+	immutable := filepath.Join(source, "immutable")
+	plain := filepath.Join(source, "plain")
+	for _, fn := range []string{nodump, immutable, plain} {
+		if err := ioutil.WriteFile(fn, []byte("first"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fileflags.Set(nodump, fileflags.NoDump, fileflags.Supported); err != nil {
+		t.Skipf("file system does not support inode flags: %v", err)
+	}
+	if got, _ := fileflags.Get(nodump); got != fileflags.NoDump {
+		t.Skipf("file system does not support inode flags (got %#x)", got)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	transfer := func() {
+		t.Helper()
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"--fileflags",
+			"rsync://localhost:" + srv.Port + "/interop/",
+			dest,
+		}
+		if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify := func() {
+		t.Helper()
+		for fn, want := range map[string]uint32{
+			"nodump":    fileflags.NoDump,
+			"immutable": fileflags.Immutable,
+			"plain":     0,
+		} {
+			got, err := fileflags.Get(filepath.Join(dest, fn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s: unexpected inode flags: got %#x, want %#x", fn, got, want)
+			}
+		}
+	}
+
+	if err := fileflags.Set(immutable, fileflags.Immutable, fileflags.Supported); err != nil {
+		t.Fatal(err)
+	}
+	transfer()
+	verify()
+
+	// Changing the immutable file in the source replaces the (immutable)
+	// destination file.
+	if err := fileflags.Set(immutable, 0, fileflags.Supported); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(immutable, []byte("second version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileflags.Set(immutable, fileflags.Immutable, fileflags.Supported); err != nil {
+		t.Fatal(err)
+	}
+	transfer()
+	verify()
+	got, err := ioutil.ReadFile(filepath.Join(dest, "immutable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "second version" {
+		t.Errorf("immutable: unexpected contents: got %q, want %q", got, "second version")
+	}
+}
@@ -0,0 +1,138 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilesFromRemoteSource(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for _, fn := range []string{
+		"hello",
+		"world",
+		"dir/nested",
+		"dir/other",
+		"empty/unlisted",
+		"skipped/file",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The names are relative to the remote source directory. Directories are
+	// not traversed, because --files-from does not imply --recursive (not
+	// even via --archive).
+	filesFrom := filepath.Join(tmp, "files-from")
+	list := strings.Join([]string{
+		"# comments are ignored",
+		"hello",
+		"dir/nested",
+		"empty",
+		"/../nonexistant",
+	}, "\n")
+	if err := ioutil.WriteFile(filesFrom, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--files-from=" + filesFrom,
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dest {
+			return nil
+		}
+		got = append(got, strings.TrimPrefix(path, dest+"/"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{
+		"dir",
+		"dir/nested",
+		"empty",
+		"hello",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected destination contents: diff (-want +got):\n%s", diff)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dest, "dir", "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), filepath.Join(source, "dir", "nested"); got != want {
+		t.Errorf("unexpected file contents: got %q, want %q", got, want)
+	}
+}
+
+func TestFilesFromEmpty(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty list transfers nothing, as opposed to the whole module.
+	filesFrom := filepath.Join(tmp, "files-from")
+	if err := ioutil.WriteFile(filesFrom, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--files-from=" + filesFrom,
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("unexpected destination contents: %v", entries)
+	}
+}
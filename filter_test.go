@@ -0,0 +1,450 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilterDotfiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	for _, fn := range []string{
+		"visible",
+		".hidden",
+		".keep",
+		"dir/visible",
+		"dir/.hidden",
+		".git/config",
+		"..dotdot",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// list returns the names of the listing of the module with the specified
+	// filter arguments.
+	list := func(t *testing.T, filters ...string) []string {
+		args := append([]string{"gokr-rsync", "-r"}, filters...)
+		args = append(args, "rsync://localhost:"+srv.Port+"/interop/")
+		var stdout bytes.Buffer
+		if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+			fields := strings.Fields(line)
+			names = append(names, fields[len(fields)-1])
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		filters []string
+		want    []string
+	}{
+		{
+			desc: "no filters",
+			want: []string{
+				".",
+				"..dotdot",
+				".git",
+				".git/config",
+				".hidden",
+				".keep",
+				"dir",
+				"dir/.hidden",
+				"dir/visible",
+				"visible",
+			},
+		},
+
+		{
+			desc:    "star matches dotfiles",
+			filters: []string{"--exclude=*"},
+			want:    []string{"."},
+		},
+
+		{
+			desc:    "star matches dotfiles in subdirectories",
+			filters: []string{"--include=*/", "--exclude", "*"},
+			want:    []string{".", ".git", "dir"},
+		},
+
+		{
+			desc:    "dot star",
+			filters: []string{"--exclude=.*"},
+			want:    []string{".", "dir", "dir/visible", "visible"},
+		},
+
+		{
+			desc:    "first matching rule wins",
+			filters: []string{"--include=.keep", "--exclude=.*"},
+			want:    []string{".", ".keep", "dir", "dir/visible", "visible"},
+		},
+
+		{
+			desc:    "directory rule",
+			filters: []string{"-f", "- .git/"},
+			want:    []string{".", "..dotdot", ".hidden", ".keep", "dir", "dir/.hidden", "dir/visible", "visible"},
+		},
+
+		{
+			desc:    "anchored",
+			filters: []string{"--filter=-_/.hidden"},
+			want:    []string{".", "..dotdot", ".git", ".git/config", ".keep", "dir", "dir/.hidden", "dir/visible", "visible"},
+		},
+
+		{
+			desc:    "dot patterns do not match the top directory",
+			filters: []string{"--exclude=.", "--exclude=..", "--exclude=./"},
+			want:    []string{".", "..dotdot", ".git", ".git/config", ".hidden", ".keep", "dir", "dir/.hidden", "dir/visible", "visible"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := list(t, tt.filters...)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected listing: diff (-want +got):\n%s", diff)
+			}
+			for _, name := range got[1:] {
+				base := filepath.Base(name)
+				if base == "." || base == ".." {
+					t.Errorf("%q listed as a regular entry", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterProtectsFromDelete(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for _, fn := range []string{
+		filepath.Join(source, "file"),
+		filepath.Join(dest, "file"),
+		filepath.Join(dest, ".local"),
+		filepath.Join(dest, "extra"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--delete",
+		"--exclude=.*",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, ".local")); err != nil {
+		t.Errorf("excluded file deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "extra")); !os.IsNotExist(err) {
+		t.Errorf("extraneous file not deleted: %v", err)
+	}
+}
+
+func TestModuleFilterFile(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	for _, fn := range []string{
+		"public/a",
+		"secret/key",
+		"secret/sub/deep",
+		"public/.env",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filterFile := filepath.Join(tmp, "module.rules")
+	const rules = `# managed by the operator
+- /secret/
+- .env
+`
+	if err := ioutil.WriteFile(filterFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filesFrom := filepath.Join(tmp, "files-from")
+	if err := ioutil.WriteFile(filesFrom, []byte("public/a\nsecret/key\nsecret/sub/deep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	modules := rsynctest.InteropModule(source)
+	modules[0].FilterFile = filterFile
+	srv := rsynctest.New(t, modules)
+
+	// Like gokr-rsyncd in a mount namespace, the server can use rules which
+	// were loaded before the filter file became unreachable.
+	loadedModules := rsynctest.InteropModule(source)
+	loadedModules[0].FilterFile = filepath.Join(tmp, "loaded.rules")
+	if err := ioutil.WriteFile(loadedModules[0].FilterFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filters, err := rsyncd.LoadFilters(loadedModules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(loadedModules[0].FilterFile); err != nil {
+		t.Fatal(err)
+	}
+	loadedSrv := rsynctest.New(t, loadedModules,
+		rsynctest.ServerOptions(rsyncd.WithFilters(filters)))
+
+	// list returns the names of the listing of the specified module path.
+	list := func(t *testing.T, args ...string) []string {
+		args = append([]string{"gokr-rsync", "-r"}, args...)
+		var stdout bytes.Buffer
+		if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			names = append(names, fields[len(fields)-1])
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, server := range []struct {
+		desc string
+		port string
+	}{
+		{"OnDemand", srv.Port},
+		{"Loaded", loadedSrv.Port},
+	} {
+		url := "rsync://localhost:" + server.port + "/interop/"
+		for _, tt := range []struct {
+			desc string
+			args []string
+			want []string
+		}{
+			{
+				desc: "module",
+				args: []string{url},
+				want: []string{".", "public", "public/a"},
+			},
+
+			{
+				desc: "excluded directory",
+				args: []string{url + "secret/"},
+				want: nil,
+			},
+
+			{
+				desc: "file within excluded directory",
+				args: []string{url + "secret/sub/deep"},
+				want: nil,
+			},
+
+			{
+				desc: "files-from",
+				args: []string{"--files-from=" + filesFrom, url},
+				want: []string{"public", "public/a"},
+			},
+
+			{
+				desc: "client include rules do not override",
+				args: []string{"--include=secret/***", "--include=.env", url},
+				want: []string{".", "public", "public/a"},
+			},
+		} {
+			t.Run(server.desc+"/"+tt.desc, func(t *testing.T) {
+				got := list(t, tt.args...)
+				if diff := cmp.Diff(tt.want, got); diff != "" {
+					t.Errorf("unexpected listing: diff (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+func TestFilterDirMerge(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// Like rsync with an old protocol peer, gokr-rsync refuses to send
+	// dir-merge rules instead of sending them as exclude patterns.
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--filter=: .rsync-filter",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if want := "dir-merge rules require protocol 29"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("Main: err = %v, want error containing %q", err, want)
+	}
+}
+
+func TestFilterDirMergeLocal(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for fn, content := range map[string]string{
+		// The rules of a/.rsync-filter must not apply to its sibling b, and
+		// vice versa.
+		"source/a/.rsync-filter": "- *.o\n",
+		"source/a/x.o":           "object",
+		"source/a/x.c":           "source",
+		"source/b/.rsync-filter": "P *.keep\n",
+		"source/b/y.o":           "object",
+		"source/b/y.c":           "source",
+		// The receiver reads the per-directory files of the destination.
+		"dest/b/.rsync-filter": "P *.keep\n",
+		"dest/b/old.keep":      "keep",
+		"dest/b/old.txt":       "extra",
+		"dest/b/gone/z.keep":   "keep",
+		"dest/b/gone/z.txt":    "extra",
+		"dest/a/old.keep":      "extra",
+	} {
+		fn = filepath.Join(tmp, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unlike over the network, the local transport passes dir-merge rules
+	// to the sender in-process.
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--delete",
+		"--filter=: .rsync-filter",
+		source + "/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a/.rsync-filter": "- *.o\n",
+		"a/x.c":           "source",
+		"b/.rsync-filter": "P *.keep\n",
+		"b/y.o":           "object",
+		"b/y.c":           "source",
+		"b/old.keep":      "keep",
+		"b/gone/z.keep":   "keep",
+	}
+	if diff := cmp.Diff(want, treeContents(t, dest)); diff != "" {
+		t.Errorf("unexpected destination contents: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilterProtectHide(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for fn, content := range map[string]string{
+		"source/file":      "content",
+		"source/secret":    "secret",
+		"source/protected": "new",
+		"dest/protected":   "old content",
+		"dest/local.bak":   "backup",
+		"dest/extra":       "extra",
+		"dest/hidden.tmp":  "tmp",
+		// gone/ is not part of the transfer, but contains a protected file,
+		// so only its other contents are deleted.
+		"dest/gone/local.bak":        "backup",
+		"dest/gone/extra":            "extra",
+		"dest/gone/deeper/local.bak": "backup",
+		"dest/gone/deeper/extra":     "extra",
+		"dest/gone2/extra":           "extra",
+	} {
+		fn = filepath.Join(tmp, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--delete",
+		// protect rules only apply to deletion: protected is still
+		// transferred, local.bak is kept.
+		"--filter=P protected",
+		"--filter=P *.bak",
+		// hide rules only apply to the sender: secret is not transferred,
+		// but hidden.tmp is deleted.
+		"--filter=H secret",
+		"--filter=H *.tmp",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"file":      "content",
+		"protected": "new",
+		"local.bak": "backup",
+
+		"gone/local.bak":        "backup",
+		"gone/deeper/local.bak": "backup",
+	}
+	if diff := cmp.Diff(want, treeContents(t, dest)); diff != "" {
+		t.Errorf("unexpected destination contents: diff (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "gone2")); !os.IsNotExist(err) {
+		t.Errorf("gone2 unexpectedly not deleted (err=%v)", err)
+	}
+}
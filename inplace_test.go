@@ -0,0 +1,76 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestInplace(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new version moves the old content: data is inserted at the start,
+	// so the sender must not refer to blocks of the destination file which
+	// the receiver has already overwritten.
+	old := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(old)
+	content := append([]byte("inserted at the start"), old...)
+	content = content[:len(content)-4096] // and the file shrinks
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dest, "file")
+	if err := ioutil.WriteFile(fn, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-1 * time.Hour)
+	if err := os.Chtimes(fn, past, past); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--inplace",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("%s differs from the source after the transfer (got %d bytes, want %d bytes)", fn, len(got), len(content))
+	}
+	after, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("%s was replaced instead of updated in place", fn)
+	}
+}
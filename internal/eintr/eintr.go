@@ -0,0 +1,24 @@
+// Package eintr retries system calls which were interrupted by a signal.
+//
+// The Go runtime installs its signal handlers with SA_RESTART and the os and
+// net packages already retry on EINTR, but raw system calls (via the syscall
+// or golang.org/x/sys/unix packages) return EINTR to the caller, e.g. when a
+// signal arrives while mknod(2) or setxattr(2) block on slow storage.
+package eintr
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Retry calls fn until it returns an error other than EINTR.
+//
+// Like os.ignoringEINTR in the standard library.
+func Retry(fn func() error) error {
+	for {
+		err := fn()
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
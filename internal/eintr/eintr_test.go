@@ -0,0 +1,36 @@
+package eintr
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := Retry(func() error {
+		calls++
+		if calls < 3 {
+			return syscall.EINTR
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("fn called %d times, want 3", calls)
+	}
+
+	calls = 0
+	err = Retry(func() error {
+		calls++
+		return syscall.ENOENT
+	})
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Retry = %v, want %v", err, syscall.ENOENT)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+}
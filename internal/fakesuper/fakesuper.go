@@ -0,0 +1,33 @@
+// Package fakesuper implements the metadata storage of rsync’s --fake-super
+// option: file attributes which cannot be applied without root privileges
+// (ownership, special permission bits and device files) are stored in an
+// extended attribute instead. The format is byte-compatible with rsync, so
+// that files can be transferred back and forth between both implementations.
+package fakesuper
+
+import "fmt"
+
+// Stat is the file metadata stored in the %stat extended attribute.
+type Stat struct {
+	Mode         uint32 // file type and permission bits, as in st_mode
+	Major, Minor uint32 // device number (devices only)
+	Uid, Gid     uint32
+}
+
+// String returns the extended attribute value for s.
+//
+// rsync/xattrs.c:set_stat_xattr
+func (s Stat) String() string {
+	return fmt.Sprintf("%o %d,%d %d:%d", s.Mode, s.Major, s.Minor, s.Uid, s.Gid)
+}
+
+// Parse parses an extended attribute value as written by String (or rsync).
+//
+// rsync/xattrs.c:get_stat_xattr
+func Parse(value string) (Stat, error) {
+	var s Stat
+	if _, err := fmt.Sscanf(value, "%o %d,%d %d:%d", &s.Mode, &s.Major, &s.Minor, &s.Uid, &s.Gid); err != nil {
+		return Stat{}, fmt.Errorf("corrupt %s xattr: %q", XattrName, value)
+	}
+	return s, nil
+}
@@ -0,0 +1,44 @@
+package fakesuper_test
+
+import (
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/fakesuper"
+)
+
+func TestFormat(t *testing.T) {
+	for _, tt := range []struct {
+		stat  fakesuper.Stat
+		value string
+	}{
+		{
+			stat:  fakesuper.Stat{Mode: 0o104755, Uid: 0, Gid: 0},
+			value: "104755 0,0 0:0",
+		},
+		{
+			stat:  fakesuper.Stat{Mode: 0o20640, Major: 4, Minor: 64, Uid: 1000, Gid: 5},
+			value: "20640 4,64 1000:5",
+		},
+		{
+			stat:  fakesuper.Stat{Mode: 0o10644, Uid: 4294967294, Gid: 65534},
+			value: "10644 0,0 4294967294:65534",
+		},
+	} {
+		if got := tt.stat.String(); got != tt.value {
+			t.Errorf("%+v.String() = %q, want %q", tt.stat, got, tt.value)
+		}
+		got, err := fakesuper.Parse(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.stat {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.value, got, tt.stat)
+		}
+	}
+
+	for _, value := range []string{"", "100644", "100644 0,0", "100644 0 0:0", "xyz 0,0 0:0"} {
+		if _, err := fakesuper.Parse(value); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package fakesuper
+
+import "golang.org/x/sys/unix"
+
+// XattrName is the name of the extended attribute holding the metadata.
+const XattrName = "rsync.%stat"
+
+const errNoAttr = unix.ENOATTR
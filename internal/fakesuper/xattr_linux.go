@@ -0,0 +1,9 @@
+package fakesuper
+
+import "golang.org/x/sys/unix"
+
+// XattrName is the name of the extended attribute holding the metadata. On
+// Linux, unprivileged processes can only use the user namespace.
+const XattrName = "user.rsync.%stat"
+
+const errNoAttr = unix.ENODATA
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package fakesuper
+
+import "errors"
+
+// XattrName is the name of the extended attribute holding the metadata.
+const XattrName = "rsync.%stat"
+
+var errNotSupported = errors.New("--fake-super is not supported on this platform")
+
+func Get(path string) (*Stat, error) { return nil, errNotSupported }
+
+func Set(path string, s Stat) error { return errNotSupported }
+
+func Remove(path string) error { return errNotSupported }
@@ -0,0 +1,60 @@
+//go:build linux || darwin
+
+package fakesuper
+
+import (
+	"fmt"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+// Get returns the metadata stored for path, or nil if path has no %stat
+// extended attribute.
+func Get(path string) (*Stat, error) {
+	buf := make([]byte, 64)
+	for {
+		var n int
+		err := eintr.Retry(func() (err error) {
+			n, err = unix.Lgetxattr(path, XattrName, buf)
+			return err
+		})
+		if err == unix.ERANGE {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if err == errNoAttr {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lgetxattr(%s, %s): %v", path, XattrName, err)
+		}
+		s, err := Parse(string(buf[:n]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return &s, nil
+	}
+}
+
+// Set stores s as the metadata of path.
+func Set(path string, s Stat) error {
+	err := eintr.Retry(func() error {
+		return unix.Lsetxattr(path, XattrName, []byte(s.String()), 0)
+	})
+	if err != nil {
+		return fmt.Errorf("lsetxattr(%s, %s): %v", path, XattrName, err)
+	}
+	return nil
+}
+
+// Remove removes the metadata stored for path, if any.
+func Remove(path string) error {
+	err := eintr.Retry(func() error {
+		return unix.Lremovexattr(path, XattrName)
+	})
+	if err != nil && err != errNoAttr {
+		return fmt.Errorf("lremovexattr(%s, %s): %v", path, XattrName, err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+// Package fileflags reads and applies Linux inode flags (as shown by
+// lsattr(1)), which rsync’s --fileflags option preserves. Only the flags
+// which are meaningful to transfer are handled: immutable, append-only and
+// nodump.
+package fileflags
+
+// Inode flags, as per /usr/include/linux/fs.h.
+const (
+	Immutable = 0x00000010 // FS_IMMUTABLE_FL
+	Append    = 0x00000020 // FS_APPEND_FL
+	NoDump    = 0x00000040 // FS_NODUMP_FL
+
+	// Supported are the flags which Get returns and Set applies.
+	Supported = Immutable | Append | NoDump
+
+	// Privileged are the flags which only processes with the
+	// CAP_LINUX_IMMUTABLE capability can change.
+	Privileged = Immutable | Append
+)
@@ -0,0 +1,82 @@
+package fileflags
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"github.com/gokrazy/rsync/internal/longpath"
+	"golang.org/x/sys/unix"
+)
+
+func open(path string) (*os.File, error) {
+	// O_NONBLOCK so that opening a FIFO does not block, O_NOFOLLOW so that
+	// the flags of symbolic links (which have none) are never confused with
+	// those of their targets.
+	return longpath.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+}
+
+func getFlags(f *os.File) (uint32, error) {
+	var flags uint32
+	err := eintr.Retry(func() (err error) {
+		flags, err = unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+		return err
+	})
+	return flags, err
+}
+
+// unsupported reports whether err means that the file system does not
+// support inode flags.
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTTY) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.EINVAL)
+}
+
+// Get returns the Supported inode flags of the regular file or directory at
+// path. File systems without inode flags report none.
+func Get(path string) (uint32, error) {
+	f, err := open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := getFlags(f)
+	if err != nil {
+		if unsupported(err) {
+			return 0, nil
+		}
+		return 0, &os.PathError{Op: "FS_IOC_GETFLAGS", Path: path, Err: err}
+	}
+	return flags & Supported, nil
+}
+
+// Set changes the inode flags selected by mask (a subset of Supported) of the
+// regular file or directory at path to flags, leaving all other flags alone.
+func Set(path string, flags, mask uint32) error {
+	f, err := open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	old, err := getFlags(f)
+	if err != nil {
+		if unsupported(err) && flags&mask == 0 {
+			return nil // nothing to set
+		}
+		return &os.PathError{Op: "FS_IOC_GETFLAGS", Path: path, Err: err}
+	}
+	mask &= Supported
+	updated := old&^mask | flags&mask
+	if updated == old {
+		return nil
+	}
+	err = eintr.Retry(func() error {
+		return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(updated))
+	})
+	if err != nil {
+		return &os.PathError{Op: "FS_IOC_SETFLAGS", Path: path, Err: err}
+	}
+	return nil
+}
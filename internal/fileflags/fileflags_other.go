@@ -0,0 +1,20 @@
+//go:build !linux
+
+package fileflags
+
+import "errors"
+
+// Get returns the Supported inode flags of the regular file or directory at
+// path. Inode flags are Linux-specific, so there are none on this platform.
+func Get(path string) (uint32, error) {
+	return 0, nil
+}
+
+// Set changes the inode flags selected by mask (a subset of Supported) of the
+// regular file or directory at path to flags, leaving all other flags alone.
+func Set(path string, flags, mask uint32) error {
+	if flags&mask == 0 {
+		return nil
+	}
+	return errors.New("inode flags are not supported on this platform")
+}
@@ -0,0 +1,180 @@
+// Package idnames maps user and group ids to names and back. rsync transfers
+// the names of the owning users and groups along with the numeric ids, so
+// that the receiver can map them to its own ids (unless --numeric-ids).
+//
+// System looks names up in the system’s user database. Within a chroot (or a
+// mount namespace with a different root directory), /etc/passwd and
+// /etc/group are usually not reachable, so daemons read a Table before
+// changing the root directory.
+package idnames
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Lookup maps user and group ids to names and back.
+type Lookup interface {
+	UserName(uid int32) (string, error)
+	GroupName(gid int32) (string, error)
+	UserID(name string) (int32, error)
+	GroupID(name string) (int32, error)
+}
+
+// System is a Lookup using the system’s user database (package os/user).
+var System Lookup = system{}
+
+type system struct{}
+
+func (system) UserName(uid int32) (string, error) {
+	u, err := user.LookupId(strconv.Itoa(int(uid)))
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+func (system) GroupName(gid int32) (string, error) {
+	g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
+
+func (system) UserID(name string) (int32, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(u.Uid)
+}
+
+func (system) GroupID(name string) (int32, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(g.Gid)
+}
+
+func parseID(s string) (int32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int32(id), nil
+}
+
+// Table is a Lookup using a copy of the user and group databases.
+type Table struct {
+	userNames  map[int32]string
+	groupNames map[int32]string
+	userIDs    map[string]int32
+	groupIDs   map[string]int32
+}
+
+// ReadTable reads the user and group databases from passwd and group, which
+// are in the format of /etc/passwd and /etc/group (name:password:id:…).
+func ReadTable(passwd, group io.Reader) (*Table, error) {
+	t := &Table{
+		userNames:  make(map[int32]string),
+		groupNames: make(map[int32]string),
+		userIDs:    make(map[string]int32),
+		groupIDs:   make(map[string]int32),
+	}
+	if err := readDatabase(passwd, t.userNames, t.userIDs); err != nil {
+		return nil, fmt.Errorf("reading passwd: %v", err)
+	}
+	if err := readDatabase(group, t.groupNames, t.groupIDs); err != nil {
+		return nil, fmt.Errorf("reading group: %v", err)
+	}
+	return t, nil
+}
+
+// LoadTable reads the user and group databases from the files passwd and
+// group (usually /etc/passwd and /etc/group). A missing file results in an
+// empty database, like on systems without users.
+func LoadTable(passwd, group string) (*Table, error) {
+	open := func(fn string) (io.ReadCloser, error) {
+		f, err := os.Open(fn)
+		if os.IsNotExist(err) {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return f, err
+	}
+	p, err := open(passwd)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	g, err := open(group)
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+	return ReadTable(p, g)
+}
+
+func readDatabase(r io.Reader, names map[int32]string, ids map[string]int32) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 3 || parts[0] == "" {
+			continue // skip malformed lines, like getpwent(3)
+		}
+		id, err := parseID(parts[2])
+		if err != nil {
+			continue
+		}
+		// Like getpwuid(3) and getpwnam(3), the first entry wins.
+		if _, ok := names[id]; !ok {
+			names[id] = parts[0]
+		}
+		if _, ok := ids[parts[0]]; !ok {
+			ids[parts[0]] = id
+		}
+	}
+	return scanner.Err()
+}
+
+func (t *Table) UserName(uid int32) (string, error) {
+	name, ok := t.userNames[uid]
+	if !ok {
+		return "", user.UnknownUserIdError(int(uid))
+	}
+	return name, nil
+}
+
+func (t *Table) GroupName(gid int32) (string, error) {
+	name, ok := t.groupNames[gid]
+	if !ok {
+		return "", user.UnknownGroupIdError(strconv.Itoa(int(gid)))
+	}
+	return name, nil
+}
+
+func (t *Table) UserID(name string) (int32, error) {
+	id, ok := t.userIDs[name]
+	if !ok {
+		return 0, user.UnknownUserError(name)
+	}
+	return id, nil
+}
+
+func (t *Table) GroupID(name string) (int32, error) {
+	id, ok := t.groupIDs[name]
+	if !ok {
+		return 0, user.UnknownGroupError(name)
+	}
+	return id, nil
+}
@@ -0,0 +1,43 @@
+package idnames_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/idnames"
+)
+
+func TestReadTable(t *testing.T) {
+	const passwd = `root:x:0:0:root:/root:/bin/sh
+# comment
+malformed
+michael:x:1000:1000:Michael:/home/michael:/bin/zsh
+alias:x:1000:1000::/:/bin/false
+`
+	const group = `root:x:0:
+users:x:100:michael
+`
+	table, err := idnames.ReadTable(strings.NewReader(passwd), strings.NewReader(group))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := table.UserName(1000); err != nil || got != "michael" {
+		t.Errorf("UserName(1000) = %q, %v, want michael", got, err)
+	}
+	if got, err := table.UserID("alias"); err != nil || got != 1000 {
+		t.Errorf("UserID(alias) = %d, %v, want 1000", got, err)
+	}
+	if got, err := table.GroupName(100); err != nil || got != "users" {
+		t.Errorf("GroupName(100) = %q, %v, want users", got, err)
+	}
+	if got, err := table.GroupID("root"); err != nil || got != 0 {
+		t.Errorf("GroupID(root) = %d, %v, want 0", got, err)
+	}
+	if _, err := table.UserName(4242); err == nil {
+		t.Errorf("UserName(4242) unexpectedly succeeded")
+	}
+	if _, err := table.GroupID("michael"); err == nil {
+		t.Errorf("GroupID(michael) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,164 @@
+// Package longpath provides file system operations which work on path names
+// exceeding PATH_MAX, as can occur in deeply nested directory trees.
+package longpath
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Open is like os.Open, but works for names exceeding PATH_MAX.
+func Open(name string) (*os.File, error) {
+	return OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile is like os.OpenFile, but works for names exceeding PATH_MAX.
+func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	resolved, release, err := Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	f, err := os.OpenFile(resolved, flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: underlying(err)}
+	}
+	return f, nil
+}
+
+// Lstat is like os.Lstat, but works for names exceeding PATH_MAX.
+func Lstat(name string) (os.FileInfo, error) {
+	resolved, release, err := Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	info, err := os.Lstat(resolved)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: underlying(err)}
+	}
+	return info, nil
+}
+
+// Readlink is like os.Readlink, but works for names exceeding PATH_MAX.
+func Readlink(name string) (string, error) {
+	resolved, release, err := Resolve(name)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	target, err := os.Readlink(resolved)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: underlying(err)}
+	}
+	return target, nil
+}
+
+// MkdirAll is like os.MkdirAll, but works for names exceeding PATH_MAX.
+func MkdirAll(name string, perm os.FileMode) error {
+	if info, err := Lstat(name); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	resolved, release, err := Resolve(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := os.Mkdir(resolved, perm); err != nil && !os.IsExist(err) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: underlying(err)}
+	}
+	return nil
+}
+
+// underlying returns the error wrapped in a *os.PathError, so that errors
+// refer to the original name instead of the resolved one.
+func underlying(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err
+	}
+	return err
+}
+
+// Walk is like filepath.Walk, but works for trees containing names exceeding
+// PATH_MAX.
+func Walk(root string, fn filepath.WalkFunc) error {
+	info, err := Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walk(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk recursively descends path, calling fn.
+//
+// Modeled after path/filepath.walk
+func walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	names, err := readDirNames(path)
+	err1 := fn(path, info, err)
+	// If err != nil, walk can't walk into this directory.
+	// err1 != nil means walkFn want walk to skip this directory or stop walking.
+	// Therefore, if one of err and err1 isn't nil, walk will return.
+	if err != nil || err1 != nil {
+		// The caller's behavior is controlled by the return value, which is
+		// decided by walkFn. walkFn may ignore err and return nil.
+		// If walkFn returns SkipDir, it will be handled by the caller.
+		// So walk should return whatever walkFn returns.
+		return err1
+	}
+
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileInfo, err := Lstat(filename)
+		if err != nil {
+			if err := fn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else {
+			err = walk(filename, fileInfo, fn)
+			if err != nil {
+				if !fileInfo.IsDir() || err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readDirNames reads the directory named by dirname and returns a sorted list
+// of directory entry names.
+func readDirNames(dirname string) ([]string, error) {
+	f, err := Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,73 @@
+package longpath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+// Resolve returns a name referring to the same file as name, which is short
+// enough to be passed to system calls even if name exceeds PATH_MAX. Long names
+// are resolved by opening their parent directory component by component using
+// openat(2), and referring to the resulting directory via /proc/self/fd.
+//
+// The returned release function must be called once the resolved name is no
+// longer in use.
+func Resolve(name string) (string, func(), error) {
+	if len(name) < unix.PathMax {
+		return name, func() {}, nil
+	}
+	dir, base := filepath.Split(filepath.Clean(name))
+	fd, err := openDir(dir)
+	if err != nil {
+		return "", nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	release := func() { unix.Close(fd) }
+	return fmt.Sprintf("/proc/self/fd/%d/%s", fd, base), release, nil
+}
+
+// openDir opens the directory dir, which may exceed PATH_MAX, with O_PATH. The
+// longest prefix of dir that fits into PATH_MAX is opened directly, all
+// remaining components are opened relative to their parent.
+func openDir(dir string) (int, error) {
+	const flags = unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC
+	prefix := dir
+	if len(prefix) >= unix.PathMax {
+		prefix = prefix[:unix.PathMax-1]
+		if idx := strings.LastIndexByte(prefix, '/'); idx > 0 {
+			prefix = prefix[:idx]
+		}
+	}
+	rest := strings.TrimPrefix(dir, prefix)
+	if prefix == "" {
+		prefix = "."
+	}
+	var fd int
+	err := eintr.Retry(func() (err error) {
+		fd, err = unix.Open(prefix, flags, 0)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	for _, component := range strings.Split(rest, "/") {
+		if component == "" {
+			continue
+		}
+		var next int
+		err := eintr.Retry(func() (err error) {
+			next, err = unix.Openat(fd, component, flags, 0)
+			return err
+		})
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
@@ -0,0 +1,36 @@
+package maincmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+// bwLimitHandler serves /bwlimit on the monitoring listener
+// (-gokr.monitoring_listen), through which the bandwidth limit of a running
+// daemon can be changed, including for transfers in progress:
+//
+//	curl http://[monitoring_listen]/bwlimit             # current limit in KiB/s
+//	curl -d kib=1024 http://[monitoring_listen]/bwlimit # change the limit
+//
+// 0 removes the limit.
+func bwLimitHandler(srv *rsyncd.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost:
+			kib, err := strconv.Atoi(r.FormValue("kib"))
+			if err != nil || kib < 0 {
+				http.Error(w, fmt.Sprintf("invalid kib value %q: expected KiB/s (0 for unlimited)", r.FormValue("kib")), http.StatusBadRequest)
+				return
+			}
+			srv.SetBwLimit(kib)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", srv.BwLimit())
+	})
+}
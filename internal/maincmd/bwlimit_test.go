@@ -0,0 +1,123 @@
+package maincmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestBwLimitHandler(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// At the initial limit of 1 KiB/s, the transfer would take minutes.
+	content := bytes.Repeat([]byte("bandwidth"), 32*1024)
+	if err := ioutil.WriteFile(filepath.Join(source, "large"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{Name: "interop", Path: source},
+	}, rsyncd.WithBwLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, ln)
+
+	monitoring := httptest.NewServer(bwLimitHandler(srv))
+	defer monitoring.Close()
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(monitoring.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(b))
+	}
+	set := func(kib string) int {
+		t.Helper()
+		resp, err := http.PostForm(monitoring.URL, url.Values{"kib": {kib}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got, want := get(), "1"; got != want {
+		t.Errorf("GET /bwlimit = %q, want %q", got, want)
+	}
+	for _, kib := range []string{"", "-1", "fast"} {
+		if got, want := set(kib), http.StatusBadRequest; got != want {
+			t.Errorf("POST /bwlimit kib=%q: status %d, want %d", kib, got, want)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		args := []string{
+			"gokr-rsync",
+			"-r",
+			"rsync://" + ln.Addr().String() + "/interop/",
+			dest,
+		}
+		_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+		done <- err
+	}()
+
+	// Lift the limit while the transfer is throttled.
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("transfer unexpectedly finished before lifting the limit: %v", err)
+	default:
+	}
+	if got, want := set("0"), http.StatusOK; got != want {
+		t.Fatalf("POST /bwlimit kib=0: status %d, want %d", got, want)
+	}
+	if got, want := get(), "0"; got != want {
+		t.Errorf("GET /bwlimit = %q, want %q", got, want)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer did not speed up after lifting the limit")
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("unexpected file contents after transfer")
+	}
+}
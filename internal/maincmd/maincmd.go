@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gokrazy/rsync/internal/anonssh"
 	"github.com/gokrazy/rsync/internal/log"
@@ -57,7 +58,10 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer,
 				return err
 			}
 		}
-		srv, err := rsyncd.NewServer(cfg.Modules)
+		srv, err := rsyncd.NewServer(cfg.Modules,
+			rsyncd.WithPersistentSessions(cfg.PersistentSessions),
+			rsyncd.WithModuleSelectionTimeout(time.Duration(cfg.ModuleSelectionTimeout)*time.Second),
+			rsyncd.WithBwLimit(opts.BwLimit))
 		if err != nil {
 			return err
 		}
@@ -196,6 +200,10 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer,
 		}
 		cfg.Modules = append(cfg.Modules, module)
 	}
+	// Within the mount namespace, files outside of the modules (e.g. the user
+	// database) are not reachable, so namespace() returns server options
+	// with their contents instead.
+	var nsOpts []rsyncd.Option
 	if cfg.DontNamespace {
 		if cfg.Listeners[0].Rsyncd != "" ||
 			cfg.Listeners[0].AnonSSH != "" {
@@ -204,7 +212,9 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer,
 		version()
 		log.Printf("environment: not namespace due to dont_namespace option")
 	} else {
-		if err := namespace(cfg.Modules, listenAddr); err == errIsParent {
+		var err error
+		nsOpts, err = namespace(cfg.Modules, listenAddr)
+		if err == errIsParent {
 			return nil
 		} else if err != nil {
 			return fmt.Errorf("namespace: %v", err)
@@ -212,7 +222,8 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer,
 	}
 	log.Printf("%d rsync modules configured in total", len(cfg.Modules))
 	for _, mod := range cfg.Modules {
-		if !cfg.DontNamespace {
+		// Uploads need write access, so only read-only modules are checked.
+		if !cfg.DontNamespace && !mod.Writable {
 			if err := canUnexpectedlyWriteTo(mod.Path); err != nil {
 				return err
 			}
@@ -221,19 +232,31 @@ func Main(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer,
 		log.Printf("rsync module %q with path %s configured", mod.Name, mod.Path)
 	}
 
+	if opts.Gokrazy.PersistentSessions {
+		cfg.PersistentSessions = true
+	}
+	srvOpts := append([]rsyncd.Option{
+		rsyncd.WithPersistentSessions(cfg.PersistentSessions),
+		rsyncd.WithModuleSelectionTimeout(time.Duration(cfg.ModuleSelectionTimeout) * time.Second),
+		rsyncd.WithBwLimit(opts.BwLimit),
+	}, nsOpts...)
+	srv, err := rsyncd.NewServer(cfg.Modules, srvOpts...)
+	if err != nil {
+		return err
+	}
+
 	if monitoringListen := opts.Gokrazy.MonitoringListen; monitoringListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/pprof/", http.DefaultServeMux)
+		mux.Handle("/bwlimit", bwLimitHandler(srv))
 		go func() {
 			log.Printf("HTTP server for monitoring listening on http://%s/debug/pprof", monitoringListen)
-			if err := http.ListenAndServe(monitoringListen, nil); err != nil {
+			if err := http.ListenAndServe(monitoringListen, mux); err != nil {
 				log.Printf("-monitoring_listen: %v", err)
 			}
 		}()
 	}
 
-	srv, err := rsyncd.NewServer(cfg.Modules)
-	if err != nil {
-		return err
-	}
 	var ln net.Listener
 	listeners, err := systemdListeners()
 	if err != nil {
@@ -15,7 +15,7 @@ import (
 	"github.com/gokrazy/rsync/rsyncd"
 )
 
-func namespace(modules []rsyncd.Module, listen string) error {
+func namespace(modules []rsyncd.Module, listen string) ([]rsyncd.Option, error) {
 	if os.Getenv("GOKRAZY_RSYNC_PRIVDROP") != "" {
 		log.Printf("pid %d (privileges dropped)", os.Getpid())
 
@@ -23,13 +23,13 @@ func namespace(modules []rsyncd.Module, listen string) error {
 		// the process in Go.
 		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
 
-		return nil
+		return nil, nil
 	}
 
 	if os.Getuid() != 0 {
 		version()
 		log.Printf("environment: unprivileged")
-		return nil
+		return nil, nil
 	}
 
 	version()
@@ -38,14 +38,14 @@ func namespace(modules []rsyncd.Module, listen string) error {
 
 	exe, err := os.Executable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create the listener while still running as uid 0 and inherit it, so that
 	// we can listen on port 873 (rsync), which requires CAP_NET_BIND_SERVICE.
 	ln, err := net.Listen("tcp", listen)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	cmd := exec.Command(exe, os.Args[1:]...)
@@ -60,14 +60,14 @@ func namespace(modules []rsyncd.Module, listen string) error {
 	cmd.Stderr = os.Stderr
 	lnFile, err := ln.(*net.TCPListener).File()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cmd.ExtraFiles = []*os.File{lnFile}
 	runAsUnprivilegedUser(cmd)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%v: %v", cmd.Args, err)
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
 	}
-	return errIsParent
+	return nil, errIsParent
 }
 
 var errIsParent = errors.New("re-exec parent process sentinel error")
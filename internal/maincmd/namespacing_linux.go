@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"syscall"
 
+	"github.com/gokrazy/rsync/internal/idnames"
 	"github.com/gokrazy/rsync/internal/log"
 	"github.com/gokrazy/rsync/rsyncd"
 	"golang.org/x/sys/unix"
@@ -71,7 +72,7 @@ func pivotRoot(newroot string) error {
 	return nil
 }
 
-func namespace(modules []rsyncd.Module, listen string) error {
+func namespace(modules []rsyncd.Module, listen string) ([]rsyncd.Option, error) {
 	if os.Getenv("GOKRAZY_RSYNC_NAMESPACE") != "" {
 		log.Printf("pid %d (inside Linux mount/pid namespace)", os.Getpid())
 
@@ -82,7 +83,7 @@ func namespace(modules []rsyncd.Module, listen string) error {
 		// Set mount point propagation to MS_SLAVE.
 		// See https://hechao.li/2020/06/09/Mini-Container-Series-Part-1-Filesystem-Isolation/
 		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
-			return fmt.Errorf("mount(/, MS_SLAVE): %v", err)
+			return nil, fmt.Errorf("mount(/, MS_SLAVE): %v", err)
 		}
 
 		// Create our own tmpfs mount so that we won’t end up with nodev,
@@ -91,74 +92,158 @@ func namespace(modules []rsyncd.Module, listen string) error {
 		// https://unix.stackexchange.com/questions/655409/in-a-user-namespace-as-non-root-on-a-nosuid-nodev-filesystem-why-does-a-bind-m
 		tmpdir, err := os.MkdirTemp("", "gokr-rsync")
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if err := syscall.Mount("tmpfs", tmpdir, "tmpfs", syscall.MS_REC, ""); err != nil {
-			return fmt.Errorf("mount(tmpfs, %s): %v", tmpdir, err)
+			return nil, fmt.Errorf("mount(tmpfs, %s): %v", tmpdir, err)
 		}
 
 		if err := os.Chdir(tmpdir); err != nil {
-			return err
+			return nil, err
 		}
 
-		// prepare read-only bind mounts for each configured rsync module:
-		log.Printf("mounting rsync modules read-only:")
+		// prepare bind mounts for each configured rsync module, read-only
+		// unless the module accepts uploads:
+		log.Printf("mounting rsync modules:")
 		for _, mod := range modules {
-			log.Printf("  rsync module %q from host=%s to namespace=/%s", mod.Name, mod.Path, mod.Name)
+			mode := "read-only"
+			if mod.Writable {
+				mode = "writable"
+			}
+			log.Printf("  rsync module %q (%s) from host=%s to namespace=/%s", mod.Name, mode, mod.Path, mod.Name)
 			// TODO: restrict module names to not contain slashes. does rsync do that?
 			if err := os.MkdirAll(mod.Name, 0755); err != nil {
-				return err
+				return nil, err
+			}
+			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND, ""); err != nil {
+				return nil, err
 			}
-			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
-				return err
+			if mod.Writable {
+				continue
 			}
+			// MS_RDONLY is ignored when creating a bind mount, it needs
+			// to be applied by remounting.
+			if err := syscall.Mount(mod.Path, mod.Name, "none", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return nil, fmt.Errorf("mount -o remount,ro %s: %v", mod.Name, err)
+			}
+		}
+
+		// Names exceeding PATH_MAX are resolved via /proc/self/fd (see
+		// package longpath), so mount a procfs for our pid namespace.
+		if err := os.Mkdir("proc", 0555); err != nil {
+			return nil, err
+		}
+		if err := syscall.Mount("proc", "proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return nil, fmt.Errorf("mount(proc): %v", err)
+		}
+
+		// The configured lock files are not reachable from within the
+		// namespace, so count connections in a separate (writable) tmpfs
+		// instead. Connections are then only counted per daemon process.
+		lockFiles := make(map[string]string)
+		for _, mod := range modules {
+			if mod.MaxConnections == 0 {
+				continue
+			}
+			if len(lockFiles) == 0 {
+				if err := os.Mkdir(".locks", 0755); err != nil {
+					return nil, err
+				}
+				if err := syscall.Mount("tmpfs", ".locks", "tmpfs", 0, "mode=0755"); err != nil {
+					return nil, fmt.Errorf("mount(tmpfs, .locks): %v", err)
+				}
+			}
+			if _, ok := lockFiles[mod.LockFile]; ok {
+				continue
+			}
+			fn := filepath.Join(".locks", strconv.Itoa(len(lockFiles)))
+			if err := os.WriteFile(fn, nil, 0600); err != nil {
+				return nil, err
+			}
+			// dropPrivileges() switches to nobody below
+			if err := os.Chown(fn, 65534, 65534); err != nil {
+				return nil, err
+			}
+			lockFiles[mod.LockFile] = "/" + fn
+		}
+
+		// The user database is not reachable after pivot_root, so read it
+		// now for mapping file owners to names and back.
+		ids, err := idnames.LoadTable("/etc/passwd", "/etc/group")
+		if err != nil {
+			return nil, err
+		}
+
+		// Neither are the secrets and filter files of the modules.
+		secrets, err := rsyncd.LoadSecrets(modules)
+		if err != nil {
+			return nil, err
+		}
+		filters, err := rsyncd.LoadFilters(modules)
+		if err != nil {
+			return nil, err
 		}
 
 		wd, err := os.Getwd()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if err := pivotRoot(wd); err != nil {
-			return fmt.Errorf("pivotRoot(%q): %v", wd, err)
+			return nil, fmt.Errorf("pivotRoot(%q): %v", wd, err)
 		}
 
 		if err := dropPrivileges(); err != nil {
-			return fmt.Errorf("dropPrivileges: %v", err)
+			return nil, fmt.Errorf("dropPrivileges: %v", err)
 		}
 
 		for idx, mod := range modules {
 			mod.Path = "/" + mod.Name
+			if mod.MaxConnections > 0 {
+				mod.LockFile = lockFiles[mod.LockFile]
+			}
 			modules[idx] = mod
 		}
 
 		if err := canUnexpectedlyWriteTo("."); err != nil {
-			return err
+			return nil, err
 		}
 
-		return nil
+		return []rsyncd.Option{
+			rsyncd.WithIDNames(ids),
+			rsyncd.WithSecrets(secrets),
+			rsyncd.WithFilters(filters),
+		}, nil
 	}
 
 	if os.Getuid() != 0 {
 		version()
 		log.Printf("environment: unprivileged")
-		return nil
+		return nil, nil
+	}
+
+	// The mount namespace contains only the modules, so there is no shell to
+	// run exec hooks with.
+	for _, mod := range modules {
+		if mod.PreXferExec != "" || mod.PostXferExec != "" {
+			return nil, fmt.Errorf("module %q: pre_xfer_exec and post_xfer_exec are not supported when running in a mount namespace (as root)", mod.Name)
+		}
 	}
 
 	version()
 	log.Printf("environment: privileged")
-	log.Printf("creating Linux mount/pid namespace for read-only rsync module mounts")
+	log.Printf("creating Linux mount/pid namespace for rsync module mounts")
 
 	exe, err := os.Executable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create the listener while still running as uid 0 and inherit it, so that
 	// we can listen on port 873 (rsync), which requires CAP_NET_BIND_SERVICE.
 	ln, err := net.Listen("tcp", listen)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	cmd := exec.Command(exe, os.Args[1:]...)
@@ -173,7 +258,7 @@ func namespace(modules []rsyncd.Module, listen string) error {
 	cmd.Stderr = os.Stderr
 	lnFile, err := ln.(*net.TCPListener).File()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cmd.ExtraFiles = []*os.File{lnFile}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -181,9 +266,9 @@ func namespace(modules []rsyncd.Module, listen string) error {
 		GidMappingsEnableSetgroups: false,
 	}
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%v: %v", cmd.Args, err)
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
 	}
-	return errIsParent
+	return nil, errIsParent
 }
 
 var errIsParent = errors.New("re-exec parent process sentinel error")
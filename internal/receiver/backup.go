@@ -0,0 +1,79 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/longpath"
+)
+
+// backupName returns the name (relative to the destination, unless BackupDir
+// is absolute) under which a backup of name is stored.
+func (rt *Transfer) backupName(name string) string {
+	if rt.Opts.BackupDir != "" {
+		return filepath.Join(rt.Opts.BackupDir, name) + rt.Opts.BackupSuffix
+	}
+	return name + rt.Opts.BackupSuffix
+}
+
+// isBackupFile reports whether name is a backup made within the destination
+// (i.e. without BackupDir). Like rsync, these are protected from --delete.
+func (rt *Transfer) isBackupFile(name string) bool {
+	return rt.Opts.Backup &&
+		rt.Opts.BackupDir == "" &&
+		rt.Opts.BackupSuffix != "" &&
+		strings.HasSuffix(name, rt.Opts.BackupSuffix)
+}
+
+// makeBackup moves the existing destination file name out of the way before it
+// is replaced or deleted (--backup). Directories are not backed up, and a file
+// which does not exist (yet) is not an error.
+//
+// rsync/backup.c:make_backup
+func (rt *Transfer) makeBackup(name string) error {
+	local, release, err := rt.localPath(&File{Name: name})
+	if err != nil {
+		return err
+	}
+	defer release()
+	st, err := os.Lstat(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if st.IsDir() {
+		return nil
+	}
+	backup := rt.backupName(name)
+	backupLocal := backup
+	if !filepath.IsAbs(backupLocal) {
+		backupLocal = filepath.Join(rt.Dest, backup)
+	}
+	if err := longpath.MkdirAll(filepath.Dir(backupLocal), 0755); err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	resolved, releaseBackup, err := longpath.Resolve(backupLocal)
+	if err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	defer releaseBackup()
+	// An older backup of a different type (e.g. a directory) is in the way.
+	if bst, err := os.Lstat(resolved); err == nil && bst.IsDir() {
+		if err := os.RemoveAll(resolved); err != nil {
+			return fmt.Errorf("backup: %v", err)
+		}
+	}
+	log.Printf("backup: renaming %s to %s", filepath.Join(rt.Dest, name), backupLocal)
+	if err := os.Rename(local, resolved); err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	if rt.Opts.InfoBackup {
+		fmt.Fprintf(rt.Env.Stdout, "backed up %s to %s\n", name, backup)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package receiver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/rsync/internal/log"
+)
+
+// copyDestPath returns the name of f below CopyDest, which is relative to the
+// destination unless absolute. Like localPath, the returned name works even if
+// the full name exceeds PATH_MAX, and the returned release function must be
+// called once it is no longer in use.
+func (rt *Transfer) copyDestPath(f *File) (string, func(), error) {
+	name := filepath.Join(rt.Opts.CopyDest, f.Name)
+	if !filepath.IsAbs(name) {
+		return rt.localPath(&File{Name: name})
+	}
+	return resolveLocal(name)
+}
+
+// tryCopyDest handles the regular file f (with file list index idx), which
+// does not exist in the destination, by looking for it below CopyDest: an
+// unchanged file is copied locally and gets the metadata of the file list
+// (like any other received file), a changed file is used as the basis for the
+// transfer. It returns false if there is no such file.
+//
+// rsync/generator.c:try_dests_reg
+func (rt *Transfer) tryCopyDest(idx int, f *File) (bool, error) {
+	basis, release, err := rt.copyDestPath(f)
+	if err != nil {
+		return false, nil
+	}
+	defer release()
+	st, err := os.Lstat(basis)
+	if err != nil || !st.Mode().IsRegular() {
+		return false, nil
+	}
+	skip, err := rt.skipFile(f, st)
+	if err != nil {
+		return false, err
+	}
+	if !skip {
+		if rt.Opts.DryRun {
+			return true, rt.Conn.WriteInt32(int32(idx))
+		}
+		in, err := os.Open(basis)
+		if err != nil {
+			log.Printf("failed to open %s, continuing: %v", basis, err)
+			return false, nil
+		}
+		defer in.Close()
+		log.Printf("sending sums for: %s (basis %s)", f.Name, basis)
+		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+			return true, err
+		}
+		return true, rt.generateAndSendSums(idx, in, st.Size())
+	}
+	if rt.Opts.DryRun {
+		return true, nil
+	}
+
+	local, releaseLocal, err := rt.localPath(f)
+	if err != nil {
+		return true, err
+	}
+	log.Printf("copying %s to %s", basis, local)
+	err = copyFile(basis, local)
+	releaseLocal()
+	if err != nil {
+		return true, err
+	}
+	// The copy is a new file, so its metadata (permissions, modification time
+	// and ownership) comes from the file list, not from the basis file.
+	if err := rt.setPerms(f); err != nil {
+		return true, err
+	}
+	// The file is up to date, so the sender can remove its copy.
+	return true, rt.sendSuccess(int32(idx))
+}
+
+// openCopyDest opens the basis file below CopyDest for f, which does not exist
+// in the destination. Like openLocalFile, it returns nil if the basis file is
+// not a regular file.
+func (rt *Transfer) openCopyDest(f *File) (*os.File, error) {
+	basis, release, err := rt.copyDestPath(f)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	in, err := os.Open(basis)
+	if err != nil {
+		return nil, err
+	}
+	st, err := in.Stat()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		in.Close()
+		return nil, nil
+	}
+	return in, nil
+}
+
+// copyFile atomically creates (or replaces) dest with the contents of src.
+//
+// rsync/util.c:copy_file
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := newPendingFile(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.CloseAtomicallyReplace()
+}
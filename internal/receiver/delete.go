@@ -0,0 +1,196 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/longpath"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+)
+
+// deleteInDir removes all entries of the local directory f which are not part
+// of the file list (--delete). Entries which are excluded by the filter rules
+// are kept. With --dry-run, the entries are only counted and itemized.
+//
+// If the sender could not read all of its files (i/o error flag), the file
+// list is incomplete and nothing is deleted, unless IgnoreErrors is set.
+//
+// rsync/generator.c:delete_in_dir
+func (rt *Transfer) deleteInDir(f *File) error {
+	if rt.names == nil {
+		return fmt.Errorf("BUG: deleteInDir called before the file list was indexed")
+	}
+	if rt.IOErrors != 0 && !rt.Opts.IgnoreErrors {
+		if !rt.deletionSkipped {
+			log.Printf("IO error encountered -- skipping file deletion")
+			rt.deletionSkipped = true
+		}
+		return nil
+	}
+	if err := rt.filterScope().Enter(f.Name, filepath.Join(rt.Dest, f.Name)); err != nil {
+		return err
+	}
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(local)
+	release()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // nothing to delete (e.g. in dry-run mode)
+		}
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(f.Name, e.Name())
+		if rt.names[name] || rt.protected(name, e.IsDir()) {
+			continue
+		}
+		rt.deleteRecursive(name, e.IsDir())
+	}
+	return nil
+}
+
+// filterScope returns the Scope which applies Filters (including the rules of
+// per-directory files in the destination) to local entries.
+func (rt *Transfer) filterScope() *rsyncfilter.Scope {
+	if rt.scope == nil {
+		rt.scope = rsyncfilter.NewReceiverScope(rt.Filters)
+	}
+	return rt.scope
+}
+
+// protected reports whether the local entry name must not be deleted because
+// it is excluded by the receiver’s filter rules (e.g. protect rules) or is a
+// backup file.
+func (rt *Transfer) protected(name string, isDir bool) bool {
+	if rt.filterScope().Excluded(name, isDir) {
+		return true
+	}
+	// like the “P *~” rule rsync adds with --backup
+	return !isDir && rt.isBackupFile(name)
+}
+
+// deleteRecursive deletes name (relative to the destination) and reports
+// whether it was deleted. Like rsync, directory contents are deleted first
+// (depth-first), so that each deleted entry is itemized individually, children
+// before their parent directory. Protected entries within the directory are
+// kept, and so is the directory itself. Symbolic links are deleted, not
+// followed. Failures are logged, but do not abort the transfer.
+//
+// rsync/delete.c:delete_item
+func (rt *Transfer) deleteRecursive(name string, isDir bool) bool {
+	local := filepath.Join(rt.Dest, name)
+	if isDir {
+		resolved, release, err := longpath.Resolve(local)
+		if err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+		if !rt.Opts.DryRun {
+			makeDeletable(resolved)
+		}
+		entries, err := os.ReadDir(resolved)
+		release()
+		if err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+		if err := rt.filterScope().Enter(name, local); err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+		// rsync/delete.c:delete_dir_contents
+		kept := false
+		for _, e := range entries {
+			child := path.Join(name, e.Name())
+			if rt.protected(child, e.IsDir()) {
+				kept = true
+				continue
+			}
+			if !rt.deleteRecursive(child, e.IsDir()) {
+				kept = true
+			}
+		}
+		if kept {
+			log.Printf("cannot delete non-empty directory: %s", name)
+			return false
+		}
+	}
+	if !rt.Opts.DryRun && !isDir && rt.Opts.Backup {
+		if err := rt.makeBackup(name); err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+	} else if !rt.Opts.DryRun {
+		resolved, release, err := longpath.Resolve(local)
+		if err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+		err = os.Remove(resolved)
+		release()
+		if err != nil {
+			log.Printf("delete_file: %v", err)
+			return false
+		}
+	}
+	rt.Deleted++
+	if rt.Opts.ItemizeChanges {
+		if isDir {
+			name += "/"
+		}
+		fmt.Fprintf(rt.Env.Stdout, "*deleting   %s\n", name)
+	}
+	return true
+}
+
+// makeDeletable adds owner write and search permission to the directory dir
+// (if needed), which is required to delete its entries. Like rsync, this only
+// matters when not running as root.
+//
+// rsync/delete.c:delete_item
+func makeDeletable(dir string) {
+	st, err := os.Lstat(dir)
+	if err != nil || !st.IsDir() {
+		return
+	}
+	if perm := st.Mode().Perm(); perm&0o300 != 0o300 {
+		if err := os.Chmod(dir, perm|0o700); err != nil {
+			log.Printf("delete_file: %v", err)
+		}
+	}
+}
+
+// indexNames records the names of all entries of fileList, so that
+// deleteInDir can determine which local entries have no counterpart.
+func (rt *Transfer) indexNames(fileList []*File) {
+	rt.names = make(map[string]bool, len(fileList))
+	for _, f := range fileList {
+		rt.names[f.Name] = true
+	}
+}
+
+// DeleteExtraneous removes the entries of all directories of fileList which
+// are not part of fileList (--delete), like the generator does for each
+// directory during a transfer. It is used for multiple sources, which are
+// transferred over separate connections: fileList must contain the entries
+// of all of them, so that no source deletes the files of another.
+func (rt *Transfer) DeleteExtraneous(fileList []*File) error {
+	rt.indexNames(fileList)
+	done := make(map[string]bool)
+	for _, f := range fileList {
+		if !f.FileMode().IsDir() || done[f.Name] {
+			continue // e.g. the destination root is part of each source
+		}
+		done[f.Name] = true
+		if err := rt.deleteInDir(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package receiver
+
+import (
+	"os"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/fileflags"
+)
+
+// fileflagsMask returns the inode flags which the receiver manages: setting
+// the immutable and append-only flags requires root privileges
+// (CAP_LINUX_IMMUTABLE), so without them, only the nodump flag is applied.
+func fileflagsMask() uint32 {
+	if os.Geteuid() == 0 {
+		return fileflags.Supported
+	}
+	return fileflags.NoDump
+}
+
+// hasFileflags reports whether files of the given mode carry inode flags.
+func hasFileflags(mode int32) bool {
+	mode &= rsync.S_IFMT
+	return mode == rsync.S_IFREG || mode == rsync.S_IFDIR
+}
+
+// makeMutable clears the immutable and append-only flags of the existing
+// file or directory local (with PreserveFileflags), so that it can be
+// replaced, modified or filled. setPerms applies the flags of the file list
+// afterwards.
+//
+// rsync/generator.c:make_mutable (fileflags patch)
+func (rt *Transfer) makeMutable(local string) error {
+	if !rt.Opts.PreserveFileflags || rt.Opts.DryRun {
+		return nil
+	}
+	return fileflags.Set(local, 0, fileflags.Privileged&fileflagsMask())
+}
+
+// setFileflags applies the inode flags of f to local (with
+// PreserveFileflags). It must be called after all other changes to local,
+// which the immutable flag would prevent.
+func (rt *Transfer) setFileflags(f *File, local string) error {
+	if !rt.Opts.PreserveFileflags || !hasFileflags(f.Mode) {
+		return nil
+	}
+	return fileflags.Set(local, f.Fileflags, fileflagsMask())
+}
@@ -0,0 +1,312 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+)
+
+// unsafePath reports whether the (cleaned) file list name refers to a path
+// outside of the destination directory.
+func unsafePath(name string) bool {
+	return filepath.IsAbs(name) ||
+		name == ".." ||
+		strings.HasPrefix(name, "../")
+}
+
+// rsync/flist.c:flist_sort_and_clean
+func sortFileList(fileList []*File) {
+	sort.Slice(fileList, func(i, j int) bool {
+		return fileList[i].Name < fileList[j].Name
+	})
+}
+
+type File struct {
+	Name       string
+	Length     int64
+	ModTime    time.Time
+	Mode       int32
+	Uid        int32
+	Gid        int32
+	LinkTarget string
+	Rdev       int32
+	Fileflags  uint32 // with PreserveFileflags
+
+	// wireMode is Mode as sent by the sender, i.e. before applying Chmod.
+	// XMIT_SAME_MODE refers to the previous entry’s wireMode.
+	wireMode int32
+}
+
+// FileMode converts from the Linux permission bits to Go’s permission bits.
+func (f *File) FileMode() fs.FileMode {
+	ret := fs.FileMode(f.Mode) & fs.ModePerm
+
+	mode := f.Mode & rsync.S_IFMT
+	switch mode {
+	case rsync.S_IFCHR:
+		ret |= fs.ModeCharDevice
+	case rsync.S_IFBLK:
+		ret |= fs.ModeDevice
+	case rsync.S_IFIFO:
+		ret |= fs.ModeNamedPipe
+	case rsync.S_IFSOCK:
+		ret |= fs.ModeSocket
+	case rsync.S_IFLNK:
+		ret |= fs.ModeSymlink
+	case rsync.S_IFDIR:
+		ret |= fs.ModeDir
+	}
+
+	return ret
+}
+
+// rsync/flist.c:receive_file_entry
+func (rt *Transfer) receiveFileEntry(flags uint16, last *File) (*File, error) {
+	f := &File{}
+
+	// XMIT_SAME_* flags refer to the previous entry, of which there is none
+	// for the first entry. Uploading clients are not trusted to get this right.
+	noLast := func(flag string) error {
+		return fmt.Errorf("protocol error: %s set on the first file list entry (flags=0x%x)", flag, flags)
+	}
+
+	var l1 int
+	if flags&rsync.XMIT_SAME_NAME != 0 {
+		if last == nil {
+			return nil, noLast("XMIT_SAME_NAME")
+		}
+		l, err := rt.Conn.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		l1 = int(l)
+		if l1 > len(last.Name) {
+			return nil, fmt.Errorf("protocol error: XMIT_SAME_NAME prefix length %d exceeds the previous name %q", l1, last.Name)
+		}
+	}
+
+	var l2 int
+	if flags&rsync.XMIT_LONG_NAME != 0 {
+		l, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		l2 = int(l)
+	} else {
+		l, err := rt.Conn.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		l2 = int(l)
+	}
+	// Unlike rsync, we do not limit names to PATH_MAX (see localPath), but
+	// still guard against corrupt or malicious length fields.
+	const maxNameLen = 1 << 20
+	if l2 >= maxNameLen-l1 {
+		const lastname = ""
+		return nil, fmt.Errorf("overflow: flags=0x%x l1=%d l2=%d lastname=%s",
+			flags, l1, l2, lastname)
+	}
+	b := make([]byte, l1+l2)
+	readb := b
+	if l1 > 0 {
+		copy(b, []byte(last.Name))
+		readb = b[l1:]
+	}
+	if _, err := io.ReadFull(rt.Conn.Reader, readb); err != nil {
+		return nil, err
+	}
+	// TODO: does rsync’s clean_fname() and sanitize_path() combination do
+	// anything more than Go’s filepath.Clean()?
+	f.Name = filepath.Clean(string(b))
+	if unsafePath(f.Name) {
+		// Do not let the sender write outside of the destination directory.
+		return nil, fmt.Errorf("unsafe pathname from sender: %q", f.Name)
+	}
+
+	length, err := rt.Conn.ReadInt64()
+	if err != nil {
+		return nil, err
+	}
+	f.Length = length
+
+	if flags&rsync.XMIT_SAME_TIME != 0 {
+		if last == nil {
+			return nil, noLast("XMIT_SAME_TIME")
+		}
+		f.ModTime = last.ModTime
+	} else {
+		modTime, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		// TODO(protocol >= 31): XMIT_MOD_NSEC (nanosecond mtimes)
+		f.ModTime = time.Unix(int64(modTime), 0)
+	}
+
+	if flags&rsync.XMIT_SAME_MODE != 0 {
+		if last == nil {
+			return nil, noLast("XMIT_SAME_MODE")
+		}
+		f.Mode = last.wireMode
+	} else {
+		mode, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		f.Mode = mode
+	}
+	f.wireMode = f.Mode
+	if rt.Chmod != nil && f.Mode&rsync.S_IFMT != rsync.S_IFLNK {
+		// Treat the result as though it were the mode that the sender sent.
+		f.Mode = rt.Chmod.Apply(f.Mode)
+	}
+
+	if rt.Opts.PreserveFileflags {
+		fileflags, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		f.Fileflags = uint32(fileflags)
+	}
+
+	if rt.Opts.PreserveUid {
+		if flags&rsync.XMIT_SAME_UID != 0 {
+			if last == nil {
+				return nil, noLast("XMIT_SAME_UID")
+			}
+			f.Uid = last.Uid
+		} else {
+			uid, err := rt.Conn.ReadInt32()
+			if err != nil {
+				return nil, err
+			}
+			f.Uid = uid
+		}
+	}
+
+	if rt.Opts.PreserveGid {
+		if flags&rsync.XMIT_SAME_GID != 0 {
+			if last == nil {
+				return nil, noLast("XMIT_SAME_GID")
+			}
+			f.Gid = last.Gid
+		} else {
+			gid, err := rt.Conn.ReadInt32()
+			if err != nil {
+				return nil, err
+			}
+			f.Gid = gid
+		}
+	}
+
+	mode := f.Mode & rsync.S_IFMT
+	isDev := mode == rsync.S_IFCHR || mode == rsync.S_IFBLK
+	isSpecial := mode == rsync.S_IFIFO || mode == rsync.S_IFSOCK
+	isLink := mode == rsync.S_IFLNK
+
+	if rt.Opts.PreserveDevices && (isDev || isSpecial) {
+		// TODO(protocol >= 28): rdev/major/minor handling
+		if flags&rsync.XMIT_SAME_RDEV_pre28 != 0 {
+			if last == nil {
+				return nil, noLast("XMIT_SAME_RDEV_pre28")
+			}
+			f.Rdev = last.Rdev
+		} else {
+			rdev, err := rt.Conn.ReadInt32()
+			if err != nil {
+				return nil, err
+			}
+			f.Rdev = rdev
+		}
+	}
+
+	if rt.Opts.PreserveLinks && isLink {
+		length, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		// Like rsync, limit symlink targets to PATH_MAX.
+		const maxLinkLen = 4096
+		if length < 0 || length > maxLinkLen {
+			return nil, fmt.Errorf("invalid symlink target length %d (must be 0..%d)", length, maxLinkLen)
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(rt.Conn.Reader, b); err != nil {
+			return nil, err
+		}
+		f.LinkTarget = string(b)
+	}
+
+	return f, nil
+}
+
+// ReceiveFileList receives the file list, the uid/gid lists and the i/o error
+// flag from the sender. The returned file list is sorted.
+//
+// rsync/flist.c:recv_file_list
+func (rt *Transfer) ReceiveFileList() ([]*File, error) {
+	var lastFileEntry *File
+	var fileList []*File
+	for {
+		b, err := rt.Conn.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			break
+		}
+		flags := uint16(b)
+		// log.Printf("flags: %x", flags)
+		// TODO(protocol >= 28): extended flags
+
+		f, err := rt.receiveFileEntry(flags, lastFileEntry)
+		if err != nil {
+			return nil, err
+		}
+		lastFileEntry = f
+		// TODO: include depth in output?
+		log.Printf("[Receiver] i=%d ? %s mode=%o len=%d uid=%d gid=%d flags=?",
+			len(fileList),
+			f.Name,
+			f.Mode,
+			f.Length,
+			f.Uid,
+			f.Gid)
+		fileList = append(fileList, f)
+	}
+
+	sortFileList(fileList)
+
+	// receive the uid/gid list
+	users, groups, err := rt.recvIdList()
+	if err != nil {
+		return nil, err
+	}
+	// rsync/uidlist.c:match_uid/match_gid
+	for _, f := range fileList {
+		if m, ok := users[f.Uid]; ok {
+			f.Uid = m.LocalId
+		}
+		if m, ok := groups[f.Gid]; ok {
+			f.Gid = m.LocalId
+		}
+	}
+
+	// read the i/o error flag
+	ioErrors, err := rt.Conn.ReadInt32()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ioErrors: %v", ioErrors)
+	rt.IOErrors = ioErrors
+
+	return fileList, nil
+}
@@ -0,0 +1,467 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/longpath"
+	"github.com/gokrazy/rsync/internal/rsyncchecksum"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+)
+
+// rsync/generator.c:generate_files()
+func (rt *Transfer) GenerateFiles(fileList []*File) error {
+	if rt.Opts.Delete {
+		rt.indexNames(fileList)
+	}
+	phase := 0
+	for idx, f := range fileList {
+		if err := rt.recvGenerator(idx, f); err != nil {
+			return err
+		}
+	}
+	phase++
+	log.Printf("generateFiles phase=%d", phase)
+	if err := rt.Conn.WriteInt32(-1); err != nil {
+		return err
+	}
+
+	// TODO: re-do any files that failed
+	phase++
+	log.Printf("generateFiles phase=%d", phase)
+	if err := rt.Conn.WriteInt32(-1); err != nil {
+		return err
+	}
+
+	log.Printf("generateFiles finished")
+	return nil
+}
+
+// deleteItem removes the existing file system entry local (of which st is the
+// Lstat result) to make room for an entry of a different type. Like rsync,
+// non-empty directories are only deleted with --force or --delete (DEL_RECURSE),
+// so that a type change on the sending side cannot silently delete entire
+// directory trees.
+//
+// rsync/delete.c:delete_item
+func (rt *Transfer) deleteItem(local string, st fs.FileInfo) error {
+	if st.IsDir() && (rt.Opts.Force || rt.Opts.Delete) {
+		log.Printf("RemoveAll(%s)", local)
+		return os.RemoveAll(local)
+	}
+	if err := os.Remove(local); err != nil {
+		if st.IsDir() {
+			return fmt.Errorf("cannot delete non-empty directory %s (use --force or --delete): %v", local, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// touchUpDirs sets the permissions and modification times of all directories
+// in the file list. This must happen after all files were transferred, because
+// creating files within a directory updates the directory’s modification time
+// (and because the permissions might not allow creating files).
+//
+// rsync/generator.c:touch_up_dirs
+func (rt *Transfer) touchUpDirs(fileList []*File) error {
+	if rt.listOnly() || rt.Opts.DryRun {
+		return nil
+	}
+	for _, f := range fileList {
+		if f.Mode&rsync.S_IFMT != rsync.S_IFDIR || rt.missingDirs[f.Name] {
+			continue
+		}
+		if err := rt.setPerms(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localPath returns the name under which f can be accessed locally. Full paths
+// exceeding PATH_MAX are resolved relative to their parent directory (see
+// longpath.Resolve), so that arbitrarily deep trees can be transferred. The
+// release function must be called once the name is no longer used.
+func (rt *Transfer) localPath(f *File) (string, func(), error) {
+	return resolveLocal(filepath.Join(rt.Dest, f.Name))
+}
+
+// resolveLocal is like localPath, but for the full path local.
+func resolveLocal(local string) (string, func(), error) {
+	resolved, release, err := longpath.Resolve(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The parent directory does not exist (yet), e.g. in dry-run
+			// mode. Fall back to the full path, so that callers see the same
+			// (not-exist) error they would get for shorter names.
+			return local, func() {}, nil
+		}
+		return "", nil, err
+	}
+	return resolved, release, nil
+}
+
+// rsync/generator.c:skip_file
+func (rt *Transfer) skipFile(f *File, st os.FileInfo) (bool, error) {
+	if st.Size() != f.Length {
+		return false, nil
+	}
+
+	// TODO: always checksum flag
+
+	// TODO: size only
+
+	// TODO: ignore times
+
+	return modTimeEqual(st.ModTime(), f.ModTime), nil
+}
+
+func modTimeEqual(a, b time.Time) bool {
+	a = a.Truncate(time.Second)
+	b = b.Truncate(time.Second)
+	log.Printf("comparing mtime: %v vs. %v", a, b)
+	return a.Equal(b)
+}
+
+// rsync/rsync.c:set_perms
+func (rt *Transfer) setPerms(f *File) error {
+	if rt.Opts.DryRun {
+		return nil
+	}
+
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return err
+	}
+	defer release()
+	st, err := os.Lstat(local)
+	if err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(f.Mode) & os.ModePerm
+	mode := f.Mode & rsync.S_IFMT
+	if hasFileflags(mode) {
+		if err := rt.makeMutable(local); err != nil {
+			return err
+		}
+	}
+	if rt.Opts.PreserveTimes &&
+		!modTimeEqual(st.ModTime(), f.ModTime) {
+		if mode == rsync.S_IFLNK {
+			// set the time of the symlink itself, not of its target
+			if err := lchtimes(local, f.ModTime); err != nil {
+				return err
+			}
+		} else if err := os.Chtimes(local, f.ModTime, f.ModTime); err != nil {
+			return err
+		}
+	}
+
+	if rt.Opts.FakeSuper {
+		if err := rt.setFakeSuper(f, local, st); err != nil {
+			return err
+		}
+		return rt.setFileflags(f, local)
+	}
+
+	_, err = rt.setUid(f, local, st)
+	if err != nil {
+		return err
+	}
+
+	if mode != rsync.S_IFLNK {
+		if err := os.Chmod(local, perm); err != nil {
+			return err
+		}
+	}
+
+	return rt.setFileflags(f, local)
+}
+
+// destMode returns the mode to use for a file the sender sent with mode
+// flistMode when not preserving permissions: existing files keep their
+// permissions, new files get the sender’s permissions without the
+// setuid/setgid/sticky bits and masked by the umask.
+//
+// rsync/rsync.c:dest_mode
+func (rt *Transfer) destMode(flistMode int32, st fs.FileInfo, exists bool) int32 {
+	const chmodBits = 0o7777
+	if exists {
+		return flistMode&^chmodBits | int32(st.Mode().Perm())
+	}
+	dfltPerms := int32(os.ModePerm &^ rt.Opts.Umask)
+	return flistMode & (^chmodBits | dfltPerms)
+}
+
+// rsync/generator.c:recv_generator
+func (rt *Transfer) recvGenerator(idx int, f *File) error {
+	if rt.listOnly() {
+		fmt.Fprintf(rt.Env.Stdout, "%s %11.0f %s %s\n",
+			f.FileMode().String(),
+			float64(f.Length), // TODO: rsync prints decimal separators
+			f.ModTime.Format("2006/01/02 15:04:05"),
+			f.Name)
+		return nil
+	}
+	log.Printf("recv_generator(f=%+v)", f)
+
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return err
+	}
+	defer release()
+	st, err := os.Lstat(local)
+
+	if !rt.Opts.PreservePerms {
+		exists := err == nil && st.IsDir() == (f.Mode&rsync.S_IFMT == rsync.S_IFDIR)
+		f.Mode = rt.destMode(f.Mode, st, exists)
+	}
+
+	mode := f.Mode & rsync.S_IFMT
+	if rt.Opts.Existing && os.IsNotExist(err) {
+		// Directories are not created, so neither is anything below them
+		// (which hence does not exist either). With --delete, only
+		// directories which exist are pruned.
+		if mode == rsync.S_IFDIR {
+			if rt.missingDirs == nil {
+				rt.missingDirs = make(map[string]bool)
+			}
+			rt.missingDirs[f.Name] = true
+		}
+		log.Printf("not creating new %s", local)
+		return nil
+	}
+
+	if mode == rsync.S_IFDIR {
+		if rt.Opts.DryRun {
+			if rt.Opts.Delete && err == nil && st.IsDir() {
+				return rt.deleteInDir(f)
+			}
+			return nil
+		}
+		if err == nil && !st.IsDir() {
+			// A file (not a directory) with this name exists. Delete it so that
+			// we can create a directory instead.
+			if err := os.Remove(local); err != nil {
+				return fmt.Errorf("unlinking to make room for directory: %v", err)
+			}
+			err = fmt.Errorf("file removed")
+		}
+		if err == nil {
+			// New entries are created within the directory, its flags are
+			// restored in touchUpDirs.
+			if err := rt.makeMutable(local); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			// Ensure we can create files within the directory, regardless of
+			// its permissions. The permissions (and modification time) are
+			// set in touchUpDirs once the directory contents are complete.
+			perm := fs.FileMode(f.Mode)&os.ModePerm | 0700
+			log.Printf("MkdirAll(%s, %v)", local, perm)
+			if err := os.MkdirAll(local, perm); err != nil {
+				// TODO: EEXIST is okay
+				return err
+			}
+		}
+		if rt.Opts.Delete {
+			return rt.deleteInDir(f)
+		}
+		return nil
+	}
+
+	if rt.Opts.PreserveLinks && mode == rsync.S_IFLNK {
+		if rt.Opts.SafeLinks && unsafeSymlink(f.LinkTarget, f.Name) {
+			log.Printf("ignoring unsafe symlink %q -> %q", f.Name, f.LinkTarget)
+			return nil
+		}
+		if err == nil && st.IsDir() {
+			// A directory with this name exists. Delete it so that we can
+			// create our symlink instead.
+			if err := rt.deleteItem(local, st); err != nil {
+				log.Printf("could not make way for new symlink: %v", err)
+				return nil
+			}
+		} else if err == nil {
+			// local file exists, verify target matches
+			if target, err := os.Readlink(local); err == nil {
+				log.Printf("existing target: %q", target)
+				if target == f.LinkTarget {
+					if err := rt.setPerms(f); err != nil {
+						return err
+					}
+					return nil // skip
+				}
+				// fallthrough to create or replace the symlink
+			}
+			// fallthrough to create or replace the symlink
+		}
+		log.Printf("symlink %s -> %s", local, f.LinkTarget)
+		if err := symlink(f.LinkTarget, local); err != nil {
+			return err
+		}
+		if err := rt.setPerms(f); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if rt.Opts.PreserveDevices && (mode == rsync.S_IFCHR ||
+		mode == rsync.S_IFBLK ||
+		mode == rsync.S_IFSOCK ||
+		mode == rsync.S_IFIFO) {
+		if err == nil && st.IsDir() {
+			if err := rt.deleteItem(local, st); err != nil {
+				log.Printf("could not make way for new device: %v", err)
+				return nil
+			}
+			st = nil
+		}
+		if err := rt.createDevice(f, st); err != nil {
+			return err
+		}
+		return rt.setPerms(f)
+	}
+
+	if rt.Opts.PreserveHardlinks {
+		// TODO: hard link check
+	}
+
+	if !f.FileMode().IsRegular() {
+		// None of the Preserve* options is enabled, so just skip over
+		// non-regular files.
+		return nil
+	}
+
+	requestFullFile := func() error {
+		log.Printf("requesting: %s", f.Name)
+		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+			return err
+		}
+		if rt.Opts.DryRun {
+			return nil
+		}
+		var sh rsync.SumHead
+		rt.recordSumHead(int32(idx), sh)
+		if err := sh.WriteTo(rt.Conn); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if os.IsNotExist(err) {
+		if rt.Opts.CopyDest != "" {
+			if found, err := rt.tryCopyDest(idx, f); found || err != nil {
+				return err
+			}
+		}
+		return requestFullFile()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !st.Mode().IsRegular() {
+		// A non-regular file with this name exists. Delete it so that we can
+		// create our file instead.
+		if err := rt.deleteItem(local, st); err != nil {
+			log.Printf("could not make way for new regular file: %v", err)
+			return nil
+		}
+		return requestFullFile()
+	}
+
+	// TODO: update-only check
+
+	skip, err := rt.skipFile(f, st)
+	if err != nil {
+		return err
+	}
+	if skip {
+		log.Printf("skipping %s", local)
+		if err := rt.setPerms(f); err != nil {
+			return err
+		}
+		// The file is up to date, so the sender can remove its copy.
+		return rt.sendSuccess(int32(idx))
+	}
+
+	if rt.Opts.DryRun {
+		if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// The file will be replaced.
+	if err := rt.makeMutable(local); err != nil {
+		return err
+	}
+
+	// TODO: if deltas are disabled, request the file in full
+
+	in, err := os.Open(local)
+	if err != nil {
+		log.Printf("failed to open %s, continuing: %v", local, err)
+		return requestFullFile()
+	}
+	defer in.Close()
+
+	log.Printf("sending sums for: %s", f.Name)
+	if err := rt.Conn.WriteInt32(int32(idx)); err != nil {
+		return err
+	}
+
+	return rt.generateAndSendSums(idx, in, st.Size())
+}
+
+// rsync/generator.c:generate_and_send_sums
+func (rt *Transfer) generateAndSendSums(idx int, in *os.File, fileLen int64) error {
+	start := time.Now()
+	defer func() {
+		rt.Timings.Checksum += time.Since(start)
+	}()
+	sh := rsynccommon.SumSizesSqroot(fileLen, rt.Opts.BlockSize)
+	rt.recordSumHead(int32(idx), sh)
+	if err := sh.WriteTo(rt.Conn); err != nil {
+		return err
+	}
+	bufLen := int64(sh.BlockLength)
+	if bufLen > fileLen {
+		// A large --block-size must not allocate more than the file needs.
+		bufLen = fileLen
+	}
+	buf := make([]byte, bufLen)
+	remaining := fileLen
+	for i := int32(0); i < sh.ChecksumCount; i++ {
+		n1 := int64(sh.BlockLength)
+		if n1 > remaining {
+			n1 = remaining
+		}
+		b := buf[:n1]
+		if _, err := io.ReadFull(in, b); err != nil {
+			return err
+		}
+
+		sum1 := rsyncchecksum.Checksum1(b)
+		sum2 := rsyncchecksum.Checksum2(rt.Seed, b)
+		if err := rt.Conn.WriteInt32(int32(sum1)); err != nil {
+			return err
+		}
+		if _, err := rt.Conn.Writer.Write(sum2); err != nil {
+			return err
+		}
+		remaining -= n1
+	}
+	return nil
+}
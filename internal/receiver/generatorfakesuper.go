@@ -0,0 +1,73 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/fakesuper"
+	"golang.org/x/sys/unix"
+)
+
+func isDevice(mode uint32) bool {
+	return mode&rsync.S_IFMT == rsync.S_IFCHR || mode&rsync.S_IFMT == rsync.S_IFBLK
+}
+
+// setFakeSuper applies the permissions of f to local (of which st is the Lstat
+// result) as far as possible without root privileges, and stores the mode,
+// device number and ownership in the %stat extended attribute if they differ
+// from those of local. This replaces setUid and chmod with --fake-super.
+//
+// rsync/xattrs.c:set_stat_xattr
+func (rt *Transfer) setFakeSuper(f *File, local string, st fs.FileInfo) error {
+	if f.Mode&rsync.S_IFMT == rsync.S_IFLNK {
+		// Linux does not support user extended attributes on symlinks.
+		return nil
+	}
+	stt := st.Sys().(*syscall.Stat_t)
+	stMode := uint32(stt.Mode) & (rsync.S_IFMT | 0o7777)
+	fmode := uint32(f.Mode) & (rsync.S_IFMT | 0o7777)
+
+	var rdev, stRdev uint64
+	if isDevice(fmode) {
+		rdev = uint64(uint32(f.Rdev))
+	}
+	if isDevice(stMode) {
+		stRdev = uint64(stt.Rdev)
+	}
+
+	// Dump the special permissions and enable full owner access.
+	perm := fmode&0o777 | 0o600
+	if stMode&rsync.S_IFMT == rsync.S_IFDIR {
+		perm |= 0o700
+	}
+	mode := stMode&rsync.S_IFMT | perm
+	if stMode != mode {
+		if err := os.Chmod(local, fs.FileMode(perm)); err != nil {
+			return err
+		}
+	}
+
+	uid, gid := uint32(stt.Uid), uint32(stt.Gid)
+	if rt.Opts.PreserveUid {
+		uid = uint32(f.Uid)
+	}
+	if rt.Opts.PreserveGid {
+		gid = uint32(f.Gid)
+	}
+
+	if mode == fmode && stRdev == rdev && uint32(stt.Uid) == uid && uint32(stt.Gid) == gid {
+		// The extended attribute is not needed, remove it if it exists.
+		return fakesuper.Remove(local)
+	}
+	return fakesuper.Set(local, fakesuper.Stat{
+		Mode:  fmode,
+		Major: unix.Major(rdev),
+		Minor: unix.Minor(rdev),
+		Uid:   uid,
+		Gid:   gid,
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package receiver
+
+import (
+	"errors"
+	"io/fs"
+)
+
+func (rt *Transfer) setFakeSuper(*File, string, fs.FileInfo) error {
+	return errors.New("--fake-super is not supported on this platform")
+}
@@ -0,0 +1,87 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+func (rt *Transfer) createDevice(f *File, st fs.FileInfo) error {
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return err
+	}
+	defer release()
+	perm := fs.FileMode(f.Mode) & os.ModePerm
+	mode := f.Mode & rsync.S_IFMT
+	if rt.Opts.FakeSuper {
+		// Like rsync, create an empty regular file instead, setPerms stores
+		// the file type and device number in an extended attribute.
+		if st != nil && st.Mode().IsRegular() {
+			return nil
+		}
+		out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	switch mode {
+	case rsync.S_IFCHR:
+		if st != nil && st.Mode().Type()&os.ModeCharDevice != 0 {
+			return nil // file of correct type exists
+		}
+		return eintr.Retry(func() error {
+			return unix.Mknod(local, uint32(perm)|syscall.S_IFCHR, int(f.Rdev))
+		})
+
+	case rsync.S_IFBLK:
+		if st != nil && (st.Mode().Type()&os.ModeDevice != 0 ||
+			st.Mode().Type()&os.ModeCharDevice != 0) {
+			return nil // file of correct type exists
+		}
+
+		return eintr.Retry(func() error {
+			return unix.Mknod(local, uint32(perm)|syscall.S_IFBLK, int(f.Rdev))
+		})
+
+	case rsync.S_IFSOCK:
+		if st != nil && st.Mode().Type()&os.ModeSocket != 0 {
+			return nil // file of correct type exists
+		}
+
+		fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+		if err != nil {
+			return err
+		}
+
+		err = eintr.Retry(func() error {
+			return unix.Bind(fd, &unix.SockaddrUnix{Name: local})
+		})
+		if err != nil {
+			unix.Close(fd)
+			return err
+		}
+
+		if err := unix.Close(fd); err != nil {
+			return err
+		}
+		return nil
+
+	case rsync.S_IFIFO:
+		if st != nil && st.Mode().Type()&os.ModeNamedPipe != 0 {
+			return nil // file of correct type exists
+		}
+
+		return eintr.Retry(func() error {
+			return unix.Mkfifo(local, uint32(perm))
+		})
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"time"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"github.com/google/renameio/v2"
+	"golang.org/x/sys/unix"
+)
+
+func symlink(oldname, newname string) error {
+	return renameio.Symlink(oldname, newname)
+}
+
+// lchtimes is like os.Chtimes, but does not follow symbolic links.
+func lchtimes(name string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	return eintr.Retry(func() error {
+		return unix.UtimesNanoAt(unix.AT_FDCWD, name, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package receiver
+
+import (
+	"os"
+	"time"
+)
+
+func symlink(oldname, newname string) error {
+	if err := os.Remove(newname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(oldname, newname)
+}
+
+// lchtimes is a no-op: the modification time of symbolic links cannot be
+// set without following them.
+func lchtimes(name string, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// isTerminal reports whether w is a terminal (character device), in which
+// case progress lines can be updated in place using carriage returns.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress implements --progress output for one file at a time.
+//
+// On a terminal, the progress line of the current file is updated in place
+// (terminated by \r) and only the final line of each file is terminated by a
+// newline. When not writing to a terminal (e.g. output redirected to a file or
+// a pipe), in-place updates would produce garbage, so progress is instead
+// printed as periodic newline-terminated lines.
+type Progress struct {
+	w        io.Writer
+	tty      bool
+	interval time.Duration
+	now      func() time.Time
+
+	// state of the current file
+	size    int64
+	written int64
+	start   time.Time
+	last    time.Time
+
+	transferred int // number of files transferred so far (xfr#)
+}
+
+func NewProgress(w io.Writer) *Progress {
+	p := &Progress{
+		w:   w,
+		tty: isTerminal(w),
+		now: time.Now,
+	}
+	if p.tty {
+		p.interval = 200 * time.Millisecond
+	} else {
+		p.interval = 1 * time.Second
+	}
+	return p
+}
+
+// startFile prints the name of the file about to be transferred and resets
+// the per-file state.
+func (p *Progress) startFile(name string, size int64) {
+	fmt.Fprintf(p.w, "%s\n", name)
+	p.size = size
+	p.written = 0
+	p.start = p.now()
+	p.last = p.start
+}
+
+// Write accounts for n bytes of the current file having been written, so that
+// progress can be plugged into an io.MultiWriter.
+func (p *Progress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if now := p.now(); now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.print(now, "")
+	}
+	return len(b), nil
+}
+
+// finishFile prints the final progress line of the current file. remaining
+// and total are the number of file list entries left to check and in total.
+func (p *Progress) finishFile(remaining, total int) {
+	p.transferred++
+	p.print(p.now(), fmt.Sprintf(" (xfr#%d, to-chk=%d/%d)", p.transferred, remaining, total))
+}
+
+// rsync/progress.c:print_progress
+func (p *Progress) print(now time.Time, suffix string) {
+	elapsed := now.Sub(p.start)
+	pct := 100
+	if p.size > 0 {
+		pct = int(p.written * 100 / p.size)
+	}
+	rate := float64(0)
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(p.written) / secs
+	}
+	units := "kB/s"
+	rate /= 1024
+	if rate > 1024 {
+		rate /= 1024
+		units = "MB/s"
+		if rate > 1024 {
+			rate /= 1024
+			units = "GB/s"
+		}
+	}
+	// While the transfer is in progress, show the estimated remaining time,
+	// once done, show the elapsed time.
+	timing := elapsed
+	if suffix == "" && p.written > 0 && p.written < p.size {
+		timing = time.Duration(float64(elapsed) * float64(p.size-p.written) / float64(p.written))
+	}
+	secs := int(timing.Seconds())
+	line := fmt.Sprintf("%15s %3d%% %7.2f%s %4d:%02d:%02d%s",
+		CommaNum(p.written),
+		pct,
+		rate,
+		units,
+		secs/3600,
+		(secs/60)%60,
+		secs%60,
+		suffix)
+	switch {
+	case !p.tty:
+		fmt.Fprintf(p.w, "%s\n", line)
+	case suffix != "":
+		fmt.Fprintf(p.w, "\r%s\n", line)
+	default:
+		fmt.Fprintf(p.w, "\r%s", line)
+	}
+}
+
+// CommaNum formats n with thousands separators.
+//
+// rsync/util.c:comma_num
+func CommaNum(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	neg := ""
+	if n < 0 {
+		neg, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return neg + s
+}
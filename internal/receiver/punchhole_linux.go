@@ -0,0 +1,22 @@
+package receiver
+
+import (
+	"os"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+// punchHole deallocates length bytes at offset of f, which then read as zeros.
+// File systems which do not support punching holes get zeros written instead.
+//
+// rsync/syscall.c:do_punch_hole
+func punchHole(f *os.File, offset, length int64) error {
+	err := eintr.Retry(func() error {
+		return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	})
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return writeZeros(f, offset, length)
+	}
+	return err
+}
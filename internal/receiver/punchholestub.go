@@ -0,0 +1,9 @@
+//go:build !linux
+
+package receiver
+
+import "os"
+
+func punchHole(f *os.File, offset, length int64) error {
+	return writeZeros(f, offset, length)
+}
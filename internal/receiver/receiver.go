@@ -0,0 +1,669 @@
+// Package receiver implements the receiving side of an rsync transfer (the
+// generator and the receiver), which is used by the gokr-rsync client when
+// downloading and by gokr-rsyncd when accepting uploads.
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/idnames"
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsynctoken"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/mmcloughlin/md4"
+	"golang.org/x/sync/errgroup"
+)
+
+// TransferOpts are the options which influence the receiving side.
+type TransferOpts struct {
+	DryRun bool
+	Force  bool // delete non-empty directories when replacing them
+
+	// FakeSuper stores privileged attributes (ownership, devices) in
+	// extended attributes instead of applying them, see package fakesuper.
+	FakeSuper bool
+
+	Delete         bool // delete extraneous files from destination directories
+	Existing       bool // only update existing files, do not create new ones
+	IgnoreErrors   bool // delete even if the sender reported i/o errors
+	ItemizeChanges bool // print a line for each deleted file
+	Compress       bool // file data is sent as a compressed token stream
+
+	// Backup keeps the previous version of replaced and deleted files: they
+	// are renamed with BackupSuffix appended or, if BackupDir is non-empty,
+	// moved to the same relative path below BackupDir (which is relative to
+	// the destination unless absolute). InfoBackup prints a line for each
+	// backup (--info=backup).
+	Backup       bool
+	BackupDir    string
+	BackupSuffix string
+	InfoBackup   bool
+
+	// RemoveSourceFiles acknowledges each file which was received
+	// successfully (or is up to date) to the sender, which then removes it.
+	// Requires Mux.
+	RemoveSourceFiles bool
+
+	// CopyDest is an additional directory (relative to the destination
+	// unless absolute) in which files missing from the destination are
+	// looked up (--copy-dest): unchanged files are copied locally, changed
+	// files are used as the basis for the transfer.
+	CopyDest string
+
+	// Partial keeps the data received so far when the transfer of a file is
+	// interrupted (--partial): it replaces the destination file, so that the
+	// next transfer uses it as the basis instead of starting over.
+	Partial bool
+
+	// Inplace writes the received data directly into the destination file
+	// (--inplace) instead of into a temporary file which replaces it. The
+	// sender must know about it, as matched blocks are read from the
+	// destination file while it is being updated.
+	Inplace bool
+
+	// Sparse skips runs of zero bytes so that they become holes (--sparse).
+	// With Inplace, holes are punched into the destination file.
+	Sparse bool
+
+	// ReadBatch replays a batch file (--read-batch) instead of a transfer:
+	// its sum heads refer to the destination at the time the batch was
+	// written, not to the ones the generator sent.
+	ReadBatch bool
+
+	// BlockSize is the block length for the checksums of basis files
+	// (--block-size), or 0 to derive it from the file size.
+	BlockSize int32
+
+	// SafeLinks ignores symlinks which are absolute or point outside of the
+	// destination (--safe-links). The daemon always sets it, so that clients
+	// cannot plant symlinks to files outside of the module.
+	SafeLinks bool
+
+	// Umask is applied to the permissions of newly created files and
+	// directories unless PreservePerms is set, usually ProcessUmask().
+	Umask fs.FileMode
+
+	// NumericIds must match the sender’s --numeric-ids: with it, no user and
+	// group name lists are transmitted.
+	NumericIds bool
+
+	PreserveGid       bool
+	PreserveUid       bool
+	PreserveLinks     bool
+	PreservePerms     bool
+	PreserveDevices   bool
+	PreserveSpecials  bool
+	PreserveTimes     bool
+	PreserveHardlinks bool
+	PreserveFileflags bool // inode flags, see package fileflags
+}
+
+// PhaseTimings is a breakdown of where the time of a transfer was spent, as
+// shown with --info=stats2. The phases do not overlap, so their sum is the
+// total duration of the transfer.
+type PhaseTimings struct {
+	FileList time.Duration // connection setup and receiving the file list
+	Checksum time.Duration // generating block checksums of existing files
+	Transfer time.Duration // receiving file data (excluding Checksum)
+	Finalize time.Duration // directory touch-up and exchanging statistics
+}
+
+// Total returns the sum of all phases.
+func (pt PhaseTimings) Total() time.Duration {
+	return pt.FileList + pt.Checksum + pt.Transfer + pt.Finalize
+}
+
+type Osenv struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type Transfer struct {
+	// config
+	Opts  *TransferOpts
+	Dest  string
+	Env   Osenv
+	Chmod rsyncchmod.Modes // applied to the modes the sender sent, if non-nil
+
+	// Filters protects excluded local files from --delete. The files named
+	// by dir-merge rules are read from the destination directories.
+	Filters *rsyncfilter.List
+
+	// IDs maps the user and group names the sender sent to local ids. If
+	// nil (--numeric-ids), the numeric ids are used as-is.
+	IDs idnames.Lookup
+
+	// Manifest receives a line with the MD4 checksum (unseeded, like rsync’s
+	// --checksum) and name of each file whose data was received, if non-nil.
+	Manifest io.Writer
+
+	// state
+	Conn     *rsyncwire.Conn
+	Mux      *rsyncwire.MultiplexWriter // Conn.Writer, with RemoveSourceFiles
+	Seed     int32
+	Progress *Progress // nil unless --progress was specified
+	IOErrors int32     // i/o error flag, as sent by the sender
+	Timings  PhaseTimings
+	Deleted  int // number of deleted (with --dry-run: to be deleted) entries
+
+	names  map[string]bool    // names of the file list, for --delete
+	scope  *rsyncfilter.Scope // Filters with per-directory rules, for --delete
+	tokens *rsynctoken.Reader // compressed token stream, with Compress
+
+	// residue is the length of the literal data token which recvToken did
+	// not yet return, tokenBuf holds the returned data.
+	residue  int32
+	tokenBuf []byte
+
+	// sentSums are the sum heads which the generator sent, by file index.
+	// The sender must send the same sum head back along with the file data.
+	sentSumsMu sync.Mutex
+	sentSums   map[int32]rsync.SumHead
+
+	// missingDirs are the directories which were not created (Existing).
+	missingDirs map[string]bool
+
+	// deletionSkipped is set once the i/o error flag prevented a deletion.
+	deletionSkipped bool
+}
+
+func (rt *Transfer) listOnly() bool { return rt.Dest == "" }
+
+// CompressedData returns the number of file data bytes received in compressed
+// form and their number after decompression (zero unless Compress is set).
+func (rt *Transfer) CompressedData() (compressed, uncompressed int64) {
+	if rt.tokens == nil {
+		return 0, 0
+	}
+	return rt.tokens.Compressed, rt.tokens.Uncompressed
+}
+
+// Do runs the generator and the receiver concurrently until all files of
+// fileList have been transferred, then sets the directory permissions and
+// modification times.
+//
+// rsync/main.c:do_recv
+func (rt *Transfer) Do(fileList []*File) error {
+	start := time.Now()
+	if err := rt.getLocalName(fileList); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return rt.GenerateFiles(fileList)
+	})
+	eg.Go(func() error {
+		// Ensure we don’t block on the receiver when the generator returns an
+		// error.
+		errChan := make(chan error)
+		go func() {
+			errChan <- rt.RecvFiles(fileList)
+		}()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errChan:
+			return err
+		}
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	// The generator computes checksums while the receiver is receiving file
+	// data, so account for checksum time only once.
+	rt.Timings.Transfer += time.Since(start) - rt.Timings.Checksum
+
+	finalizeStart := time.Now()
+	defer func() {
+		rt.Timings.Finalize += time.Since(finalizeStart)
+	}()
+	return rt.touchUpDirs(fileList)
+}
+
+// getLocalName adjusts the destination of a transfer of a single file (not a
+// directory): unless Dest is an existing directory or ends in a slash, the
+// file is stored as Dest instead of within it. A missing Dest directory is
+// created.
+//
+// rsync/main.c:get_local_name
+func (rt *Transfer) getLocalName(fileList []*File) error {
+	if rt.listOnly() || len(fileList) != 1 || fileList[0].FileMode().IsDir() {
+		return nil
+	}
+	st, err := os.Stat(rt.Dest)
+	if err == nil && st.IsDir() {
+		return nil // the file is stored within Dest
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.HasSuffix(rt.Dest, "/") {
+		if err == nil {
+			return fmt.Errorf("destination %s is not a directory", rt.Dest)
+		}
+		if rt.Opts.DryRun {
+			return nil
+		}
+		return os.MkdirAll(rt.Dest, 0777)
+	}
+	// Store the file under the destination name, like a rename.
+	dest := filepath.Clean(rt.Dest)
+	rt.Dest = filepath.Dir(dest)
+	fileList[0].Name = filepath.Base(dest)
+	return nil
+}
+
+// rsync/receiver.c:recv_files
+func (rt *Transfer) RecvFiles(fileList []*File) error {
+	phase := 0
+	for {
+		idx, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return err
+		}
+		if idx == -1 {
+			if phase == 0 {
+				phase++
+				log.Printf("recvFiles phase=%d", phase)
+				// TODO: send done message
+				continue
+			}
+			break
+		}
+		if idx < 0 || int(idx) >= len(fileList) {
+			return fmt.Errorf("protocol error: invalid file index %d (file list has %d entries)", idx, len(fileList))
+		}
+		log.Printf("receiving file idx=%d: %+v", idx, fileList[idx])
+		if rt.Progress != nil {
+			rt.Progress.startFile(fileList[idx].Name, fileList[idx].Length)
+		}
+		if err := rt.recvFile1(idx, fileList[idx]); err != nil {
+			return err
+		}
+		if err := rt.sendSuccess(idx); err != nil {
+			return err
+		}
+		if rt.Progress != nil {
+			rt.Progress.finishFile(len(fileList)-int(idx)-1, len(fileList))
+		}
+	}
+	log.Printf("recvFiles finished")
+	return nil
+}
+
+func (rt *Transfer) recvFile1(idx int32, f *File) error {
+	localFile, err := rt.openLocalFile(f)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("opening local file failed, continuing: %v", err)
+	}
+	defer localFile.Close()
+	if err := rt.receiveData(idx, f, localFile); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (rt *Transfer) openLocalFile(f *File) (*os.File, error) {
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	in, err := os.Open(local)
+	if os.IsNotExist(err) && rt.Opts.CopyDest != "" {
+		// Like the generator, use the file below CopyDest as basis.
+		return rt.openCopyDest(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if st.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", local)
+	}
+
+	if !st.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	if !rt.Opts.PreservePerms {
+		// If the file exists already and we are not preserving permissions,
+		// then act as though the remote sent us the existing permissions:
+		f.Mode = int32(st.Mode().Perm())
+	}
+
+	return in, nil
+}
+
+// rsync/receiver.c:receive_data
+func (rt *Transfer) receiveData(idx int32, f *File, localFile *os.File) error {
+	var sh rsync.SumHead
+	if err := sh.ReadFrom(rt.Conn); err != nil {
+		return err
+	}
+	// The block length and count determine which parts of the basis file
+	// are read, so they must not be chosen by the sender.
+	if want := rt.sentSumHead(idx); !rt.Opts.ReadBatch &&
+		(sh.ChecksumCount != want.ChecksumCount ||
+			sh.BlockLength != want.BlockLength ||
+			sh.ChecksumLength != want.ChecksumLength ||
+			sh.RemainderLength != want.RemainderLength) {
+		return fmt.Errorf("protocol error: sum head for %s (count=%d, blength=%d, s2length=%d, remainder=%d) does not match the requested one (count=%d, blength=%d, s2length=%d, remainder=%d)",
+			f.Name,
+			sh.ChecksumCount, sh.BlockLength, sh.ChecksumLength, sh.RemainderLength,
+			want.ChecksumCount, want.BlockLength, want.ChecksumLength, want.RemainderLength)
+	}
+
+	local, release, err := rt.localPath(f)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if rt.Opts.Inplace && rt.Opts.Backup {
+		// The backup moves the old file (which remains open as basis) out of
+		// the way, so the new file is not written in place.
+		if err := rt.makeBackup(f.Name); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("creating %s", local)
+	out, outFile, err := rt.openOutput(local)
+	if err != nil {
+		return err
+	}
+	defer out.Cleanup()
+
+	// Whether the basis file is the output file, i.e. blocks matched at the
+	// same offset are already in place.
+	//
+	// rsync/receiver.c:updating_basis_or_equiv
+	updating := false
+	if rt.Opts.Inplace && localFile != nil {
+		lst, err := localFile.Stat()
+		if err != nil {
+			return err
+		}
+		ost, err := outFile.Stat()
+		if err != nil {
+			return err
+		}
+		updating = os.SameFile(lst, ost)
+	}
+
+	h := md4.New()
+	binary.Write(h, binary.LittleEndian, rt.Seed)
+
+	fw := &fileWriter{
+		f:       outFile,
+		sparse:  rt.Opts.Sparse,
+		inplace: updating,
+	}
+	output := wrapOutput(fw)
+	sums := []io.Writer{h}
+	var fileSum hash.Hash
+	if rt.Manifest != nil {
+		fileSum = md4.New()
+		sums = append(sums, fileSum)
+	}
+	if rt.Progress != nil {
+		sums = append(sums, rt.Progress)
+	}
+	sum := io.MultiWriter(sums...)
+
+	// Only writes to the output file can fail, so all write errors are
+	// reported as file I/O errors.
+	var offset int64
+	write := func(data []byte, inPlace bool) error {
+		var err error
+		if inPlace {
+			err = fw.skip(data)
+		} else {
+			_, err = output.Write(data)
+		}
+		if err != nil {
+			return fileIOError("write", f.Name, err)
+		}
+		sum.Write(data)
+		offset += int64(len(data))
+		return nil
+	}
+
+	// The partial file is not appended to by the next transfer, but used as
+	// the basis like any other outdated destination file, i.e. only the
+	// blocks which still match the (possibly changed) source are re-used.
+	//
+	// rsync/cleanup.c:_exit_cleanup
+	gotLiteral := false
+	interrupted := func(err error) error {
+		if !rt.Opts.Partial || !gotLiteral {
+			return err
+		}
+		log.Printf("keeping partial file %s", local)
+		if err := out.CloseAtomicallyReplace(); err != nil {
+			log.Printf("keeping partial file failed: %v", err)
+		}
+		return err
+	}
+
+	for {
+		token, data, err := rt.recvToken()
+		if err != nil {
+			return interrupted(err)
+		}
+		if token == 0 {
+			break
+		}
+		if token > 0 {
+			gotLiteral = true
+			if err := write(data, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if localFile == nil {
+			return fmt.Errorf("BUG: local file %s not open for copying chunk", local)
+		}
+		token = -(token + 1)
+		if token >= sh.ChecksumCount {
+			return fmt.Errorf("protocol error: block %d of %s out of range (%d blocks)", token, f.Name, sh.ChecksumCount)
+		}
+		offset2 := int64(token) * int64(sh.BlockLength)
+		dataLen := sh.BlockLength
+		if token == sh.ChecksumCount-1 && sh.RemainderLength != 0 {
+			dataLen = sh.RemainderLength
+		}
+		data = make([]byte, dataLen)
+		if _, err := localFile.ReadAt(data, offset2); err != nil {
+			return err
+		}
+		if rt.tokens != nil {
+			// The decompressor’s history needs to contain matched blocks,
+			// too, as the sender’s compressor refers to them.
+			rt.tokens.See(data)
+		}
+
+		if err := write(data, updating && offset2 == offset); err != nil {
+			return err
+		}
+	}
+	localSum := h.Sum(nil)
+	remoteSum := make([]byte, len(localSum))
+	if _, err := io.ReadFull(rt.Conn.Reader, remoteSum); err != nil {
+		return interrupted(err)
+	}
+	if !bytes.Equal(localSum, remoteSum) {
+		return fmt.Errorf("file corruption in %s", f.Name)
+	}
+	log.Printf("checksum %x matches!", localSum)
+
+	if err := fw.finish(); err != nil {
+		return fileIOError("write", f.Name, err)
+	}
+
+	if rt.Opts.Backup && !rt.Opts.Inplace {
+		if err := rt.makeBackup(f.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := out.CloseAtomicallyReplace(); err != nil {
+		return fileIOError("close", f.Name, err)
+	}
+
+	if fileSum != nil {
+		if _, err := fmt.Fprintf(rt.Manifest, "%x  %s\n", fileSum.Sum(nil), f.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := rt.setPerms(f); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recordSumHead remembers the sum head which the generator sends for the file
+// with index idx, see sentSumHead.
+func (rt *Transfer) recordSumHead(idx int32, sh rsync.SumHead) {
+	rt.sentSumsMu.Lock()
+	defer rt.sentSumsMu.Unlock()
+	if rt.sentSums == nil {
+		rt.sentSums = make(map[int32]rsync.SumHead)
+	}
+	sh.Sums = nil
+	rt.sentSums[idx] = sh
+}
+
+// sentSumHead returns the sum head which the generator sent for the file with
+// index idx. If it did not send any, the file can only be received in full,
+// i.e. with an empty sum head.
+func (rt *Transfer) sentSumHead(idx int32) rsync.SumHead {
+	rt.sentSumsMu.Lock()
+	defer rt.sentSumsMu.Unlock()
+	sh := rt.sentSums[idx]
+	delete(rt.sentSums, idx)
+	return sh
+}
+
+// outputFile is the file to which receiveData writes: a temporary file which
+// atomically replaces the destination once complete, or with Inplace the
+// destination file itself.
+type outputFile interface {
+	CloseAtomicallyReplace() error
+	Cleanup() error
+}
+
+func (rt *Transfer) openOutput(local string) (outputFile, *os.File, error) {
+	if rt.Opts.Inplace {
+		f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		return inplaceFile{f}, f, nil
+	}
+	out, err := newPendingFile(local)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, pendingOSFile(out), nil
+}
+
+// inplaceFile is the destination file, updated in place (--inplace).
+type inplaceFile struct {
+	*os.File
+}
+
+func (f inplaceFile) CloseAtomicallyReplace() error {
+	return f.Close()
+}
+
+// Cleanup closes the file, leaving the data written so far in place, like
+// rsync does with --inplace.
+func (f inplaceFile) Cleanup() error {
+	if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// wrapOutput wraps the writer for the temporary output file. Tests replace it
+// to simulate write errors, e.g. a full file system (ENOSPC).
+var wrapOutput = func(w io.Writer) io.Writer { return w }
+
+// fileIOError returns the error with which the transfer is aborted when
+// writing the output file name failed, e.g. because the file system is full.
+// Like in rsync, this results in exit code 11 (RERR_FILEIO). The temporary
+// file is removed by the caller’s deferred cleanup.
+func fileIOError(op, name string, err error) error {
+	return &rsync.ExitError{
+		Code: rsync.RERR_FILEIO,
+		Err:  fmt.Errorf("%s failed on %q: %w", op, name, err),
+	}
+}
+
+// chunkSize is the maximum length of literal data returned by recvToken.
+// rsync/rsync.h defines CHUNK_SIZE as 32 * 1024, but the gokrazy sender sends
+// literal data in chunks of 256K, which are not split up.
+const chunkSize = 256 * 1024
+
+// rsync/token.c:recv_token
+func (rt *Transfer) recvToken() (token int32, data []byte, _ error) {
+	if rt.Opts.Compress {
+		if rt.tokens == nil {
+			rt.tokens = rsynctoken.NewReader(rt.Conn)
+		}
+		return rt.tokens.Recv()
+	}
+	if rt.residue == 0 {
+		var err error
+		token, err = rt.Conn.ReadInt32()
+		if err != nil {
+			return 0, nil, err
+		}
+		if token <= 0 {
+			return token, nil, nil
+		}
+		rt.residue = token
+	}
+	// Like rsync, return literal data in pieces of at most chunkSize bytes,
+	// so that the sender cannot make us allocate arbitrary amounts of memory.
+	n := rt.residue
+	if n > chunkSize {
+		n = chunkSize
+	}
+	rt.residue -= n
+	if rt.tokenBuf == nil {
+		rt.tokenBuf = make([]byte, chunkSize)
+	}
+	data = rt.tokenBuf[:n]
+	if _, err := io.ReadFull(rt.Conn.Reader, data); err != nil {
+		return 0, nil, err
+	}
+	return n, data, nil
+}
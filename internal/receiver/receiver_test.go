@@ -0,0 +1,333 @@
+package receiver
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// fullWriter simulates a file system which fills up after limit bytes.
+type fullWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (fw *fullWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		n, _ := fw.w.Write(p[:fw.limit])
+		fw.limit = 0
+		return n, syscall.ENOSPC
+	}
+	fw.limit -= len(p)
+	return fw.w.Write(p)
+}
+
+func TestReceiveDataNoSpace(t *testing.T) {
+	wrapOutput = func(w io.Writer) io.Writer { return &fullWriter{w: w, limit: 5} }
+	defer func() { wrapOutput = func(w io.Writer) io.Writer { return w } }()
+
+	// The sender transmits the file in two literal data tokens (no existing
+	// blocks to match against): the first one fits, the second one fails.
+	var buf rsyncwire.Buffer
+	for i := 0; i < 4; i++ {
+		buf.WriteInt32(0) // empty sum head
+	}
+	for _, data := range []string{"hello", "world"} {
+		buf.WriteInt32(int32(len(data)))
+		buf.WriteString(data)
+	}
+	buf.WriteInt32(0) // end of file
+	buf.WriteString(strings.Repeat("\x00", 16))
+
+	dest := t.TempDir()
+	rt := &Transfer{
+		Opts: &TransferOpts{},
+		Dest: dest,
+		Conn: &rsyncwire.Conn{
+			Reader: strings.NewReader(buf.String()),
+			Writer: io.Discard,
+		},
+	}
+	err := rt.receiveData(0, &File{Name: "full.txt", Length: 10}, nil)
+	if err == nil {
+		t.Fatal("receiveData unexpectedly succeeded")
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("receiveData = %v, want ENOSPC", err)
+	}
+	if !strings.Contains(err.Error(), `"full.txt"`) {
+		t.Errorf("error %q does not identify the file", err)
+	}
+	var ee *rsync.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("receiveData = %v (%T), want *rsync.ExitError", err, err)
+	}
+	if got, want := ee.Code, rsync.RERR_FILEIO; got != want {
+		t.Errorf("unexpected exit code: got %d, want %d", got, want)
+	}
+
+	// Neither the destination file nor the temporary file must remain.
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file left behind: %s", e.Name())
+	}
+}
+
+func TestReceiveFileEntryChmodSameMode(t *testing.T) {
+	chmod, err := rsyncchmod.Parse("Fu+x,Fa+X")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two regular files with mode 0644, the second one using XMIT_SAME_MODE,
+	// as sent by rsync (the gokrazy sender always transmits the mode).
+	var buf rsyncwire.Buffer
+	for _, name := range []string{"a", "b"} {
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+		buf.WriteInt64(5) // length
+		buf.WriteInt32(0) // mtime
+		if name == "a" {
+			buf.WriteInt32(rsync.S_IFREG | 0644)
+		}
+	}
+
+	rt := &Transfer{
+		Opts:  &TransferOpts{},
+		Chmod: chmod,
+		Conn: &rsyncwire.Conn{
+			Reader: strings.NewReader(buf.String()),
+			Writer: io.Discard,
+		},
+	}
+	a, err := rt.receiveFileEntry(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rt.receiveFileEntry(rsync.XMIT_SAME_MODE, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chmod specification must be applied to the mode the sender sent,
+	// not to the previous entry’s already modified mode (which would result
+	// in 0755).
+	for _, f := range []*File{a, b} {
+		if got, want := f.Mode, int32(rsync.S_IFREG|0744); got != want {
+			t.Errorf("%s: unexpected mode: got %o, want %o", f.Name, got, want)
+		}
+	}
+}
+
+func TestRecvFilesInvalidIndex(t *testing.T) {
+	for _, idx := range []int32{-2, 1} {
+		var buf rsyncwire.Buffer
+		buf.WriteInt32(idx)
+		rt := &Transfer{
+			Opts: &TransferOpts{},
+			Dest: t.TempDir(),
+			Conn: &rsyncwire.Conn{
+				Reader: strings.NewReader(buf.String()),
+				Writer: io.Discard,
+			},
+		}
+		err := rt.RecvFiles([]*File{{Name: "hello"}})
+		if err == nil || !strings.Contains(err.Error(), "invalid file index") {
+			t.Errorf("RecvFiles(idx=%d) = %v, want invalid file index error", idx, err)
+		}
+	}
+}
+
+func TestUnsafeSymlink(t *testing.T) {
+	for _, tt := range []struct {
+		target, name string
+		want         bool
+	}{
+		{"", "link", true},
+		{"/etc/passwd", "link", true},
+		{"file", "link", false},
+		{"dir/file", "link", false},
+		{"./file", "link", false},
+		{"../file", "link", true},
+		{"../file", "dir/link", false},
+		{"../../file", "dir/link", true},
+		{"dir/../../file", "link", true},
+		{"..", "link", true},
+		{"..", "dir/link", false},
+		{"a/../b/../../c", "dir/link", false},
+		{"a/../../../c", "dir/link", true},
+		{"../file", "dir/../link", true},
+	} {
+		if got := unsafeSymlink(tt.target, tt.name); got != tt.want {
+			t.Errorf("unsafeSymlink(%q, %q) = %v, want %v", tt.target, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSafeLinks(t *testing.T) {
+	dest := t.TempDir()
+	rt := &Transfer{
+		Opts: &TransferOpts{
+			PreserveLinks: true,
+			SafeLinks:     true,
+		},
+		Dest: dest,
+		Conn: &rsyncwire.Conn{Writer: io.Discard},
+	}
+	for _, f := range []*File{
+		{Name: "safe", Mode: rsync.S_IFLNK | 0777, LinkTarget: "file"},
+		{Name: "unsafe", Mode: rsync.S_IFLNK | 0777, LinkTarget: "../../etc/passwd"},
+	} {
+		if err := rt.recvGenerator(0, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "safe")); err != nil {
+		t.Errorf("safe symlink not created: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "unsafe")); !os.IsNotExist(err) {
+		t.Errorf("unsafe symlink unexpectedly created (lstat: %v)", err)
+	}
+}
+
+func TestReceiveFileEntryMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		desc  string
+		flags uint16
+		last  *File
+		entry func(*rsyncwire.Buffer)
+		want  string
+	}{
+		{
+			desc:  "XMIT_SAME_NAME on first entry",
+			flags: rsync.XMIT_SAME_NAME,
+			entry: func(buf *rsyncwire.Buffer) {
+				buf.WriteByte(3)
+				buf.WriteByte(1)
+				buf.WriteString("a")
+			},
+			want: "XMIT_SAME_NAME set on the first file list entry",
+		},
+		{
+			desc:  "XMIT_SAME_TIME on first entry",
+			flags: rsync.XMIT_SAME_TIME,
+			entry: func(buf *rsyncwire.Buffer) {
+				buf.WriteByte(1)
+				buf.WriteString("a")
+				buf.WriteInt64(0) // length
+			},
+			want: "XMIT_SAME_TIME set on the first file list entry",
+		},
+		{
+			desc:  "XMIT_SAME_NAME prefix longer than previous name",
+			flags: rsync.XMIT_SAME_NAME,
+			last:  &File{Name: "ab"},
+			entry: func(buf *rsyncwire.Buffer) {
+				buf.WriteByte(3)
+				buf.WriteByte(1)
+				buf.WriteString("c")
+			},
+			want: "exceeds the previous name",
+		},
+		{
+			desc: "negative symlink length",
+			entry: func(buf *rsyncwire.Buffer) {
+				buf.WriteByte(4)
+				buf.WriteString("link")
+				buf.WriteInt64(0) // length
+				buf.WriteInt32(0) // mtime
+				buf.WriteInt32(rsync.S_IFLNK | 0777)
+				buf.WriteInt32(-1)
+			},
+			want: "invalid symlink target length",
+		},
+		{
+			desc: "oversized symlink length",
+			entry: func(buf *rsyncwire.Buffer) {
+				buf.WriteByte(4)
+				buf.WriteString("link")
+				buf.WriteInt64(0) // length
+				buf.WriteInt32(0) // mtime
+				buf.WriteInt32(rsync.S_IFLNK | 0777)
+				buf.WriteInt32(1 << 30)
+			},
+			want: "invalid symlink target length",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var buf rsyncwire.Buffer
+			tt.entry(&buf)
+			rt := &Transfer{
+				Opts: &TransferOpts{PreserveLinks: true},
+				Conn: &rsyncwire.Conn{
+					Reader: strings.NewReader(buf.String()),
+					Writer: io.Discard,
+				},
+			}
+			_, err := rt.receiveFileEntry(tt.flags, tt.last)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("receiveFileEntry = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiveDataSumHeadMismatch(t *testing.T) {
+	// The generator requested the file in full, but the sender refers to
+	// blocks of a sum head of its own choosing.
+	var buf rsyncwire.Buffer
+	buf.WriteInt32(1 << 20) // count
+	buf.WriteInt32(1 << 30) // blength
+	buf.WriteInt32(16)      // s2length
+	buf.WriteInt32(0)       // remainder
+	buf.WriteInt32(-1)      // block 0
+
+	rt := &Transfer{
+		Opts: &TransferOpts{},
+		Dest: t.TempDir(),
+		Conn: &rsyncwire.Conn{
+			Reader: strings.NewReader(buf.String()),
+			Writer: io.Discard,
+		},
+	}
+	rt.recordSumHead(0, rsync.SumHead{})
+	err := rt.receiveData(0, &File{Name: "file"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not match the requested one") {
+		t.Errorf("receiveData = %v, want sum head mismatch error", err)
+	}
+}
+
+func TestRecvTokenLarge(t *testing.T) {
+	data := strings.Repeat("x", chunkSize+5)
+	var buf rsyncwire.Buffer
+	buf.WriteInt32(int32(len(data)))
+	buf.WriteString(data)
+	buf.WriteInt32(0)
+	rt := &Transfer{
+		Opts: &TransferOpts{},
+		Conn: &rsyncwire.Conn{
+			Reader: strings.NewReader(buf.String()),
+			Writer: io.Discard,
+		},
+	}
+	// Large literal data is returned in pieces of at most chunkSize bytes.
+	for _, want := range []int32{chunkSize, 5, 0} {
+		token, got, err := rt.recvToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != want || len(got) != int(want) {
+			t.Errorf("recvToken = %d (%d bytes), want %d", token, len(got), want)
+		}
+	}
+}
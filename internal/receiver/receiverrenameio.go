@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/google/renameio/v2"
+)
+
+func newPendingFile(fn string) (*renameio.PendingFile, error) {
+	// Create the temporary file next to its destination (like rsync does).
+	// Without an explicit directory, renameio probes whether os.TempDir() is
+	// on the same file system for every file, which costs four additional
+	// file system operations per file.
+	return renameio.NewPendingFile(fn, renameio.WithTempDir(filepath.Dir(fn)))
+}
+
+func pendingOSFile(p *renameio.PendingFile) *os.File { return p.File }
@@ -1,6 +1,6 @@
 //go:build windows
 
-package receivermaincmd
+package receiver
 
 import (
 	"os"
@@ -45,3 +45,5 @@ func (p *pendingFile) Cleanup() error {
 	}
 	return err
 }
+
+func pendingOSFile(p *pendingFile) *os.File { return p.f }
@@ -0,0 +1,23 @@
+package receiver
+
+import (
+	"encoding/binary"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// sendSuccess tells the sender that the file with index idx was received
+// successfully (or was already up to date), so that the sender can remove its
+// copy (--remove-source-files). It must only be called once the file is in
+// place under its final name.
+//
+// rsync/io.c:send_msg_success
+func (rt *Transfer) sendSuccess(idx int32) error {
+	if !rt.Opts.RemoveSourceFiles || rt.Opts.DryRun {
+		return nil
+	}
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(idx))
+	_, err := rt.Mux.WriteMsg(rsyncwire.MsgSuccess, buf[:])
+	return err
+}
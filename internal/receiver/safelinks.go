@@ -0,0 +1,47 @@
+package receiver
+
+import "strings"
+
+// unsafeSymlink reports whether the symlink target, which is located at name
+// (relative to the destination), is absolute or leaves the destination.
+//
+// rsync/util.c:unsafe_symlink
+func unsafeSymlink(target, name string) bool {
+	if target == "" || strings.HasPrefix(target, "/") {
+		return true
+	}
+
+	// The directories of name are the safety margin for “..” elements in the
+	// target. A “..” element in name itself starts the count over.
+	depth := 0
+	elems := strings.Split(name, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth = 0
+		default:
+			depth++
+		}
+	}
+	if elems[len(elems)-1] == ".." {
+		depth = 0
+	}
+
+	elems = strings.Split(target, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true // went outside of the destination
+			}
+		default:
+			depth++
+		}
+	}
+	if elems[len(elems)-1] == ".." {
+		depth--
+	}
+	return depth < 0
+}
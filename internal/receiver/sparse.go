@@ -0,0 +1,142 @@
+package receiver
+
+import (
+	"io"
+	"os"
+)
+
+// sparseWriteSize is the size of the pieces in which data is written with
+// --sparse: zero bytes at the start and end of each piece are skipped instead
+// of written.
+const sparseWriteSize = 1024 // rsync/rsync.h:SPARSE_WRITE_SIZE
+
+// fileWriter writes the received file data sequentially to f.
+//
+// With sparse (--sparse), runs of zero bytes are skipped instead of written,
+// so that they become holes once the file is complete. When f is the
+// destination file itself (--inplace), the skipped ranges might still contain
+// old data, so holes are punched into them instead.
+//
+// rsync/fileio.c:write_sparse
+type fileWriter struct {
+	f       *os.File
+	sparse  bool
+	inplace bool
+
+	offset int64 // of the next byte, including a pending hole
+	hole   int64 // length of the skipped zero bytes ending at offset
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if err := w.write(p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// skip advances past p, which the destination file already contains at the
+// current offset (a block matched in place with --inplace).
+func (w *fileWriter) skip(p []byte) error {
+	return w.write(p, true)
+}
+
+func (w *fileWriter) write(p []byte, present bool) error {
+	if !w.sparse {
+		w.offset += int64(len(p))
+		if present {
+			_, err := w.f.Seek(int64(len(p)), io.SeekCurrent)
+			return err
+		}
+		_, err := w.f.Write(p)
+		return err
+	}
+	for len(p) > 0 {
+		n := len(p)
+		if n > sparseWriteSize {
+			n = sparseWriteSize
+		}
+		chunk := p[:n]
+		p = p[n:]
+
+		leading := 0
+		for leading < len(chunk) && chunk[leading] == 0 {
+			leading++
+		}
+		w.hole += int64(leading)
+		w.offset += int64(leading)
+		if leading == len(chunk) {
+			continue
+		}
+		trailing := 0
+		for chunk[len(chunk)-1-trailing] == 0 {
+			trailing++
+		}
+		data := chunk[leading : len(chunk)-trailing]
+		if err := w.flushHole(); err != nil {
+			return err
+		}
+		if present {
+			if _, err := w.f.Seek(int64(len(data)), io.SeekCurrent); err != nil {
+				return err
+			}
+		} else {
+			if _, err := w.f.Write(data); err != nil {
+				return err
+			}
+		}
+		w.offset += int64(len(data))
+		w.hole += int64(trailing)
+		w.offset += int64(trailing)
+	}
+	return nil
+}
+
+// flushHole moves the file position past the pending hole, punching it into
+// the file if necessary.
+func (w *fileWriter) flushHole() error {
+	if w.hole == 0 {
+		return nil
+	}
+	if w.inplace {
+		if err := punchHole(w.f, w.offset-w.hole, w.hole); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.Seek(w.hole, io.SeekCurrent); err != nil {
+		return err
+	}
+	w.hole = 0
+	return nil
+}
+
+// finish completes the file after all data was written: a hole at the end
+// extends the file, and an in-place update truncates any remaining old data.
+//
+// rsync/fileio.c:sparse_end
+func (w *fileWriter) finish() error {
+	if err := w.flushHole(); err != nil {
+		return err
+	}
+	if !w.sparse && !w.inplace {
+		return nil
+	}
+	return w.f.Truncate(w.offset)
+}
+
+// writeZeros overwrites length bytes at offset with zeros, for file systems
+// which cannot punch holes.
+func writeZeros(f *os.File, offset, length int64) error {
+	zeros := make([]byte, 32*1024)
+	for length > 0 {
+		n := int64(len(zeros))
+		if n > length {
+			n = length
+		}
+		if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package receiver
+
+import (
+	"io"
+	"log"
+)
+
+type mapping struct {
+	Name    string
+	LocalId int32
+}
+
+func (rt *Transfer) recvIdMapping1(localId func(id int32, name string) int32) (map[int32]mapping, error) {
+	idMapping := make(map[int32]mapping)
+	for {
+		id, err := rt.Conn.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			break
+		}
+		length, err := rt.Conn.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(rt.Conn.Reader, name); err != nil {
+			return nil, err
+		}
+		idMapping[id] = mapping{
+			Name:    string(name),
+			LocalId: localId(id, string(name)),
+		}
+	}
+	return idMapping, nil
+}
+
+// rsync/uidlist.c:recv_id_list
+func (rt *Transfer) recvIdList() (users map[int32]mapping, groups map[int32]mapping, _ error) {
+	// The sender only transmits the user list with -o and the group list
+	// with -g, and neither with --numeric-ids.
+	if rt.Opts.NumericIds {
+		return nil, nil, nil
+	}
+	var err error
+	if rt.Opts.PreserveUid {
+		users, err = rt.recvIdMapping1(func(remoteUid int32, remoteUsername string) int32 {
+			if rt.IDs == nil {
+				return remoteUid
+			}
+			if uid, err := rt.IDs.UserID(remoteUsername); err == nil {
+				return uid
+			}
+			return remoteUid
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for remoteUid, mapping := range users {
+			log.Printf("remote uid %d(%s) maps to local uid %d", remoteUid, mapping.Name, mapping.LocalId)
+		}
+	}
+	if rt.Opts.PreserveGid {
+		groups, err = rt.recvIdMapping1(func(remoteGid int32, remoteGroupname string) int32 {
+			if rt.IDs == nil {
+				return remoteGid
+			}
+			if gid, err := rt.IDs.GroupID(remoteGroupname); err == nil {
+				return gid
+			}
+			return remoteGid
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for remoteGid, mapping := range groups {
+			log.Printf("remote gid %d(%s) maps to local gid %d", remoteGid, mapping.Name, mapping.LocalId)
+		}
+	}
+	return users, groups, nil
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package receiver
+
+import (
+	"bufio"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ProcessUmask returns the umask of the process.
+func ProcessUmask() fs.FileMode {
+	// Linux ≥ 4.7 exposes the umask, so that it can be read without changing
+	// it (which would affect files created concurrently).
+	if f, err := os.Open("/proc/self/status"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			val := strings.TrimPrefix(scanner.Text(), "Umask:")
+			if val == scanner.Text() {
+				continue
+			}
+			if umask, err := strconv.ParseUint(strings.TrimSpace(val), 8, 32); err == nil {
+				return fs.FileMode(umask) & fs.ModePerm
+			}
+		}
+	}
+	old := syscall.Umask(0)
+	syscall.Umask(old)
+	return fs.FileMode(old) & fs.ModePerm
+}
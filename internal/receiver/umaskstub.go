@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package receiver
+
+import "io/fs"
+
+// ProcessUmask returns 0: there is no umask on this platform.
+func ProcessUmask() fs.FileMode {
+	return 0
+}
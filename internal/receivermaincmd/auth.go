@@ -0,0 +1,62 @@
+package receivermaincmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncauth"
+)
+
+// authClient answers the daemon’s authentication challenge. Like rsync, the
+// user defaults to $USER (or $LOGNAME), and the password is read from
+// --password-file or $RSYNC_PASSWORD.
+//
+// rsync/authenticate.c:auth_client
+func authClient(opts *Opts, w io.Writer, user, challenge string) error {
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if user == "" {
+		user = os.Getenv("LOGNAME")
+	}
+	if user == "" {
+		user = "nobody"
+	}
+	password, err := getPassword(opts)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", user, rsyncauth.Response(password, challenge))
+	return err
+}
+
+// rsync/authenticate.c:getpassf
+func getPassword(opts *Opts) (string, error) {
+	if opts.PasswordFile != "" {
+		f, err := os.Open(opts.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if st.Mode().Perm()&0o006 != 0 {
+			return "", errors.New("password file must not be other-accessible")
+		}
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if password, ok := os.LookupEnv("RSYNC_PASSWORD"); ok {
+		return password, nil
+	}
+	return "", errors.New("authentication required, but no password specified: use --password-file or set RSYNC_PASSWORD")
+}
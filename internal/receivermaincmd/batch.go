@@ -0,0 +1,202 @@
+package receivermaincmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// Batch files (--write-batch) record the (demultiplexed) data which the
+// receiver read from the sender, so that the same changes can later be
+// applied to other destinations (--read-batch) without a connection.
+//
+// The file starts with a header of the protocol version, the stream flags
+// (the options which determine the format of the data) and the checksum
+// seed. Unlike with rsync, no shell script is written alongside. Batch files
+// whose name ends in .gz are gzip-compressed.
+//
+// rsync/batch.c
+
+// Stream flags, at the bit positions of rsync/batch.c:flag_ptr, so that the
+// header is compatible with rsync. Bits 6 (always_checksum) and 7 (xfer_dirs)
+// are never set, as --checksum and --dirs are not implemented.
+//
+// Like with rsync, the stream flags only cover the options which determine
+// the format of the data, not e.g. --specials: other options must be
+// repeated with --read-batch (rsync writes them into a shell script).
+// --numeric-ids also changes the format (no user and group name lists are
+// sent), but rsync only records it in the shell script, so it is stored in
+// bit 16, which rsync does not use.
+const (
+	batchRecurse           = 1 << 0
+	batchPreserveUid       = 1 << 1
+	batchPreserveGid       = 1 << 2
+	batchPreserveLinks     = 1 << 3
+	batchPreserveDevices   = 1 << 4
+	batchPreserveHardlinks = 1 << 5
+	batchCompress          = 1 << 8 // do_compression
+	batchNumericIds        = 1 << 16
+)
+
+func streamFlags(opts *Opts) int32 {
+	var flags int32
+	for _, f := range []struct {
+		set  bool
+		flag int32
+	}{
+		{opts.Recurse, batchRecurse},
+		{opts.PreserveUid, batchPreserveUid},
+		{opts.PreserveGid, batchPreserveGid},
+		{opts.PreserveLinks, batchPreserveLinks},
+		{opts.PreserveDevices, batchPreserveDevices},
+		{opts.PreserveHardlinks, batchPreserveHardlinks},
+		{opts.Compress, batchCompress},
+		{opts.NumericIds, batchNumericIds},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// setStreamFlags overrides the options recorded in the batch file.
+//
+// rsync/batch.c:read_stream_flags
+func setStreamFlags(opts *Opts, flags int32) {
+	opts.Recurse = flags&batchRecurse != 0
+	opts.PreserveUid = flags&batchPreserveUid != 0
+	opts.PreserveGid = flags&batchPreserveGid != 0
+	opts.PreserveLinks = flags&batchPreserveLinks != 0
+	opts.PreserveDevices = flags&batchPreserveDevices != 0
+	opts.PreserveHardlinks = flags&batchPreserveHardlinks != 0
+	opts.Compress = flags&batchCompress != 0
+	opts.NumericIds = flags&batchNumericIds != 0
+}
+
+// batchWriter writes a batch file, compressing it if its name ends in .gz.
+type batchWriter struct {
+	f  *os.File
+	bw *bufio.Writer
+	zw *gzip.Writer // nil unless compressed
+	io.Writer
+}
+
+func createBatch(opts *Opts, seed int32) (*batchWriter, error) {
+	f, err := os.Create(opts.WriteBatch)
+	if err != nil {
+		return nil, err
+	}
+	w := &batchWriter{
+		f:  f,
+		bw: bufio.NewWriter(f),
+	}
+	w.Writer = w.bw
+	if strings.HasSuffix(opts.WriteBatch, ".gz") {
+		w.zw = gzip.NewWriter(w.bw)
+		w.Writer = w.zw
+	}
+	c := &rsyncwire.Conn{Writer: w}
+	for _, i := range []int32{rsync.ProtocolVersion, streamFlags(opts), seed} {
+		if err := c.WriteInt32(i); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Close flushes and closes the batch file.
+func (w *batchWriter) Close() error {
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+	if err := w.bw.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// openBatch opens the batch file for reading, transparently decompressing
+// gzip-compressed batch files (regardless of their name). It applies the
+// stream flags to opts and returns the checksum seed.
+func openBatch(opts *Opts) (io.ReadCloser, int32, error) {
+	f, err := os.Open(opts.ReadBatch)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, seed, err := readBatchHeader(opts, f)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s: %v", opts.ReadBatch, err)
+	}
+	return rc, seed, nil
+}
+
+func readBatchHeader(opts *Opts, f *os.File) (io.ReadCloser, int32, error) {
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, err := br.Peek(2)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = zr
+	}
+	c := &rsyncwire.Conn{Reader: r}
+	protocol, err := c.ReadInt32()
+	if err != nil {
+		return nil, 0, err
+	}
+	if protocol != rsync.ProtocolVersion {
+		return nil, 0, fmt.Errorf("unsupported batch protocol version %d", protocol)
+	}
+	flags, err := c.ReadInt32()
+	if err != nil {
+		return nil, 0, err
+	}
+	setStreamFlags(opts, flags)
+	seed, err := c.ReadInt32()
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, seed, nil
+}
+
+// readBatch applies the changes recorded in the batch file to dest.
+//
+// rsync/main.c:do_recv (with read_batch)
+func readBatch(osenv osenv, opts *Opts, dest string) (*Stats, error) {
+	rc, seed, err := openBatch(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	c := &rsyncwire.Conn{
+		Reader: bufio.NewReader(rc),
+		// The checksums of the generator are not needed: the recorded data
+		// refers to the destination at the time the batch was written.
+		Writer: ioutil.Discard,
+	}
+	return transfer(osenv, opts, c, seed, dest, time.Now())
+}
@@ -0,0 +1,43 @@
+package receivermaincmd
+
+import "testing"
+
+func TestStreamFlags(t *testing.T) {
+	opts := &Opts{
+		Recurse:          true,
+		PreserveUid:      true,
+		PreserveGid:      true,
+		PreserveLinks:    true,
+		PreserveDevices:  true,
+		PreserveSpecials: true,
+		Compress:         true,
+	}
+	// rsync -a -z writes recurse, preserve_uid, preserve_gid,
+	// preserve_links, preserve_devices (bits 0-4) and do_compression (bit 8).
+	if got, want := streamFlags(opts), int32(0x11f); got != want {
+		t.Errorf("streamFlags = %#x, want %#x", got, want)
+	}
+
+	opts.NumericIds = true
+	flags := streamFlags(opts)
+	var got Opts
+	setStreamFlags(&got, flags)
+	for _, tt := range []struct {
+		name      string
+		got, want bool
+	}{
+		{"Recurse", got.Recurse, true},
+		{"PreserveUid", got.PreserveUid, true},
+		{"PreserveGid", got.PreserveGid, true},
+		{"PreserveLinks", got.PreserveLinks, true},
+		{"PreserveDevices", got.PreserveDevices, true},
+		{"PreserveHardlinks", got.PreserveHardlinks, false},
+		{"PreserveSpecials", got.PreserveSpecials, false}, // not recorded
+		{"Compress", got.Compress, true},
+		{"NumericIds", got.NumericIds, true},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("setStreamFlags(%#x): %s = %v, want %v", flags, tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -2,15 +2,17 @@ package receivermaincmd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
 // rsync/clientserver.c:start_socket_client
@@ -19,66 +21,132 @@ func socketClient(osenv osenv, opts *Opts, src, dest string) (*Stats, error) {
 	if err != nil {
 		return nil, err
 	}
-	host := u.Host
-	if _, _, err := net.SplitHostPort(host); err != nil {
-		host += ":873" // rsync daemon port
-	}
-	log.Printf("Opening TCP connection to %s", host)
-	conn, err := net.Dial("tcp", host)
+	conn, err := dialDaemon(opts, daemonAddr(u.Host))
 	if err != nil {
 		return nil, err
 	}
-	path := strings.TrimPrefix(u.Path, "/")
-	if path == "" {
-		return nil, fmt.Errorf("empty remote path")
-	}
-	module := path
-	if idx := strings.IndexByte(module, '/'); idx > -1 {
-		module = module[:idx]
+	module, path, err := modulePath(u)
+	if err != nil {
+		return nil, err
 	}
 	log.Printf("rsync module %q, path %q", module, path)
-	if err := startInbandExchange(opts, conn, module, path); err != nil {
+	rd := bufio.NewReader(conn)
+	if err := exchangeGreeting(conn, rd); err != nil {
+		return nil, err
+	}
+	if err := requestModule(osenv, opts, conn, rd, u.User.Username(), module, path); err != nil {
+		if err == errDaemonExit {
+			return &Stats{}, nil // module listing complete
+		}
 		return nil, err
 	}
-	stats, err := clientRun(osenv, opts, conn, dest, false)
+	stats, err := clientRun(osenv, opts, &readWriter{Reader: rd, Writer: conn}, dest, false)
 	if err != nil {
 		return nil, err
 	}
 	return stats, nil
 }
 
+// daemonAddr returns the host:port address of the rsync daemon on host, which
+// may specify a port.
+func daemonAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":873" // rsync daemon port
+	}
+	return host
+}
+
+// daemonURL returns the rsync:// URL for a HOST::PATH source, as returned by
+// checkForHostspec (port is -1 for the default port).
+func daemonURL(host, path string, port int) string {
+	u := url.URL{
+		Scheme: "rsync",
+		Path:   "/" + path,
+	}
+	if idx := strings.LastIndexByte(host, '@'); idx > -1 {
+		u.User = url.User(host[:idx])
+		host = host[idx+1:]
+	}
+	if port > 0 {
+		u.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.IndexByte(host, ':') > -1 {
+		u.Host = "[" + host + "]" // IPv6 address
+	} else {
+		u.Host = host
+	}
+	return u.String()
+}
+
+// modulePath splits the path of an rsync:// URL into the module name and the
+// path (which includes the module name). An empty path requests the listing
+// of all modules.
+func modulePath(u *url.URL) (module, path string, _ error) {
+	path = strings.TrimPrefix(u.Path, "/")
+	module = path
+	if idx := strings.IndexByte(module, '/'); idx > -1 {
+		module = module[:idx]
+	}
+	return module, path, nil
+}
+
 // rsync/clientserver.c:start_inband_exchange
-func startInbandExchange(opts *Opts, conn io.ReadWriter, module, path string) error {
+func startInbandExchange(osenv osenv, opts *Opts, conn io.ReadWriter, module, path string) error {
 	rd := bufio.NewReader(conn)
+	if err := exchangeGreeting(conn, rd); err != nil {
+		return err
+	}
+	return requestModule(osenv, opts, conn, rd, "", module, path)
+}
 
+// exchangeGreeting sends the client greeting and reads the server greeting.
+func exchangeGreeting(conn io.Writer, rd *bufio.Reader) error {
 	// send client greeting
-	fmt.Fprintf(conn, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	fmt.Fprintf(conn, "%s\n", rsyncwire.Greeting{Protocol: rsync.ProtocolVersion})
 
 	// read server greeting
-	serverGreeting, err := rd.ReadString('\n')
+	line, err := rd.ReadString('\n')
 	if err != nil {
 		return fmt.Errorf("ReadString: %v", err)
 	}
-	serverGreeting = strings.TrimSpace(serverGreeting)
-	const serverGreetingPrefix = "@RSYNCD: "
-	if !strings.HasPrefix(serverGreeting, serverGreetingPrefix) {
-		return fmt.Errorf("invalid server greeting: got %q", serverGreeting)
+	// Daemons may reject connections before the greeting, too.
+	if kind, msg, _ := rsyncwire.ParseDaemonLine(line); kind == rsyncwire.LineError {
+		return daemonError(msg)
 	}
-	// protocol negotiation: require at least version 27
-	serverGreeting = strings.TrimPrefix(serverGreeting, serverGreetingPrefix)
-	var remoteProtocol, remoteSub int32
-	if _, err := fmt.Sscanf(serverGreeting, "%d.%d", &remoteProtocol, &remoteSub); err != nil {
-		if _, err := fmt.Sscanf(serverGreeting, "%d", &remoteProtocol); err != nil {
-			return fmt.Errorf("reading server greeting: %v", err)
-		}
+	serverGreeting, err := rsyncwire.ParseGreeting(line)
+	if err != nil {
+		return fmt.Errorf("reading server greeting: %v", err)
 	}
+	// protocol negotiation: require at least version 27
+	remoteProtocol := serverGreeting.Protocol
 	if remoteProtocol < 27 {
 		return fmt.Errorf("server version %d too old", remoteProtocol)
 	}
 
-	log.Printf("(Client) Protocol versions: remote=%d, negotiated=%d", remoteProtocol, rsync.ProtocolVersion)
+	log.Printf("(Client) Protocol versions: remote=%d.%d, negotiated=%d", remoteProtocol, serverGreeting.SubProtocol, rsync.ProtocolVersion)
 	log.Printf("Client checksum: md4")
+	return nil
+}
+
+// daemonError is returned when the daemon rejected the connection with an
+// @ERROR line, e.g. because of an unknown module, an access control list or
+// max connections. Like rsync, the client exits with RERR_STARTCLIENT.
+//
+// rsync/clientserver.c:start_inband_exchange
+func daemonError(msg string) error {
+	return &rsync.ExitError{
+		Code: rsync.RERR_STARTCLIENT,
+		Err:  fmt.Errorf("daemon error: %s", msg),
+	}
+}
+
+// errDaemonExit is returned by requestModule when the daemon ended the
+// connection with @RSYNCD: EXIT, i.e. after listing its modules.
+var errDaemonExit = errors.New("daemon sent @RSYNCD: EXIT")
 
+// requestModule requests module from the daemon, authenticating as user if
+// the daemon requires it, and sends the server arguments. An empty module
+// requests the module listing, which ends with errDaemonExit.
+func requestModule(osenv osenv, opts *Opts, conn io.Writer, rd *bufio.Reader, user, module, path string) error {
 	// send module name
 	fmt.Fprintf(conn, "%s\n", module)
 	for {
@@ -86,26 +154,35 @@ func startInbandExchange(opts *Opts, conn io.ReadWriter, module, path string) er
 		if err != nil {
 			return fmt.Errorf("did not get server startup line: %v", err)
 		}
-		line = strings.TrimSpace(line)
-
-		if strings.HasPrefix(line, "@RSYNCD: AUTHREQD ") {
-			// TODO: implement support for authentication
-			return fmt.Errorf("authentication not yet implemented")
+		kind, arg, err := rsyncwire.ParseDaemonLine(line)
+		if err != nil {
+			return err
 		}
+		switch kind {
+		case rsyncwire.LineAuthReqd:
+			if err := authClient(opts, conn, user, arg); err != nil {
+				return err
+			}
+			continue
 
-		if line == "@RSYNCD: OK" {
-			break
-		}
+		case rsyncwire.LineOK:
+			// transfer starts
 
-		// TODO: @RSYNCD: EXIT after listing modules
+		case rsyncwire.LineExit:
+			if module != "" {
+				return fmt.Errorf("daemon unexpectedly ended the connection")
+			}
+			return errDaemonExit
 
-		if strings.HasPrefix(line, "@ERROR") {
-			fmt.Fprintf(os.Stderr, "%s\n", line)
-			return fmt.Errorf("abort (rsync fatal error)")
-		}
+		case rsyncwire.LineError:
+			return daemonError(arg)
 
-		// print rsync server message of the day (MOTD)
-		fmt.Fprintf(os.Stdout, "%s\n", line)
+		default:
+			// print rsync server message of the day (MOTD) or module listing
+			fmt.Fprintf(osenv.stdout, "%s\n", arg)
+			continue
+		}
+		break
 	}
 
 	sargv := serverOptions(opts)
@@ -0,0 +1,67 @@
+package receivermaincmd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// remoteFilesFrom reports whether the --files-from argument refers to a file
+// on the remote side (specified as :path), and returns the remote path.
+func remoteFilesFrom(filesFrom string) (string, bool) {
+	if strings.HasPrefix(filesFrom, ":") {
+		return strings.TrimPrefix(filesFrom, ":"), true
+	}
+	return "", false
+}
+
+// sendFilesFrom transmits the local --files-from list to the server as
+// null-terminated names, followed by an empty name.
+//
+// rsync/io.c:forward_filesfrom_data
+func sendFilesFrom(osenv osenv, opts *Opts, c *rsyncwire.Conn) error {
+	var r io.Reader
+	if opts.FilesFrom == "-" {
+		r = osenv.stdin
+	} else {
+		f, err := os.Open(opts.FilesFrom)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	delim := byte('\n')
+	if opts.From0 {
+		delim = 0
+	}
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(c.Writer)
+	for {
+		line, err := br.ReadString(delim)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		name := strings.TrimSuffix(line, string(delim))
+		if !opts.From0 {
+			name = strings.TrimSuffix(name, "\r")
+			if strings.HasPrefix(name, "#") || strings.HasPrefix(name, ";") {
+				name = "" // comment
+			}
+		}
+		if name != "" {
+			bw.WriteString(name)
+			bw.WriteByte(0)
+		}
+		if eof {
+			break
+		}
+	}
+	// An empty name terminates the list.
+	bw.WriteByte(0)
+	return bw.Flush()
+}
@@ -0,0 +1,33 @@
+package receivermaincmd
+
+import (
+	"fmt"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// sendFilterList sends the filter rules to the server, which applies them
+// when sending its file list (and, when receiving with --delete, to protect
+// excluded files from deletion). Like rsync with an old protocol peer, it
+// refuses to send dir-merge rules, which cannot be expressed on the wire
+// before protocol 29 (the local transport passes them in-process instead).
+//
+// rsync/exclude.c:send_filter_list
+func sendFilterList(c *rsyncwire.Conn, filters *rsyncfilter.List) error {
+	for _, rule := range filters.Rules() {
+		if rule.Action == rsyncfilter.DirMerge {
+			return fmt.Errorf("filter rule %q cannot be sent: dir-merge rules require protocol 29 or higher (gokr-rsync speaks protocol %d)", rule, rsync.ProtocolVersion)
+		}
+		wire := rule.Wire()
+		if err := c.WriteInt32(int32(len(wire))); err != nil {
+			return err
+		}
+		if err := c.WriteString(wire); err != nil {
+			return err
+		}
+	}
+	const exclusionListEnd = 0
+	return c.WriteInt32(exclusionListEnd)
+}
@@ -1,9 +0,0 @@
-//go:build linux || darwin
-
-package receivermaincmd
-
-import "github.com/google/renameio/v2"
-
-func symlink(oldname, newname string) error {
-	return renameio.Symlink(oldname, newname)
-}
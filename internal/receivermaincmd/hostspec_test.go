@@ -220,3 +220,35 @@ func TestCheckForHostspec(t *testing.T) {
 		})
 	}
 }
+
+func TestDaemonURL(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want string
+	}{
+		{
+			src:  "localhost::module/path",
+			want: "rsync://localhost/module/path",
+		},
+
+		{
+			src:  "user@localhost::module/",
+			want: "rsync://user@localhost/module/",
+		},
+
+		{
+			src:  "user@[2001:db8::1]::module",
+			want: "rsync://user@[2001:db8::1]/module",
+		},
+	} {
+		t.Run(tt.src, func(t *testing.T) {
+			host, path, port, err := checkForHostspec(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := daemonURL(host, path, port); got != tt.want {
+				t.Errorf("daemonURL(%q, %q, %d) = %q, want %q", host, path, port, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package receivermaincmd
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+// localClient transfers the local path src to dest. Like rsync, which forks a
+// local server process for local transfers, the sender runs in-process and is
+// connected to the receiver via pipes, speaking the same protocol as over a
+// remote shell.
+//
+// rsync/main.c:do_cmd (local_server)
+func localClient(osenv osenv, opts *Opts, src, dest string) (*Stats, error) {
+	// The implicit module is rooted at /, so resolve relative names against
+	// the working directory, keeping a trailing slash (copy contents).
+	path, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(src, "/") && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	sopts, opt := rsyncd.NewGetOpt()
+	if _, err := opt.Parse(append(serverOptions(opts), ".", path)); err != nil {
+		return nil, err
+	}
+	// Pass the filter rules in-process: unlike over the connection, this
+	// includes dir-merge rules, which protocol 27 cannot express.
+	srv, err := rsyncd.NewServer(nil, rsyncd.WithSenderFilters(opts.Filters.Sender()))
+	if err != nil {
+		return nil, err
+	}
+	local := *opts
+	local.filtersInProcess = true
+	opts = &local
+	mod := rsyncd.Module{
+		Name: "implicit",
+		Path: "/",
+	}
+
+	clientRd, serverWr := io.Pipe()
+	serverRd, clientWr := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		crd, cwr := rsyncd.CounterPair(serverRd, serverWr)
+		err := srv.HandleConn(mod, crd, crd, cwr, []string{path}, sopts, true)
+		serverWr.CloseWithError(err)
+		errc <- err
+	}()
+
+	stats, err := clientRun(osenv, opts, &readWriter{Reader: clientRd, Writer: clientWr}, dest, true)
+	clientWr.Close()
+	if err != nil {
+		clientRd.Close() // unblock the sender
+		<-errc
+		return nil, err
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
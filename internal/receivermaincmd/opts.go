@@ -1,6 +1,15 @@
 package receivermaincmd
 
-import "github.com/DavidGamba/go-getoptions"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/DavidGamba/go-getoptions"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsynctoken"
+)
 
 type Opts struct {
 	Gokrazy struct {
@@ -13,6 +22,11 @@ type Opts struct {
 	Archive           bool
 	Update            bool
 	PreserveHardlinks bool
+	RemoveSourceFiles bool
+	OpenNoatime       bool
+	PreserveAtimes    bool // refused: requires protocol 30
+	ListOnly          bool
+	PreserveFileflags bool
 
 	Server           bool
 	Sender           bool
@@ -26,8 +40,56 @@ type Opts struct {
 	Recurse          bool
 	IgnoreTimes      bool
 	DryRun           bool
+	Force            bool
+	FakeSuper        bool
+	Delete           bool
+	Existing         bool
+	IgnoreErrors     bool
+	Partial          bool
+	Inplace          bool
+	Sparse           bool
+	NumericIds       bool
+	BlockSize        int
+	CopyDest         string
+	WriteBatch       string
+	ReadBatch        string
+	ItemizeChanges   bool
+	Backup           bool
+	BackupDir        string
+	Suffix           string
+	InfoBackup       bool // derived from --info
+	Compress         bool
+	CompressChoice   string
+	CompressLevel    int
+	BwLimit          string
+	BwLimitKiB       int // derived from --bwlimit
+	Protocol         int
+	Timeout          int
+	Filter           []string
+	Filters          rsyncfilter.List // derived from --filter, --include and --exclude
 	D                bool
 	ShellCommand     string
+	PasswordFile     string
+	Proxy            string
+	Chmod            string
+	Progress         bool
+	Manifest         string
+	Stats            bool
+	Info             string
+	StatsLevel       int // derived from --stats and --info
+	FilesFrom        string
+	From0            bool
+	FilesNewerThan   string
+	FilesOlderThan   string
+
+	// mergedDelete collects the file lists of multiple sources, so that
+	// --delete can be applied once all of them were transferred.
+	mergedDelete *mergedDeletion
+
+	// filtersInProcess is set when the sender runs in-process (local
+	// transport) and received the filter rules via rsyncd.WithSenderFilters
+	// instead of over the connection.
+	filtersInProcess bool
 }
 
 func NewGetOpt() (*Opts, *getoptions.GetOpt) {
@@ -51,6 +113,7 @@ func NewGetOpt() (*Opts, *getoptions.GetOpt) {
 	opt.BoolVar(&opts.Archive, "archive", false, opt.Alias("a"))
 	opt.BoolVar(&opts.Update, "update", false, opt.Alias("u"))
 	opt.BoolVar(&opts.PreserveHardlinks, "hard-links", false, opt.Alias("H"))
+	opt.BoolVar(&opts.PreserveFileflags, "fileflags", false, opt.Description("preserve file-flags (aka chflags)"))
 
 	opt.BoolVar(&opts.PreserveGid, "group", false, opt.Alias("g"))
 	opt.BoolVar(&opts.PreserveUid, "owner", false, opt.Alias("o"))
@@ -66,8 +129,49 @@ func NewGetOpt() (*Opts, *getoptions.GetOpt) {
 	// TODO: implement IgnoreTimes
 	opt.BoolVar(&opts.IgnoreTimes, "ignore-times", false, opt.Alias("I"))
 	opt.BoolVar(&opts.DryRun, "dry-run", false, opt.Alias("n"))
+	opt.BoolVar(&opts.Force, "force", false, opt.Description("force deletion of directories even if not empty"))
+	opt.BoolVar(&opts.FakeSuper, "fake-super", false, opt.Description("store/recover privileged attrs using xattrs"))
+	opt.BoolVar(&opts.Delete, "delete", false, opt.Description("delete extraneous files from dest dirs"))
+	opt.BoolVar(&opts.Existing, "existing", false, opt.Alias("ignore-non-existing"), opt.Description("skip creating new files on receiver"))
+	opt.BoolVar(&opts.IgnoreErrors, "ignore-errors", false, opt.Description("delete even if there are I/O errors"))
+	opt.BoolVar(&opts.Partial, "partial", false, opt.Description("keep partially transferred files"))
+	opt.BoolVar(&opts.Inplace, "inplace", false, opt.Description("update destination files in-place"))
+	opt.BoolVar(&opts.Sparse, "sparse", false, opt.Alias("S"), opt.Description("turn sequences of nulls into sparse blocks"))
+	opt.BoolVar(&opts.NumericIds, "numeric-ids", false, opt.Description("don't map uid/gid values by user/group name"))
+	opt.IntVar(&opts.BlockSize, "block-size", 0, opt.Alias("B"), opt.Description("force a fixed checksum block-size"))
+	opt.StringVar(&opts.CopyDest, "copy-dest", "", opt.Description("also compare destination files relative to DIR, and include copies of unchanged files"))
+	opt.StringVar(&opts.WriteBatch, "write-batch", "", opt.Description("write a batched update to FILE (gzip-compressed if FILE ends in .gz)"))
+	opt.StringVar(&opts.ReadBatch, "read-batch", "", opt.Description("read a batched update from FILE"))
+	opt.BoolVar(&opts.ListOnly, "list-only", false, opt.Description("list the files instead of copying them"))
+	opt.BoolVar(&opts.ItemizeChanges, "itemize-changes", false, opt.Alias("i"), opt.Description("output a change-summary for all updates"))
+	opt.BoolVar(&opts.Backup, "backup", false, opt.Alias("b"), opt.Description("make backups (see --suffix & --backup-dir)"))
+	opt.StringVar(&opts.BackupDir, "backup-dir", "", opt.Description("make backups into hierarchy based in DIR"))
+	opt.StringVar(&opts.Suffix, "suffix", "", opt.Description("backup suffix (default ~ w/o --backup-dir)"))
+	opt.BoolVar(&opts.OpenNoatime, "open-noatime", false, opt.Description("avoid changing the atime on opened files"))
+	opt.BoolVar(&opts.PreserveAtimes, "atimes", false, opt.Alias("U"), opt.Description("preserve access (use) times (requires protocol 30, not supported)"))
+	opt.BoolVar(&opts.RemoveSourceFiles, "remove-source-files", false, opt.Alias("remove-sent-files"), opt.Description("sender removes synchronized files (non-dir)"))
+	opt.BoolVar(&opts.Compress, "compress", false, opt.Alias("z"), opt.Description("compress file data during the transfer"))
+	opt.StringVar(&opts.CompressChoice, "compress-choice", "", opt.Description("choose the compression algorithm (only zlib is supported)"))
+	opt.IntVar(&opts.CompressLevel, "compress-level", rsynctoken.LevelNotSpecified, opt.Description("explicitly set compression level"))
+	opt.StringVar(&opts.BwLimit, "bwlimit", "", opt.Description("limit socket I/O bandwidth (RATE in KiB/s, or with a K, M or G suffix)"))
+	opt.IntVar(&opts.Protocol, "protocol", 0, opt.Description("force an older protocol version to be used (only 27 is supported)"))
+	opt.IntVar(&opts.Timeout, "timeout", 0, opt.Description("set I/O timeout in seconds"))
 
 	opt.StringVar(&opts.ShellCommand, "rsh", "", opt.Alias("e"))
+	opt.StringVar(&opts.Proxy, "proxy", "", opt.Description("connect to the rsync daemon through the HTTP proxy [user:pass@]HOST:PORT (default $RSYNC_PROXY)"))
+	opt.StringVar(&opts.PasswordFile, "password-file", "", opt.Description("read daemon-access password from FILE"))
+	opt.StringVar(&opts.Chmod, "chmod", "", opt.Description("affect file and/or directory permissions"))
+	opt.BoolVar(&opts.Progress, "progress", false, opt.Description("show progress during transfer"))
+	opt.StringVar(&opts.Manifest, "manifest", "", opt.Description("write the MD4 checksum and name of each transferred file to FILE"))
+	opt.BoolVar(&opts.Stats, "stats", false, opt.Description("give some file-transfer stats (same as --info=stats2)"))
+	opt.StringVar(&opts.Info, "info", "", opt.Description("fine-grained informational verbosity (supported: backup, stats, progress)"))
+	opt.StringVar(&opts.FilesFrom, "files-from", "", opt.Description("read list of source-file names from FILE"))
+	opt.BoolVar(&opts.From0, "from0", false, opt.Alias("0"), opt.Description("all *-from/filter files are delimited by 0s"))
+	opt.StringSliceVar(&opts.Filter, "filter", 1, 1, opt.Alias("f"), opt.Description("add a file-filtering RULE (--include=PATTERN and --exclude=PATTERN are short for --filter='+ PATTERN' and --filter='- PATTERN')"))
+
+	// non-standard flags, only understood by gokr-rsyncd
+	opt.StringVar(&opts.FilesNewerThan, "files-newer-than", "", opt.Description("only transfer files modified after DATE (or within DURATION, e.g. 7d)"))
+	opt.StringVar(&opts.FilesOlderThan, "files-older-than", "", opt.Description("only transfer files modified before DATE (or more than DURATION ago, e.g. 7d)"))
 
 	return &opts, opt
 }
@@ -149,8 +253,12 @@ func serverOptions(clientOptions *Opts) []string {
 	// 	argstr[x++] = 'x';
 	// if (sparse_files)
 	// 	argstr[x++] = 'S';
-	// if (do_compression)
-	// 	argstr[x++] = 'z';
+	if clientOptions.Sparse {
+		argstr += "S"
+	}
+	if clientOptions.Compress {
+		argstr += "z"
+	}
 
 	// /* this is a complete hack - blame Rusty
 
@@ -170,6 +278,9 @@ func serverOptions(clientOptions *Opts) []string {
 	// 		goto oom;
 	// 	args[ac++] = arg;
 	// }
+	if clientOptions.BlockSize > 0 {
+		sargv = append(sargv, fmt.Sprintf("--block-size=%d", clientOptions.BlockSize))
+	}
 
 	// if (max_delete && am_sender) {
 	// 	if (asprintf(&arg, "--max-delete=%d", max_delete) < 0)
@@ -190,11 +301,15 @@ func serverOptions(clientOptions *Opts) []string {
 	// 	args[ac++] = arg;
 	// }
 
-	// if (bwlimit) {
-	// 	if (asprintf(&arg, "--bwlimit=%d", bwlimit) < 0)
-	// 		goto oom;
-	// 	args[ac++] = arg;
-	// }
+	if clientOptions.Compress && clientOptions.CompressLevel != rsynctoken.LevelNotSpecified {
+		sargv = append(sargv, fmt.Sprintf("--compress-level=%d", clientOptions.CompressLevel))
+	}
+	if clientOptions.BwLimitKiB > 0 {
+		sargv = append(sargv, fmt.Sprintf("--bwlimit=%d", clientOptions.BwLimitKiB))
+	}
+	if clientOptions.Timeout > 0 {
+		sargv = append(sargv, fmt.Sprintf("--timeout=%d", clientOptions.Timeout))
+	}
 
 	// if (backup_dir) {
 	// 	args[ac++] = "--backup-dir";
@@ -213,6 +328,21 @@ func serverOptions(clientOptions *Opts) []string {
 	// 	args[ac++] = "--delete-excluded";
 	// else if (delete_mode)
 	// 	args[ac++] = "--delete";
+	if clientOptions.Delete {
+		sargv = append(sargv, "--delete")
+	}
+
+	if clientOptions.RemoveSourceFiles {
+		sargv = append(sargv, "--remove-source-files")
+	}
+
+	if clientOptions.OpenNoatime {
+		sargv = append(sargv, "--open-noatime")
+	}
+
+	if clientOptions.PreserveFileflags {
+		sargv = append(sargv, "--fileflags")
+	}
 
 	// if (size_only)
 	// 	args[ac++] = "--size-only";
@@ -225,6 +355,15 @@ func serverOptions(clientOptions *Opts) []string {
 
 	// if (keep_partial)
 	// 	args[ac++] = "--partial";
+	if clientOptions.Partial {
+		sargv = append(sargv, "--partial")
+	}
+
+	// if (inplace)
+	// 	args[ac++] = "--inplace";
+	if clientOptions.Inplace {
+		sargv = append(sargv, "--inplace")
+	}
 
 	// if (force_delete)
 	// 	args[ac++] = "--force";
@@ -234,6 +373,9 @@ func serverOptions(clientOptions *Opts) []string {
 
 	// if (ignore_errors)
 	// 	args[ac++] = "--ignore-errors";
+	if clientOptions.IgnoreErrors {
+		sargv = append(sargv, "--ignore-errors")
+	}
 
 	// if (copy_unsafe_links)
 	// 	args[ac++] = "--copy-unsafe-links";
@@ -243,6 +385,9 @@ func serverOptions(clientOptions *Opts) []string {
 
 	// if (numeric_ids)
 	// 	args[ac++] = "--numeric-ids";
+	if clientOptions.NumericIds {
+		sargv = append(sargv, "--numeric-ids")
+	}
 
 	// if (only_existing && am_sender)
 	// 	args[ac++] = "--existing";
@@ -264,17 +409,132 @@ func serverOptions(clientOptions *Opts) []string {
 	// 	args[ac++] = compare_dest;
 	// }
 
-	// if (files_from && (!am_sender || remote_filesfrom_file)) {
-	// 	if (remote_filesfrom_file) {
-	// 		args[ac++] = "--files-from";
-	// 		args[ac++] = remote_filesfrom_file;
-	// 		if (eol_nulls)
-	// 			args[ac++] = "--from0";
-	// 	} else {
-	// 		args[ac++] = "--files-from=-";
-	// 		args[ac++] = "--from0";
-	// 	}
-	// }
+	if clientOptions.FilesFrom != "" {
+		if remote, ok := remoteFilesFrom(clientOptions.FilesFrom); ok {
+			sargv = append(sargv, "--files-from="+remote)
+			if clientOptions.From0 {
+				sargv = append(sargv, "--from0")
+			}
+		} else {
+			// The client sends the (null-terminated) list to the server.
+			sargv = append(sargv, "--files-from=-", "--from0")
+		}
+	}
+
+	// The modification time window is applied by the sender.
+	if clientOptions.FilesNewerThan != "" {
+		sargv = append(sargv, "--files-newer-than="+clientOptions.FilesNewerThan)
+	}
+	if clientOptions.FilesOlderThan != "" {
+		sargv = append(sargv, "--files-older-than="+clientOptions.FilesOlderThan)
+	}
 
 	return sargv
 }
+
+// parseInfo applies the comma-separated --info flags (e.g. stats2,progress)
+// to opts. Each flag consists of a name and an optional level, which defaults
+// to 1.
+//
+// rsync/options.c:parse_output_words
+func parseInfo(opts *Opts, info string) error {
+	for _, word := range strings.Split(info, ",") {
+		if word == "" {
+			continue
+		}
+		name := strings.TrimRightFunc(word, unicode.IsDigit)
+		level := 1
+		if digits := word[len(name):]; digits != "" {
+			var err error
+			level, err = strconv.Atoi(digits)
+			if err != nil {
+				return fmt.Errorf("invalid --info level %q: %v", word, err)
+			}
+		}
+		switch strings.ToLower(name) {
+		case "none":
+			opts.StatsLevel = 0
+			opts.Progress = false
+			opts.InfoBackup = false
+		case "backup":
+			opts.InfoBackup = level > 0
+		case "stats":
+			opts.StatsLevel = level
+		case "progress":
+			opts.Progress = level > 0
+		default:
+			return fmt.Errorf("unknown --info item: %q", word)
+		}
+	}
+	return nil
+}
+
+// parseBwLimit parses the --bwlimit RATE, which is in units of KiB/s unless
+// it carries a K, M or G suffix (e.g. 1.5M), and returns it in KiB/s. A rate
+// of 0 means no limit.
+//
+// rsync/options.c:parse_size_arg
+func parseBwLimit(rate string) (int, error) {
+	num := strings.TrimRightFunc(rate, unicode.IsLetter)
+	mult := 1.0
+	switch strings.ToUpper(rate[len(num):]) {
+	case "", "K", "KB", "KIB":
+	case "M", "MB", "MIB":
+		mult = 1024
+	case "G", "GB", "GIB":
+		mult = 1024 * 1024
+	default:
+		return 0, fmt.Errorf("invalid --bwlimit value: %q", rate)
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid --bwlimit value: %q", rate)
+	}
+	kib := int(f*mult + 0.5)
+	if f > 0 && kib == 0 {
+		// Like rsync, round tiny non-zero rates up instead of disabling the
+		// limit.
+		kib = 1
+	}
+	return kib, nil
+}
+
+// filterArgs rewrites --include=PATTERN and --exclude=PATTERN (or with the
+// pattern as separate argument) into the equivalent --filter rules, so that
+// all filter rules retain their order relative to each other. Rules passed as
+// separate argument to --filter or -f are joined with the option, as the
+// option parser would otherwise reject rules starting with a dash, e.g.
+// -f '- *.o'.
+func filterArgs(args []string) []string {
+	rewritten := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rewritten = append(rewritten, args[i:]...)
+			break
+		}
+		var prefix string
+		switch {
+		case arg == "--filter" || arg == "-f":
+			prefix = ""
+		case arg == "--include" || strings.HasPrefix(arg, "--include="):
+			prefix = "+ "
+		case arg == "--exclude" || strings.HasPrefix(arg, "--exclude="):
+			prefix = "- "
+		default:
+			rewritten = append(rewritten, arg)
+			continue
+		}
+		if idx := strings.IndexByte(arg, '='); idx > -1 {
+			rewritten = append(rewritten, "--filter="+prefix+arg[idx+1:])
+			continue
+		}
+		if i+1 == len(args) {
+			rewritten = append(rewritten, arg) // let the parser report the error
+			continue
+		}
+		i++
+		rewritten = append(rewritten, "--filter="+prefix+args[i])
+	}
+	return rewritten
+}
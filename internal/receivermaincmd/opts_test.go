@@ -0,0 +1,188 @@
+package receivermaincmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctoken"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseBwLimit(t *testing.T) {
+	for _, tt := range []struct {
+		rate    string
+		want    int
+		wantErr bool
+	}{
+		{rate: "0", want: 0},
+		{rate: "100", want: 100},
+		{rate: "100K", want: 100},
+		{rate: "1.5m", want: 1536},
+		{rate: "2G", want: 2 * 1024 * 1024},
+		{rate: "0.0001", want: 1},
+		{rate: "", wantErr: true},
+		{rate: "-5", wantErr: true},
+		{rate: "10X", wantErr: true},
+		{rate: "fast", wantErr: true},
+	} {
+		t.Run(tt.rate, func(t *testing.T) {
+			got, err := parseBwLimit(tt.rate)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBwLimit(%q): err = %v, wantErr = %v", tt.rate, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseBwLimit(%q) = %d, want %d", tt.rate, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterArgs(t *testing.T) {
+	got := filterArgs([]string{
+		"-a",
+		"--include=*.go",
+		"--exclude", "*",
+		"-f", "- .git/",
+		"--filter", "+ dir/",
+		"--filter=!",
+		"--",
+		"--exclude=literal",
+	})
+	want := []string{
+		"-a",
+		"--filter=+ *.go",
+		"--filter=- *",
+		"--filter=- .git/",
+		"--filter=+ dir/",
+		"--filter=!",
+		"--",
+		"--exclude=literal",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("filterArgs: unexpected result: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	for _, tt := range []struct {
+		args         []string
+		wantCompress bool
+		wantLevel    int
+		wantErr      string
+	}{
+		{args: []string{"-z"}, wantCompress: true, wantLevel: rsynctoken.LevelNotSpecified},
+		{args: []string{"--compress-level=9"}, wantCompress: true, wantLevel: 9},
+		{args: []string{"-z", "--compress-level=-1"}, wantCompress: true, wantLevel: 6},
+		{args: []string{"-z", "--compress-level=0"}, wantCompress: false, wantLevel: 0},
+		{args: []string{"-z", "--compress-choice=none"}, wantCompress: false, wantLevel: rsynctoken.LevelNotSpecified},
+		{args: []string{"-z", "--compress-level=10"}, wantErr: "out of range for zlib"},
+		{args: []string{"--compress-choice=zstd", "--compress-level=99"}, wantErr: "out of range for zstd"},
+		{args: []string{"--compress-choice=zstd"}, wantErr: "zstd is not supported"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args, "rsync://localhost/module/", "dest/")
+			opts, _, err := parseArgs(args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseArgs: err = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Compress != tt.wantCompress {
+				t.Errorf("Compress = %v, want %v", opts.Compress, tt.wantCompress)
+			}
+			if opts.CompressLevel != tt.wantLevel {
+				t.Errorf("CompressLevel = %d, want %d", opts.CompressLevel, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		flag      string
+		wantErr   string
+		unwantErr string
+	}{
+		{flag: "--protocol=27"},
+		{flag: "--protocol=31", wantErr: "nanosecond mtimes require protocol 31"},
+		{flag: "--protocol=26", wantErr: "speaks protocol 27 only", unwantErr: "nanosecond"},
+		{flag: "--protocol=30", wantErr: "speaks protocol 27 only", unwantErr: "nanosecond"},
+	} {
+		t.Run(tt.flag, func(t *testing.T) {
+			args := []string{"gokr-rsync", tt.flag, "rsync://localhost/module/", "dest/"}
+			_, _, err := parseArgs(args)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseArgs(%q): err = %v, want error containing %q", args, err, tt.wantErr)
+			}
+			if tt.unwantErr != "" && strings.Contains(err.Error(), tt.unwantErr) {
+				t.Errorf("parseArgs(%q): err = %v, want error not containing %q", args, err, tt.unwantErr)
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, tt := range []struct {
+		args    []string
+		want    int
+		wantErr string
+	}{
+		{args: []string{}, want: 0},
+		{args: []string{"--block-size=2048"}, want: 2048},
+		{args: []string{"-B", "1"}, want: 1},
+		{args: []string{"-B700"}, want: 700},
+		{args: []string{"--block-size=536870912"}, want: 1 << 29},
+		{args: []string{"--block-size=536870913"}, wantErr: "is too large (max: 536870912)"},
+		{args: []string{"-B0"}, wantErr: "is too small (min: 1)"},
+		{args: []string{"--block-size=-5"}, wantErr: "is too small (min: 1)"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			args := append([]string{"gokr-rsync"}, tt.args...)
+			args = append(args, "rsync://localhost/module/", "dest/")
+			opts, _, err := parseArgs(args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseArgs: err = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.BlockSize != tt.want {
+				t.Errorf("BlockSize = %d, want %d", opts.BlockSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgeFilterDelete(t *testing.T) {
+	for _, flag := range []string{"--files-newer-than=7d", "--files-older-than=2021-01-01"} {
+		args := []string{"gokr-rsync", "-a", "--delete", flag, "rsync://localhost/module/", "dest/"}
+		_, _, err := parseArgs(args)
+		if want := "cannot be combined with --delete"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseArgs(%q): err = %v, want error containing %q", args, err, want)
+		}
+	}
+}
+
+func TestAtimes(t *testing.T) {
+	for _, flag := range []string{"--atimes", "-U", "-aU"} {
+		args := []string{"gokr-rsync", flag, "--open-noatime", "rsync://localhost/module/", "dest/"}
+		_, _, err := parseArgs(args)
+		if want := "--atimes requires protocol 30"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseArgs(%q): err = %v, want error containing %q", args, err, want)
+		}
+	}
+}
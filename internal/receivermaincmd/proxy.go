@@ -0,0 +1,99 @@
+package receivermaincmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/log"
+)
+
+// dialDaemon connects to the rsync daemon at addr, either directly or through
+// the HTTP proxy specified by --proxy or the RSYNC_PROXY environment variable
+// ([user:pass@]host:port).
+func dialDaemon(opts *Opts, addr string) (net.Conn, error) {
+	proxy := opts.Proxy
+	if proxy == "" {
+		proxy = os.Getenv("RSYNC_PROXY")
+	}
+	if proxy == "" {
+		log.Printf("Opening TCP connection to %s", addr)
+		return net.Dial("tcp", addr)
+	}
+	var auth string
+	if idx := strings.LastIndexByte(proxy, '@'); idx > -1 {
+		auth = proxy[:idx]
+		proxy = proxy[idx+1:]
+	}
+	if _, _, err := net.SplitHostPort(proxy); err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	log.Printf("Opening TCP connection to %s via proxy %s", addr, proxy)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	if err := establishProxyConnection(conn, addr, auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// establishProxyConnection tunnels conn to addr using HTTP CONNECT. The
+// response is read one byte at a time so that no data of the daemon (which
+// might be sent right after the response) is consumed.
+//
+// rsync/socket.c:establish_proxy_connection
+func establishProxyConnection(conn io.ReadWriter, addr, auth string) error {
+	req := "CONNECT " + addr + " HTTP/1.0\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(auth)) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	status, err := readProxyLine(conn)
+	if err != nil {
+		return fmt.Errorf("reading proxy response: %v", err)
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("bad response from proxy -- %s", status)
+	}
+	if fields[1] != "200" {
+		return fmt.Errorf("bad response from proxy -- %s", status)
+	}
+	// throw away the rest of the HTTP header
+	for {
+		line, err := readProxyLine(conn)
+		if err != nil {
+			return fmt.Errorf("reading proxy response: %v", err)
+		}
+		if line == "" {
+			return nil
+		}
+	}
+}
+
+// readProxyLine reads one (CR)LF-terminated line from r without buffering.
+func readProxyLine(r io.Reader) (string, error) {
+	const maxLen = 1024
+	var line []byte
+	var b [1]byte
+	for len(line) < maxLen {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("proxy response line too long")
+}
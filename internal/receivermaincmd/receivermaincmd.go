@@ -2,7 +2,6 @@ package receivermaincmd
 
 import (
 	"bufio"
-	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,13 +9,19 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/idnames"
 	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsynctoken"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 	"github.com/google/shlex"
-	"golang.org/x/sync/errgroup"
 )
 
 type osenv struct {
@@ -25,23 +30,18 @@ type osenv struct {
 	stderr io.Writer
 }
 
-type recvTransfer struct {
-	// config
-	opts *Opts
-	dest string
-	env  osenv
-
-	// state
-	conn *rsyncwire.Conn
-	seed int32
-}
-
-func (rt *recvTransfer) listOnly() bool { return rt.dest == "" }
-
 type Stats struct {
 	Read    int64 // total bytes read (from network connection)
 	Written int64 // total bytes written (to network connection)
 	Size    int64 // total size of files
+	Deleted int   // number of deleted files (with --dry-run: to be deleted)
+
+	Timings receiver.PhaseTimings // per-phase timing breakdown (--info=stats2)
+
+	// With --compress: the file data bytes received in compressed form and
+	// their number after decompression.
+	CompressedData   int64
+	UncompressedData int64
 }
 
 // parseHostspec returns the [USER@]HOST part of the string
@@ -158,68 +158,170 @@ func checkForHostspec(src string) (host, path string, port int, _ error) {
 func RsyncMain(osenv osenv, opts *Opts, sources []string, dest string) (*Stats, error) {
 	log.Printf("dest: %q, sources: %q", dest, sources)
 	log.Printf("opts: %+v", opts)
+	if len(sources) > 1 && opts.WriteBatch != "" {
+		return nil, fmt.Errorf("--write-batch cannot be used with multiple sources")
+	}
+	if len(sources) > 1 && dest != "" {
+		// Like with rsync, the destination of multiple sources must be a
+		// directory. Each source is transferred over its own connection, so
+		// mark it as such: otherwise, a missing destination would be used as
+		// the name of a single file source.
+		//
+		// rsync/main.c:get_local_name
+		if st, err := os.Stat(dest); err == nil && !st.IsDir() {
+			return nil, fmt.Errorf("destination must be a directory when copying more than 1 file")
+		}
+		if !strings.HasSuffix(dest, "/") {
+			dest += "/"
+		}
+	}
+	if len(sources) > 1 && opts.Delete && dest != "" {
+		// Each source is transferred over its own connection, so deleting
+		// during each transfer would delete the files of all other sources.
+		// Instead, delete once all file lists are known.
+		o := *opts
+		o.mergedDelete = &mergedDeletion{}
+		opts = &o
+	}
+	total := &Stats{}
 	for _, src := range sources {
-		log.Printf("processing src=%s", src)
-		daemonConnection := 0 // no daemon
-		host, path, port, err := checkForHostspec(src)
-		log.Printf("host=%q, path=%q, port=%d, err=%v", host, path, port, err)
+		stats, err := startClient(osenv, opts, src, dest)
 		if err != nil {
-			// TODO: source is local, check dest arg
-			return nil, fmt.Errorf("push not yet implemented")
-		} else {
-			// source is remote
-			if port != 0 {
-				if opts.ShellCommand != "" {
-					daemonConnection = 1 // daemon via remote shell
-				} else {
-					daemonConnection = -1 // daemon via socket
-				}
-			}
+			return nil, err
 		}
-		module := path
-		if idx := strings.IndexByte(module, '/'); idx > -1 {
-			module = module[:idx]
+		total.add(stats)
+	}
+	if md := opts.mergedDelete; md != nil {
+		deleted, err := md.run(osenv, opts, dest)
+		if err != nil {
+			return nil, err
 		}
-		log.Printf("module=%q, path=%q", module, path)
+		total.Deleted += deleted
+	}
+	return total, nil
+}
 
-		if daemonConnection < 0 {
-			stats, err := socketClient(osenv, opts, src, dest)
-			if err != nil {
-				return nil, err
-			}
-			return stats, nil
-		} else {
-			machine := host
-			user := ""
-			if idx := strings.IndexByte(machine, '@'); idx > -1 {
-				user = machine[:idx]
-				machine = machine[idx+1:]
-			}
-			rc, wc, err := doCmd(opts, machine, user, path, daemonConnection)
-			if err != nil {
-				return nil, err
-			}
-			defer rc.Close()
-			defer wc.Close()
-			conn := &readWriter{
-				Reader: rc,
-				Writer: wc,
+// mergedDeletion applies --delete to the destination of multiple sources: like
+// rsync, which sends the files of all sources in one file list, each
+// directory is pruned of the entries which are not part of any source.
+type mergedDeletion struct {
+	fileList []*receiver.File
+	ioErrors int32
+}
+
+// add records the file list received for one source and its i/o error flag.
+func (md *mergedDeletion) add(fileList []*receiver.File, ioErrors int32) {
+	md.fileList = append(md.fileList, fileList...)
+	md.ioErrors |= ioErrors
+}
+
+// run deletes the extraneous entries below dest and returns their number.
+func (md *mergedDeletion) run(osenv osenv, opts *Opts, dest string) (int, error) {
+	rt := &receiver.Transfer{
+		Opts: &receiver.TransferOpts{
+			DryRun:         opts.DryRun,
+			Delete:         true,
+			IgnoreErrors:   opts.IgnoreErrors,
+			ItemizeChanges: opts.ItemizeChanges,
+			Backup:         opts.Backup,
+			BackupDir:      opts.BackupDir,
+			BackupSuffix:   opts.Suffix,
+			InfoBackup:     opts.InfoBackup,
+		},
+		Dest: dest,
+		Env: receiver.Osenv{
+			Stdin:  osenv.stdin,
+			Stdout: osenv.stdout,
+			Stderr: osenv.stderr,
+		},
+		Filters:  opts.Filters.Receiver(),
+		IOErrors: md.ioErrors,
+	}
+	if err := rt.DeleteExtraneous(md.fileList); err != nil {
+		return 0, err
+	}
+	return rt.Deleted, nil
+}
+
+// add accumulates the statistics of another connection.
+func (s *Stats) add(o *Stats) {
+	s.Read += o.Read
+	s.Written += o.Written
+	s.Size += o.Size
+	s.Deleted += o.Deleted
+	s.Timings.FileList += o.Timings.FileList
+	s.Timings.Checksum += o.Timings.Checksum
+	s.Timings.Transfer += o.Timings.Transfer
+	s.Timings.Finalize += o.Timings.Finalize
+	s.CompressedData += o.CompressedData
+	s.UncompressedData += o.UncompressedData
+}
+
+// startClient transfers src to dest over a new connection. Sources which
+// span multiple daemon modules (or hosts) each need their own connection.
+func startClient(osenv osenv, opts *Opts, src, dest string) (*Stats, error) {
+	log.Printf("processing src=%s", src)
+	daemonConnection := 0 // no daemon
+	host, path, port, err := checkForHostspec(src)
+	log.Printf("host=%q, path=%q, port=%d, err=%v", host, path, port, err)
+	if err != nil {
+		// source is local
+		if dest != "" {
+			if _, _, _, err := checkForHostspec(dest); err == nil {
+				return nil, fmt.Errorf("push not yet implemented")
 			}
-			negotiate := true
-			if daemonConnection != 0 {
-				if err := startInbandExchange(opts, conn, module, path); err != nil {
-					return nil, err
-				}
-				negotiate = false // already done
+		}
+		return localClient(osenv, opts, src, dest)
+	} else {
+		// source is remote
+		if port != 0 {
+			if opts.ShellCommand != "" {
+				daemonConnection = 1 // daemon via remote shell
+			} else {
+				daemonConnection = -1 // daemon via socket
 			}
-			stats, err := clientRun(osenv, opts, conn, dest, negotiate)
-			if err != nil {
-				return nil, err
+		}
+	}
+	module := path
+	if idx := strings.IndexByte(module, '/'); idx > -1 {
+		module = module[:idx]
+	}
+	log.Printf("module=%q, path=%q", module, path)
+
+	if daemonConnection < 0 {
+		if !strings.HasPrefix(src, "rsync://") {
+			src = daemonURL(host, path, port)
+		}
+		return socketClient(osenv, opts, src, dest)
+	}
+
+	machine := host
+	user := ""
+	if idx := strings.IndexByte(machine, '@'); idx > -1 {
+		user = machine[:idx]
+		machine = machine[idx+1:]
+	}
+	rc, wc, err := doCmd(opts, machine, user, path, daemonConnection)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	defer wc.Close()
+	conn := &readWriter{
+		Reader: rc,
+		Writer: wc,
+	}
+	negotiate := true
+	if daemonConnection != 0 {
+		if err := startInbandExchange(osenv, opts, conn, module, path); err != nil {
+			if err == errDaemonExit {
+				return &Stats{}, nil // module listing complete
 			}
-			return stats, nil
+			return nil, err
 		}
+		negotiate = false // already done
 	}
-	return nil, nil
+	return clientRun(osenv, opts, conn, dest, negotiate)
 }
 
 type readWriter struct {
@@ -235,6 +337,19 @@ func (prw *readWriter) Write(p []byte) (n int, err error) {
 	return prw.Writer.Write(p)
 }
 
+// closeConn closes conn (or its parts) to unblock pending reads and writes.
+func closeConn(conn io.ReadWriter) {
+	parts := []interface{}{conn}
+	if prw, ok := conn.(*readWriter); ok {
+		parts = []interface{}{prw.Reader, prw.Writer}
+	}
+	for _, part := range parts {
+		if c, ok := part.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
 // rsync/main.c:do_cmd
 func doCmd(opts *Opts, machine, user, path string, daemonConnection int) (io.ReadCloser, io.WriteCloser, error) {
 	cmd := opts.ShellCommand
@@ -301,10 +416,28 @@ func doCmd(opts *Opts, machine, user, path string, daemonConnection int) (io.Rea
 
 // rsync/main.c:client_run
 func clientRun(osenv osenv, opts *Opts, conn io.ReadWriter, dest string, negotiate bool) (*Stats, error) {
+	start := time.Now()
+	var idle *rsyncwire.IdleTimeout
+	if opts.Timeout > 0 {
+		underlying := conn
+		idle = &rsyncwire.IdleTimeout{
+			Timeout: time.Duration(opts.Timeout) * time.Second,
+			Abort:   func() { closeConn(underlying) },
+		}
+		conn = &readWriter{
+			Reader: idle.Reader(conn),
+			Writer: idle.Writer(conn),
+		}
+		idle.Start()
+		defer idle.Stop()
+	}
 	c := &rsyncwire.Conn{
 		Reader: conn,
 		Writer: conn,
 	}
+	if opts.BwLimitKiB > 0 {
+		c.Writer = &rsyncwire.BwLimitWriter{Writer: conn, Limit: opts.BwLimitKiB, Idle: idle}
+	}
 
 	if negotiate {
 		if err := c.WriteInt32(rsync.ProtocolVersion); err != nil {
@@ -319,82 +452,163 @@ func clientRun(osenv osenv, opts *Opts, conn io.ReadWriter, dest string, negotia
 
 	seed, err := c.ReadInt32()
 	if err != nil {
-		return nil, fmt.Errorf("reading seed: %v", err)
+		return nil, fmt.Errorf("reading seed: %w", err)
 	}
 
 	mrd := &rsyncwire.MultiplexReader{
 		Reader: conn,
 	}
-	// TODO: rearchitect such that our buffer can be smaller than the largest
-	// rsync message size
-	rd := bufio.NewReaderSize(mrd, 256*1024)
-	c.Reader = rd
+	c.Reader = bufio.NewReader(mrd)
+	if opts.WriteBatch != "" {
+		batch, err := createBatch(opts, seed)
+		if err != nil {
+			return nil, err
+		}
+		defer batch.Close()
+		c.Reader = bufio.NewReader(io.TeeReader(mrd, batch))
+		stats, err := transfer(osenv, opts, c, seed, dest, start)
+		if err != nil {
+			return nil, err
+		}
+		if err := batch.Close(); err != nil {
+			return nil, err
+		}
+		return stats, nil
+	}
+
+	return transfer(osenv, opts, c, seed, dest, start)
+}
 
-	rt := &recvTransfer{
-		opts: opts,
-		dest: dest,
-		env:  osenv,
-		conn: c,
-		seed: seed,
+// transfer receives the file list and files from c into dest.
+func transfer(osenv osenv, opts *Opts, c *rsyncwire.Conn, seed int32, dest string, start time.Time) (*Stats, error) {
+	var err error
+	rt := &receiver.Transfer{
+		Opts: &receiver.TransferOpts{
+			DryRun:    opts.DryRun,
+			Force:     opts.Force,
+			FakeSuper: opts.FakeSuper,
+			Compress:  opts.Compress,
+
+			Delete:         opts.Delete && opts.mergedDelete == nil,
+			Existing:       opts.Existing,
+			IgnoreErrors:   opts.IgnoreErrors,
+			ItemizeChanges: opts.ItemizeChanges,
+
+			Backup:       opts.Backup,
+			BackupDir:    opts.BackupDir,
+			BackupSuffix: opts.Suffix,
+			InfoBackup:   opts.InfoBackup,
+
+			RemoveSourceFiles: opts.RemoveSourceFiles,
+			CopyDest:          opts.CopyDest,
+			Partial:           opts.Partial,
+			Inplace:           opts.Inplace,
+			Sparse:            opts.Sparse,
+			BlockSize:         int32(opts.BlockSize),
+			ReadBatch:         opts.ReadBatch != "",
+
+			Umask:      receiver.ProcessUmask(),
+			NumericIds: opts.NumericIds,
+
+			PreserveGid:       opts.PreserveGid,
+			PreserveUid:       opts.PreserveUid,
+			PreserveLinks:     opts.PreserveLinks,
+			PreservePerms:     opts.PreservePerms,
+			PreserveDevices:   opts.PreserveDevices,
+			PreserveSpecials:  opts.PreserveSpecials,
+			PreserveTimes:     opts.PreserveTimes,
+			PreserveHardlinks: opts.PreserveHardlinks,
+			PreserveFileflags: opts.PreserveFileflags,
+		},
+		Dest: dest,
+		Env: receiver.Osenv{
+			Stdin:  osenv.stdin,
+			Stdout: osenv.stdout,
+			Stderr: osenv.stderr,
+		},
+		Conn: c,
+		Seed: seed,
+	}
+	if !opts.NumericIds {
+		rt.IDs = idnames.System
+	}
+	if opts.Delete {
+		rt.Filters = opts.Filters.Receiver()
+	}
+	if opts.Chmod != "" {
+		rt.Chmod, err = rsyncchmod.Parse(opts.Chmod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Progress && dest != "" {
+		rt.Progress = receiver.NewProgress(osenv.stdout)
+	}
+	var manifest *os.File
+	if opts.Manifest != "" && dest != "" {
+		manifest, err = os.Create(opts.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		defer manifest.Close()
+		rt.Manifest = manifest
 	}
 
-	// TODO: implement support for exclusion, send exclusion list here
-	const exclusionListEnd = 0
-	if err := c.WriteInt32(exclusionListEnd); err != nil {
-		return nil, err
+	if opts.RemoveSourceFiles {
+		// The receiver acknowledges files to the sender with MsgSuccess, so
+		// our output is multiplexed, too.
+		//
+		// rsync/main.c:client_run (need_messages_from_generator)
+		mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
+		c.Writer = mpx
+		rt.Mux = mpx
 	}
 
-	log.Printf("exclusion list sent")
+	if opts.ReadBatch == "" {
+		filters := opts.Filters.Sender()
+		if opts.filtersInProcess {
+			filters = nil // an empty list, the sender already has the rules
+		}
+		if err := sendFilterList(c, filters); err != nil {
+			return nil, err
+		}
+
+		log.Printf("exclusion list sent")
+
+		if opts.FilesFrom != "" {
+			if _, remote := remoteFilesFrom(opts.FilesFrom); !remote {
+				if err := sendFilesFrom(osenv, opts, c); err != nil {
+					return nil, err
+				}
+				log.Printf("files-from list sent")
+			}
+		}
+	}
 
 	// receive file list
 	log.Printf("receiving file list")
-	fileList, err := rt.receiveFileList()
+	fileList, err := rt.ReceiveFileList()
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("received %d names", len(fileList))
+	rt.Timings.FileList = time.Since(start)
 
-	sortFileList(fileList)
-
-	// receive the uid/gid list
-	users, groups, err := rt.recvIdList()
-	if err != nil {
+	if err := rt.Do(fileList); err != nil {
 		return nil, err
 	}
-	_ = users
-	_ = groups
-
-	// read the i/o error flag
-	ioErrors, err := c.ReadInt32()
-	if err != nil {
-		return nil, err
+	if opts.mergedDelete != nil {
+		opts.mergedDelete.add(fileList, rt.IOErrors)
 	}
-	log.Printf("ioErrors: %v", ioErrors)
-
-	ctx := context.Background()
-	eg, ctx := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		return rt.generateFiles(fileList)
-	})
-	eg.Go(func() error {
-		// Ensure we don’t block on the receiver when the generator returns an
-		// error.
-		errChan := make(chan error)
-		go func() {
-			errChan <- rt.recvFiles(fileList)
-		}()
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case err := <-errChan:
-			return err
-		}
-	})
-	if err := eg.Wait(); err != nil {
-		return nil, err
+	if manifest != nil {
+		if err := manifest.Close(); err != nil {
+			return nil, err
+		}
 	}
+	finalizeStart := time.Now()
 
-	// read statistics:
+	// read statistics, which the server sends even without --stats (see
+	// rsyncd.Server.HandleConn), so that the connection stays in sync:
 	// total bytes read (from network connection)
 	read, err := c.ReadInt64()
 	if err != nil {
@@ -417,28 +631,23 @@ func clientRun(osenv osenv, opts *Opts, conn io.ReadWriter, dest string, negotia
 		return nil, err
 	}
 
-	return &Stats{
+	rt.Timings.Finalize += time.Since(finalizeStart)
+
+	stats := &Stats{
 		Read:    read,
 		Written: written,
 		Size:    size,
-	}, nil
-}
-
-// rsync/token.c:recvToken
-func (rt *recvTransfer) recvToken() (token int32, data []byte, _ error) {
-	var err error
-	token, err = rt.conn.ReadInt32()
-	if err != nil {
-		return 0, nil, err
+		Deleted: rt.Deleted,
+		Timings: rt.Timings,
 	}
-	if token <= 0 {
-		return token, nil, nil
+	stats.CompressedData, stats.UncompressedData = rt.CompressedData()
+	if opts.StatsLevel >= 2 {
+		printStats(osenv.stdout, stats, len(fileList))
 	}
-	data = make([]byte, int(token))
-	if _, err := io.ReadFull(rt.conn.Reader, data); err != nil {
-		return 0, nil, err
+	if rt.Progress != nil || opts.StatsLevel >= 1 {
+		printSummary(osenv.stdout, stats, time.Since(start))
 	}
-	return token, data, nil
+	return stats, nil
 }
 
 func Main(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*Stats, error) {
@@ -447,13 +656,41 @@ func Main(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*
 		stdout: stdout,
 		stderr: stderr,
 	}
+	opts, remaining, err := parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ReadBatch != "" {
+		if len(remaining) != 1 {
+			return nil, errors.New("--read-batch requires exactly one DEST argument")
+		}
+		return readBatch(osenv, opts, remaining[0])
+	}
+	if len(remaining) == 1 {
+		// Usages with just one SRC arg and no DEST arg list the source files
+		// instead of copying.
+		dest := ""
+		sources := remaining
+		return RsyncMain(osenv, opts, sources, dest)
+	}
+	dest := remaining[len(remaining)-1]
+	sources := remaining[:len(remaining)-1]
+	if opts.ListOnly {
+		dest = "" // list the source files, leaving DEST alone
+	}
+	return RsyncMain(osenv, opts, sources, dest)
+}
+
+// parseArgs parses the command line args (including the program name) and
+// returns the options and the remaining (SRC and DEST) arguments.
+func parseArgs(args []string) (*Opts, []string, error) {
 	opts, opt := NewGetOpt()
-	remaining, err := opt.Parse(args[1:])
+	remaining, err := opt.Parse(rsynccommon.BlockSizeArgs(filterArgs(args[1:])))
 	if opt.Called("help") {
-		return nil, errors.New(opt.Help())
+		return nil, nil, errors.New(opt.Help())
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if opts.Archive {
@@ -472,17 +709,104 @@ func Main(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*
 		opts.PreserveSpecials = true
 	}
 
-	if len(remaining) == 0 {
-		return nil, errors.New(opt.Help())
+	if opts.Stats {
+		opts.StatsLevel = 2
 	}
-	if len(remaining) == 1 {
-		// Usages with just one SRC arg and no DEST arg list the source files
-		// instead of copying.
-		dest := ""
-		sources := remaining
-		return RsyncMain(osenv, opts, sources, dest)
+	if err := parseInfo(opts, opts.Info); err != nil {
+		return nil, nil, err
 	}
-	dest := remaining[len(remaining)-1]
-	sources := remaining[:len(remaining)-1]
-	return RsyncMain(osenv, opts, sources, dest)
+
+	if opts.FilesFrom != "" && !opt.Called("recursive") {
+		// Like rsync, --files-from does not imply --recursive, not even as
+		// part of --archive: only the listed names are transferred.
+		opts.Recurse = false
+	}
+
+	for _, f := range opts.Filter {
+		rule, err := rsyncfilter.ParseRule(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Filters.Add(rule)
+	}
+
+	// Access times are only part of the file list as of protocol 30.
+	//
+	// TODO(protocol >= 30): implement --atimes. Combined with --open-noatime,
+	// the sender must transfer the access times from before it read the files.
+	if opts.PreserveAtimes {
+		return nil, nil, fmt.Errorf("--atimes requires protocol 30 or higher (gokr-rsync speaks protocol %d)", rsync.ProtocolVersion)
+	}
+
+	// Files outside of the --files-newer-than/--files-older-than window are
+	// missing from the file list, so --delete would delete them.
+	if opts.Delete && (opts.FilesNewerThan != "" || opts.FilesOlderThan != "") {
+		return nil, nil, fmt.Errorf("--files-newer-than and --files-older-than cannot be combined with --delete")
+	}
+
+	if opt.Called("block-size") {
+		if err := rsynccommon.CheckBlockSize(opts.BlockSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.BwLimit != "" {
+		opts.BwLimitKiB, err = parseBwLimit(opts.BwLimit)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Only protocol 27 is implemented. In particular, nanosecond modification
+	// times are only part of the file list as of protocol 31, so mtimes are
+	// transferred (and applied) with whole-second precision.
+	if opt.Called("protocol") && opts.Protocol != rsync.ProtocolVersion {
+		err := fmt.Errorf("--protocol=%d is not supported: gokr-rsync speaks protocol %d only", opts.Protocol, rsync.ProtocolVersion)
+		if opts.Protocol >= 31 {
+			err = fmt.Errorf("%v (nanosecond mtimes require protocol 31)", err)
+		}
+		return nil, nil, err
+	}
+
+	if opts.CompressChoice == "none" {
+		opts.Compress = false
+	} else if opts.Compress || opts.CompressChoice != "" || opts.CompressLevel != rsynctoken.LevelNotSpecified {
+		// Like rsync, --compress-choice and --compress-level imply
+		// --compress, unless they turn off compression.
+		level, ok, err := rsynctoken.Level(opts.CompressChoice, opts.CompressLevel)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Compress = ok
+		if opts.CompressLevel != rsynctoken.LevelNotSpecified {
+			opts.CompressLevel = level
+		}
+	}
+
+	if opts.BackupDir != "" {
+		opts.Backup = true // --backup-dir implies --backup
+	}
+	if opts.Backup && !opt.Called("suffix") && opts.BackupDir == "" {
+		// rsync/options.c: BACKUP_SUFFIX
+		opts.Suffix = "~"
+	}
+	if strings.Contains(opts.Suffix, "/") {
+		return nil, nil, fmt.Errorf("--suffix cannot contain slashes: %s", opts.Suffix)
+	}
+	if opts.Backup && opts.BackupDir == "" && opts.Suffix == "" {
+		return nil, nil, errors.New("--suffix cannot be empty without --backup-dir")
+	}
+
+	if opts.WriteBatch != "" && opts.ReadBatch != "" {
+		return nil, nil, errors.New("--write-batch and --read-batch cannot be combined")
+	}
+
+	if opts.Delete && !opts.Recurse {
+		return nil, nil, errors.New("--delete does not work without --recursive (-r)")
+	}
+
+	if len(remaining) == 0 {
+		return nil, nil, errors.New(opt.Help())
+	}
+	return opts, remaining, nil
 }
@@ -0,0 +1,118 @@
+package receivermaincmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/log"
+)
+
+// Session is a persistent connection to a gokr-rsyncd daemon, which can be
+// used for multiple transfers (from the same or different modules). The client
+// only needs to authenticate once per session (as long as the modules accept
+// the same user and password).
+//
+// Persistent sessions are a gokr-rsync extension of the rsync daemon protocol
+// and need to be enabled on the daemon.
+type Session struct {
+	host   string
+	conn   net.Conn
+	rd     *bufio.Reader
+	broken error
+}
+
+// DialSession connects to the rsync daemon on host (optionally including a
+// port) and starts a persistent session.
+func DialSession(host string) (*Session, error) {
+	// Per-transfer options are only known in Session.Main, so the proxy (if
+	// any) is taken from RSYNC_PROXY.
+	conn, err := dialDaemon(&Opts{}, daemonAddr(host))
+	if err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(conn)
+	if err := exchangeGreeting(conn, rd); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fmt.Fprintf(conn, "#session\n")
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("did not get session startup line: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	if line != "@RSYNCD: SESSION" {
+		conn.Close()
+		return nil, fmt.Errorf("daemon does not support persistent sessions: %s", line)
+	}
+	return &Session{
+		host: host,
+		conn: conn,
+		rd:   rd,
+	}, nil
+}
+
+// Main runs a transfer within the session. args are parsed like the
+// command line of Main, but the source must be a single rsync:// URL on the
+// host of the session.
+func (s *Session) Main(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*Stats, error) {
+	if s.broken != nil {
+		return nil, fmt.Errorf("session unusable after earlier error: %v", s.broken)
+	}
+	osenv := osenv{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	opts, remaining, err := parseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) != 2 {
+		return nil, errors.New("sessions require exactly one SRC and one DEST argument")
+	}
+	src, dest := remaining[0], remaining[1]
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rsync" {
+		return nil, fmt.Errorf("SRC %q is not an rsync:// URL", src)
+	}
+	if u.Host != s.host {
+		return nil, fmt.Errorf("SRC %q is not on session host %q", src, s.host)
+	}
+	module, path, err := modulePath(u)
+	if err != nil {
+		return nil, err
+	}
+	if module == "" {
+		return nil, fmt.Errorf("listing modules is not supported within a session")
+	}
+	log.Printf("rsync module %q, path %q", module, path)
+	stats, err := s.transfer(osenv, opts, u.User.Username(), module, path, dest)
+	if err != nil {
+		// The connection is in an unknown protocol state.
+		s.broken = err
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (s *Session) transfer(osenv osenv, opts *Opts, user, module, path, dest string) (*Stats, error) {
+	if err := requestModule(osenv, opts, s.conn, s.rd, user, module, path); err != nil {
+		return nil, err
+	}
+	return clientRun(osenv, opts, &readWriter{Reader: s.rd, Writer: s.conn}, dest, false)
+}
+
+// Close ends the session.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
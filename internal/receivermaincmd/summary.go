@@ -0,0 +1,55 @@
+package receivermaincmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receiver"
+)
+
+// printStats prints the detailed statistics shown with --info=stats2,
+// including the per-phase timing breakdown.
+//
+// rsync/main.c:output_summary
+func printStats(w io.Writer, stats *Stats, numFiles int) {
+	seconds := func(d time.Duration) string {
+		return fmt.Sprintf("%.3f seconds", d.Seconds())
+	}
+	fmt.Fprintf(w, "\nNumber of files: %s\n", receiver.CommaNum(int64(numFiles)))
+	fmt.Fprintf(w, "Number of deleted files: %s\n", receiver.CommaNum(int64(stats.Deleted)))
+	fmt.Fprintf(w, "Total file size: %s bytes\n", receiver.CommaNum(stats.Size))
+	fmt.Fprintf(w, "File list transfer time: %s\n", seconds(stats.Timings.FileList))
+	fmt.Fprintf(w, "Checksum generation time: %s\n", seconds(stats.Timings.Checksum))
+	fmt.Fprintf(w, "Data transfer time: %s\n", seconds(stats.Timings.Transfer))
+	fmt.Fprintf(w, "Finalize time: %s\n", seconds(stats.Timings.Finalize))
+	// The statistics are from the perspective of the server.
+	fmt.Fprintf(w, "Total bytes sent: %s\n", receiver.CommaNum(stats.Read))
+	fmt.Fprintf(w, "Total bytes received: %s\n", receiver.CommaNum(stats.Written))
+	if stats.CompressedData > 0 {
+		fmt.Fprintf(w, "Uncompressed data: %s bytes\n", receiver.CommaNum(stats.UncompressedData))
+		fmt.Fprintf(w, "Compressed data: %s bytes\n", receiver.CommaNum(stats.CompressedData))
+		fmt.Fprintf(w, "Compression ratio: %.2f\n", float64(stats.UncompressedData)/float64(stats.CompressedData))
+	}
+}
+
+// rsync/main.c:output_summary
+func printSummary(w io.Writer, stats *Stats, elapsed time.Duration) {
+	// The statistics are from the perspective of the server.
+	sent, received := stats.Read, stats.Written
+	rate := float64(0)
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(sent+received) / secs
+	}
+	speedup := float64(0)
+	if total := sent + received; total > 0 {
+		speedup = float64(stats.Size) / float64(total)
+	}
+	fmt.Fprintf(w, "\nsent %s bytes  received %s bytes  %.2f bytes/sec\n",
+		receiver.CommaNum(sent),
+		receiver.CommaNum(received),
+		rate)
+	fmt.Fprintf(w, "total size is %s  speedup is %.2f\n",
+		receiver.CommaNum(stats.Size),
+		speedup)
+}
@@ -0,0 +1,31 @@
+package rsyncauth
+
+import "testing"
+
+func TestResponse(t *testing.T) {
+	// base64(md4("\0\0\0\0" + password + challenge)), without padding
+	const want = "Q8wPqq929q5VYqYrJ8je2Q"
+	if got := Response("s3cret", "qXpKnDBvOeM0Ufh7QjSv1w"); got != want {
+		t.Errorf("Response() = %q, want %q", got, want)
+	}
+	if got := Response("wrong", "qXpKnDBvOeM0Ufh7QjSv1w"); got == want {
+		t.Errorf("Response() identical for different passwords")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	c1, err := Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 == c2 {
+		t.Errorf("Challenge() returned %q twice", c1)
+	}
+	if len(c1) != 22 {
+		t.Errorf("Challenge() = %q, want 22 characters", c1)
+	}
+}
@@ -0,0 +1,170 @@
+// Package rsyncchmod implements the mode specifications accepted by rsync’s
+// --chmod option and by the incoming chmod/outgoing chmod module settings.
+package rsyncchmod
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+)
+
+// chmodBits are the bits a mode specification can modify (rsync/chmod.c).
+const chmodBits = 0o7777
+
+const (
+	flagDirsOnly = 1 << iota
+	flagFilesOnly
+	flagXKeep
+)
+
+type mode struct {
+	flags   int
+	modeAND int32
+	modeOR  int32
+}
+
+// Modes is a parsed, comma-separated list of mode specifications, applied in
+// order.
+type Modes []mode
+
+// Parse parses a comma-separated list of chmod(1)-style mode specifications,
+// optionally prefixed with D (directories only) or F (non-directories only),
+// e.g. “Dg+s,ug+w,Fo-w,+X” or “D755,F644”.
+//
+// Unlike chmod(1), a specification without who letters (e.g. “+x”) applies to
+// all of user, group and other, without masking by the umask.
+//
+// rsync/chmod.c:parse_chmod
+func Parse(spec string) (Modes, error) {
+	var modes Modes
+	for _, item := range strings.Split(spec, ",") {
+		m, err := parseOne(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chmod specification %q: %v", spec, err)
+		}
+		modes = append(modes, m)
+	}
+	return modes, nil
+}
+
+func parseOne(item string) (mode, error) {
+	var m mode
+	var where, what, topoct, topbits int32
+	op := byte(0)
+	i := 0
+	for ; i < len(item) && op == 0; i++ {
+		switch c := item[i]; c {
+		case 'D':
+			if m.flags&flagFilesOnly != 0 {
+				return m, fmt.Errorf("D and F are mutually exclusive")
+			}
+			m.flags |= flagDirsOnly
+		case 'F':
+			if m.flags&flagDirsOnly != 0 {
+				return m, fmt.Errorf("D and F are mutually exclusive")
+			}
+			m.flags |= flagFilesOnly
+		case 'u':
+			where |= 0o100
+			topbits |= 0o4000
+		case 'g':
+			where |= 0o010
+			topbits |= 0o2000
+		case 'o':
+			where |= 0o001
+		case 'a':
+			where |= 0o111
+		case '+', '-', '=':
+			op = c
+		default:
+			if c < '0' || c > '7' || where != 0 {
+				return m, fmt.Errorf("unexpected %q", c)
+			}
+			var bits int32
+			for _, d := range item[i:] {
+				if d < '0' || d > '7' {
+					return m, fmt.Errorf("invalid octal digit %q", d)
+				}
+				bits = bits*8 + int32(d-'0')
+			}
+			if bits > chmodBits {
+				return m, fmt.Errorf("octal mode %s out of range", item[i:])
+			}
+			m.modeAND = 0
+			m.modeOR = bits
+			return m, nil
+		}
+	}
+	if op == 0 {
+		return m, fmt.Errorf("missing operator (+, - or =)")
+	}
+	for ; i < len(item); i++ {
+		switch c := item[i]; c {
+		case 'r':
+			what |= 4
+		case 'w':
+			what |= 2
+		case 'X':
+			m.flags |= flagXKeep
+			what |= 1
+		case 'x':
+			what |= 1
+		case 's':
+			if topbits != 0 {
+				topoct |= topbits
+			} else {
+				topoct = 0o4000
+			}
+		case 't':
+			topoct |= 0o1000
+		default:
+			return m, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	if where == 0 {
+		where = 0o111
+	}
+	bits := where * what
+	switch op {
+	case '+':
+		m.modeAND = chmodBits
+		m.modeOR = bits + topoct
+	case '-':
+		m.modeAND = chmodBits - bits - topoct
+		m.modeOR = 0
+	case '=':
+		m.modeAND = chmodBits - where*7
+		if topoct != 0 {
+			m.modeAND -= topbits
+		}
+		m.modeOR = bits + topoct
+	}
+	return m, nil
+}
+
+// Apply returns mode (which includes the S_IFMT file type bits) with the
+// mode specifications applied in order. Callers are expected to not apply
+// modes to symbolic links, whose permission bits are meaningless.
+//
+// rsync/chmod.c:tweak_mode
+func (ms Modes) Apply(mode int32) int32 {
+	isX := mode&0o111 != 0
+	nonPerm := mode &^ chmodBits
+	isDir := nonPerm&rsync.S_IFMT == rsync.S_IFDIR
+	for _, m := range ms {
+		if m.flags&flagDirsOnly != 0 && !isDir {
+			continue
+		}
+		if m.flags&flagFilesOnly != 0 && isDir {
+			continue
+		}
+		mode &= m.modeAND
+		if m.flags&flagXKeep != 0 && !isX && !isDir {
+			mode |= m.modeOR &^ 0o111
+		} else {
+			mode |= m.modeOR
+		}
+	}
+	return mode&chmodBits | nonPerm
+}
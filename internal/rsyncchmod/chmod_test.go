@@ -0,0 +1,54 @@
+package rsyncchmod_test
+
+import (
+	"testing"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+)
+
+func TestApply(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		mode int32
+		want int32
+	}{
+		{spec: "u+x", mode: rsync.S_IFREG | 0o644, want: rsync.S_IFREG | 0o744},
+		{spec: "go-rwx", mode: rsync.S_IFREG | 0o644, want: rsync.S_IFREG | 0o600},
+		{spec: "a=r", mode: rsync.S_IFREG | 0o755, want: rsync.S_IFREG | 0o444},
+		{spec: "+X", mode: rsync.S_IFREG | 0o644, want: rsync.S_IFREG | 0o644},
+		{spec: "+X", mode: rsync.S_IFREG | 0o744, want: rsync.S_IFREG | 0o755},
+		{spec: "+X", mode: rsync.S_IFDIR | 0o644, want: rsync.S_IFDIR | 0o755},
+		{spec: "Dg+s", mode: rsync.S_IFDIR | 0o755, want: rsync.S_IFDIR | 0o2755},
+		{spec: "Dg+s", mode: rsync.S_IFREG | 0o755, want: rsync.S_IFREG | 0o755},
+		{spec: "D755,F644", mode: rsync.S_IFDIR | 0o700, want: rsync.S_IFDIR | 0o755},
+		{spec: "D755,F644", mode: rsync.S_IFREG | 0o600, want: rsync.S_IFREG | 0o644},
+		{spec: "Fo-r,Fo+w", mode: rsync.S_IFREG | 0o644, want: rsync.S_IFREG | 0o642},
+		{spec: "+t", mode: rsync.S_IFDIR | 0o777, want: rsync.S_IFDIR | 0o1777},
+	} {
+		t.Run(tt.spec, func(t *testing.T) {
+			modes, err := rsyncchmod.Parse(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := modes.Apply(tt.mode); got != tt.want {
+				t.Fatalf("Apply(%o) = %o, want %o", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"u",
+		"u+q",
+		"DF+x",
+		"u755",
+		"7778",
+	} {
+		if _, err := rsyncchmod.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
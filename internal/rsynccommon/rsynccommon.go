@@ -3,25 +3,58 @@
 package rsynccommon
 
 import (
+	"fmt"
 	"math"
+	"strings"
 
 	"github.com/gokrazy/rsync"
 )
 
 const blockSize = 700 // rsync/rsync.h
 
-// Corresponds to rsync/generator.c:sum_sizes_sqroot
-func SumSizesSqroot(contentLen int64) rsync.SumHead {
-	// * The block size is a rounded square root of file length.
+// MaxBlockSize is the largest block size (--block-size) which protocol
+// versions before 30 allow.
+const MaxBlockSize = 1 << 29 // rsync/rsync.h:OLD_MAX_BLOCK_SIZE
 
-	// 	The block size algorithm plays a crucial role in the protocol efficiency. In general, the block size is the rounded square root of the total file size. The minimum block size, however, is 700 B. Otherwise, the square root computation is simply sqrt(3) followed by ceil(3)
+// CheckBlockSize returns an error if n is not a valid --block-size.
+//
+// rsync/options.c:parse_arguments
+func CheckBlockSize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("--block-size=%d is too small (min: 1)", n)
+	}
+	if n > MaxBlockSize {
+		return fmt.Errorf("--block-size=%d is too large (max: %d)", n, MaxBlockSize)
+	}
+	return nil
+}
 
-	// For reasons unknown, the square root result is rounded up to the nearest multiple of eight.
+// BlockSizeArgs rewrites -B with an attached value (e.g. -B2048, as sent by
+// rsync to the server) into --block-size=2048, as the option parser does not
+// support attached values for bundled short options.
+func BlockSizeArgs(args []string) []string {
+	rewritten := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			rewritten = append(rewritten, args[i:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-B") && len(arg) > len("-B") {
+			arg = "--block-size=" + strings.TrimPrefix(arg[len("-B"):], "=")
+		}
+		rewritten = append(rewritten, arg)
+	}
+	return rewritten
+}
 
-	// TODO: round this
-	blockLength := int32(math.Sqrt(float64(contentLen)))
-	if blockLength < blockSize {
-		blockLength = blockSize
+// SumSizesSqroot returns the checksum header for a file of contentLen bytes.
+// A non-zero blockLength (--block-size) is used instead of the computed block
+// length.
+//
+// Corresponds to rsync/generator.c:sum_sizes_sqroot
+func SumSizesSqroot(contentLen int64, blockLength int32) rsync.SumHead {
+	if blockLength == 0 {
+		blockLength = sqrootBlockLength(contentLen)
 	}
 
 	// * The checksum size is determined according to:
@@ -38,3 +71,18 @@ func SumSizesSqroot(contentLen int64) rsync.SumHead {
 		ChecksumLength:  checksumLength,
 	}
 }
+
+func sqrootBlockLength(contentLen int64) int32 {
+	// * The block size is a rounded square root of file length.
+
+	// 	The block size algorithm plays a crucial role in the protocol efficiency. In general, the block size is the rounded square root of the total file size. The minimum block size, however, is 700 B. Otherwise, the square root computation is simply sqrt(3) followed by ceil(3)
+
+	// For reasons unknown, the square root result is rounded up to the nearest multiple of eight.
+
+	// TODO: round this
+	blockLength := int32(math.Sqrt(float64(contentLen)))
+	if blockLength < blockSize {
+		blockLength = blockSize
+	}
+	return blockLength
+}
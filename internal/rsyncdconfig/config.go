@@ -25,6 +25,14 @@ type Config struct {
 	Listeners     []Listener      `toml:"listener"`
 	Modules       []rsyncd.Module `toml:"module"`
 	DontNamespace bool            `toml:"dont_namespace"`
+
+	// PersistentSessions allows clients to reuse their connection for
+	// multiple transfers (a gokr-rsync extension of the daemon protocol).
+	PersistentSessions bool `toml:"persistent_sessions"`
+
+	// ModuleSelectionTimeout is the number of seconds after which clients
+	// which did not select a module are disconnected (0 means no timeout).
+	ModuleSelectionTimeout int `toml:"module_selection_timeout"`
 }
 
 func FromString(input string) (*Config, error) {
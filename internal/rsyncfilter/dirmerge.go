@@ -0,0 +1,176 @@
+package rsyncfilter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Scope applies the rules of a List while traversing a directory tree,
+// including the rules which DirMerge rules read from per-directory files.
+//
+// The rules of a per-directory file are inserted at the position of their
+// DirMerge rule. They apply within the file’s directory and all of its
+// subdirectories, with the rules of deeper directories taking precedence, and
+// go out of scope when the traversal leaves the directory, so that they never
+// apply to sibling directories. Like in rsync, anchored patterns (“/foo”) are
+// relative to the directory of the per-directory file, and a “!” rule clears
+// the rules inherited from parent directories.
+//
+// DirMerge rules within per-directory files are not applied. A nil *Scope
+// matches nothing.
+//
+// Clients cannot send dir-merge rules with protocol 27 (see Rule.Wire), so
+// they only reach the sender with the local transport, which passes the rules
+// in-process. The receiver reads the per-directory files of the destination
+// to protect files from deletion.
+//
+// rsync/exclude.c:push_local_filters
+type Scope struct {
+	list   *List
+	side   func(*List) *List // selects the rules of per-directory files
+	frames []frame           // per entered directory
+}
+
+// frame holds the per-directory rules read when entering dir.
+type frame struct {
+	dir string // relative to the root of the transfer, "" for the root
+
+	// rules and cleared are indexed by the position of the DirMerge rule in
+	// the List.
+	rules   map[int][]Rule
+	cleared map[int]bool
+}
+
+// NewScope returns a Scope applying l, which may be nil, on the sending side:
+// like with List.Sender, protect and risk rules of per-directory files are
+// ignored.
+func NewScope(l *List) *Scope {
+	return &Scope{list: l, side: (*List).Sender}
+}
+
+// NewReceiverScope is like NewScope, but for the receiving side: hide and
+// show rules of per-directory files are ignored.
+func NewReceiverScope(l *List) *Scope {
+	return &Scope{list: l, side: (*List).Receiver}
+}
+
+// contains reports whether name is within f.dir.
+func (f *frame) contains(name string) bool {
+	return f.dir == "" || strings.HasPrefix(name, f.dir+"/")
+}
+
+// leave pops the frames of all directories which do not contain name, i.e.
+// which the traversal left.
+//
+// rsync/exclude.c:pop_local_filters
+func (s *Scope) leave(name string) {
+	for len(s.frames) > 0 && !s.frames[len(s.frames)-1].contains(name) {
+		s.frames = s.frames[:len(s.frames)-1]
+	}
+}
+
+// Enter reads the per-directory files of the directory name (relative to the
+// root of the transfer), which is located at the local path dir. Enter must be
+// called for each directory after checking whether it is excluded and before
+// checking its contents. Parent directories (except for the root of the
+// transfer) which were not entered yet, e.g. because directories are not
+// visited in walk order, are entered first.
+func (s *Scope) Enter(name, dir string) error {
+	if s == nil {
+		return nil
+	}
+	if name == "." {
+		name = ""
+	}
+	s.leave(name)
+	if !s.list.hasDirMerge() {
+		return nil
+	}
+	if name != "" {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		top := len(s.frames) - 1
+		if parent != "" && (top < 0 || s.frames[top].dir != parent) {
+			if err := s.Enter(parent, filepath.Dir(dir)); err != nil {
+				return err
+			}
+		}
+	}
+	f := frame{
+		dir:     name,
+		rules:   make(map[int][]Rule),
+		cleared: make(map[int]bool),
+	}
+	for idx, r := range s.list.Rules() {
+		if r.Action != DirMerge {
+			continue
+		}
+		fn := filepath.Join(dir, strings.TrimLeft(r.Pattern, "/"))
+		file, err := openMergeFile(dir, strings.TrimLeft(r.Pattern, "/"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		rules, err := ReadRules(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		var l List
+		for _, rule := range rules {
+			if rule.Action == Clear {
+				f.cleared[idx] = true
+			}
+			l.Add(rule)
+		}
+		f.rules[idx] = s.side(&l).rules
+	}
+	// Directories without per-directory files are recorded, too, so that
+	// their parent directories are not entered again.
+	s.frames = append(s.frames, f)
+	return nil
+}
+
+// Match is like List.Match, but includes the per-directory rules of the
+// directories containing name.
+func (s *Scope) Match(name string, isDir bool) (Rule, bool) {
+	if s == nil || isDotEntry(name) {
+		return Rule{}, false
+	}
+	s.leave(name)
+	for idx, r := range s.list.Rules() {
+		if r.Action != DirMerge {
+			if r.matches(name, isDir) {
+				return r, true
+			}
+			continue
+		}
+		for i := len(s.frames) - 1; i >= 0; i-- {
+			f := &s.frames[i]
+			rel := strings.TrimPrefix(name, f.dir+"/")
+			for _, mr := range f.rules[idx] {
+				if mr.Action != DirMerge && mr.matches(rel, isDir) {
+					return mr, true
+				}
+			}
+			if f.cleared[idx] {
+				break // parent directories’ rules are not inherited
+			}
+		}
+	}
+	return Rule{}, false
+}
+
+// Excluded is like List.Excluded, but includes the per-directory rules of the
+// directories containing name.
+func (s *Scope) Excluded(name string, isDir bool) bool {
+	r, ok := s.Match(name, isDir)
+	return ok && r.Action.excludes()
+}
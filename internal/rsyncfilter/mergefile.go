@@ -0,0 +1,46 @@
+//go:build linux || darwin
+
+package rsyncfilter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+// openMergeFile opens the per-directory file name within dir. The file is
+// opened relative to the directory and must not be a symlink, so that a
+// client-controlled rule cannot make the sender read files elsewhere.
+func openMergeFile(dir, name string) (*os.File, error) {
+	var dirfd int
+	err := eintr.Retry(func() (err error) {
+		dirfd, err = unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(dirfd)
+	var fd int
+	err = eintr.Retry(func() (err error) {
+		// O_NONBLOCK so that opening a FIFO does not block.
+		fd, err = unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: dir + "/" + name, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), dir+"/"+name)
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a regular file", f.Name())
+	}
+	return f, nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package rsyncfilter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// openMergeFile opens the per-directory file name within dir, which must be a
+// regular file (not a symlink).
+func openMergeFile(dir, name string) (*os.File, error) {
+	fn := filepath.Join(dir, name)
+	st, err := os.Lstat(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", fn)
+	}
+	return os.Open(fn)
+}
@@ -0,0 +1,332 @@
+// Package rsyncfilter implements rsync’s filter rules (--filter, --include,
+// --exclude), which select the files of a transfer by matching their names
+// against wildcard patterns.
+//
+// Like in rsync, hidden (dot) files are not special: a * matches a leading
+// dot, so --exclude='*' excludes .hidden, too. The “.” and “..” directory
+// entries are never matched against rules; see Match.
+package rsyncfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Action is what happens to a file matched by a Rule.
+type Action byte
+
+const (
+	Exclude Action = iota
+	Include
+	Clear // clears the list of rules (“!”)
+
+	// DirMerge (“:”) reads additional rules from the per-directory file
+	// named by the pattern, see Scope. DirMerge rules cannot be transmitted
+	// before protocol 29, see Rule.Wire.
+	DirMerge
+
+	// Hide (“H”) and Show (“S”) exclude and include files on the sending
+	// side only, i.e. they select which files are transferred, but do not
+	// affect deletion on the receiving side.
+	Hide
+	Show
+
+	// Protect (“P”) and Risk (“R”) exclude and include files on the
+	// receiving side only, i.e. they select which files --delete may
+	// remove, but do not affect which files are transferred.
+	Protect
+	Risk
+)
+
+// excludes reports whether a matching rule with action a excludes the file
+// (on its side).
+func (a Action) excludes() bool {
+	return a == Exclude || a == Hide || a == Protect
+}
+
+// Rule is a single filter rule.
+type Rule struct {
+	Action  Action
+	Pattern string // as specified, including any leading or trailing slash
+}
+
+// ParseRule parses a rule as specified with --filter, i.e. a rule name (long
+// or short form), followed by a space or underscore and the pattern, e.g.
+// “- *.o”, “+_dir/”, “exclude .git/”, “P backup/” or “: .rsync-filter”.
+//
+// rsync/exclude.c:parse_rule_tok
+func ParseRule(s string) (Rule, error) {
+	if s == "!" || s == "clear" {
+		return Rule{Action: Clear}, nil
+	}
+	for _, prefix := range []struct {
+		name   string
+		action Action
+	}{
+		{"-", Exclude},
+		{"exclude", Exclude},
+		{"+", Include},
+		{"include", Include},
+		{":", DirMerge},
+		{"dir-merge", DirMerge},
+		{"H", Hide},
+		{"hide", Hide},
+		{"S", Show},
+		{"show", Show},
+		{"P", Protect},
+		{"protect", Protect},
+		{"R", Risk},
+		{"risk", Risk},
+	} {
+		rest := strings.TrimPrefix(s, prefix.name)
+		if rest == s || rest == "" || (rest[0] != ' ' && rest[0] != '_') {
+			continue
+		}
+		pattern := rest[1:]
+		if pattern == "" {
+			return Rule{}, fmt.Errorf("invalid filter rule %q: empty pattern", s)
+		}
+		if prefix.action == DirMerge && strings.Contains(strings.TrimLeft(pattern, "/"), "/") {
+			return Rule{}, fmt.Errorf("invalid filter rule %q: per-directory merge file name must not contain a slash", s)
+		}
+		return Rule{Action: prefix.action, Pattern: pattern}, nil
+	}
+	return Rule{}, fmt.Errorf("invalid filter rule %q: unknown rule", s)
+}
+
+// ReadRules reads rules from a filter file: one rule (in the format of
+// ParseRule) per line. Empty lines and lines starting with “#” or “;” are
+// ignored.
+//
+// rsync/exclude.c:parse_filter_file
+func ReadRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ParseWire parses a rule as transmitted by protocol versions before 29:
+// include rules carry a “+ ” prefix, exclude rules are sent without prefix
+// (unless their pattern starts with a prefix, in which case “- ” is used).
+//
+// rsync/exclude.c:parse_rule_tok (XFLG_OLD_PREFIXES)
+func ParseWire(s string) Rule {
+	switch {
+	case strings.HasPrefix(s, "+ "):
+		return Rule{Action: Include, Pattern: s[2:]}
+	case strings.HasPrefix(s, "- "):
+		return Rule{Action: Exclude, Pattern: s[2:]}
+	case s == "!":
+		return Rule{Action: Clear}
+	}
+	return Rule{Action: Exclude, Pattern: s}
+}
+
+// Wire returns the rule in the format of protocol versions before 29, see
+// ParseWire. Like with rsync, the format cannot express on which side a rule
+// applies: hide and show rules are sent as exclude and include rules.
+// Receiver-side rules (protect and risk) are not meant to be sent at all, see
+// List.Sender. DirMerge rules cannot be expressed in this format either, and
+// must not be sent (rsync refuses to send them to an old protocol peer).
+//
+// rsync/exclude.c:get_rule_prefix
+func (r Rule) Wire() string {
+	switch r.Action {
+	case Include, Show, Risk:
+		return "+ " + r.Pattern
+	case Clear:
+		return "!"
+	}
+	if strings.HasPrefix(r.Pattern, "+ ") ||
+		strings.HasPrefix(r.Pattern, "- ") ||
+		r.Pattern == "!" {
+		return "- " + r.Pattern
+	}
+	return r.Pattern
+}
+
+func (r Rule) String() string {
+	switch r.Action {
+	case Include:
+		return "+ " + r.Pattern
+	case Clear:
+		return "!"
+	case DirMerge:
+		return ": " + r.Pattern
+	case Hide:
+		return "H " + r.Pattern
+	case Show:
+		return "S " + r.Pattern
+	case Protect:
+		return "P " + r.Pattern
+	case Risk:
+		return "R " + r.Pattern
+	}
+	return "- " + r.Pattern
+}
+
+// matches reports whether the pattern of r matches name, a slash-separated
+// path relative to the root of the transfer.
+//
+// rsync/exclude.c:rule_matches
+func (r Rule) matches(name string, isDir bool) bool {
+	pattern := r.Pattern
+	if strings.HasSuffix(pattern, "/") {
+		// A trailing slash only matches directories.
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	// A trailing “dir/***” matches the directory itself as well as
+	// everything within it.
+	if strings.HasSuffix(pattern, "/***") &&
+		isDir && matchPattern(strings.TrimSuffix(pattern, "/***"), name) {
+		return true
+	}
+	return matchPattern(pattern, name)
+}
+
+func matchPattern(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "/") {
+		// Anchored to the root of the transfer.
+		return wildmatch(strings.TrimLeft(pattern, "/"), name)
+	}
+	if strings.Contains(pattern, "**") {
+		// Matched against the full path name, or any trailing part of it
+		// which starts at a directory boundary.
+		for {
+			if wildmatch(pattern, name) {
+				return true
+			}
+			idx := strings.IndexByte(name, '/')
+			if idx == -1 {
+				return false
+			}
+			name = name[idx+1:]
+		}
+	}
+	// Match against as many trailing path components as the pattern has,
+	// e.g. only the final component for patterns without slashes.
+	slashes := strings.Count(pattern, "/")
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] != '/' {
+			continue
+		}
+		if slashes == 0 {
+			name = name[i+1:]
+			break
+		}
+		slashes--
+	}
+	return wildmatch(pattern, name)
+}
+
+// List is an ordered list of filter rules. The first matching rule
+// determines whether a file is included or excluded.
+type List struct {
+	rules []Rule
+}
+
+// Add appends r to the list. A Clear rule removes all previous rules.
+func (l *List) Add(r Rule) {
+	if r.Action == Clear {
+		l.rules = nil
+		return
+	}
+	l.rules = append(l.rules, r)
+}
+
+// Rules returns the rules of the list in order.
+func (l *List) Rules() []Rule {
+	if l == nil {
+		return nil
+	}
+	return l.rules
+}
+
+// Sender returns the rules which apply on the sending side, i.e. the list
+// without protect and risk rules.
+func (l *List) Sender() *List {
+	return l.without(Protect, Risk)
+}
+
+// Receiver returns the rules which apply on the receiving side, i.e. the list
+// without hide and show rules.
+func (l *List) Receiver() *List {
+	return l.without(Hide, Show)
+}
+
+func (l *List) without(a, b Action) *List {
+	var side List
+	for _, r := range l.Rules() {
+		if r.Action != a && r.Action != b {
+			side.rules = append(side.rules, r)
+		}
+	}
+	return &side
+}
+
+// Match returns the first rule of the list which matches name, a
+// slash-separated path relative to the root of the transfer. DirMerge rules
+// never match (see Scope for applying them).
+//
+// The root of the transfer (“.”) and “.” or “..” path components are never
+// treated as regular entries and do not match any rule.
+//
+// rsync/exclude.c:check_filter
+func (l *List) Match(name string, isDir bool) (Rule, bool) {
+	if l == nil || isDotEntry(name) {
+		return Rule{}, false
+	}
+	for _, r := range l.rules {
+		if r.Action != DirMerge && r.matches(name, isDir) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// hasDirMerge reports whether the list contains DirMerge rules.
+func (l *List) hasDirMerge() bool {
+	for _, r := range l.Rules() {
+		if r.Action == DirMerge {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded reports whether name is excluded by the list, i.e. whether the
+// first matching rule is an exclude, hide or protect rule. Use Sender or
+// Receiver to only consider the rules of one side.
+//
+// rsync/exclude.c:is_excluded
+func (l *List) Excluded(name string, isDir bool) bool {
+	r, ok := l.Match(name, isDir)
+	return ok && r.Action.excludes()
+}
+
+func isDotEntry(name string) bool {
+	if name == "" {
+		return true
+	}
+	base := name[strings.LastIndexByte(name, '/')+1:]
+	return base == "." || base == ".."
+}
@@ -0,0 +1,416 @@
+package rsyncfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWildmatch(t *testing.T) {
+	// A selection of rsync/wildtest.txt
+	for _, tt := range []struct {
+		pattern string
+		text    string
+		want    bool
+	}{
+		{"foo", "foo", true},
+		{"bar", "foo", false},
+		{"", "", true},
+		{"???", "foo", true},
+		{"??", "foo", false},
+		{"*", "foo", true},
+		{"f*", "foo", true},
+		{"*f", "foo", false},
+		{"*foo*", "foo", true},
+		{"*ob*a*r*", "foobar", true},
+		{"*ab", "aaaaaaabababab", true},
+		{`foo\*`, "foo*", true},
+		{`foo\*bar`, "foobar", false},
+		{`f\\oo`, `f\oo`, true},
+		{"*[al]?", "ball", true},
+		{"[ten]", "ten", false},
+		{"**[!te]", "ten", true},
+		{"**[!ten]", "ten", false},
+		{"t[a-g]n", "ten", true},
+		{"t[!a-g]n", "ten", false},
+		{"t[!a-g]n", "ton", true},
+		{"t[^a-g]n", "ton", true},
+		{"a[]]b", "a]b", true},
+		{"a[]-]b", "a-b", true},
+		{"a[]a-]b", "aab", true},
+		{"]", "]", true},
+		{"foo*bar", "foo/baz/bar", false},
+		{"foo**bar", "foo/baz/bar", true},
+		{"foo?bar", "foo/bar", false},
+		{"foo[/]bar", "foo/bar", false},
+		{"f[^eiu][^eiu][^eiu][^eiu][^eiu]r", "foo/bar", false},
+		{"f[^eiu][^eiu][^eiu][^eiu][^eiu]r", "foo-bar", true},
+		{"**/foo", "foo", false},
+		{"**/foo", "XXX/foo", true},
+		{"**/foo", "bar/baz/foo", true},
+		{"*/foo", "bar/baz/foo", false},
+		{"**/bar*", "foo/bar/baz", false},
+		{"**/bar/*", "deep/foo/bar/baz", true},
+		{"**/bar/*", "deep/foo/bar/baz/", false},
+		{"**/bar/**", "deep/foo/bar/baz/", true},
+		{"*/bar/**", "foo/bar/baz/x", true},
+		{"**/bar/*/*", "deep/foo/bar/baz/x", true},
+		{"[[:alpha:]][[:digit:]][[:upper:]]", "a1B", true},
+		{"[[:digit:][:upper:][:space:]]", "a", false},
+		{"[[:digit:][:upper:][:space:]]", "A", true},
+		{"[[:xdigit:]]", "5", true},
+		{"[a-c[:digit:]x-z]", "y", true},
+		{"[[:notaclass:]]", "a", false},
+		{"[abc", "a", false},
+
+		// Leading dots are not special:
+		{"*", ".hidden", true},
+		{".*", ".hidden", true},
+		{"?hidden", ".hidden", true},
+		{"[.]hidden", ".hidden", true},
+		{"*/*", "dir/.hidden", true},
+		{"**", ".git/config", true},
+	} {
+		if got := wildmatch(tt.pattern, tt.text); got != tt.want {
+			t.Errorf("wildmatch(%q, %q) = %v, want %v", tt.pattern, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, tt := range []struct {
+		rule    string
+		want    Rule
+		wantErr bool
+	}{
+		{rule: "- *.o", want: Rule{Action: Exclude, Pattern: "*.o"}},
+		{rule: "-_*.o", want: Rule{Action: Exclude, Pattern: "*.o"}},
+		{rule: "exclude .git/", want: Rule{Action: Exclude, Pattern: ".git/"}},
+		{rule: "+ dir/***", want: Rule{Action: Include, Pattern: "dir/***"}},
+		{rule: "include_*.go", want: Rule{Action: Include, Pattern: "*.go"}},
+		{rule: "!", want: Rule{Action: Clear}},
+		{rule: "clear", want: Rule{Action: Clear}},
+		{rule: ": .rsync-filter", want: Rule{Action: DirMerge, Pattern: ".rsync-filter"}},
+		{rule: "dir-merge_.filter", want: Rule{Action: DirMerge, Pattern: ".filter"}},
+		{rule: ": sub/.filter", wantErr: true},
+		{rule: "H secret", want: Rule{Action: Hide, Pattern: "secret"}},
+		{rule: "show_*.go", want: Rule{Action: Show, Pattern: "*.go"}},
+		{rule: "P backup/", want: Rule{Action: Protect, Pattern: "backup/"}},
+		{rule: "risk *.bak", want: Rule{Action: Risk, Pattern: "*.bak"}},
+		{rule: "-", wantErr: true},
+		{rule: "- ", wantErr: true},
+		{rule: "*.o", wantErr: true},
+		{rule: "excludes foo", wantErr: true},
+	} {
+		got, err := ParseRule(tt.rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRule(%q): err = %v, wantErr = %v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestWire(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: Exclude, Pattern: "*.o"},
+		{Action: Include, Pattern: "*.go"},
+		{Action: Exclude, Pattern: "+ weird"},
+		{Action: Exclude, Pattern: "- weird"},
+		{Action: Exclude, Pattern: "!"},
+		{Action: Clear},
+	} {
+		if got := ParseWire(r.Wire()); got != r {
+			t.Errorf("ParseWire(%q) = %+v, want %+v", r.Wire(), got, r)
+		}
+	}
+	if got, want := (Rule{Action: Exclude, Pattern: "*.o"}).Wire(), "*.o"; got != want {
+		t.Errorf("exclude rule: Wire() = %q, want %q", got, want)
+	}
+	// rsync sends --exclude=': foo' without prefix: there are no dir-merge
+	// rules on the wire before protocol 29.
+	for _, s := range []string{": foo", ": ../../../etc/x", ": a/b"} {
+		if got, want := ParseWire(s), (Rule{Action: Exclude, Pattern: s}); got != want {
+			t.Errorf("ParseWire(%q) = %+v, want %+v", s, got, want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	list := func(rules ...string) *List {
+		var l List
+		for _, s := range rules {
+			r, err := ParseRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Add(r)
+		}
+		return &l
+	}
+
+	for _, tt := range []struct {
+		rules []string
+		name  string
+		isDir bool
+		want  bool // excluded
+	}{
+		// * matches hidden files, in any directory:
+		{rules: []string{"- *"}, name: ".hidden", want: true},
+		{rules: []string{"- *"}, name: "dir/.hidden", want: true},
+		{rules: []string{"- .*"}, name: "dir/.hidden", want: true},
+		{rules: []string{"- .*"}, name: "visible", want: false},
+		{rules: []string{"- *~"}, name: ".hidden~", want: true},
+
+		// . and .. are never matched:
+		{rules: []string{"- *"}, name: ".", isDir: true, want: false},
+		{rules: []string{"- .*"}, name: ".", isDir: true, want: false},
+		{rules: []string{"- ."}, name: ".", isDir: true, want: false},
+		{rules: []string{"- .*"}, name: "..", isDir: true, want: false},
+		{rules: []string{"- .*"}, name: "dir/..", isDir: true, want: false},
+
+		// Patterns without slash match the final component only:
+		{rules: []string{"- foo"}, name: "a/b/foo", want: true},
+		{rules: []string{"- foo"}, name: "a/foo/b", want: false},
+
+		// Trailing slash only matches directories:
+		{rules: []string{"- .git/"}, name: "src/.git", isDir: true, want: true},
+		{rules: []string{"- .git/"}, name: "src/.git", want: false},
+
+		// Leading slash anchors to the root of the transfer:
+		{rules: []string{"- /foo"}, name: "foo", want: true},
+		{rules: []string{"- /foo"}, name: "sub/foo", want: false},
+		{rules: []string{"- /sub/.hidden"}, name: "sub/.hidden", want: true},
+
+		// Inner slashes match trailing components:
+		{rules: []string{"- b/foo"}, name: "a/b/foo", want: true},
+		{rules: []string{"- b/foo"}, name: "a/xb/foo", want: false},
+		{rules: []string{"- */.cache"}, name: "home/.cache", isDir: true, want: true},
+		{rules: []string{"- **/.cache"}, name: "a/b/.cache", isDir: true, want: true},
+		{rules: []string{"- a/**/x"}, name: "top/a/b/c/x", want: true},
+
+		// dir/*** matches the directory and its contents:
+		{rules: []string{"- .config/***"}, name: ".config", isDir: true, want: true},
+		{rules: []string{"- .config/***"}, name: ".config/a/b", want: true},
+		{rules: []string{"- .config/***"}, name: ".config", want: false},
+
+		// The first matching rule wins:
+		{rules: []string{"+ .keep", "- .*"}, name: "dir/.keep", want: false},
+		{rules: []string{"+ .keep", "- .*"}, name: "dir/.other", want: true},
+		{rules: []string{"- .*", "+ .keep"}, name: "dir/.keep", want: true},
+		{rules: []string{"- .*", "!", "+ .keep"}, name: "dir/.other", want: false},
+	} {
+		l := list(tt.rules...)
+		if got := l.Excluded(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("%q: Excluded(%q, isDir=%v) = %v, want %v", tt.rules, tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestReadRules(t *testing.T) {
+	const file = `# comment
+; another comment
+
+- /secret/
++ *.go
+exclude_*.o
+`
+	got, err := ReadRules(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Action: Exclude, Pattern: "/secret/"},
+		{Action: Include, Pattern: "*.go"},
+		{Action: Exclude, Pattern: "*.o"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ReadRules = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rule %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := ReadRules(strings.NewReader("- ok\nbogus\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("ReadRules(invalid) = %v, want error mentioning line 2", err)
+	}
+}
+
+func TestScope(t *testing.T) {
+	root := t.TempDir()
+	for fn, content := range map[string]string{
+		"a/.filter":       "- *.o\n- /top\n",
+		"a/sub/.filter":   "+ keep.o\n",
+		"b/.filter":       "- *.txt\n",
+		"b/clear/.filter": "!\n- *.go\n",
+	} {
+		fn = filepath.Join(root, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var l List
+	for _, s := range []string{": .filter", "- *.log"} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Add(r)
+	}
+	s := NewScope(&l)
+
+	// Entries in the order of a directory walk. Directories are entered
+	// after being checked.
+	for _, tt := range []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{name: ".", isDir: true, want: false},
+		{name: "a", isDir: true, want: false},
+		{name: "a/x.o", want: true},
+		{name: "a/x.txt", want: false},
+		{name: "a/x.log", want: true},
+		{name: "a/top", want: true},
+		{name: "a/sub", isDir: true, want: false},
+		{name: "a/sub/keep.o", want: false},
+		{name: "a/sub/y.o", want: true},
+		{name: "a/sub/top", want: false}, // anchored to a/
+		{name: "b", isDir: true, want: false},
+		{name: "b/clear", isDir: true, want: false},
+		{name: "b/clear/x.go", want: true},
+		{name: "b/clear/x.txt", want: false}, // inheritance cleared
+		{name: "b/x.o", want: false},         // a/.filter out of scope
+		{name: "b/x.txt", want: true},
+		{name: "top.o", want: false},
+		{name: "top.txt", want: false},
+	} {
+		if got := s.Excluded(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.isDir {
+			if err := s.Enter(tt.name, filepath.Join(root, tt.name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReceiverScope(t *testing.T) {
+	root := t.TempDir()
+	for fn, content := range map[string]string{
+		"a/.filter":   "P *.bak\nH *.tmp\n",
+		"a/b/.filter": "P *.keep\n",
+	} {
+		fn = filepath.Join(root, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var l List
+	r, err := ParseRule(": .filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add(r)
+	s := NewReceiverScope(&l)
+
+	// The receiver visits directories in file list order, in which a
+	// sibling (a.d) can be visited between a directory and its children.
+	for _, tt := range []struct {
+		enter string
+		name  string
+		want  bool
+	}{
+		{enter: "a", name: "a/x.bak", want: true},
+		{enter: "a", name: "a/x.tmp", want: false}, // hide rules do not apply
+		{enter: "a.d", name: "a.d/x.bak", want: false},
+		{enter: "a/b", name: "a/b/x.bak", want: true}, // inherited from a/
+		{enter: "a/b", name: "a/b/x.keep", want: true},
+		{enter: "c", name: "c/x.bak", want: false},
+	} {
+		if err := s.Enter(tt.enter, filepath.Join(root, tt.enter)); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Excluded(tt.name, false); got != tt.want {
+			t.Errorf("Excluded(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScopeSymlink(t *testing.T) {
+	root := t.TempDir()
+	secret := filepath.Join(root, "secret")
+	if err := os.WriteFile(secret, []byte("- *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, ".filter")); err != nil {
+		t.Fatal(err)
+	}
+
+	var l List
+	r, err := ParseRule(": .filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add(r)
+	s := NewScope(&l)
+	// The per-directory file must not be read through a symlink.
+	if err := s.Enter(".", dir); err == nil {
+		t.Fatal("Enter unexpectedly read a symlinked per-directory file")
+	}
+	if s.Excluded("file", false) {
+		t.Errorf("rules of the symlink target unexpectedly applied")
+	}
+}
+
+func TestSides(t *testing.T) {
+	var l List
+	for _, s := range []string{"P keep", "H keep", "S *.go", "R *.go", "- *"} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Add(r)
+	}
+	for _, tt := range []struct {
+		name         string
+		wantSender   bool
+		wantReceiver bool
+	}{
+		{name: "keep", wantSender: true, wantReceiver: true},
+		{name: "main.go", wantSender: false, wantReceiver: false},
+		{name: "other", wantSender: true, wantReceiver: true},
+	} {
+		if got := l.Sender().Excluded(tt.name, false); got != tt.wantSender {
+			t.Errorf("Sender().Excluded(%q) = %v, want %v", tt.name, got, tt.wantSender)
+		}
+		if got := l.Receiver().Excluded(tt.name, false); got != tt.wantReceiver {
+			t.Errorf("Receiver().Excluded(%q) = %v, want %v", tt.name, got, tt.wantReceiver)
+		}
+	}
+	var wire []string
+	for _, r := range l.Sender().Rules() {
+		wire = append(wire, r.Wire())
+	}
+	if got, want := strings.Join(wire, "|"), "keep|+ *.go|*"; got != want {
+		t.Errorf("sender rules on the wire: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,231 @@
+package rsyncfilter
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	wmAbortToStarStar = -2
+	wmAbortAll        = -1
+	wmNoMatch         = 0
+	wmMatch           = 1
+)
+
+// wildmatch reports whether text matches the shell-style pattern: ? matches
+// any character but a slash, * matches any number of characters but slashes,
+// ** matches any number of characters including slashes, [...] matches a
+// character class and a backslash quotes the next character. Unlike shell
+// globbing, a leading dot does not need to be matched explicitly.
+//
+// rsync/lib/wildmatch.c:wildmatch
+func wildmatch(pattern, text string) bool {
+	return dowild(pattern, text) == wmMatch
+}
+
+// rsync/lib/wildmatch.c:dowild
+func dowild(p, text string) int {
+	for ; len(p) > 0; p, text = p[1:], text[1:] {
+		pCh := p[0]
+		if len(text) == 0 && pCh != '*' {
+			return wmAbortAll
+		}
+		var tCh byte
+		if len(text) > 0 {
+			tCh = text[0]
+		}
+		switch pCh {
+		case '\\':
+			// Literal match with the following character.
+			p = p[1:]
+			if len(p) == 0 || tCh != p[0] {
+				return wmNoMatch
+			}
+
+		default:
+			if tCh != pCh {
+				return wmNoMatch
+			}
+
+		case '?':
+			// Match anything but '/'.
+			if tCh == '/' {
+				return wmNoMatch
+			}
+
+		case '*':
+			special := false
+			p = p[1:]
+			if len(p) > 0 && p[0] == '*' {
+				for len(p) > 0 && p[0] == '*' {
+					p = p[1:]
+				}
+				special = true
+			}
+			if len(p) == 0 {
+				// Trailing ** matches everything. Trailing * matches only if
+				// there are no more slash characters.
+				if !special {
+					for i := 0; i < len(text); i++ {
+						if text[i] == '/' {
+							return wmNoMatch
+						}
+					}
+				}
+				return wmMatch
+			}
+			for ; len(text) > 0; text = text[1:] {
+				matched := dowild(p, text)
+				if matched != wmNoMatch {
+					if !special || matched != wmAbortToStarStar {
+						return matched
+					}
+				} else if !special && text[0] == '/' {
+					return wmAbortToStarStar
+				}
+			}
+			return wmAbortAll
+
+		case '[':
+			var matched int
+			p, matched = matchClass(p[1:], tCh)
+			if matched != wmMatch {
+				return matched
+			}
+		}
+	}
+	if len(text) == 0 {
+		return wmMatch
+	}
+	return wmNoMatch
+}
+
+// matchClass matches tCh against the character class at the beginning of p
+// (just after the opening bracket). It returns the pattern starting at the
+// closing bracket.
+func matchClass(p string, tCh byte) (string, int) {
+	if len(p) == 0 {
+		return "", wmAbortAll
+	}
+	negated := false
+	if p[0] == '!' || p[0] == '^' {
+		negated = true
+		p = p[1:]
+	}
+	matched := false
+	var prevCh byte
+	for first := true; first || len(p) > 0 && p[0] != ']'; first = false {
+		if len(p) == 0 {
+			return "", wmAbortAll
+		}
+		pCh := p[0]
+		switch {
+		case pCh == '\\':
+			p = p[1:]
+			if len(p) == 0 {
+				return "", wmAbortAll
+			}
+			pCh = p[0]
+			if tCh == pCh {
+				matched = true
+			}
+
+		case pCh == '-' && prevCh != 0 && len(p) > 1 && p[1] != ']':
+			p = p[1:]
+			pCh = p[0]
+			if pCh == '\\' {
+				p = p[1:]
+				if len(p) == 0 {
+					return "", wmAbortAll
+				}
+				pCh = p[0]
+			}
+			if tCh <= pCh && tCh >= prevCh {
+				matched = true
+			}
+			pCh = 0 // the end of a range cannot start another range
+
+		case pCh == '[' && len(p) > 1 && p[1] == ':':
+			end := indexClassEnd(p[2:])
+			if end == -1 {
+				// Not a character class name, treat as a literal '['.
+				if tCh == '[' {
+					matched = true
+				}
+				break
+			}
+			name := p[2 : 2+end]
+			ok, known := matchNamedClass(name, tCh)
+			if !known {
+				return "", wmAbortAll // malformed [:class:] string
+			}
+			if ok {
+				matched = true
+			}
+			p = p[2+end+1:] // positioned at the closing ']' of [:class:]
+			pCh = 0
+
+		default:
+			if tCh == pCh {
+				matched = true
+			}
+		}
+		prevCh = pCh
+		p = p[1:]
+	}
+	if len(p) == 0 {
+		return "", wmAbortAll
+	}
+	if matched == negated || tCh == '/' {
+		return p, wmNoMatch
+	}
+	return p, wmMatch
+}
+
+// indexClassEnd returns the index of the “:]” terminating a character class
+// name, or -1.
+func indexClassEnd(p string) int {
+	for i := 0; i+1 < len(p); i++ {
+		if p[i] == ']' {
+			return -1
+		}
+		if p[i] == ':' && p[i+1] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+func matchNamedClass(name string, ch byte) (ok, known bool) {
+	r := rune(ch)
+	if ch >= utf8.RuneSelf {
+		r = -1 // like in the C locale, only ASCII characters are classified
+	}
+	switch name {
+	case "alnum":
+		return unicode.IsLetter(r) || unicode.IsDigit(r), true
+	case "alpha":
+		return unicode.IsLetter(r), true
+	case "blank":
+		return ch == ' ' || ch == '\t', true
+	case "cntrl":
+		return unicode.IsControl(r), true
+	case "digit":
+		return '0' <= ch && ch <= '9', true
+	case "graph":
+		return unicode.IsGraphic(r) && ch != ' ', true
+	case "lower":
+		return unicode.IsLower(r), true
+	case "print":
+		return unicode.IsPrint(r), true
+	case "punct":
+		return unicode.IsPunct(r) || unicode.IsSymbol(r), true
+	case "space":
+		return unicode.IsSpace(r), true
+	case "upper":
+		return unicode.IsUpper(r), true
+	case "xdigit":
+		return ('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F'), true
+	}
+	return false, false
+}
@@ -27,8 +27,9 @@ import (
 
 type TestServer struct {
 	// config
-	listener  net.Listener
-	listeners []rsyncdconfig.Listener
+	listener   net.Listener
+	listeners  []rsyncdconfig.Listener
+	serverOpts []rsyncd.Option
 
 	// Port is the port on which the test server is listening on. Useful to pass
 	// to rsync’s --port option.
@@ -60,7 +61,14 @@ func Listener(ln net.Listener) Option {
 	}
 }
 
-func New(t *testing.T, modules []rsyncd.Module, opts ...Option) *TestServer {
+// ServerOptions specifies options for the rsyncd.Server of the test server.
+func ServerOptions(opts ...rsyncd.Option) Option {
+	return func(ts *TestServer) {
+		ts.serverOpts = opts
+	}
+}
+
+func New(t testing.TB, modules []rsyncd.Module, opts ...Option) *TestServer {
 	ts := &TestServer{}
 	for _, opt := range opts {
 		opt(ts)
@@ -70,7 +78,7 @@ func New(t *testing.T, modules []rsyncd.Module, opts ...Option) *TestServer {
 			{Rsyncd: "localhost:0"},
 		}
 	}
-	srv, err := rsyncd.NewServer(modules)
+	srv, err := rsyncd.NewServer(modules, ts.serverOpts...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,85 @@
+package rsynctoken
+
+import (
+	"compress/flate"
+	"fmt"
+	"math"
+
+	"github.com/gokrazy/rsync"
+)
+
+// LevelNotSpecified is the --compress-level default, meaning the default level
+// of the compression algorithm.
+//
+// rsync/rsync.h:CLVL_NOT_SPECIFIED
+const LevelNotSpecified = math.MinInt32
+
+// algorithm describes the compression levels accepted for a --compress-choice
+// algorithm.
+type algorithm struct {
+	min, max  int
+	def       int
+	off       int  // level which turns off compression
+	hasOff    bool // whether off is meaningful
+	supported bool // whether the algorithm can be used with our protocol
+}
+
+// algorithms are the compression algorithms known to rsync. Only zlib is
+// supported: the others require protocol 31 negotiation (--compress-choice),
+// but we speak protocol 27.
+//
+// rsync/token.c:init_compression_level
+var algorithms = map[string]algorithm{
+	"zlib": {
+		min:       flate.BestSpeed,
+		max:       flate.BestCompression,
+		def:       6,
+		off:       flate.NoCompression,
+		hasOff:    true,
+		supported: true,
+	},
+	"zstd": {
+		min: -131072, // ZSTD_minCLevel()
+		max: 22,      // ZSTD_maxCLevel()
+		def: 3,
+	},
+	"lz4": {}, // lz4 has no levels
+}
+
+// Level validates the --compress-level requested for the --compress-choice
+// algorithm (empty means zlib) and returns the level to use. Unlike rsync,
+// which silently clamps out-of-range levels, Level returns an error for levels
+// outside the algorithm’s range:
+//
+//   - zlib: 1 (fastest) to 9 (best), -1 for the default (6); 0 turns off
+//     compression, in which case Level returns ok == false.
+//   - zstd: -131072 to 22, default 3; not supported (protocol 27).
+//   - lz4: only 0, the default; not supported (protocol 27).
+//
+// LevelNotSpecified selects the default level of the algorithm.
+func Level(choice string, level int) (_ int, ok bool, _ error) {
+	if choice == "" {
+		choice = "zlib"
+	}
+	alg, known := algorithms[choice]
+	if !known {
+		return 0, false, fmt.Errorf("unknown compression algorithm %q (known: zlib, zstd, lz4)", choice)
+	}
+	switch {
+	case level == LevelNotSpecified:
+		level = alg.def
+	case choice == "zlib" && level == flate.DefaultCompression:
+		level = alg.def
+	case alg.hasOff && level == alg.off:
+		return 0, false, nil
+	case level < alg.min || level > alg.max:
+		if alg.min == alg.max {
+			return 0, false, fmt.Errorf("--compress-level=%d is invalid for %s, which does not support compression levels", level, choice)
+		}
+		return 0, false, fmt.Errorf("--compress-level=%d is out of range for %s (%d to %d)", level, choice, alg.min, alg.max)
+	}
+	if !alg.supported {
+		return 0, false, fmt.Errorf("compression algorithm %s is not supported: only zlib is available in protocol %d", choice, rsync.ProtocolVersion)
+	}
+	return level, true, nil
+}
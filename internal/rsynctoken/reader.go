@@ -0,0 +1,233 @@
+package rsynctoken
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+type recvState int
+
+const (
+	stateIdle      recvState = iota // expecting a flag byte
+	stateInflating                  // returning data of a data run
+	stateRunning                    // returning the tokens of a token run
+)
+
+// Reader receives a compressed token stream, as sent by Writer (or rsync).
+//
+// rsync/token.c:recv_deflated_token
+type Reader struct {
+	conn *rsyncwire.Conn
+
+	state     recvState
+	savedFlag int // flag byte read while inflating, or -1
+	rxToken   int32
+	rxRun     int32
+
+	fr   io.ReadCloser // decompressor, reset for each data run
+	in   runReader
+	buf  []byte
+	hist history
+
+	// Compressed and Uncompressed count the bytes of all data runs received
+	// so far, as transferred (excluding the chunk headers) and after
+	// decompression, respectively.
+	Compressed   int64
+	Uncompressed int64
+}
+
+// NewReader returns a Reader which receives from conn.
+func NewReader(conn *rsyncwire.Conn) *Reader {
+	r := &Reader{
+		conn:      conn,
+		savedFlag: -1,
+		buf:       make([]byte, 32*1024),
+	}
+	r.in.r = r
+	return r
+}
+
+// Recv returns the next token of the current file with the same semantics as
+// the uncompressed protocol: a positive token is the length of the returned
+// (uncompressed) data, a negative token -(i+1) refers to block i, and token 0
+// marks the end of the file. The returned data is only valid until the next
+// call of Recv.
+//
+// For each block token, the caller must pass the block’s data to See.
+func (r *Reader) Recv() (int32, []byte, error) {
+	for {
+		switch r.state {
+		case stateInflating:
+			n, err := r.fr.Read(r.buf)
+			if n > 0 {
+				r.hist.add(r.buf[:n])
+				r.Uncompressed += int64(n)
+				return int32(n), r.buf[:n], nil
+			}
+			if err == nil {
+				continue
+			}
+			if r.in.done && (err == io.ErrUnexpectedEOF || err == io.EOF) {
+				// The decompressor ran out of input after the end of the
+				// data run, i.e. all data of the run has been returned.
+				r.state = stateIdle
+				continue
+			}
+			return 0, nil, fmt.Errorf("inflate: %v", err)
+
+		case stateRunning:
+			r.rxToken++
+			r.rxRun--
+			if r.rxRun == 0 {
+				r.state = stateIdle
+			}
+			return -1 - r.rxToken, nil, nil
+		}
+
+		flag, err := r.readFlag()
+		if err != nil {
+			return 0, nil, err
+		}
+		if flag&0xc0 == deflatedData {
+			if err := r.in.start(flag); err != nil {
+				return 0, nil, err
+			}
+			if r.fr == nil {
+				r.fr = flate.NewReaderDict(&r.in, r.hist)
+			} else if err := r.fr.(flate.Resetter).Reset(&r.in, r.hist); err != nil {
+				return 0, nil, err
+			}
+			r.state = stateInflating
+			continue
+		}
+
+		if flag == endFlag {
+			// that’s all folks: prepare for the next file
+			r.rxToken = 0
+			r.hist = r.hist[:0]
+			return 0, nil, nil
+		}
+
+		// here we have a token of some kind
+		if flag&tokenRel != 0 {
+			r.rxToken += int32(flag & 0x3f)
+			flag >>= 6
+		} else {
+			r.rxToken, err = r.conn.ReadInt32()
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if flag&1 != 0 {
+			lo, err := r.conn.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			hi, err := r.conn.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			r.rxRun = int32(lo) | int32(hi)<<8
+			if r.rxRun > 0 {
+				r.state = stateRunning
+			}
+		}
+		return -1 - r.rxToken, nil, nil
+	}
+}
+
+// See adds the data of a matched block to the decompressor’s history.
+//
+// rsync/token.c:see_deflate_token
+func (r *Reader) See(block []byte) {
+	r.hist.addBlock(block)
+}
+
+func (r *Reader) readFlag() (int, error) {
+	if r.savedFlag != -1 {
+		flag := r.savedFlag
+		r.savedFlag = -1
+		return flag, nil
+	}
+	b, err := r.conn.ReadByte()
+	return int(b), err
+}
+
+// runReader provides the compressed data of a data run (a sequence of
+// DEFLATED_DATA chunks) to the decompressor, followed by the sync marker which
+// the sender stripped. It implements io.ByteReader so that the decompressor
+// does not read ahead.
+type runReader struct {
+	r     *Reader
+	chunk []byte
+	done  bool // all data (including the sync marker) was returned
+	final bool // chunk holds the sync marker
+}
+
+func (rr *runReader) start(flag int) error {
+	rr.done = false
+	rr.final = false
+	return rr.readChunk(flag)
+}
+
+func (rr *runReader) readChunk(flag int) error {
+	lo, err := rr.r.conn.ReadByte()
+	if err != nil {
+		return err
+	}
+	n := (flag&0x3f)<<8 | int(lo)
+	rr.r.Compressed += int64(n)
+	if cap(rr.chunk) < n {
+		rr.chunk = make([]byte, n)
+	}
+	rr.chunk = rr.chunk[:n]
+	_, err = io.ReadFull(rr.r.conn.Reader, rr.chunk)
+	return err
+}
+
+// fill ensures that rr.chunk is non-empty, reading the next chunk (or
+// switching to the sync marker) if required.
+func (rr *runReader) fill() error {
+	for len(rr.chunk) == 0 {
+		if rr.final {
+			rr.done = true
+			return io.EOF
+		}
+		flag, err := rr.r.conn.ReadByte()
+		if err != nil {
+			return err
+		}
+		if flag&0xc0 == deflatedData {
+			if err := rr.readChunk(int(flag)); err != nil {
+				return err
+			}
+			continue
+		}
+		// End of the data run: keep the flag for Recv.
+		rr.r.savedFlag = int(flag)
+		rr.chunk = append(rr.chunk[:0], syncMarker...)
+		rr.final = true
+	}
+	return nil
+}
+
+func (rr *runReader) ReadByte() (byte, error) {
+	if err := rr.fill(); err != nil {
+		return 0, err
+	}
+	b := rr.chunk[0]
+	rr.chunk = rr.chunk[1:]
+	return b, nil
+}
+
+func (rr *runReader) Read(p []byte) (int, error) {
+	if err := rr.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, rr.chunk)
+	rr.chunk = rr.chunk[n:]
+	return n, nil
+}
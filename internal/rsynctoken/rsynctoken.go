@@ -0,0 +1,59 @@
+// Package rsynctoken implements rsync’s compressed token stream (-z), in which
+// file data is transmitted as a zlib (raw deflate) stream and matched blocks
+// are encoded as (runs of) block indices.
+//
+// Both sides feed the data of matched blocks into the deflate history so that
+// subsequent data can refer to it. rsync does this with a patched zlib
+// (Z_INSERT_ONLY); we instead track the history and start each run of data
+// with a preset dictionary, which results in the same stream semantics.
+package rsynctoken
+
+// rsync/token.c
+const (
+	endFlag      = 0     // that's all folks
+	tokenLong    = 0x20  // followed by 32-bit token number
+	tokenrunLong = 0x21  // ditto with 16-bit run count
+	deflatedData = 0x40  // + 6-bit high len, then low len byte
+	tokenRel     = 0x80  // + 6-bit relative token number
+	tokenrunRel  = 0xc0  // ditto with 16-bit run count
+	maxDataCount = 16383 // fit 14 bit count into 2 bytes with flags
+)
+
+// windowSize is the maximum distance of deflate back-references, i.e. how
+// much history needs to be tracked.
+const windowSize = 32 * 1024
+
+// syncMarker is the end of the empty stored block which a zlib Z_SYNC_FLUSH
+// emits. rsync strips it from the stream and the receiver re-adds it.
+var syncMarker = []byte{0, 0, 0xff, 0xff}
+
+// history is the sliding window of uncompressed data that deflate
+// back-references can refer to.
+type history []byte
+
+func (h *history) add(p []byte) {
+	if len(p) >= windowSize {
+		*h = append((*h)[:0], p[len(p)-windowSize:]...)
+		return
+	}
+	if keep := windowSize - len(p); len(*h) > keep {
+		*h = append((*h)[:0], (*h)[len(*h)-keep:]...)
+	}
+	*h = append(*h, p...)
+}
+
+// addBlock adds the data of a matched block. Like rsync with protocol versions
+// before 31 (which fixed a data-duplicating bug), blocks longer than 0xffff
+// bytes are added in pieces which all start at the beginning of the block.
+//
+// rsync/token.c:see_deflate_token
+func (h *history) addBlock(block []byte) {
+	for toklen := len(block); toklen > 0; {
+		n1 := toklen
+		if n1 > 0xffff {
+			n1 = 0xffff
+		}
+		toklen -= n1
+		h.add(block[:n1])
+	}
+}
@@ -0,0 +1,150 @@
+package rsynctoken
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+// op is either literal data or a block token.
+type op struct {
+	data  []byte
+	token int32 // only if data == nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abcdefgh"[rnd.Intn(8)]
+		}
+		return b
+	}
+
+	// blocks are the data of the receiver’s existing file.
+	blocks := [][]byte{
+		text(700),
+		text(700),
+		text(700),
+		text(100000), // longer than 0xffff bytes
+	}
+	for i := 4; i < 200; i++ {
+		blocks = append(blocks, text(10))
+	}
+	files := [][]op{
+		// data only, larger than maxDataCount when compressed
+		{{data: text(200000)}},
+		// no data at all
+		{},
+		// a run of consecutive tokens, data referring to the block history
+		{{token: 0}, {token: 1}, {token: 2}, {data: blocks[1][:300]}, {token: 3}, {data: text(5000)}},
+		// tokens requiring TOKEN_LONG and run lengths
+		{{data: text(10)}, {token: 150}, {token: 151}, {token: 5}, {token: 199}, {data: blocks[199]}},
+		// data split into multiple writes (like rsync’s token -2)
+		{{data: text(40000)}, {data: text(40000)}, {token: 7}},
+	}
+
+	var wire bytes.Buffer
+	w := NewWriter(&rsyncwire.Conn{Writer: &wire}, flate.DefaultCompression)
+	for _, ops := range files {
+		for _, o := range ops {
+			if o.data != nil {
+				if _, err := w.Write(o.data); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if err := w.Token(o.token, blocks[o.token]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.End(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(&rsyncwire.Conn{Reader: &wire})
+	for idx, ops := range files {
+		var want, got []byte
+		var wantTokens, gotTokens []int32
+		for _, o := range ops {
+			if o.data != nil {
+				want = append(want, o.data...)
+			} else {
+				wantTokens = append(wantTokens, o.token)
+				want = append(want, blocks[o.token]...)
+			}
+		}
+		for {
+			token, data, err := r.Recv()
+			if err != nil {
+				t.Fatalf("file %d: %v", idx, err)
+			}
+			if token == 0 {
+				break
+			}
+			if token > 0 {
+				got = append(got, data...)
+				continue
+			}
+			i := -(token + 1)
+			gotTokens = append(gotTokens, i)
+			r.See(blocks[i])
+			got = append(got, blocks[i]...)
+		}
+		if diff := cmp.Diff(wantTokens, gotTokens); diff != "" {
+			t.Errorf("file %d: unexpected tokens: diff (-want +got):\n%s", idx, diff)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("file %d: received data (%d bytes) differs from sent data (%d bytes)", idx, len(got), len(want))
+		}
+	}
+	if wire.Len() > 0 {
+		t.Errorf("%d bytes left unread", wire.Len())
+	}
+}
+
+func TestLevel(t *testing.T) {
+	for _, tt := range []struct {
+		choice  string
+		level   int
+		want    int
+		wantOk  bool
+		wantErr string
+	}{
+		{choice: "", level: LevelNotSpecified, want: 6, wantOk: true},
+		{choice: "zlib", level: -1, want: 6, wantOk: true},
+		{choice: "zlib", level: 1, want: 1, wantOk: true},
+		{choice: "zlib", level: 9, want: 9, wantOk: true},
+		{choice: "zlib", level: 0, wantOk: false},
+		{choice: "zlib", level: 10, wantErr: "out of range for zlib (1 to 9)"},
+		{choice: "zlib", level: -2, wantErr: "out of range for zlib (1 to 9)"},
+		{choice: "zstd", level: 23, wantErr: "out of range for zstd (-131072 to 22)"},
+		{choice: "zstd", level: 3, wantErr: "zstd is not supported"},
+		{choice: "zstd", level: LevelNotSpecified, wantErr: "zstd is not supported"},
+		{choice: "lz4", level: 1, wantErr: "lz4, which does not support compression levels"},
+		{choice: "lz4", level: LevelNotSpecified, wantErr: "lz4 is not supported"},
+		{choice: "brotli", level: 1, wantErr: "unknown compression algorithm"},
+	} {
+		got, ok, err := Level(tt.choice, tt.level)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Level(%q, %d): err = %v, want error containing %q", tt.choice, tt.level, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Level(%q, %d): %v", tt.choice, tt.level, err)
+			continue
+		}
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("Level(%q, %d) = %d, %v, want %d, %v", tt.choice, tt.level, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
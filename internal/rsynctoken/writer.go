@@ -0,0 +1,171 @@
+package rsynctoken
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// Writer sends a file’s data and matched block tokens as a compressed token
+// stream. For each file, call Write for literal data and Token for matched
+// blocks in file order, followed by End.
+//
+// rsync/token.c:send_deflated_token
+type Writer struct {
+	conn  *rsyncwire.Conn
+	level int
+
+	// run-length encoding of consecutive tokens
+	haveRun    bool
+	runStart   int32
+	lastToken  int32
+	lastRunEnd int32
+
+	fw   *flate.Writer // compressor of the current data run, if any
+	out  bytes.Buffer  // compressed data not yet sent
+	hist history
+}
+
+// NewWriter returns a Writer which sends to conn, compressing with the
+// specified compress/flate level.
+func NewWriter(conn *rsyncwire.Conn, level int) *Writer {
+	return &Writer{conn: conn, level: level}
+}
+
+// Write compresses and sends literal file data.
+func (w *Writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.haveRun {
+		// Data follows, so the current run of tokens is complete.
+		if err := w.sendRun(); err != nil {
+			return 0, err
+		}
+	}
+	if w.fw == nil {
+		var err error
+		w.fw, err = flate.NewWriterDict(&w.out, w.level, w.hist)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.fw.Write(p); err != nil {
+		return 0, err
+	}
+	w.hist.add(p)
+	// Send full chunks, but always keep the last bytes of the stream, which
+	// need to be trimmed once the data run is flushed.
+	for w.out.Len() > maxDataCount+len(syncMarker) {
+		if err := w.sendData(w.out.Next(maxDataCount)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Token sends a token for the matched block with index token, whose data is
+// block.
+func (w *Writer) Token(token int32, block []byte) error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.haveRun && (token != w.lastToken+1 || token >= w.runStart+65536) {
+		if err := w.sendRun(); err != nil {
+			return err
+		}
+	}
+	if !w.haveRun {
+		w.haveRun = true
+		w.runStart = token
+	}
+	w.lastToken = token
+	w.hist.addBlock(block)
+	return nil
+}
+
+// End completes the file, after which the Writer can be used for the next
+// file.
+func (w *Writer) End() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.haveRun {
+		if err := w.sendRun(); err != nil {
+			return err
+		}
+	}
+	if err := w.conn.WriteByte(endFlag); err != nil {
+		return err
+	}
+	w.lastRunEnd = 0
+	w.hist = w.hist[:0]
+	return nil
+}
+
+// flush completes the current data run (if any) with a sync flush, whose
+// trailing empty stored block marker is not transmitted.
+func (w *Writer) flush() error {
+	if w.fw == nil {
+		return nil
+	}
+	if err := w.fw.Flush(); err != nil {
+		return err
+	}
+	w.fw = nil
+	b := w.out.Bytes()
+	if !bytes.HasSuffix(b, syncMarker) {
+		return fmt.Errorf("BUG: deflate sync flush did not end in %x", syncMarker)
+	}
+	b = b[:len(b)-len(syncMarker)]
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxDataCount {
+			n = maxDataCount
+		}
+		if err := w.sendData(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	w.out.Reset()
+	return nil
+}
+
+func (w *Writer) sendData(b []byte) error {
+	var buf rsyncwire.Buffer
+	buf.WriteByte(byte(deflatedData + (len(b) >> 8)))
+	buf.WriteByte(byte(len(b)))
+	buf.WriteString(string(b))
+	return w.conn.WriteString(buf.String())
+}
+
+// sendRun sends the current run of consecutive tokens.
+func (w *Writer) sendRun() error {
+	var buf rsyncwire.Buffer
+	r := w.runStart - w.lastRunEnd
+	n := w.lastToken - w.runStart
+	if r >= 0 && r <= 63 {
+		if n == 0 {
+			buf.WriteByte(byte(tokenRel + r))
+		} else {
+			buf.WriteByte(byte(tokenrunRel + r))
+		}
+	} else {
+		if n == 0 {
+			buf.WriteByte(tokenLong)
+		} else {
+			buf.WriteByte(tokenrunLong)
+		}
+		buf.WriteInt32(w.runStart)
+	}
+	if n != 0 {
+		buf.WriteByte(byte(n))
+		buf.WriteByte(byte(n >> 8))
+	}
+	w.lastRunEnd = w.lastToken
+	w.haveRun = false
+	return w.conn.WriteString(buf.String())
+}
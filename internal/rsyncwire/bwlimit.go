@@ -0,0 +1,119 @@
+package rsyncwire
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Rate is a bandwidth limit in KiB per second which can be changed while
+// transfers are running. The zero value means unlimited.
+type Rate struct {
+	kib int64
+}
+
+// Set changes the limit to kib KiB per second. 0 means unlimited.
+func (r *Rate) Set(kib int) {
+	atomic.StoreInt64(&r.kib, int64(kib))
+}
+
+// Get returns the current limit in KiB per second.
+func (r *Rate) Get() int {
+	return int(atomic.LoadInt64(&r.kib))
+}
+
+// BwLimitWriter limits the rate at which data is written to Writer to Limit
+// KiB per second. Because the accounting happens on the bytes passed to
+// Writer, wrap the underlying connection (i.e. below compression and
+// multiplexing) to limit the on-wire rate.
+//
+// If Rate is non-nil, the lower of Limit and Rate applies. Changes of Rate
+// take effect while a Write is in progress.
+//
+// If Idle is non-nil, its timeout is paused while sleeping.
+//
+// rsync/io.c:sleep_for_bwlimit
+type BwLimitWriter struct {
+	Writer io.Writer
+	Limit  int   // KiB/s, 0 means unlimited
+	Rate   *Rate // optional, adjustable limit
+	Idle   *IdleTimeout
+
+	prior        time.Time
+	totalWritten int64
+}
+
+// limit returns the effective limit in KiB/s, or 0 if unlimited.
+func (w *BwLimitWriter) limit() int {
+	limit := w.Limit
+	if w.Rate != nil {
+		if rate := w.Rate.Get(); rate > 0 && (limit <= 0 || rate < limit) {
+			limit = rate
+		}
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+func (w *BwLimitWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		limit := w.limit()
+		if limit == 0 {
+			// Unlimited: restart the accounting once a limit is set again.
+			w.prior = time.Time{}
+			w.totalWritten = 0
+			written, err := w.Writer.Write(p)
+			return n + written, err
+		}
+		// Write in small pieces so that the sleeps are spread evenly instead
+		// of bursting a large buffer at full speed.
+		//
+		// rsync/options.c:bwlimit_writemax
+		writeMax := limit * 128
+		if writeMax < 512 {
+			writeMax = 512
+		}
+		chunk := p
+		if len(chunk) > writeMax {
+			chunk = chunk[:writeMax]
+		}
+		written, err := w.Writer.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		if written == 0 {
+			return n, io.ErrShortWrite
+		}
+		w.sleep(limit, written)
+		p = p[written:]
+	}
+	return n, nil
+}
+
+func (w *BwLimitWriter) sleep(limit, written int) {
+	bytesPerSec := int64(limit) * 1024
+	w.totalWritten += int64(written)
+	start := time.Now()
+	if !w.prior.IsZero() {
+		elapsed := start.Sub(w.prior)
+		w.totalWritten -= int64(elapsed.Seconds() * float64(bytesPerSec))
+		if w.totalWritten < 0 {
+			w.totalWritten = 0
+		}
+	}
+	sleep := time.Duration(w.totalWritten * int64(time.Second) / bytesPerSec)
+	if sleep < time.Second/10 {
+		w.prior = start
+		return
+	}
+	if w.Idle != nil {
+		defer w.Idle.pause()()
+	}
+	time.Sleep(sleep)
+	w.prior = time.Now()
+	elapsed := w.prior.Sub(start)
+	w.totalWritten = int64((sleep - elapsed).Seconds() * float64(bytesPerSec))
+}
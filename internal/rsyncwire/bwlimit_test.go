@@ -0,0 +1,62 @@
+package rsyncwire
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBwLimitRateChange(t *testing.T) {
+	var rate Rate
+	rate.Set(100)
+	w := &BwLimitWriter{Writer: ioutil.Discard, Rate: &rate}
+
+	// throughput writes size bytes and returns the resulting KiB/s.
+	throughput := func(size int) float64 {
+		start := time.Now()
+		buf := make([]byte, 1024)
+		for written := 0; written < size; written += len(buf) {
+			if _, err := w.Write(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return float64(size) / 1024 / time.Since(start).Seconds()
+	}
+
+	slow := throughput(50 * 1024) // 0.5s at 100 KiB/s
+	rate.Set(1000)
+	fast := throughput(500 * 1024) // 0.5s at 1000 KiB/s
+	t.Logf("throughput at 100 KiB/s: %.0f KiB/s, at 1000 KiB/s: %.0f KiB/s", slow, fast)
+	if slow > 200 {
+		t.Errorf("throughput at a 100 KiB/s limit is %.0f KiB/s, want at most 200 KiB/s", slow)
+	}
+	if fast < 4*slow {
+		t.Errorf("throughput did not increase after raising the limit: %.0f KiB/s before, %.0f KiB/s after", slow, fast)
+	}
+
+	rate.Set(100)
+	if slow := throughput(50 * 1024); slow > 200 {
+		t.Errorf("throughput after lowering the limit is %.0f KiB/s, want at most 200 KiB/s", slow)
+	}
+}
+
+func TestBwLimitLowerLimitApplies(t *testing.T) {
+	var rate Rate
+	for _, tt := range []struct {
+		limit int
+		rate  int
+		want  int
+	}{
+		{limit: 0, rate: 0, want: 0},
+		{limit: 100, rate: 0, want: 100},
+		{limit: 0, rate: 100, want: 100},
+		{limit: 100, rate: 1000, want: 100},
+		{limit: 1000, rate: 100, want: 100},
+	} {
+		rate.Set(tt.rate)
+		w := &BwLimitWriter{Limit: tt.limit, Rate: &rate}
+		if got := w.limit(); got != tt.want {
+			t.Errorf("limit (Limit=%d, Rate=%d) = %d, want %d", tt.limit, tt.rate, got, tt.want)
+		}
+	}
+}
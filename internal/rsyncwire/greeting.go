@@ -0,0 +1,110 @@
+package rsyncwire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// greetingPrefix starts all lines of the daemon protocol which are not
+// messages for the user.
+const greetingPrefix = "@RSYNCD: "
+
+// Greeting is the version line which client and daemon send at the start of
+// a daemon connection, e.g. “@RSYNCD: 27”, or “@RSYNCD: 31.0 md5 md4” for
+// protocol 31 and newer, which add a sub-protocol version and the list of
+// supported checksum algorithms.
+//
+// rsync/clientserver.c:exchange_protocols
+type Greeting struct {
+	Protocol    int32
+	SubProtocol int32
+	Digests     []string
+}
+
+// ParseGreeting parses a greeting line (with or without the line terminator).
+func ParseGreeting(line string) (Greeting, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, greetingPrefix) {
+		return Greeting{}, fmt.Errorf("invalid greeting: got %q", line)
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, greetingPrefix))
+	if len(fields) == 0 {
+		return Greeting{}, fmt.Errorf("invalid greeting: got %q", line)
+	}
+	version, sub := fields[0], ""
+	if idx := strings.IndexByte(version, '.'); idx > -1 {
+		version, sub = version[:idx], version[idx+1:]
+	}
+	var g Greeting
+	protocol, err := strconv.ParseInt(version, 10, 32)
+	if err != nil || protocol <= 0 {
+		// e.g. @RSYNCD: EXIT, which is not valid in place of a greeting
+		return Greeting{}, fmt.Errorf("invalid protocol version in greeting %q", line)
+	}
+	g.Protocol = int32(protocol)
+	if sub != "" {
+		subProtocol, err := strconv.ParseInt(sub, 10, 32)
+		if err != nil || subProtocol < 0 {
+			return Greeting{}, fmt.Errorf("invalid sub-protocol version in greeting %q", line)
+		}
+		g.SubProtocol = int32(subProtocol)
+	}
+	if len(fields) > 1 {
+		g.Digests = fields[1:]
+	}
+	return g, nil
+}
+
+// String returns the greeting line (without the line terminator).
+func (g Greeting) String() string {
+	s := greetingPrefix + strconv.Itoa(int(g.Protocol))
+	if g.SubProtocol != 0 {
+		s += "." + strconv.Itoa(int(g.SubProtocol))
+	}
+	for _, d := range g.Digests {
+		s += " " + d
+	}
+	return s
+}
+
+// LineKind is the kind of a line which the daemon sends in response to a
+// module request.
+type LineKind int
+
+const (
+	LineMessage  LineKind = iota // message of the day or module listing
+	LineOK                       // @RSYNCD: OK, the transfer starts
+	LineAuthReqd                 // @RSYNCD: AUTHREQD <challenge>
+	LineExit                     // @RSYNCD: EXIT, after the module listing
+	LineError                    // @ERROR: <message>
+)
+
+// ParseDaemonLine classifies a line which the daemon sent in response to a
+// module request and returns its argument: the challenge for LineAuthReqd,
+// the message for LineError and the line itself for LineMessage.
+//
+// rsync/clientserver.c:start_inband_exchange
+func ParseDaemonLine(line string) (LineKind, string, error) {
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == greetingPrefix+"OK":
+		return LineOK, "", nil
+
+	case line == greetingPrefix+"EXIT":
+		return LineExit, "", nil
+
+	case strings.HasPrefix(line, greetingPrefix+"AUTHREQD"):
+		challenge := strings.TrimSpace(strings.TrimPrefix(line, greetingPrefix+"AUTHREQD"))
+		if challenge == "" {
+			return 0, "", fmt.Errorf("missing challenge in %q", line)
+		}
+		return LineAuthReqd, challenge, nil
+
+	case strings.HasPrefix(line, "@ERROR"):
+		msg := strings.TrimPrefix(line, "@ERROR")
+		msg = strings.TrimPrefix(msg, ":")
+		return LineError, strings.TrimSpace(msg), nil
+	}
+	return LineMessage, line, nil
+}
@@ -0,0 +1,105 @@
+package rsyncwire
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseGreeting(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		want    Greeting
+		wantErr bool
+	}{
+		{line: "@RSYNCD: 27\n", want: Greeting{Protocol: 27}},
+		{line: "@RSYNCD: 27", want: Greeting{Protocol: 27}},
+		{line: "@RSYNCD: 29\r\n", want: Greeting{Protocol: 29}},
+		{line: "@RSYNCD: 31.0\n", want: Greeting{Protocol: 31}},
+		{line: "@RSYNCD: 30.5\n", want: Greeting{Protocol: 30, SubProtocol: 5}},
+		{
+			line: "@RSYNCD: 31.0 sha512 sha256 sha1 md5 md4\n",
+			want: Greeting{
+				Protocol: 31,
+				Digests:  []string{"sha512", "sha256", "sha1", "md5", "md4"},
+			},
+		},
+		{line: "@RSYNCD: \n", wantErr: true},
+		{line: "@RSYNCD: EXIT\n", wantErr: true},
+		{line: "@RSYNCD: AUTHREQD abc\n", wantErr: true},
+		{line: "@RSYNCD: 31.x\n", wantErr: true},
+		{line: "@RSYNCD: .0\n", wantErr: true},
+		{line: "@RSYNCD: -1\n", wantErr: true},
+		{line: "RSYNCD: 27\n", wantErr: true},
+		{line: "@ERROR: protocol startup error\n", wantErr: true},
+	} {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseGreeting(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseGreeting(%q) = %+v, want error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseGreeting(%q): unexpected result: diff (-want +got):\n%s", tt.line, diff)
+			}
+		})
+	}
+}
+
+func TestGreetingString(t *testing.T) {
+	for _, g := range []Greeting{
+		{Protocol: 27},
+		{Protocol: 30, SubProtocol: 5},
+		{Protocol: 31, Digests: []string{"md5", "md4"}},
+	} {
+		got, err := ParseGreeting(g.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(g, got); diff != "" {
+			t.Errorf("ParseGreeting(%q): round trip failed: diff (-want +got):\n%s", g.String(), diff)
+		}
+	}
+}
+
+func TestParseDaemonLine(t *testing.T) {
+	for _, tt := range []struct {
+		line     string
+		wantKind LineKind
+		wantArg  string
+		wantErr  bool
+	}{
+		{line: "@RSYNCD: OK\n", wantKind: LineOK},
+		{line: "@RSYNCD: EXIT\n", wantKind: LineExit},
+		{line: "@RSYNCD: EXIT\r\n", wantKind: LineExit},
+		{line: "@RSYNCD: AUTHREQD gxk5Ky7pZzNB3Wzl8Yh/Kg\n", wantKind: LineAuthReqd, wantArg: "gxk5Ky7pZzNB3Wzl8Yh/Kg"},
+		{line: "@RSYNCD: AUTHREQD\n", wantErr: true},
+		{line: "@RSYNCD: AUTHREQD \n", wantErr: true},
+		{line: "@ERROR: Unknown module \"foo\"\n", wantKind: LineError, wantArg: "Unknown module \"foo\""},
+		{line: "@ERROR access denied\n", wantKind: LineError, wantArg: "access denied"},
+		{line: "Welcome to the rsync daemon!\n", wantKind: LineMessage, wantArg: "Welcome to the rsync daemon!"},
+		{line: "interop\tinterop\n", wantKind: LineMessage, wantArg: "interop\tinterop"},
+		{line: "\n", wantKind: LineMessage, wantArg: ""},
+	} {
+		t.Run(tt.line, func(t *testing.T) {
+			kind, arg, err := ParseDaemonLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseDaemonLine(%q) = %v, %q, want error", tt.line, kind, arg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tt.wantKind || arg != tt.wantArg {
+				t.Errorf("ParseDaemonLine(%q) = %v, %q, want %v, %q", tt.line, kind, arg, tt.wantKind, tt.wantArg)
+			}
+		})
+	}
+}
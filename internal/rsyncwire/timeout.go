@@ -0,0 +1,153 @@
+package rsyncwire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by the Reader and Writer of an IdleTimeout once the
+// connection was idle for too long.
+var ErrTimeout = errors.New("timeout")
+
+// IdleTimeout aborts a connection on which no data was transferred for
+// Timeout (--timeout). Time which BwLimitWriter deliberately spends sleeping
+// does not count as idle time, so that a throttled transfer does not time
+// out.
+//
+// Wrap the underlying connection with Reader and Writer, then call Start.
+//
+// rsync/io.c:check_timeout
+type IdleTimeout struct {
+	Timeout time.Duration
+
+	// Abort is called when the timeout expires. It must unblock pending
+	// reads and writes, typically by closing the connection.
+	Abort func()
+
+	mu      sync.Mutex
+	last    time.Time // last I/O, or end of the last pause
+	paused  int
+	expired bool
+	stop    chan struct{}
+}
+
+// Start starts checking for the timeout until Stop is called.
+func (t *IdleTimeout) Start() {
+	t.mu.Lock()
+	t.last = time.Now()
+	t.stop = make(chan struct{})
+	t.mu.Unlock()
+	go t.check(t.stop)
+}
+
+// Stop stops checking for the timeout.
+func (t *IdleTimeout) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+func (t *IdleTimeout) check(stop <-chan struct{}) {
+	interval := t.Timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		t.mu.Lock()
+		expired := t.paused == 0 && time.Since(t.last) > t.Timeout
+		if expired {
+			t.expired = true
+		}
+		t.mu.Unlock()
+		if expired {
+			t.Abort()
+			return
+		}
+	}
+}
+
+// active records that data was transferred.
+func (t *IdleTimeout) active() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = time.Now()
+}
+
+// pause suspends the timeout until the returned function is called.
+func (t *IdleTimeout) pause() (resume func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.paused--
+		t.last = time.Now()
+	}
+}
+
+// err returns ErrTimeout (with context) once the timeout expired, or err
+// otherwise.
+func (t *IdleTimeout) err(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expired {
+		return fmt.Errorf("%w: no data transferred for %v", ErrTimeout, t.Timeout)
+	}
+	return err
+}
+
+// Reader returns a Reader which records reading data from r as activity.
+func (t *IdleTimeout) Reader(r io.Reader) io.Reader {
+	return &timeoutReader{t: t, r: r}
+}
+
+// Writer returns a Writer which records writing data to w as activity.
+func (t *IdleTimeout) Writer(w io.Writer) io.Writer {
+	return &timeoutWriter{t: t, w: w}
+}
+
+type timeoutReader struct {
+	t *IdleTimeout
+	r io.Reader
+}
+
+func (r *timeoutReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 {
+		r.t.active()
+	}
+	if err != nil {
+		err = r.t.err(err)
+	}
+	return n, err
+}
+
+type timeoutWriter struct {
+	t *IdleTimeout
+	w io.Writer
+}
+
+func (w *timeoutWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	if n > 0 {
+		w.t.active()
+	}
+	if err != nil {
+		err = w.t.err(err)
+	}
+	return n, err
+}
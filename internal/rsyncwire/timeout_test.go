@@ -0,0 +1,50 @@
+package rsyncwire
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	aborted := make(chan struct{})
+	idle := &IdleTimeout{
+		Timeout: 100 * time.Millisecond,
+		Abort:   func() { close(aborted) },
+	}
+	idle.Start()
+	defer idle.Stop()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle connection did not time out")
+	}
+	w := idle.Writer(&errWriter{})
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Write after timeout: got err=%v, want %v", err, ErrTimeout)
+	}
+}
+
+type errWriter struct{}
+
+func (*errWriter) Write(p []byte) (int, error) { return 0, errors.New("closed") }
+
+func TestIdleTimeoutBwLimitPause(t *testing.T) {
+	idle := &IdleTimeout{
+		Timeout: 100 * time.Millisecond,
+		Abort:   func() { t.Errorf("throttled transfer timed out") },
+	}
+	// At 1 KiB/s, each 512 byte chunk is followed by a sleep of about 500ms,
+	// i.e. much longer than the timeout.
+	w := &BwLimitWriter{
+		Writer: idle.Writer(ioutil.Discard),
+		Limit:  1,
+		Idle:   idle,
+	}
+	idle.Start()
+	defer idle.Stop()
+	if _, err := w.Write(make([]byte, 1536)); err != nil {
+		t.Fatal(err)
+	}
+}
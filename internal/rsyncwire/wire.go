@@ -1,10 +1,12 @@
 package rsyncwire
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/gokrazy/rsync/internal/log"
 )
@@ -13,12 +15,20 @@ const (
 	MsgData  uint8 = 0
 	MsgInfo  uint8 = 2
 	MsgError uint8 = 1
+
+	// MsgSuccess carries the (little-endian int32) file list index of a file
+	// which the receiver received successfully (--remove-source-files).
+	MsgSuccess uint8 = 100
 )
 
 const mplexBase = 7
 
+// MultiplexWriter is safe for concurrent use: messages are written atomically,
+// so that e.g. the receiver can send MsgSuccess while the generator writes.
 type MultiplexWriter struct {
 	Writer io.Writer
+
+	mu sync.Mutex
 }
 
 func (w *MultiplexWriter) Write(p []byte) (n int, err error) {
@@ -26,17 +36,60 @@ func (w *MultiplexWriter) Write(p []byte) (n int, err error) {
 }
 
 func (w *MultiplexWriter) WriteMsg(tag uint8, p []byte) (n int, err error) {
-	header := uint32(mplexBase+tag)<<24 | uint32(len(p))
-	// log.Printf("len %d (hex %x)", len(p), uint32(len(p)))
-	// log.Printf("header=%v (%x)", header, header)
-	if err := binary.Write(w.Writer, binary.LittleEndian, header); err != nil {
-		return 0, err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// The length field of the header is only 24 bits wide, so larger payloads
+	// are split into multiple messages.
+	for {
+		chunk := p
+		if len(chunk) > maxMessageSize {
+			chunk = chunk[:maxMessageSize]
+		}
+		header := uint32(mplexBase+tag)<<24 | uint32(len(chunk))
+		// log.Printf("len %d (hex %x)", len(chunk), uint32(len(chunk)))
+		// log.Printf("header=%v (%x)", header, header)
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], header)
+		if err := writeFull(w.Writer, buf[:]); err != nil {
+			return n, err
+		}
+		if err := writeFull(w.Writer, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// writeFull writes all of p to w. Well-behaved writers return an error when
+// they do not write all of p, but some connection wrappers return short
+// writes without an error, which would silently corrupt the stream.
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
 	}
-	return w.Writer.Write(p)
+	return nil
 }
 
 type MultiplexReader struct {
 	Reader io.Reader
+
+	// Handler is called for messages other than MsgData, MsgInfo and
+	// MsgError, e.g. MsgSuccess. Without a Handler, such messages are an
+	// error.
+	Handler func(tag uint8, payload []byte) error
+
+	pending []byte // data of the current MsgData message not yet returned
 }
 
 // rsync.h defines IO_BUFFER_SIZE as 32 * 1024, but gokr-rsyncd increases it to
@@ -68,24 +121,56 @@ func (w *MultiplexReader) ReadMsg() (tag uint8, p []byte, err error) {
 	return tag, p, nil
 }
 
+// Read returns data of MsgData messages. Messages which are larger than p are
+// returned over multiple calls. Empty messages and MsgInfo messages are
+// skipped, so that Read never returns 0 bytes without an error.
 func (w *MultiplexReader) Read(p []byte) (n int, err error) {
-	tag, payload, err := w.ReadMsg()
-	if err != nil {
-		return 0, err
+	if len(p) == 0 {
+		return 0, nil
 	}
-	if tag == MsgError {
-		return 0, fmt.Errorf("%s", payload)
-	}
-	if tag == MsgInfo {
-		log.Printf("info: %s", payload)
-	}
-	if tag != MsgData {
-		return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
+	for len(w.pending) == 0 {
+		tag, payload, err := w.ReadMsg()
+		if err != nil {
+			return 0, err
+		}
+		if tag == MsgError {
+			return 0, fmt.Errorf("%s", payload)
+		}
+		if tag == MsgInfo {
+			log.Printf("info: %s", payload)
+			continue
+		}
+		if tag != MsgData && w.Handler != nil {
+			if err := w.Handler(tag, payload); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if tag != MsgData {
+			return 0, fmt.Errorf("unexpected tag: got %v, want %v", tag, MsgData)
+		}
+		w.pending = payload
 	}
-	if len(p) < len(payload) {
-		panic(fmt.Sprintf("not enough buffer space! %d < %d", len(p), len(payload)))
+	n = copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+// FlushReader flushes Writer before each read from Reader: buffered output
+// needs to be sent before waiting for input, because the peer might only
+// respond once it received the output.
+//
+// rsync/io.c:io_flush
+type FlushReader struct {
+	Reader io.Reader
+	Writer *bufio.Writer
+}
+
+func (r *FlushReader) Read(p []byte) (n int, err error) {
+	if err := r.Writer.Flush(); err != nil {
+		return 0, err
 	}
-	return copy(p, payload), nil
+	return r.Reader.Read(p)
 }
 
 type Buffer struct {
@@ -126,11 +211,13 @@ type Conn struct {
 }
 
 func (c *Conn) WriteByte(data byte) error {
-	return binary.Write(c.Writer, binary.LittleEndian, data)
+	return writeFull(c.Writer, []byte{data})
 }
 
 func (c *Conn) WriteInt32(data int32) error {
-	return binary.Write(c.Writer, binary.LittleEndian, data)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(data))
+	return writeFull(c.Writer, buf[:])
 }
 
 func (c *Conn) WriteInt64(data int64) error {
@@ -142,12 +229,13 @@ func (c *Conn) WriteInt64(data int64) error {
 	if err := c.WriteInt32(-1); err != nil {
 		return err
 	}
-	return binary.Write(c.Writer, binary.LittleEndian, data)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(data))
+	return writeFull(c.Writer, buf[:])
 }
 
 func (c *Conn) WriteString(data string) error {
-	_, err := io.WriteString(c.Writer, data)
-	return err
+	return writeFull(c.Writer, []byte(data))
 }
 
 func (c *Conn) ReadByte() (byte, error) {
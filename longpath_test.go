@@ -0,0 +1,164 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/longpath"
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// createLongFile creates a file with the specified content below root, in a
+// directory tree whose full path exceeds PATH_MAX (4096 on Linux), which cannot
+// be done using the full path directly. It returns the name of the file
+// relative to root.
+func createLongFile(t *testing.T, root, content string) string {
+	t.Helper()
+	component := strings.Repeat("d", 200)
+	deep := root
+	for i := 0; i < 25; i++ {
+		deep = filepath.Join(deep, component)
+	}
+	if err := longpath.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := filepath.Join(deep, "hello")
+	if len(hello) <= 4096 {
+		t.Fatalf("BUG: path length %d does not exceed PATH_MAX", len(hello))
+	}
+	resolved, release, err := longpath.Resolve(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(resolved, []byte(content), 0644)
+	release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(root, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
+
+func readLongFile(t *testing.T, fn string) string {
+	t.Helper()
+	f, err := longpath.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLongPaths(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	rel := createLongFile(t, source, "world")
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readLongFile(t, filepath.Join(dest, rel)), "world"; got != want {
+		t.Errorf("unexpected file contents: got %q, want %q", got, want)
+	}
+}
+
+func TestLongPathsBackup(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	rel := createLongFile(t, source, "world")
+	createLongFile(t, dest, "old content")
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--backup",
+		"--backup-dir=backups",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readLongFile(t, filepath.Join(dest, rel)), "world"; got != want {
+		t.Errorf("unexpected file contents: got %q, want %q", got, want)
+	}
+	backup := filepath.Join(dest, "backups", rel)
+	if got, want := readLongFile(t, backup), "old content"; got != want {
+		t.Errorf("unexpected backup contents: got %q, want %q", got, want)
+	}
+}
+
+func TestLongPathsCopyDest(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	basis := filepath.Join(tmp, "basis")
+	dest := filepath.Join(tmp, "dest")
+
+	content := strings.Repeat("basis data ", 10000)
+	rel := createLongFile(t, source, content)
+	createLongFile(t, basis, content)
+	mtime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	for _, root := range []string{source, basis} {
+		resolved, release, err := longpath.Resolve(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(resolved, mtime, mtime)
+		release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--copy-dest=../basis",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readLongFile(t, filepath.Join(dest, rel)), content; got != want {
+		t.Errorf("unexpected file contents (%d bytes, want %d bytes)", len(got), len(want))
+	}
+	// The file was copied from the basis, not transferred.
+	if stats.Written >= int64(len(content)) {
+		t.Errorf("received %d bytes on the wire for a %d byte file despite --copy-dest", stats.Written, len(content))
+	}
+}
@@ -0,0 +1,88 @@
+package rsync_test
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mmcloughlin/md4"
+)
+
+func TestManifest(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	manifest := filepath.Join(tmp, "manifest")
+
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	for fn, content := range map[string]string{
+		"hello":          "world",
+		"empty":          "",
+		"dir/nested.txt": "nested",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The destination has an outdated version of the large file, so that it
+	// is transferred as a delta, i.e. partially from the local file.
+	rsynctest.WriteLargeDataFile(t, dest, headPattern, []byte{0x22}, endPattern)
+	old := time.Now().Add(-1 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dest, "large-data-file"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--manifest=" + manifest,
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			t.Fatalf("malformed manifest line: %q", line)
+		}
+		got[fields[1]] = fields[0]
+	}
+
+	want := make(map[string]string)
+	for _, fn := range []string{"hello", "empty", "dir/nested.txt", "large-data-file"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := md4.New()
+		h.Write(content)
+		want[fn] = hex.EncodeToString(h.Sum(nil))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected manifest: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,79 @@
+package rsync_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestMaxFiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	// 8 file list entries: the top directory, the subdirectory and 6 files
+	for i := 0; i < 6; i++ {
+		fn := filepath.Join(source, "sub", fmt.Sprintf("file%d", i))
+		if i%2 == 0 {
+			fn = filepath.Join(source, fmt.Sprintf("file%d", i))
+		}
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modules := rsynctest.InteropModule(source)
+	modules = append(modules, modules[0], modules[0])
+	modules[0].MaxFiles = 7
+	modules[1].Name = "exact"
+	modules[1].MaxFiles = 8
+	modules[2].Name = "unlimited"
+	srv := rsynctest.New(t, modules)
+
+	t.Run("Exceeded", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "dest")
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"rsync://localhost:" + srv.Port + "/interop/",
+			dest,
+		}
+		_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+		if err == nil {
+			t.Fatal("transfer exceeding max_files unexpectedly succeeded")
+		}
+		if want := `file list exceeds the limit of 7 files of module "interop"`; !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+		// The transfer was rejected before any file was sent.
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("destination unexpectedly created: %v (contents: %v)", err, treeContents(t, dest))
+		}
+	})
+
+	for _, module := range []string{"exact", "unlimited"} {
+		t.Run(module, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				"rsync://localhost:" + srv.Port + "/" + module + "/",
+				dest,
+			}
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(treeContents(t, dest)), 6; got != want {
+				t.Errorf("unexpected number of files transferred: got %d, want %d", got, want)
+			}
+		})
+	}
+}
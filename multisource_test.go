@@ -0,0 +1,94 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMultipleModules(t *testing.T) {
+	tmp := t.TempDir()
+	first := filepath.Join(tmp, "first")
+	second := filepath.Join(tmp, "second")
+	for fn, content := range map[string]string{
+		filepath.Join(first, "a"):               "first a",
+		filepath.Join(first, "sub", "b"):        "first b",
+		filepath.Join(second, "tree", "c"):      "second c",
+		filepath.Join(second, "tree", "d", "e"): "second e",
+		filepath.Join(second, "ignored"):        "not requested",
+	} {
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{Name: "first", Path: first},
+		{Name: "second", Path: second},
+	})
+
+	dest := filepath.Join(tmp, "dest")
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/first/",
+		"rsync://localhost:" + srv.Port + "/second/tree",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for fn, want := range map[string]string{
+		"a":        "first a",
+		"sub/b":    "first b",
+		"tree/c":   "second c",
+		"tree/d/e": "second e",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, string(got)); diff != "" {
+			t.Errorf("%s: unexpected file contents: diff (-want +got):\n%s", fn, diff)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "ignored")); !os.IsNotExist(err) {
+		t.Errorf("ignored unexpectedly transferred (err=%v)", err)
+	}
+
+	// With --delete, each directory is pruned of the entries which are not
+	// part of any source: the files of the other module are kept.
+	for _, fn := range []string{"extraneous", "sub/extraneous", "tree/d/extraneous"} {
+		if err := ioutil.WriteFile(filepath.Join(dest, fn), []byte("delete me"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args = append([]string{"gokr-rsync", "--delete"}, args[1:]...)
+	stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"extraneous", "sub/extraneous", "tree/d/extraneous"} {
+		if _, err := os.Stat(filepath.Join(dest, fn)); !os.IsNotExist(err) {
+			t.Errorf("%s unexpectedly not deleted (err=%v)", fn, err)
+		}
+	}
+	for _, fn := range []string{"a", "sub/b", "tree/c", "tree/d/e"} {
+		if _, err := os.Stat(filepath.Join(dest, fn)); err != nil {
+			t.Errorf("%s unexpectedly deleted: %v", fn, err)
+		}
+	}
+	if got, want := stats.Deleted, 3; got != want {
+		t.Errorf("unexpected number of deleted files: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// TestOpenNoatime verifies that the source access time is left untouched.
+// Transferring access times (--atimes) is not supported: they are only part of
+// the file list as of protocol 30, so the client refuses --atimes (see
+// TestAtimes in internal/receivermaincmd).
+func TestOpenNoatime(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(source, "file")
+	if err := ioutil.WriteFile(fn, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// With relatime (the Linux default), reading a file only updates its
+	// access time if it is older than the modification time.
+	mtime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	atime := mtime.Add(-1 * time.Hour)
+	resetAtime := func() {
+		t.Helper()
+		if err := os.Chtimes(fn, atime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getAtime := func() time.Time {
+		t.Helper()
+		st, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := st.Sys().(*syscall.Stat_t).Atim
+		return time.Unix(at.Unix())
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	transfer := func(extra ...string) {
+		t.Helper()
+		args := append([]string{"gokr-rsync", "-a"}, extra...)
+		args = append(args,
+			"rsync://localhost:"+srv.Port+"/interop/",
+			filepath.Join(t.TempDir(), "dest"))
+		if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resetAtime()
+	transfer()
+	if getAtime().Equal(atime) {
+		t.Skip("file system does not update access times (noatime?)")
+	}
+
+	resetAtime()
+	transfer("--open-noatime")
+	if got := getAtime(); !got.Equal(atime) {
+		t.Errorf("source access time changed: got %v, want %v", got, atime)
+	}
+}
@@ -0,0 +1,156 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+	"github.com/google/go-cmp/cmp"
+)
+
+// With --numeric-ids, neither side transmits user and group name lists
+// (rsync/uidlist.c:send_id_lists and recv_id_list). These tests use rsync on
+// the other end, as a gokrazy/rsync sender and receiver would agree with each
+// other even if both wrongly transmitted the lists.
+
+func verifyNumericIdsTree(t *testing.T, dest string) {
+	t.Helper()
+	for _, subdir := range []string{"expensive", "cheap"} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, subdir, "dummy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]byte(subdir), got); diff != "" {
+			t.Fatalf("unexpected file contents: diff (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestInteropNumericIds(t *testing.T) {
+	_, source, dest := createSourceFiles(t)
+
+	// start a server to sync from
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	rsync := exec.Command("rsync",
+		"--archive",
+		"--numeric-ids",
+		"--port="+srv.Port,
+		"rsync://localhost/interop/",
+		dest)
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+	verifyNumericIdsTree(t, dest)
+}
+
+func TestInteropNumericIdsUpload(t *testing.T) {
+	_, source, dest := createSourceFiles(t)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     dest,
+			Writable: true,
+		},
+	})
+
+	rsync := exec.Command("rsync",
+		"--archive",
+		"--numeric-ids",
+		"--port="+srv.Port,
+		source+"/",
+		"rsync://localhost/interop/")
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+	verifyNumericIdsTree(t, dest)
+}
+
+// startRsyncDaemon starts rsync --daemon serving source as module interop and
+// returns its port.
+func startRsyncDaemon(t *testing.T, source string) string {
+	t.Helper()
+	tmp := t.TempDir()
+	config := filepath.Join(tmp, "rsyncd.conf")
+	rsyncdConfig := `use chroot = no
+pid file = ` + filepath.Join(tmp, "rsyncd.pid") + `
+
+[interop]
+	path = ` + source + `
+	read only = yes
+`
+	if err := ioutil.WriteFile(config, []byte(rsyncdConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port for rsync to listen on.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	srv := exec.Command("rsync",
+		"--daemon",
+		"--config="+config,
+		"--address=localhost",
+		"--no-detach",
+		"--port="+port)
+	srv.Stdout = os.Stdout
+	srv.Stderr = os.Stderr
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Process.Kill()
+		srv.Wait()
+	})
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("rsync --daemon did not start listening: %v", err)
+		}
+	}
+	return port
+}
+
+func TestInteropNumericIdsRsyncDaemon(t *testing.T) {
+	_, source, dest := createSourceFiles(t)
+	port := startRsyncDaemon(t, source)
+
+	args := []string{
+		"gokr-rsync",
+		"--archive",
+		"--numeric-ids",
+		"rsync://localhost:" + port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	verifyNumericIdsTree(t, dest)
+}
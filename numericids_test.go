@@ -0,0 +1,155 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/idnames"
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+// When started by TestNumericIdsChroot, this test binary serves the directory
+// /source from within a chroot into $CHROOT_DAEMON_DIR, with the user database
+// read from $CHROOT_DAEMON_PASSWD and $CHROOT_DAEMON_GROUP before entering the
+// chroot.
+func init() {
+	dir := os.Getenv("CHROOT_DAEMON_DIR")
+	if dir == "" {
+		return
+	}
+	ids, err := idnames.LoadTable(os.Getenv("CHROOT_DAEMON_PASSWD"), os.Getenv("CHROOT_DAEMON_GROUP"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.FileListener(os.NewFile(3, "listener"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name: "interop",
+			Path: "/source",
+		},
+	}, rsyncd.WithIDNames(ids))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.Serve(context.Background(), ln); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+func TestNumericIdsChroot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chroot(2) and chown(2) require root")
+	}
+	// The client maps the names it receives using the system’s user database.
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		t.Skip(err)
+	}
+	g, err := user.LookupGroup("daemon")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	source := filepath.Join(root, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	owned := filepath.Join(source, "owned")
+	if err := ioutil.WriteFile(owned, []byte("owned"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const remoteUid, remoteGid = 4242, 4343
+	if err := os.Chown(owned, remoteUid, remoteGid); err != nil {
+		t.Fatal(err)
+	}
+
+	// On the server, the file is owned by user and group “daemon”, which the
+	// server can only know from the user database it read before entering
+	// the chroot (which does not contain /etc/passwd).
+	passwd := filepath.Join(tmp, "passwd")
+	if err := ioutil.WriteFile(passwd, []byte("daemon:x:4242:4343::/:/bin/false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	group := filepath.Join(tmp, "group")
+	if err := ioutil.WriteFile(group, []byte("daemon:x:4343:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := exec.Command(os.Args[0])
+	daemon.Env = append(os.Environ(),
+		"CHROOT_DAEMON_DIR="+root,
+		"CHROOT_DAEMON_PASSWD="+passwd,
+		"CHROOT_DAEMON_GROUP="+group)
+	daemon.Stderr = os.Stderr
+	daemon.ExtraFiles = []*os.File{lnFile}
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Wait()
+	defer daemon.Process.Kill()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localUid, _ := strconv.Atoi(u.Uid)
+	localGid, _ := strconv.Atoi(g.Gid)
+	for _, tt := range []struct {
+		desc     string
+		flags    []string
+		uid, gid int
+	}{
+		{desc: "names", flags: []string{"-a"}, uid: localUid, gid: localGid},
+		{desc: "numeric", flags: []string{"-a", "--numeric-ids"}, uid: remoteUid, gid: remoteGid},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync"}, tt.flags...)
+			args = append(args, "rsync://localhost:"+port+"/interop/", dest)
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			st, err := os.Stat(filepath.Join(dest, "owned"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stt := st.Sys().(*syscall.Stat_t)
+			if int(stt.Uid) != tt.uid || int(stt.Gid) != tt.gid {
+				t.Errorf("unexpected ownership: got %d:%d, want %d:%d", stt.Uid, stt.Gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
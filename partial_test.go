@@ -0,0 +1,121 @@
+package rsync_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// cutConn closes the connection once limit bytes were written.
+type cutConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *cutConn) Write(p []byte) (int, error) {
+	if len(p) > c.limit {
+		n, _ := c.Conn.Write(p[:c.limit])
+		c.limit = 0
+		c.Conn.Close()
+		return n, errors.New("connection cut")
+	}
+	c.limit -= len(p)
+	return c.Conn.Write(p)
+}
+
+// cutListener cuts the first accepted connection after limit bytes.
+type cutListener struct {
+	net.Listener
+	limit int
+	once  sync.Once
+}
+
+func (l *cutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.once.Do(func() { conn = &cutConn{Conn: conn, limit: l.limit} })
+	return conn, nil
+}
+
+func TestPartialResume(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(source, "large")
+	content := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile(large, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	const limit = 1024 * 1024
+	srv := rsynctest.New(t, rsynctest.InteropModule(source), rsynctest.Listener(&cutListener{Listener: ln, limit: limit}))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--partial",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err == nil {
+		t.Fatal("interrupted transfer unexpectedly succeeded")
+	}
+
+	partial, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+	if err != nil {
+		t.Fatalf("partial file not kept: %v", err)
+	}
+	if len(partial) == 0 || len(partial) >= len(content) {
+		t.Fatalf("unexpected partial file size: got %d bytes, want between 0 and %d", len(partial), len(content))
+	}
+	if !bytes.HasPrefix(content, partial) {
+		t.Fatalf("partial file is not a prefix of the source")
+	}
+
+	// Change the source before resuming: the start of the file (which the
+	// partial file contains) differs now, and the file grows.
+	rand.New(rand.NewSource(2)).Read(content[:4096])
+	content = append(content, []byte("appended after the interruption")...)
+	if err := ioutil.WriteFile(large, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("resumed file differs from the changed source (got %d bytes, want %d bytes)", len(got), len(content))
+	}
+
+	// The unchanged blocks of the partial file were re-used instead of being
+	// transferred again. Written is reported by the sender, i.e. what the
+	// client received.
+	if stats.Written >= int64(len(content)-len(partial)/2) {
+		t.Errorf("resuming received %d bytes, want less than %d (partial file not used as basis?)", stats.Written, len(content)-len(partial)/2)
+	}
+}
@@ -0,0 +1,102 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// trickleConn reads and writes at most one byte at a time. Writes return
+// short without an error, like some connection wrappers do.
+type trickleConn struct {
+	net.Conn
+}
+
+func (c *trickleConn) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *trickleConn) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Write(p)
+}
+
+type trickleListener struct {
+	net.Listener
+}
+
+func (l *trickleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &trickleConn{Conn: conn}, nil
+}
+
+func TestPartialIO(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// larger than the sender’s chunk size, so that it spans multiple
+	// multiplexed messages
+	large := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := map[string][]byte{
+		"large":      large,
+		"dir/small":  []byte("small file"),
+		"dir/empty":  nil,
+		"compressed": bytes.Repeat([]byte("compressible "), 10000),
+	}
+	for fn, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(source, fn), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := rsynctest.New(t, rsynctest.InteropModule(source), rsynctest.Listener(&trickleListener{ln}))
+
+	for _, tt := range []struct {
+		desc  string
+		flags []string
+	}{
+		{desc: "uncompressed", flags: []string{"-a"}},
+		{desc: "compressed", flags: []string{"-az"}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync"}, tt.flags...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			for fn, want := range files {
+				got, err := ioutil.ReadFile(filepath.Join(dest, fn))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: content differs after transfer (got %d bytes, want %d bytes)", fn, len(got), len(want))
+				}
+			}
+		})
+	}
+}
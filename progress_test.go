@@ -0,0 +1,68 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestProgressNonTTY(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"hello", "world"} {
+		if err := ioutil.WriteFile(filepath.Join(source, fn), []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// A bytes.Buffer is not a terminal, so progress must not be updated in
+	// place using carriage returns.
+	var stdout bytes.Buffer
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--progress",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	output := stdout.String()
+	t.Logf("output:\n%s", output)
+	if strings.Contains(output, "\r") {
+		t.Errorf("progress output unexpectedly contains carriage returns: %q", output)
+	}
+	if !strings.HasSuffix(output, "\n") {
+		t.Errorf("progress output does not end in a newline: %q", output)
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	for _, want := range []string{
+		"hello",
+		"world",
+		"      5 100%",
+		"(xfr#1, to-chk=1/3)",
+		"(xfr#2, to-chk=0/3)",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("progress output does not contain %q", want)
+		}
+	}
+	if got, want := lines[len(lines)-1], "total size is "; !strings.HasPrefix(got, want) {
+		t.Errorf("unexpected final summary line: got %q, want prefix %q", got, want)
+	}
+}
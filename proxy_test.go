@@ -0,0 +1,153 @@
+package rsync_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy which records the requested
+// addresses.
+type connectProxy struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func startConnectProxy(t *testing.T) *connectProxy {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &connectProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Method != "CONNECT" {
+		fmt.Fprintf(conn, "HTTP/1.0 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	p.mu.Lock()
+	p.requested = append(p.requested, req.Host)
+	p.mu.Unlock()
+	backend, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.0 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer backend.Close()
+	fmt.Fprintf(conn, "HTTP/1.0 200 Connection established\r\nProxy-Agent: test\r\n\r\n")
+	go io.Copy(backend, br)
+	io.Copy(conn, backend)
+}
+
+func (p *connectProxy) Requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requested...)
+}
+
+func TestProxy(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	daemon := "localhost:" + srv.Port
+
+	for _, tt := range []struct {
+		desc string
+		flag bool // --proxy instead of RSYNC_PROXY
+	}{
+		{desc: "flag", flag: true},
+		{desc: "env"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			proxy := startConnectProxy(t)
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := []string{"gokr-rsync", "-a"}
+			if tt.flag {
+				args = append(args, "--proxy="+proxy.ln.Addr().String())
+			} else {
+				os.Setenv("RSYNC_PROXY", proxy.ln.Addr().String())
+				defer os.Unsetenv("RSYNC_PROXY")
+			}
+			args = append(args, "rsync://"+daemon+"/interop/", dest+"/")
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(dest, "hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "world" {
+				t.Errorf("hello: got %q, want %q", got, "world")
+			}
+			if got, want := proxy.Requested(), []string{daemon}; len(got) != 1 || got[0] != want[0] {
+				t.Errorf("proxy CONNECT requests: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	srv := rsynctest.New(t, rsynctest.InteropModule(t.TempDir()))
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprintf(conn, "HTTP/1.0 403 Forbidden\r\n\r\n")
+	}()
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--proxy=" + ln.Addr().String(),
+		"rsync://localhost:" + srv.Port + "/interop/",
+		t.TempDir() + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err == nil {
+		t.Fatal("transfer through refusing proxy unexpectedly succeeded")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gokrazy/rsync/internal/receivermaincmd"
 	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -60,3 +61,88 @@ func TestReceiverListing(t *testing.T) {
 		t.Fatalf("unexpected listing: diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestReceiverModuleListing(t *testing.T) {
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{Name: "interop", Path: t.TempDir()},
+		{Name: "other", Path: t.TempDir()},
+	})
+
+	var stdout bytes.Buffer
+	args := []string{
+		"gokr-rsync",
+		"rsync://localhost:" + srv.Port + "/",
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	want := "interop\tinterop\nother\tother\n"
+	if diff := cmp.Diff(want, stdout.String()); diff != "" {
+		t.Errorf("unexpected module listing: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReceiverListOnly(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hello := filepath.Join(source, "hello")
+	if err := ioutil.WriteFile(hello, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime, err := time.Parse(time.RFC3339, "2009-11-10T23:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(hello, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(source, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// The listing is the same regardless of the transport.
+	for _, tt := range []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "Daemon",
+			args: []string{"rsync://localhost:" + srv.Port + "/interop/"},
+		},
+		{
+			name: "RemoteShell",
+			// os.Args[0] (this test binary) acts as remote shell, see TestMain
+			args: []string{"-e", os.Args[0], "localhost:" + source + "/"},
+		},
+		{
+			name: "Local",
+			args: []string{source + "/"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync", "-a", "--list-only"}, tt.args...)
+			args = append(args, dest)
+			var stdout bytes.Buffer
+			if _, err := receivermaincmd.Main(args, os.Stdin, &stdout, &stdout); err != nil {
+				t.Fatal(err)
+			}
+			want := `drwxr-xr-x        4096 2009/11/10 23:00:00 .
+-rw-r--r--           5 2009/11/10 23:00:00 hello
+`
+			if diff := cmp.Diff(want, stdout.String()); diff != "" {
+				t.Fatalf("unexpected listing: diff (-want +got):\n%s", diff)
+			}
+			// --list-only does not copy into the destination.
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("destination unexpectedly created (err=%v)", err)
+			}
+		})
+	}
+}
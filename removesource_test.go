@@ -0,0 +1,222 @@
+package rsync_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+// createRemoveSourceTree creates files in source and returns their names.
+func createRemoveSourceTree(t *testing.T, source string) []string {
+	t.Helper()
+	names := []string{"a", "b", "sub/c", "blocked"}
+	for _, fn := range names {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte("content of "+fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+// blockDest creates a non-empty directory dest/blocked, which prevents
+// receiving the file “blocked” (without --force).
+func blockDest(t *testing.T, dest string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dest, "blocked", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitRemoved waits until fn no longer exists. The daemon handles the last
+// acknowledgements while reading the client’s final goodbye, i.e. possibly
+// after the client returned.
+func waitRemoved(fn string) error {
+	var err error
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Lstat(fn); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s still exists (err=%v)", fn, err)
+}
+
+// verifyRemoved verifies that the received files were removed from source,
+// but the file which could not be received and all directories were kept.
+func verifyRemoved(t *testing.T, source, dest string) {
+	t.Helper()
+	for _, fn := range []string{"a", "b", "sub/c"} {
+		if _, err := os.Stat(filepath.Join(dest, fn)); err != nil {
+			t.Errorf("%s not received: %v", fn, err)
+		}
+		if err := waitRemoved(filepath.Join(source, fn)); err != nil {
+			t.Errorf("not removed from source after successful transfer: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(source, "blocked")); err != nil {
+		t.Errorf("blocked removed from source although it was not received: %v", err)
+	}
+	if st, err := os.Stat(filepath.Join(source, "sub")); err != nil || !st.IsDir() {
+		t.Errorf("directory sub removed from source: %v", err)
+	}
+}
+
+func TestRemoveSourceFiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	createRemoveSourceTree(t, source)
+	blockDest(t, dest)
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     source,
+			Writable: true,
+		},
+	})
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--remove-source-files",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	verifyRemoved(t, source, dest)
+}
+
+func TestRemoveSourceFilesUpToDate(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	createRemoveSourceTree(t, source)
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     source,
+			Writable: true,
+		},
+	})
+
+	// The first transfer makes the destination up to date, so that the
+	// second transfer does not need to transfer any data.
+	url := "rsync://localhost:" + srv.Port + "/interop/"
+	if _, err := receivermaincmd.Main([]string{"gokr-rsync", "-a", url, dest}, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receivermaincmd.Main([]string{"gokr-rsync", "-a", "--remove-source-files", url, dest}, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"a", "b", "sub/c", "blocked"} {
+		if err := waitRemoved(filepath.Join(source, fn)); err != nil {
+			t.Errorf("up to date file not removed from source: %v", err)
+		}
+	}
+}
+
+func TestRemoveSourceFilesReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	names := createRemoveSourceTree(t, source)
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--remove-source-files",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err == nil {
+		t.Fatalf("--remove-source-files unexpectedly succeeded on a read-only module")
+	}
+	for _, fn := range names {
+		if _, err := os.Stat(filepath.Join(source, fn)); err != nil {
+			t.Errorf("%s removed from read-only module: %v", fn, err)
+		}
+	}
+}
+
+func TestInteropRemoveSourceFiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	createRemoveSourceTree(t, source)
+	blockDest(t, dest)
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     source,
+			Writable: true,
+		},
+	})
+
+	rsync := exec.Command("rsync",
+		"--archive",
+		"--remove-source-files",
+		"--port="+srv.Port,
+		"rsync://localhost/interop/",
+		dest)
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	// rsync exits with status 23 (partial transfer) because of the blocked
+	// file, which must not be removed from the source.
+	if err := rsync.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 23 {
+			t.Fatalf("%v: %v", rsync.Args, err)
+		}
+	}
+	verifyRemoved(t, source, dest)
+}
+
+func TestInteropRemoveSourceFilesUpload(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	createRemoveSourceTree(t, source)
+	blockDest(t, dest)
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     dest,
+			Writable: true,
+		},
+	})
+
+	// The daemon receives the files and acknowledges each one, so that the
+	// client (the sender) removes it.
+	rsync := exec.Command("rsync",
+		"--archive",
+		"--remove-source-files",
+		"--port="+srv.Port,
+		source+"/",
+		"rsync://localhost/interop/")
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 23 {
+			t.Fatalf("%v: %v", rsync.Args, err)
+		}
+	}
+	verifyRemoved(t, source, dest)
+}
@@ -0,0 +1,103 @@
+package rsyncd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ageFilter restricts the file list to non-directory files whose
+// modification time lies within a window, as configured by the (non-standard)
+// --files-newer-than and --files-older-than options. Directories are always
+// included so that the tree structure of in-window files is retained.
+type ageFilter struct {
+	newerThan time.Time // zero if unset
+	olderThan time.Time // zero if unset
+}
+
+func newAgeFilter(opts *Opts, now time.Time) (*ageFilter, error) {
+	if opts.Delete && (opts.FilesNewerThan != "" || opts.FilesOlderThan != "") {
+		// The receiver cannot tell files outside of the window from
+		// extraneous files, so it would delete them.
+		return nil, fmt.Errorf("--files-newer-than and --files-older-than cannot be combined with --delete")
+	}
+	var af ageFilter
+	if opts.FilesNewerThan != "" {
+		t, err := parseAgeThreshold(opts.FilesNewerThan, now)
+		if err != nil {
+			return nil, fmt.Errorf("--files-newer-than: %v", err)
+		}
+		af.newerThan = t
+	}
+	if opts.FilesOlderThan != "" {
+		t, err := parseAgeThreshold(opts.FilesOlderThan, now)
+		if err != nil {
+			return nil, fmt.Errorf("--files-older-than: %v", err)
+		}
+		af.olderThan = t
+	}
+	return &af, nil
+}
+
+// includes reports whether the file described by info should be transferred.
+func (af *ageFilter) includes(info os.FileInfo) bool {
+	if info.IsDir() {
+		return true
+	}
+	mtime := info.ModTime()
+	if !af.newerThan.IsZero() && !mtime.After(af.newerThan) {
+		return false
+	}
+	if !af.olderThan.IsZero() && !mtime.Before(af.olderThan) {
+		return false
+	}
+	return true
+}
+
+// dateLayouts are the absolute date formats accepted by parseAgeThreshold.
+// Dates without a time zone are interpreted in the local time zone.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ageUnits are the units accepted by parseAgeThreshold in addition to those
+// understood by time.ParseDuration.
+var ageUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseAgeThreshold parses arg as either an absolute date (e.g. 2021-12-31 or
+// 2021-12-31T23:59:59Z) or as a duration relative to now (e.g. 7d, 2w, 36h or
+// 1h30m), returning the corresponding point in time.
+func parseAgeThreshold(arg string, now time.Time) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, arg, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if len(arg) > 1 {
+		if unit, ok := ageUnits[arg[len(arg)-1:]]; ok {
+			if n, err := strconv.ParseInt(arg[:len(arg)-1], 10, 64); err == nil && n >= 0 {
+				if n > math.MaxInt64/int64(unit) {
+					return time.Time{}, fmt.Errorf("duration %q out of range", arg)
+				}
+				return now.Add(-time.Duration(n) * unit), nil
+			}
+		}
+	}
+	if d, err := time.ParseDuration(arg); err == nil && !strings.HasPrefix(arg, "-") {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date or duration %q (examples: 2006-01-02, 7d, 12h)", arg)
+}
@@ -0,0 +1,131 @@
+package rsyncd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAgeThreshold(t *testing.T) {
+	now := time.Date(2022, 1, 15, 12, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		arg  string
+		want time.Time
+	}{
+		{arg: "2021-12-31", want: time.Date(2021, 12, 31, 0, 0, 0, 0, time.Local)},
+		{arg: "2021-12-31 23:59:59", want: time.Date(2021, 12, 31, 23, 59, 59, 0, time.Local)},
+		{arg: "2021-12-31T23:59:59Z", want: time.Date(2021, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{arg: "7d", want: now.Add(-7 * 24 * time.Hour)},
+		{arg: "2w", want: now.Add(-14 * 24 * time.Hour)},
+		{arg: "36h", want: now.Add(-36 * time.Hour)},
+		{arg: "1h30m", want: now.Add(-90 * time.Minute)},
+	} {
+		t.Run(tt.arg, func(t *testing.T) {
+			got, err := parseAgeThreshold(tt.arg, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseAgeThreshold(%q) = %v, want %v", tt.arg, got, tt.want)
+			}
+		})
+	}
+
+	for _, arg := range []string{"", "d", "-7d", "7x", "yesterday", "2021-13-01", "106752d", "9223372036854775807s"} {
+		if _, err := parseAgeThreshold(arg, now); err == nil {
+			t.Errorf("parseAgeThreshold(%q) unexpectedly succeeded", arg)
+		}
+	}
+}
+
+func TestFileListAgeFilter(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	if err := os.MkdirAll(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for name, mtime := range map[string]time.Time{
+		"recent":     now.Add(-1 * time.Hour),
+		"dir/recent": now.Add(-3 * 24 * time.Hour),
+		"lastmonth":  now.Add(-30 * 24 * time.Hour),
+		"ancient":    time.Date(2001, 1, 1, 0, 0, 0, 0, time.Local),
+	} {
+		fn := filepath.Join(source, name)
+		if err := ioutil.WriteFile(fn, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(t *testing.T, opts *Opts) []string {
+		st := &sendTransfer{
+			logger: log.Default(),
+			opts:   opts,
+			conn:   &rsyncwire.Conn{Writer: io.Discard},
+		}
+		mod := Module{Name: "interop", Path: source}
+		fileList, err := st.sendFileList(mod, st.opts, []string{"interop/"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range fileList.files {
+			names = append(names, f.wpath())
+		}
+		return names
+	}
+
+	for _, tt := range []struct {
+		desc string
+		opts Opts
+		want []string
+	}{
+		{
+			desc: "relative duration",
+			opts: Opts{FilesNewerThan: "7d"},
+			want: []string{".", "dir", "dir/recent", "recent"},
+		},
+		{
+			desc: "date threshold",
+			opts: Opts{FilesOlderThan: "2010-01-01"},
+			want: []string{".", "ancient", "dir"},
+		},
+		{
+			desc: "window",
+			opts: Opts{FilesNewerThan: "2010-01-01", FilesOlderThan: "2d"},
+			want: []string{".", "dir", "dir/recent", "lastmonth"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := list(t, &tt.opts)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected file list: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	st := &sendTransfer{
+		logger: log.Default(),
+		opts:   &Opts{FilesNewerThan: "someday"},
+		conn:   &rsyncwire.Conn{Writer: io.Discard},
+	}
+	mod := Module{Name: "interop", Path: source}
+	if _, err := st.sendFileList(mod, st.opts, []string{"interop/"}, nil); err == nil {
+		t.Errorf("sendFileList with invalid --files-newer-than unexpectedly succeeded")
+	}
+
+	// The receiver would delete the files outside of the window.
+	st.opts = &Opts{FilesNewerThan: "7d", Delete: true}
+	if _, err := st.sendFileList(mod, st.opts, []string{"interop/"}, nil); err == nil {
+		t.Errorf("sendFileList with --files-newer-than and --delete unexpectedly succeeded")
+	}
+}
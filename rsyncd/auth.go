@@ -0,0 +1,178 @@
+package rsyncd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gokrazy/rsync/internal/rsyncauth"
+)
+
+// authUser is a user who authenticated successfully for a module.
+type authUser struct {
+	name   string
+	secret string
+}
+
+// authRequired reports whether clients need to authenticate to use the module.
+func (mod Module) authRequired() bool {
+	return len(mod.AuthUsers) > 0
+}
+
+// authorized reports whether user name is listed in the module’s auth users,
+// which may contain wildcards.
+func (mod Module) authorized(name string) bool {
+	for _, pattern := range mod.AuthUsers {
+		for _, tok := range strings.FieldsFunc(pattern, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '\t'
+		}) {
+			if ok, _ := path.Match(tok, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Secrets contains the user:password entries of the modules’ secrets files,
+// keyed by module name and user name.
+type Secrets map[string]map[string]string
+
+// LoadSecrets reads the secrets files of all modules, for use with
+// WithSecrets.
+func LoadSecrets(modules []Module) (Secrets, error) {
+	secrets := make(Secrets)
+	for _, mod := range modules {
+		if mod.SecretsFile == "" {
+			continue
+		}
+		entries, err := mod.readSecrets()
+		if err != nil {
+			return nil, fmt.Errorf("module %q: %v", mod.Name, err)
+		}
+		secrets[mod.Name] = entries
+	}
+	return secrets, nil
+}
+
+// WithSecrets specifies the secrets (see LoadSecrets) the server uses to
+// authenticate clients. By default, the server reads the module’s secrets
+// file for each authentication, which is not reachable after changing the
+// root directory (chroot or mount namespace): load the secrets before doing
+// so. Changes to the secrets files then require restarting the daemon.
+func WithSecrets(secrets Secrets) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.secrets = secrets
+	})
+}
+
+// secret returns the password of user name from the module’s secrets file.
+//
+// rsync/authenticate.c:get_secret
+func (s *Server) secret(mod Module, name string) (string, error) {
+	entries, ok := s.secrets[mod.Name]
+	if !ok {
+		var err error
+		entries, err = mod.readSecrets()
+		if err != nil {
+			return "", err
+		}
+	}
+	password, ok := entries[name]
+	if !ok {
+		return "", fmt.Errorf("missing secret for user %q", name)
+	}
+	return password, nil
+}
+
+// readSecrets reads the user:password lines of the module’s secrets file.
+// Like with rsync, the first line for a user is used.
+func (mod Module) readSecrets() (map[string]string, error) {
+	f, err := os.Open(mod.SecretsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Like rsync’s default “strict modes = yes”:
+	if st.Mode().Perm()&0o006 != 0 {
+		return nil, fmt.Errorf("secrets file %s must not be other-accessible", mod.SecretsFile)
+	}
+	if uid, ok := uidFromFileInfo(st); ok && os.Getuid() == 0 && uid != 0 {
+		return nil, fmt.Errorf("secrets file %s must be owned by root when running as root", mod.SecretsFile)
+	}
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if _, ok := secrets[user]; !ok {
+			secrets[user] = password
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// errAuthFailed is returned when a client fails to authenticate. The reason
+// is only logged, the client just learns that authentication failed.
+var errAuthFailed = errors.New("auth failed")
+
+// errAuthAbandoned is returned when the client disconnects instead of
+// responding to the challenge.
+var errAuthAbandoned = errors.New("client abandoned auth")
+
+// authServer authenticates the client for mod using rsync’s
+// challenge/response protocol.
+//
+// rsync/authenticate.c:auth_server
+func (s *Server) authServer(mod Module, rd *bufio.Reader, w io.Writer) (*authUser, error) {
+	challenge, err := rsyncauth.Challenge()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "@RSYNCD: AUTHREQD %s\n", challenge)
+
+	line, err := readLine(rd)
+	if err == errLineTooLong {
+		s.logger.Printf("auth failed on module %s: challenge response too long", mod.Name)
+		return nil, errAuthFailed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAuthAbandoned, err)
+	}
+	name, response, ok := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	if !ok {
+		s.logger.Printf("auth failed on module %s: invalid challenge response", mod.Name)
+		return nil, errAuthFailed
+	}
+	if !mod.authorized(name) {
+		s.logger.Printf("auth failed on module %s: unauthorized user %q", mod.Name, name)
+		return nil, errAuthFailed
+	}
+	secret, err := s.secret(mod, name)
+	if err != nil {
+		s.logger.Printf("auth failed on module %s: %v", mod.Name, err)
+		return nil, errAuthFailed
+	}
+	if rsyncauth.Response(secret, challenge) != response {
+		s.logger.Printf("auth failed on module %s: password mismatch for user %q", mod.Name, name)
+		return nil, errAuthFailed
+	}
+	return &authUser{name: name, secret: secret}, nil
+}
@@ -0,0 +1,24 @@
+package rsyncd
+
+// WithBwLimit limits the bandwidth of each transfer to kib KiB per second. A
+// client which requests a lower limit (--bwlimit) gets the lower limit.
+//
+// rsync/options.c (--bwlimit in daemon mode)
+func WithBwLimit(kib int) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.bwlimit.Set(kib)
+	})
+}
+
+// SetBwLimit changes the bandwidth limit (see WithBwLimit) to kib KiB per
+// second, including for transfers which are in progress. 0 removes the limit.
+func (s *Server) SetBwLimit(kib int) {
+	s.logger.Printf("bandwidth limit changed to %d KiB/s", kib)
+	s.bwlimit.Set(kib)
+}
+
+// BwLimit returns the current bandwidth limit in KiB per second, 0 meaning
+// unlimited.
+func (s *Server) BwLimit() int {
+	return s.bwlimit.Get()
+}
@@ -0,0 +1,32 @@
+package rsyncd
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// defaultLockFile is rsync’s default “lock file” module parameter.
+const defaultLockFile = "/var/run/rsyncd.lock"
+
+var errMaxConnections = errors.New("max connections reached")
+
+// lockFile returns the name of the file in which the module’s connections are
+// counted.
+func (mod Module) lockFile() string {
+	if mod.LockFile != "" {
+		return mod.LockFile
+	}
+	return defaultLockFile
+}
+
+// slotOffset returns the offset of the module’s first slot within its lock
+// file. Like with rsync, each connection locks a 4 byte record (slot).
+// Unlike rsync, whose modules all count from the start of the lock file (so
+// that modules sharing a lock file share their slots), each module’s slots
+// start at an offset derived from its name. This keeps the limits of modules
+// which share a lock file independent, also across daemon processes.
+func (mod Module) slotOffset() int64 {
+	h := fnv.New32a()
+	h.Write([]byte(mod.Name))
+	return int64(h.Sum32()) << 24
+}
@@ -0,0 +1,48 @@
+package rsyncd
+
+import (
+	"io"
+	"os"
+
+	"github.com/gokrazy/rsync/internal/eintr"
+	"golang.org/x/sys/unix"
+)
+
+// connLimitSupported is true on Linux, where slots are locked using open
+// file description locks: unlike traditional POSIX record locks, they
+// conflict between connections served by the same process.
+const connLimitSupported = true
+
+// claimConnection locks one of the module’s MaxConnections slots in its lock
+// file. It returns errMaxConnections if all slots are locked. The returned
+// function releases the slot.
+//
+// rsync/connection.c:claim_connection
+func (mod Module) claimConnection() (release func(), _ error) {
+	f, err := os.OpenFile(mod.lockFile(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	const slotSize = 4
+	for i := 0; i < mod.MaxConnections; i++ {
+		lk := unix.Flock_t{
+			Type:   unix.F_WRLCK,
+			Whence: io.SeekStart,
+			Start:  mod.slotOffset() + int64(i)*slotSize,
+			Len:    slotSize,
+		}
+		err := eintr.Retry(func() error {
+			return unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk)
+		})
+		if err == nil {
+			// Closing the file releases the lock.
+			return func() { f.Close() }, nil
+		}
+		if err != unix.EAGAIN && err != unix.EACCES {
+			f.Close()
+			return nil, &os.PathError{Op: "fcntl(F_OFD_SETLK)", Path: f.Name(), Err: err}
+		}
+	}
+	f.Close()
+	return nil, errMaxConnections
+}
@@ -0,0 +1,147 @@
+package rsyncd_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestMaxConnections(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "rsyncd.lock")
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name:           "one",
+			Path:           t.TempDir(),
+			MaxConnections: 1,
+			LockFile:       lockFile,
+		},
+		{
+			Name:           "two",
+			Path:           t.TempDir(),
+			MaxConnections: 2,
+			LockFile:       lockFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connect requests the module and returns the response of the daemon. The
+	// connection is kept open until the returned function is called (or the
+	// test ends).
+	connect := func(t *testing.T, module string) (release func(), _ string) {
+		t.Helper()
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			srv.HandleDaemonConn(context.Background(), server, client.LocalAddr())
+		}()
+		release = func() {
+			client.Close()
+			<-done // wait for the daemon to release the slot
+		}
+		t.Cleanup(release)
+		rd := bufio.NewReader(client)
+		if _, err := rd.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(client, "@RSYNCD: 27\n")
+		fmt.Fprintf(client, "%s\n", module)
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return release, strings.TrimSpace(line)
+	}
+	const ok = "@RSYNCD: OK"
+
+	closeOne, got := connect(t, "one")
+	if got != ok {
+		t.Fatalf("first connection to module one: got %q, want %q", got, ok)
+	}
+	if _, got := connect(t, "one"); got != "@ERROR: max connections (1) reached -- try again later" {
+		t.Errorf("second connection to module one: got %q, want max connections error", got)
+	}
+
+	// Module two shares the lock file, but not the slots of module one.
+	for i := 0; i < 2; i++ {
+		if _, got := connect(t, "two"); got != ok {
+			t.Errorf("connection %d to module two: got %q, want %q", i, got, ok)
+		}
+	}
+	if _, got := connect(t, "two"); got != "@ERROR: max connections (2) reached -- try again later" {
+		t.Errorf("third connection to module two: got %q, want max connections error", got)
+	}
+
+	// Terminating the connection releases its slot.
+	closeOne()
+	if _, got := connect(t, "one"); got != ok {
+		t.Errorf("connection to module one after release: got %q, want %q", got, ok)
+	}
+}
+
+func TestMaxConnectionsAuthAbandoned(t *testing.T) {
+	tmp := t.TempDir()
+	secrets := filepath.Join(tmp, "secrets")
+	if err := os.WriteFile(secrets, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name:           "auth",
+			Path:           t.TempDir(),
+			AuthUsers:      []string{"alice"},
+			SecretsFile:    secrets,
+			MaxConnections: 1,
+			LockFile:       filepath.Join(tmp, "rsyncd.lock"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			errc <- srv.HandleDaemonConn(context.Background(), server, client.LocalAddr())
+		}()
+		rd := bufio.NewReader(client)
+		if _, err := rd.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(client, "@RSYNCD: 27\n")
+		fmt.Fprintf(client, "auth\n")
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The second challenge is only sent if the first connection
+		// released its slot.
+		if got, want := line, "@RSYNCD: AUTHREQD "; !strings.HasPrefix(got, want) {
+			t.Fatalf("connection %d: got %q, want prefix %q", i, got, want)
+		}
+
+		// Disconnect instead of responding to the challenge.
+		client.Close()
+		select {
+		case err := <-errc:
+			if err == nil || !strings.Contains(err.Error(), "abandoned auth") {
+				t.Errorf("HandleDaemonConn: got err=%v, want abandoned auth error", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("HandleDaemonConn did not return after the client disconnected")
+		}
+	}
+}
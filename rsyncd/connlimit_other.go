@@ -0,0 +1,13 @@
+//go:build !linux
+
+package rsyncd
+
+import "errors"
+
+// connLimitSupported is false: without open file description locks, the
+// connections served by the same daemon process cannot be told apart.
+const connLimitSupported = false
+
+func (mod Module) claimConnection() (release func(), _ error) {
+	return nil, errors.New("max connections is not supported on this platform")
+}
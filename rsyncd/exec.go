@@ -0,0 +1,146 @@
+package rsyncd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/log"
+)
+
+// defaultXferExecTimeout applies to exec hooks of modules which do not
+// specify XferExecTimeout.
+const defaultXferExecTimeout = 60 * time.Second
+
+// xferExecTimeout returns how long the module’s exec hooks may run before they
+// are killed.
+func (mod Module) xferExecTimeout() time.Duration {
+	if mod.XferExecTimeout > 0 {
+		return time.Duration(mod.XferExecTimeout) * time.Second
+	}
+	return defaultXferExecTimeout
+}
+
+// xferExecEnv returns the environment variables which rsync provides to the
+// pre-xfer and post-xfer exec commands.
+//
+// rsync/clientserver.c:rsync_module
+func xferExecEnv(mod Module, remoteAddr net.Addr, user string) []string {
+	var host string
+	if remoteAddr != nil { // nil when serving a remote shell connection
+		host = remoteAddr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return append(os.Environ(),
+		"RSYNC_MODULE_NAME="+mod.Name,
+		"RSYNC_MODULE_PATH="+mod.Path,
+		"RSYNC_HOST_ADDR="+host,
+		"RSYNC_USER_NAME="+user,
+		"RSYNC_PID="+strconv.Itoa(os.Getpid()))
+}
+
+// preXferEnv adds the client request and arguments to env.
+func preXferEnv(env []string, requested string, args []string) []string {
+	env = append(env, "RSYNC_REQUEST="+requested)
+	env = append(env, "RSYNC_ARG0=rsyncd")
+	for idx, arg := range args {
+		env = append(env, fmt.Sprintf("RSYNC_ARG%d=%s", idx+1, arg))
+	}
+	return env
+}
+
+// postXferEnv adds the transfer result to env. RSYNC_EXIT_STATUS is the exit
+// code determined by xferErr (see rsync.ExitError), or 1 for errors without
+// one. Like rsync, RSYNC_RAW_STATUS is the wait(2) status, i.e. the exit status
+// shifted by 8 bits.
+func postXferEnv(env []string, xferErr error) []string {
+	status := rsync.RERR_OK
+	if xferErr != nil {
+		status = 1
+		var ee *rsync.ExitError
+		if errors.As(xferErr, &ee) {
+			status = ee.Code
+		}
+	}
+	return append(env,
+		"RSYNC_EXIT_STATUS="+strconv.Itoa(status),
+		"RSYNC_RAW_STATUS="+strconv.Itoa(status<<8))
+}
+
+// errXferExecTimeout is returned by runXferExec when the command was killed
+// because it did not finish within the timeout.
+var errXferExecTimeout = errors.New("timed out")
+
+// runXferExec runs the exec hook command (using the shell) with env. The
+// command (including any processes it started) is killed if it does not
+// finish within timeout. Its standard output and standard error are logged
+// line by line.
+func (s *Server) runXferExec(ctx context.Context, hook, command string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out := &lineLogger{logger: s.logger, prefix: hook + ": "}
+	defer out.Flush()
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// Kill the entire process group: processes started by the command
+		// would otherwise keep the output pipe open, and Wait would not
+		// return until they exit.
+		killProcessGroup(cmd)
+		<-done
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%w after %v", errXferExecTimeout, timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+// lineLogger is an io.Writer which logs each line written to it.
+type lineLogger struct {
+	logger log.Logger
+	prefix string
+	buf    []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		idx := bytes.IndexByte(l.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		l.logger.Printf("%s%s", l.prefix, strings.TrimSuffix(string(l.buf[:idx]), "\r"))
+		l.buf = l.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs the last line, if it was not terminated by a newline.
+func (l *lineLogger) Flush() {
+	if len(l.buf) > 0 {
+		l.logger.Printf("%s%s", l.prefix, l.buf)
+		l.buf = nil
+	}
+}
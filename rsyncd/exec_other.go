@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package rsyncd
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,91 @@
+package rsyncd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync"
+	"github.com/google/go-cmp/cmp"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recordingLogger) Printf(msg string, a ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(msg, a...))
+}
+
+func TestRunXferExecTimeout(t *testing.T) {
+	logger := &recordingLogger{}
+	s := &Server{logger: logger}
+	start := time.Now()
+	err := s.runXferExec(context.Background(), "pre-xfer exec", "echo hello; echo oops >&2; sleep 10; echo unreachable", nil, 1*time.Second)
+	if !errors.Is(err, errXferExecTimeout) {
+		t.Fatalf("runXferExec: got %v, want %v", err, errXferExecTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runXferExec returned after %v, want the hook to be killed after 1s", elapsed)
+	}
+	got := strings.Join(logger.lines, "\n")
+	for _, want := range []string{"pre-xfer exec: hello", "pre-xfer exec: oops"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log output does not contain %q: %q", want, got)
+		}
+	}
+	if strings.Contains(got, "unreachable") {
+		t.Errorf("log output unexpectedly contains output after the timeout: %q", got)
+	}
+}
+
+func TestRunXferExecStatus(t *testing.T) {
+	s := &Server{logger: &recordingLogger{}}
+	if err := s.runXferExec(context.Background(), "post-xfer exec", "exit 0", nil, time.Minute); err != nil {
+		t.Errorf("runXferExec(exit 0): %v", err)
+	}
+	if err := s.runXferExec(context.Background(), "post-xfer exec", "exit 3", nil, time.Minute); err == nil {
+		t.Errorf("runXferExec(exit 3): unexpectedly succeeded")
+	}
+}
+
+func TestPostXferEnv(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		xferErr error
+		want    []string
+	}{
+		{
+			name: "Success",
+			want: []string{"RSYNC_EXIT_STATUS=0", "RSYNC_RAW_STATUS=0"},
+		},
+		{
+			name:    "Error",
+			xferErr: errors.New("connection reset"),
+			want:    []string{"RSYNC_EXIT_STATUS=1", "RSYNC_RAW_STATUS=256"},
+		},
+		{
+			name: "ExitError",
+			xferErr: fmt.Errorf("receiving: %w", &rsync.ExitError{
+				Code: rsync.RERR_FILEIO,
+				Err:  errors.New("write failed"),
+			}),
+			want: []string{"RSYNC_EXIT_STATUS=11", "RSYNC_RAW_STATUS=2816"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := postXferEnv([]string{"RSYNC_MODULE_NAME=interop"}, tt.xferErr)
+			want := append([]string{"RSYNC_MODULE_NAME=interop"}, tt.want...)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("postXferEnv: unexpected env: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package rsyncd
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// A negative pid signals the process group, see kill(2).
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,33 @@
+package rsyncd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/rsync/internal/longpath"
+)
+
+// InjectWalkError makes the file list traversal (and looking up the names of a
+// --files-from list) fail to read path with err, regardless of the permissions
+// of the file (and of the uid of the test). The returned function restores the
+// regular traversal.
+func InjectWalkError(path string, err error) (restore func()) {
+	walk = func(root string, fn filepath.WalkFunc) error {
+		return longpath.Walk(root, func(p string, info os.FileInfo, walkErr error) error {
+			if p == path {
+				return fn(p, nil, &os.PathError{Op: "lstat", Path: p, Err: err})
+			}
+			return fn(p, info, walkErr)
+		})
+	}
+	lstat = func(p string) (os.FileInfo, error) {
+		if p == path {
+			return nil, &os.PathError{Op: "lstat", Path: p, Err: err}
+		}
+		return longpath.Lstat(p)
+	}
+	return func() {
+		walk = longpath.Walk
+		lstat = longpath.Lstat
+	}
+}
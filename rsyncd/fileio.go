@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/longpath"
 )
 
 // rsync.h:map_struct
@@ -68,6 +69,14 @@ func (ms *mapStruct) ptr(offset int64, l int32) []byte {
 	if windowSize < len+alignFudge {
 		windowSize = alignedLength(len + alignFudge)
 	}
+	if windowStart+windowSize > ms.fileSize && windowStart+len+alignFudge <= ms.fileSize {
+		// hashSearch requests regions larger than the default window when
+		// an unmatched run near the end of the file grows beyond chunkSize
+		// (rsync’s smaller CHUNK_SIZE keeps such runs within its window).
+		// Do not let the alignment extend the window past the end of the
+		// file, where reading fails.
+		windowSize = ms.fileSize - windowStart
+	}
 	if windowSize > ms.pSize {
 		win := make([]byte, windowSize)
 		copy(win, ms.window)
@@ -116,3 +125,15 @@ func (ms *mapStruct) ptr(offset int64, l int32) []byte {
 	}
 	return ms.window[alignFudge : alignFudge+len]
 }
+
+// openFile opens the file at path for reading. With --open-noatime, reading
+// the file does not update its access time.
+//
+// rsync/syscall.c:do_open
+func (st *sendTransfer) openFile(path string) (*os.File, error) {
+	flag := os.O_RDONLY
+	if st.opts.OpenNoatime {
+		flag |= oNoatime
+	}
+	return longpath.OpenFile(path, flag, 0)
+}
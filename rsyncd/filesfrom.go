@@ -0,0 +1,171 @@
+package rsyncd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/longpath"
+)
+
+// readFilesFrom reads a --files-from list from r. Names are terminated by a
+// null byte (--from0) or a newline. When reading from the connection, the list
+// is terminated by an empty name; when reading from a file, by EOF.
+//
+// rsync/io.c:read_filesfrom_line
+func readFilesFrom(r *bufio.Reader, from0, fromConn bool) ([]string, error) {
+	delim := byte('\n')
+	if from0 {
+		delim = 0
+	}
+	var names []string
+	for {
+		line, err := r.ReadString(delim)
+		if err != nil && (err != io.EOF || fromConn) {
+			return nil, err
+		}
+		eof := err == io.EOF
+		line = strings.TrimSuffix(line, string(delim))
+		if !from0 {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		if line == "" && fromConn {
+			return names, nil
+		}
+		if !from0 && (strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";")) {
+			line = "" // comment
+		}
+		if name := sanitizePath(line); name != "" {
+			names = append(names, name)
+		}
+		if eof {
+			return names, nil
+		}
+	}
+}
+
+// sanitizePath turns name into a relative path which cannot escape the
+// directory it is relative to: leading slashes and “..” elements which would
+// go above the top are removed. An empty result means the name refers to the
+// top directory itself.
+//
+// rsync/util.c:sanitize_path
+func sanitizePath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// receiveFilesFrom returns the --files-from list, either as sent by the client
+// (--files-from=-) or read from a file within the module.
+func (st *sendTransfer) receiveFilesFrom(mod Module, opts *Opts) ([]string, error) {
+	if opts.FilesFrom == "-" {
+		br, ok := st.conn.Reader.(*bufio.Reader)
+		if !ok {
+			br = bufio.NewReader(st.conn.Reader)
+			// Subsequent reads must go through br so that no buffered
+			// data is lost.
+			st.conn.Reader = br
+		}
+		return readFilesFrom(br, opts.From0, true)
+	}
+	fn := filepath.Join(mod.Path, sanitizePath(opts.FilesFrom))
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("--files-from: %v", err)
+	}
+	defer f.Close()
+	return readFilesFrom(bufio.NewReader(f), opts.From0, false)
+}
+
+// addFilesFrom adds the names of the --files-from list, which are relative to
+// strip, to the file list. Like rsync, the parent directories of each name are
+// added as well (implied directories), and listed directories are only
+// traversed with --recursive. The filter rules apply to the listed names and
+// their contents, but not to the implied directories.
+//
+// Like when traversing the requested paths, names which cannot be read are
+// skipped and reflected in the returned i/o error flags.
+func (st *sendTransfer) addFilesFrom(opts *Opts, strip string, names []string, addEntry func(path, strip, name string, info os.FileInfo, flags byte) error) (ioErrors int32, _ error) {
+	// Only ever transmit long names, like openrsync
+	const flags = byte(rsync.XMIT_LONG_NAME)
+	seen := make(map[string]bool)
+	addName := func(path string, info os.FileInfo) error {
+		name := strings.TrimPrefix(path, strip)
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		return addEntry(path, strip, name, info, flags)
+	}
+	add := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			st.logger.Printf("%v", err)
+			ioErrors |= rsync.IOERR_GENERAL
+			if info == nil {
+				return nil // cannot be transmitted
+			}
+		}
+		name := strings.TrimPrefix(path, strip)
+		if st.excluded(name, info) || st.daemonExcluded(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := st.enterDir(name, path, info); err != nil {
+			return err
+		}
+		return addName(path, info)
+	}
+Names:
+	for _, name := range names {
+		for idx := strings.IndexByte(name, '/'); idx > -1; {
+			dir := filepath.Join(strip, name[:idx])
+			info, err := longpath.Lstat(dir)
+			if err != nil {
+				// Like a missing name itself, skip names whose implied
+				// directories cannot be found.
+				st.logger.Printf("link_stat %q failed: %v", dir, err)
+				ioErrors |= rsync.IOERR_GENERAL
+				continue Names
+			}
+			if st.daemonExcluded(dir, info) {
+				break
+			}
+			if err := addName(dir, info); err != nil {
+				return 0, err
+			}
+			next := strings.IndexByte(name[idx+1:], '/')
+			if next == -1 {
+				break
+			}
+			idx += 1 + next
+		}
+		path := filepath.Join(strip, name)
+		info, err := lstat(path)
+		if err != nil {
+			// Like rsync, skip files which cannot be found and continue, but
+			// keep the receiver from deleting them.
+			st.logger.Printf("link_stat %q failed: %v", path, err)
+			ioErrors |= rsync.IOERR_GENERAL
+			continue
+		}
+		if info.IsDir() && opts.Recurse {
+			if err := walk(path, add); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := add(path, info, nil); err != nil && err != filepath.SkipDir {
+			return 0, err
+		}
+	}
+	return ioErrors, nil
+}
@@ -1,14 +1,18 @@
 package rsyncd
 
 import (
+	"fmt"
 	"os"
-	"os/user"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/fileflags"
+	"github.com/gokrazy/rsync/internal/idnames"
+	"github.com/gokrazy/rsync/internal/longpath"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
@@ -17,180 +21,376 @@ var (
 	lookupGroupOnce sync.Once
 )
 
+// idNames returns the Lookup for the names of the file owners.
+func (st *sendTransfer) idNames() idnames.Lookup {
+	if st.ids == nil {
+		return idnames.System
+	}
+	return st.ids
+}
+
+// excluded reports whether the file list entry name (relative to the root of
+// the transfer) is excluded by the client’s filter rules. The top directory
+// (“.”) is never excluded.
+//
+// rsync/flist.c:is_excluded
+func (st *sendTransfer) excluded(name string, info os.FileInfo) bool {
+	return st.scope.Excluded(name, info.IsDir())
+}
+
+// enterDir reads the per-directory filter files of the file list entry name
+// (if it is a directory) at (local) path, which apply to its contents.
+func (st *sendTransfer) enterDir(name, path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return nil
+	}
+	return st.scope.Enter(name, path)
+}
+
+// daemonExcluded reports whether the file at (local) path is excluded by the
+// module’s filter rules, which match paths relative to the module root. Unlike
+// the client’s rules, they apply to the requested paths themselves, and to
+// everything within excluded directories, even when not reached by traversal
+// (e.g. names listed with --files-from).
+//
+// rsync/flist.c:is_excluded (daemon_filter_list)
+func (st *sendTransfer) daemonExcluded(path string, info os.FileInfo) bool {
+	if st.daemonFilters == nil {
+		return false
+	}
+	rel, err := filepath.Rel(st.modRoot, path)
+	if err != nil {
+		return true
+	}
+	if excludedByModule(st.daemonFilters, filepath.ToSlash(rel), info.IsDir()) {
+		st.logger.Printf("skipping daemon-excluded file %q", path)
+		return true
+	}
+	return false
+}
+
+// excludedByModule reports whether rel (relative to the module root) or any of
+// its parent directories is excluded by the module’s filter rules.
+func excludedByModule(filters *rsyncfilter.List, rel string, isDir bool) bool {
+	if filters.Excluded(rel, isDir) {
+		return true
+	}
+	for idx := strings.IndexByte(rel, '/'); idx > -1; {
+		if filters.Excluded(rel[:idx], true) {
+			return true
+		}
+		next := strings.IndexByte(rel[idx+1:], '/')
+		if next == -1 {
+			break
+		}
+		idx += 1 + next
+	}
+	return false
+}
+
+// walk traverses the requested paths for the file list, and lstat looks up
+// the names of a --files-from list. Tests replace them to inject errors which
+// would otherwise require unreadable files.
+var (
+	walk  = longpath.Walk
+	lstat = longpath.Lstat
+)
+
 // rsync/flist.c:send_file_list
-func (st *sendTransfer) sendFileList(mod Module, opts *Opts, paths []string) (*fileList, error) {
+// With --files-from, filesFrom contains the names read from the list, which
+// are used instead of traversing the requested paths. An empty list transfers
+// no files.
+func (st *sendTransfer) sendFileList(mod Module, opts *Opts, paths []string, filesFrom []string) (*fileList, error) {
 	var fileList fileList
 	fec := &rsyncwire.Buffer{}
 
 	uidMap := make(map[int32]string)
 	gidMap := make(map[int32]string)
 
+	// dirs interns the directory part of wire paths so that all files within
+	// the same directory share one string.
+	dirs := make(map[string]string)
+	intern := func(dir string) string {
+		if interned, ok := dirs[dir]; ok {
+			return interned
+		}
+		// copy to not pin the (longer) walked path in memory
+		dir = string([]byte(dir))
+		dirs[dir] = dir
+		return dir
+	}
+
 	// TODO: flush in between to keep the pipes filled when traversal takes long
 
-	// TODO: handle info == nil case (permission denied?): should set an i/o
-	// error flag, but traversal should continue
+	// ioErrors is transmitted after the file list so that the receiver can
+	// skip deletions when the file list is incomplete.
+	var ioErrors int32
 
-	st.logger.Printf("sendFileList(module=%q)", mod.Name)
-	// TODO: handle |root| referring to an individual file, symlink or special (skip)
-	for _, requested := range paths {
-		modRoot := mod.Path
-		st.logger.Printf("  path %q (module root %q)", requested, modRoot)
-		root := strings.TrimPrefix(requested, mod.Name+"/")
-		root = filepath.Clean(mod.Path + "/" + root)
-		// st.logger.Printf("  filepath.Walk(%q)", root)
-		strip := filepath.Dir(filepath.Clean(root)) + "/"
-		if strings.HasSuffix(requested, "/") {
-			strip = filepath.Clean(root) + "/"
-		}
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			// st.logger.Printf("filepath.WalkFn(path=%s)", path)
+	chmod, err := mod.chmod(mod.OutgoingChmod)
+	if err != nil {
+		return nil, err
+	}
+
+	st.modRoot = mod.Path
+
+	ages, err := newAgeFilter(opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// addEntry appends the file at (local) path to the file list and encodes
+	// its file list entry, using the wire path name (relative to strip).
+	fakeSuper := opts.FakeSuper || mod.FakeSuper
+
+	addEntry := func(path, strip, name string, info os.FileInfo, flags byte) error {
+		if !ages.includes(info) {
+			return nil
+		}
+		if fakeSuper {
+			var err error
+			info, err = fakeSuperStat(path, info)
 			if err != nil {
 				return err
 			}
+		}
+		if mod.MaxFiles > 0 && len(fileList.files) >= mod.MaxFiles {
+			return fmt.Errorf("file list exceeds the limit of %d files of module %q", mod.MaxFiles, mod.Name)
+		}
+		dir, base := "", name
+		if idx := strings.LastIndexByte(name, '/'); idx > -1 {
+			dir, base = intern(name[:idx]), name[idx+1:]
+		}
+		fileList.files = append(fileList.files, file{
+			root:    strip,
+			dir:     dir,
+			name:    string([]byte(base)),
+			regular: info.Mode().IsRegular(),
+			size:    info.Size(),
+			mtime:   info.ModTime().Unix(),
+		})
 
-			// Only ever transmit long names, like openrsync
-			flags := byte(rsync.XMIT_LONG_NAME)
+		// 1.   status byte (integer)
+		fec.WriteByte(flags)
 
-			name := strings.TrimPrefix(path, strip)
-			// st.logger.Printf("Trim(path=%q, %q) = %q", path, strip, name)
-			if name == root {
-				name = "."
-				flags |= rsync.XMIT_TOP_DIR
-			}
-			// st.logger.Printf("flags for %q: %v", name, flags)
+		// 2.   inherited filename length (optional, byte)
+		// 3.   filename length (integer or byte)
+		fec.WriteInt32(int32(len(name)))
 
-			fileList.files = append(fileList.files, file{
-				path:    path,
-				regular: info.Mode().IsRegular(),
-				wpath:   name,
-			})
+		// 4.   file (byte array)
+		fec.WriteString(name)
 
-			// 1.   status byte (integer)
-			fec.WriteByte(flags)
+		// 5.   file length (long)
+		size := info.Size()
+		if info.Mode().IsDir() {
+			// tmpfs returns non-4K sizes for directories. Override with
+			// 4096 to make the tests succeed regardless of the /tmp file
+			// system type.
+			size = 4096
+		}
+		fec.WriteInt64(size)
 
-			// 2.   inherited filename length (optional, byte)
-			// 3.   filename length (integer or byte)
-			fec.WriteInt32(int32(len(name)))
+		fileList.totalSize += size
 
-			// 4.   file (byte array)
-			fec.WriteString(name)
+		// 6.   file modification time (optional, integer)
+		// TODO: this will overflow in 2038! :(
+		fec.WriteInt32(int32(info.ModTime().Unix()))
 
-			// 5.   file length (long)
-			size := info.Size()
-			if info.Mode().IsDir() {
-				// tmpfs returns non-4K sizes for directories. Override with
-				// 4096 to make the tests succeed regardless of the /tmp file
-				// system type.
-				size = 4096
-			}
-			fec.WriteInt64(size)
-
-			fileList.totalSize += size
-
-			// 6.   file modification time (optional, integer)
-			// TODO: this will overflow in 2038! :(
-			fec.WriteInt32(int32(info.ModTime().Unix()))
-
-			// 7.   file mode (optional, mode_t, integer)
-			mode := int32(info.Mode() & os.ModePerm)
-			isDev := false
-			isSpecial := false
-			if info.Mode().IsDir() {
-				mode |= rsync.S_IFDIR
-			} else if info.Mode().IsRegular() {
-				mode |= rsync.S_IFREG
-			} else if info.Mode().Type()&os.ModeSymlink != 0 {
-				mode |= rsync.S_IFLNK
-				// TODO: skip symlink if PreserveSymlinks is not set
-			}
+		// 7.   file mode (optional, mode_t, integer)
+		mode := int32(info.Mode() & os.ModePerm)
+		if info.Mode()&os.ModeSetuid != 0 {
+			mode |= 0o4000
+		}
+		if info.Mode()&os.ModeSetgid != 0 {
+			mode |= 0o2000
+		}
+		if info.Mode()&os.ModeSticky != 0 {
+			mode |= 0o1000
+		}
+		isDev := false
+		isSpecial := false
+		if info.Mode().IsDir() {
+			mode |= rsync.S_IFDIR
+		} else if info.Mode().IsRegular() {
+			mode |= rsync.S_IFREG
+		} else if info.Mode().Type()&os.ModeSymlink != 0 {
+			mode |= rsync.S_IFLNK
+			// TODO: skip symlink if PreserveSymlinks is not set
+		}
 
-			if info.Mode().Type()&os.ModeCharDevice != 0 {
-				mode |= rsync.S_IFCHR
-				isDev = true
-			} else if info.Mode().Type()&os.ModeDevice != 0 {
-				mode |= rsync.S_IFBLK
-				isDev = true
-			}
+		if info.Mode().Type()&os.ModeCharDevice != 0 {
+			mode |= rsync.S_IFCHR
+			isDev = true
+		} else if info.Mode().Type()&os.ModeDevice != 0 {
+			mode |= rsync.S_IFBLK
+			isDev = true
+		}
 
-			if info.Mode().Type()&os.ModeNamedPipe != 0 {
-				mode |= rsync.S_IFIFO
-				isSpecial = true
-			}
+		if info.Mode().Type()&os.ModeNamedPipe != 0 {
+			mode |= rsync.S_IFIFO
+			isSpecial = true
+		}
 
-			if info.Mode().Type()&os.ModeSocket != 0 {
-				mode |= rsync.S_IFSOCK
-				isSpecial = true
+		if info.Mode().Type()&os.ModeSocket != 0 {
+			mode |= rsync.S_IFSOCK
+			isSpecial = true
+		}
+
+		if chmod != nil && mode&rsync.S_IFMT != rsync.S_IFLNK {
+			mode = chmod.Apply(mode)
+		}
+		fec.WriteInt32(mode)
+
+		if opts.PreserveFileflags {
+			var flags uint32
+			if info.Mode().IsRegular() || info.IsDir() {
+				var err error
+				flags, err = fileflags.Get(path)
+				if err != nil {
+					st.logger.Printf("%v", err)
+				}
 			}
+			fec.WriteInt32(int32(flags))
+		}
 
-			fec.WriteInt32(mode)
-
-			if opts.PreserveUid {
-				uid, ok := uidFromFileInfo(info)
-				if ok {
-					if _, ok := uidMap[uid]; !ok && uid != 0 {
-						u, err := user.LookupId(strconv.Itoa(int(uid)))
-						if err != nil {
-							lookupOnce.Do(func() {
-								st.logger.Printf("lookup(%d) = %v", uid, err)
-							})
-						} else {
-							uidMap[uid] = u.Username
-						}
+		if opts.PreserveUid {
+			uid, ok := uidFromFileInfo(info)
+			if ok {
+				if _, ok := uidMap[uid]; !ok && uid != 0 && !opts.NumericIds {
+					name, err := st.idNames().UserName(uid)
+					if err != nil {
+						lookupOnce.Do(func() {
+							st.logger.Printf("lookup(%d) = %v", uid, err)
+						})
+					} else {
+						uidMap[uid] = name
 					}
 				}
-				// 8.   if -o, the user id (integer)
-				fec.WriteInt32(uid)
 			}
+			// 8.   if -o, the user id (integer)
+			fec.WriteInt32(uid)
+		}
 
-			if opts.PreserveGid {
-				gid, ok := gidFromFileInfo(info)
-				if ok {
-					if _, ok := gidMap[gid]; !ok && gid != 0 {
-						g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
-						if err != nil {
-							lookupGroupOnce.Do(func() {
-								st.logger.Printf("lookupgroup(%d) = %v", gid, err)
-							})
-						} else {
-							gidMap[gid] = g.Name
-						}
+		if opts.PreserveGid {
+			gid, ok := gidFromFileInfo(info)
+			if ok {
+				if _, ok := gidMap[gid]; !ok && gid != 0 && !opts.NumericIds {
+					name, err := st.idNames().GroupName(gid)
+					if err != nil {
+						lookupGroupOnce.Do(func() {
+							st.logger.Printf("lookupgroup(%d) = %v", gid, err)
+						})
+					} else {
+						gidMap[gid] = name
 					}
 				}
-				// 9.   if -g, the group id (integer)
-				fec.WriteInt32(gid)
 			}
+			// 9.   if -g, the group id (integer)
+			fec.WriteInt32(gid)
+		}
+
+		if (opts.PreserveDevices && isDev) ||
+			(opts.PreserveSpecials && isSpecial) {
+			// 10.  if a special file and -D, the device “rdev” type (integer)
+			rdev, _ := rdevFromFileInfo(info)
+			fec.WriteInt32(rdev)
+		}
 
-			if (opts.PreserveDevices && isDev) ||
-				(opts.PreserveSpecials && isSpecial) {
-				// 10.  if a special file and -D, the device “rdev” type (integer)
-				rdev, _ := rdevFromFileInfo(info)
-				fec.WriteInt32(rdev)
+		if opts.PreserveLinks && info.Mode().Type()&os.ModeSymlink != 0 {
+			// 11.  if a symbolic link and -l, the link target's length (integer)
+			// 12.  if a symbolic link and -l, the link target (byte array)
+			target, err := longpath.Readlink(path)
+			if err != nil {
+				return err // TODO
 			}
+			fec.WriteInt32(int32(len(target)))
+			fec.WriteString(target)
+		}
 
-			if opts.PreserveLinks && info.Mode().Type()&os.ModeSymlink != 0 {
-				// 11.  if a symbolic link and -l, the link target's length (integer)
-				// 12.  if a symbolic link and -l, the link target (byte array)
-				target, err := os.Readlink(path)
-				if err != nil {
-					return err // TODO
+		// The status byte may consist of the following bits and determines which of the optional fields are transmitted.
+
+		// 0x01    A top-level directory.  (Only applies to directory files.)  If specified, the matching local directory is for deletions.
+		// 0x02    Do not send the file mode: it is a repeat of the last file's mode.
+		// 0x08    Like 0x02, but for the user id.
+		// 0x10    Like 0x02, but for the group id.
+		// 0x20    Inherit some of the prior file name.  Enables the inherited filename length transmission.
+		// 0x40    Use full integer length for file name.  Otherwise, use only the byte length.
+		// 0x80    Do not send the file modification time: it is a repeat of the last file's.
+
+		// If the status byte is zero, the file-list has terminated.
+
+		return nil
+	}
+
+	st.logger.Printf("sendFileList(module=%q)", mod.Name)
+	// TODO: handle |root| referring to an individual file, symlink or special (skip)
+	for _, requested := range paths {
+		modRoot := mod.Path
+		st.logger.Printf("  path %q (module root %q)", requested, modRoot)
+		sub := mod.subpath(requested)
+		root := filepath.Join(mod.Path, sub)
+		if opts.FilesFrom != "" {
+			// With --files-from, the requested path is the directory to which
+			// the listed names are relative. Like with rsync’s --relative
+			// (implied by --files-from), names are transmitted including their
+			// directories.
+			ioErr, err := st.addFilesFrom(opts, root+"/", filesFrom, addEntry)
+			if err != nil {
+				return nil, err
+			}
+			ioErrors |= ioErr
+			continue
+		}
+		// st.logger.Printf("  longpath.Walk(%q)", root)
+		// Like rsync, a trailing slash (or requesting the module itself, which
+		// rsync turns into “.”) transfers the contents of the directory
+		// instead of the directory itself.
+		strip := filepath.Dir(root) + "/"
+		if sub == "" || strings.HasSuffix(requested, "/") {
+			strip = root + "/"
+		}
+		err := walk(root, func(path string, info os.FileInfo, err error) error {
+			// st.logger.Printf("filepath.WalkFn(path=%s)", path)
+			if err != nil {
+				// Like rsync, report the error, set the i/o error flag and
+				// continue with the next entry.
+				st.logger.Printf("%v", err)
+				ioErrors |= rsync.IOERR_GENERAL
+				if info == nil {
+					return nil // cannot be transmitted
 				}
-				fec.WriteInt32(int32(len(target)))
-				fec.WriteString(target)
+				// The directory itself is transmitted, but its contents could
+				// not be read (longpath.Walk does not descend).
 			}
 
-			// The status byte may consist of the following bits and determines which of the optional fields are transmitted.
+			// Only ever transmit long names, like openrsync
+			flags := byte(rsync.XMIT_LONG_NAME)
 
-			// 0x01    A top-level directory.  (Only applies to directory files.)  If specified, the matching local directory is for deletions.
-			// 0x02    Do not send the file mode: it is a repeat of the last file's mode.
-			// 0x08    Like 0x02, but for the user id.
-			// 0x10    Like 0x02, but for the group id.
-			// 0x20    Inherit some of the prior file name.  Enables the inherited filename length transmission.
-			// 0x40    Use full integer length for file name.  Otherwise, use only the byte length.
-			// 0x80    Do not send the file modification time: it is a repeat of the last file's.
+			if st.daemonExcluded(path, info) {
+				if info.IsDir() {
+					return filepath.SkipDir // do not descend
+				}
+				return nil
+			}
 
-			// If the status byte is zero, the file-list has terminated.
+			name := strings.TrimPrefix(path, strip)
+			// st.logger.Printf("Trim(path=%q, %q) = %q", path, strip, name)
+			if name == root {
+				name = "."
+				flags |= rsync.XMIT_TOP_DIR
+			} else if st.excluded(name, info) {
+				if info.IsDir() {
+					return filepath.SkipDir // do not descend
+				}
+				return nil
+			}
+			// st.logger.Printf("flags for %q: %v", name, flags)
 
-			return nil
+			if err == nil {
+				if err := st.enterDir(name, path, info); err != nil {
+					return err
+				}
+			}
+			return addEntry(path, strip, name, info, flags)
 		})
 		if err != nil {
 			return nil, err
@@ -200,21 +400,25 @@ func (st *sendTransfer) sendFileList(mod Module, opts *Opts, paths []string) (*f
 	const endOfFileList = 0
 	fec.WriteByte(endOfFileList)
 
+	// rsync/uidlist.c:send_id_lists (not sent with --numeric-ids)
 	const endOfSet = 0
-	for uid, name := range uidMap {
-		fec.WriteInt32(uid)
-		fec.WriteByte(byte(len(name)))
-		fec.WriteString(name)
+	if opts.PreserveUid && !opts.NumericIds {
+		for uid, name := range uidMap {
+			fec.WriteInt32(uid)
+			fec.WriteByte(byte(len(name)))
+			fec.WriteString(name)
+		}
+		fec.WriteInt32(endOfSet)
 	}
-	fec.WriteInt32(endOfSet)
-	for gid, name := range gidMap {
-		fec.WriteInt32(gid)
-		fec.WriteByte(byte(len(name)))
-		fec.WriteString(name)
+	if opts.PreserveGid && !opts.NumericIds {
+		for gid, name := range gidMap {
+			fec.WriteInt32(gid)
+			fec.WriteByte(byte(len(name)))
+			fec.WriteString(name)
+		}
+		fec.WriteInt32(endOfSet)
 	}
-	fec.WriteInt32(endOfSet)
 
-	const ioErrors = 0
 	fec.WriteInt32(ioErrors)
 
 	if err := st.conn.WriteString(fec.String()); err != nil {
@@ -0,0 +1,286 @@
+package rsyncd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+	"github.com/google/go-cmp/cmp"
+)
+
+// createDeepTree creates a tree of the specified depth below dir, with the
+// specified number of files in each directory.
+func createDeepTree(tb testing.TB, dir string, depth, filesPerDir int) {
+	for level := 0; level < depth; level++ {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for i := 0; i < filesPerDir; i++ {
+			fn := filepath.Join(dir, fmt.Sprintf("file-%02d", i))
+			if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		dir = filepath.Join(dir, fmt.Sprintf("directory-level-%02d", level))
+	}
+}
+
+func buildFileList(tb testing.TB, source string) *fileList {
+	st := &sendTransfer{
+		logger: log.Default(),
+		opts:   &Opts{},
+		conn:   &rsyncwire.Conn{Writer: io.Discard},
+	}
+	mod := Module{Name: "interop", Path: source}
+	fileList, err := st.sendFileList(mod, st.opts, []string{"interop/"}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fileList
+}
+
+func TestFileListPaths(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	createDeepTree(t, source, 5, 3)
+
+	var want []string
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		want = append(want, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileList := buildFileList(t, source)
+	var got []string
+	for _, f := range fileList.files {
+		got = append(got, f.path())
+
+		wpath := strings.TrimPrefix(f.path(), source+"/")
+		if f.path() == source {
+			wpath = "."
+		}
+		if got, want := f.wpath(), wpath; got != want {
+			t.Errorf("unexpected wire path for %s: got %q, want %q", f.path(), got, want)
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected file list paths: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileListModulePaths(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	for _, fn := range []string{"top.txt", "sub/inner.txt"} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod := Module{Name: "interop", Path: source}
+
+	for _, tt := range []struct {
+		requested string
+		want      []string
+	}{
+		{"interop", []string{".", "sub", "sub/inner.txt", "top.txt"}},
+		{"interop/", []string{".", "sub", "sub/inner.txt", "top.txt"}},
+		{"interop/sub/", []string{".", "inner.txt"}},
+		{"interop/sub", []string{"sub", "sub/inner.txt"}},
+		{"interop/sub/inner.txt", []string{"inner.txt"}},
+		{"interop/../sub/", []string{".", "inner.txt"}},
+	} {
+		t.Run(tt.requested, func(t *testing.T) {
+			st := &sendTransfer{
+				logger: log.Default(),
+				opts:   &Opts{Recurse: true},
+				conn:   &rsyncwire.Conn{Writer: io.Discard},
+			}
+			fileList, err := st.sendFileList(mod, st.opts, []string{tt.requested}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range fileList.files {
+				got = append(got, f.wpath())
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected file list: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWpathLess(t *testing.T) {
+	names := []string{
+		".",
+		"a",
+		"a.b",
+		"a.b/y",
+		"a/x",
+		"a/b/c",
+		"ab",
+		"b/a",
+		"b",
+	}
+	files := make([]file, len(names))
+	for idx, name := range names {
+		dir, base := "", name
+		if i := strings.LastIndexByte(name, '/'); i > -1 {
+			dir, base = name[:i], name[i+1:]
+		}
+		files[idx] = file{dir: dir, name: base}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return wpathLess(&files[i], &files[j])
+	})
+	want := append([]string{}, names...)
+	sort.Strings(want)
+	var got []string
+	for _, f := range files {
+		got = append(got, f.wpath())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected sort order: diff (-want +got):\n%s", diff)
+	}
+}
+
+// fullPathFile is the file list entry as it was stored before interning: with
+// the full local and wire path of each file.
+type fullPathFile struct {
+	path    string
+	wpath   string
+	regular bool
+	size    int64
+	mtime   int64
+}
+
+// BenchmarkFileList measures building the file list of a deep tree. Run with
+// -benchmem; the retained-B/op metric reports the heap size of the resulting
+// file list. The FullPaths sub-benchmark stores the full paths of each file
+// instead, as a baseline for the interned representation.
+func BenchmarkFileList(b *testing.B) {
+	source := filepath.Join(b.TempDir(), "source")
+	createDeepTree(b, source, 64, 16)
+
+	measure := func(b *testing.B, build func() interface{}) {
+		var retained uint64
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			fileList := build()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(fileList)
+			if after.HeapAlloc > before.HeapAlloc {
+				retained = after.HeapAlloc - before.HeapAlloc
+			}
+		}
+		b.ReportMetric(float64(retained), "retained-B/op")
+	}
+
+	b.Run("Interned", func(b *testing.B) {
+		measure(b, func() interface{} {
+			return buildFileList(b, source)
+		})
+	})
+
+	b.Run("FullPaths", func(b *testing.B) {
+		measure(b, func() interface{} {
+			fileList := buildFileList(b, source)
+			files := make([]fullPathFile, len(fileList.files))
+			for idx, f := range fileList.files {
+				files[idx] = fullPathFile{
+					path:    f.path(),
+					wpath:   f.wpath(),
+					regular: f.regular,
+					size:    f.size,
+					mtime:   f.mtime,
+				}
+			}
+			return files
+		})
+	})
+}
+
+func TestReadFilterListDirMerge(t *testing.T) {
+	// Protocol 27 cannot express dir-merge rules: like with rsync, a rule
+	// which looks like one is an exclude pattern.
+	var buf rsyncwire.Buffer
+	for _, rule := range []string{"- *.o", ": ../../../etc/x"} {
+		buf.WriteInt32(int32(len(rule)))
+		buf.WriteString(rule)
+	}
+	buf.WriteInt32(0)
+	c := &rsyncwire.Conn{Reader: strings.NewReader(buf.String())}
+	filters, err := readFilterList(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rsyncfilter.Rule{
+		{Action: rsyncfilter.Exclude, Pattern: "*.o"},
+		{Action: rsyncfilter.Exclude, Pattern: ": ../../../etc/x"},
+	}
+	if diff := cmp.Diff(want, filters.Rules()); diff != "" {
+		t.Errorf("unexpected filter rules: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFileListNumericIds(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "source")
+	createDeepTree(t, source, 2, 2)
+	mod := Module{Name: "interop", Path: source}
+
+	// With --numeric-ids, rsync neither sends nor receives the user and group
+	// name lists, so the i/o error flag directly follows the file list.
+	var buf bytes.Buffer
+	opts := &Opts{Recurse: true, PreserveUid: true, PreserveGid: true, NumericIds: true}
+	st := &sendTransfer{
+		logger: log.Default(),
+		opts:   opts,
+		conn:   &rsyncwire.Conn{Writer: &buf},
+	}
+	if _, err := st.sendFileList(mod, opts, []string{"interop/"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r := strings.NewReader(buf.String())
+	rt := &receiver.Transfer{
+		Opts: &receiver.TransferOpts{
+			PreserveUid: true,
+			PreserveGid: true,
+			NumericIds:  true,
+		},
+		Conn: &rsyncwire.Conn{Reader: r},
+	}
+	fileList, err := rt.ReceiveFileList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fileList), 6; got != want {
+		t.Errorf("unexpected file list length: got %d, want %d", got, want)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left unread after the file list", r.Len())
+	}
+}
@@ -0,0 +1,92 @@
+package rsyncd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestIOErrorSkipsDeletion(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		filesFrom string // if non-empty, the --files-from list
+	}{
+		{name: "Walk"},
+		// The sender cannot look up one of the listed names.
+		{name: "FilesFrom", filesFrom: "sub/file\nsub/unreadable\n"},
+		// The implied parent directory of one of the listed names is missing.
+		{name: "FilesFromMissingDir", filesFrom: "sub/file\nmissing/file\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+
+			write := func(fn, content string) {
+				if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write(filepath.Join(source, "sub", "file"), "content")
+			write(filepath.Join(source, "sub", "unreadable"), "content")
+			write(filepath.Join(dest, "sub", "extra"), "extra")
+			write(filepath.Join(dest, "sub", "unreadable"), "old content")
+
+			// The sender cannot read one of the files, so its file list is
+			// incomplete.
+			restore := rsyncd.InjectWalkError(filepath.Join(source, "sub", "unreadable"), syscall.EACCES)
+			defer restore()
+
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			args := []string{
+				"gokr-rsync",
+				"-rt",
+				"--delete",
+			}
+			if tt.filesFrom != "" {
+				filesFrom := filepath.Join(tmp, "files-from")
+				if err := ioutil.WriteFile(filesFrom, []byte(tt.filesFrom), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "--files-from="+filesFrom)
+			}
+			args = append(args,
+				"rsync://localhost:"+srv.Port+"/interop/",
+				dest)
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ioutil.ReadFile(filepath.Join(dest, "sub", "file")); err != nil {
+				t.Fatalf("file not transferred: %v", err)
+			}
+			// Despite --delete, nothing was deleted.
+			for _, fn := range []string{"extra", "unreadable"} {
+				if _, err := os.Stat(filepath.Join(dest, "sub", fn)); err != nil {
+					t.Errorf("%s unexpectedly deleted: %v", fn, err)
+				}
+			}
+
+			// --ignore-errors deletes regardless.
+			args = append([]string{"gokr-rsync", "--ignore-errors"}, args[1:]...)
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			for _, fn := range []string{"extra", "unreadable"} {
+				if _, err := os.Stat(filepath.Join(dest, "sub", fn)); !os.IsNotExist(err) {
+					t.Errorf("%s unexpectedly not deleted (err=%v)", fn, err)
+				}
+			}
+		})
+	}
+}
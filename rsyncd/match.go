@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash"
-	"os"
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
@@ -14,8 +13,8 @@ import (
 
 // rsync/match.c:hash_search
 func (st *sendTransfer) hashSearch(targets []target, tagTable map[uint16]int, head rsync.SumHead, fileIndex int32, fl file) error {
-	st.logger.Printf("hashSearch(path=%s, len(sums)=%d)", fl.path, len(head.Sums))
-	f, err := os.Open(fl.path)
+	st.logger.Printf("hashSearch(path=%s, len(sums)=%d)", fl.path(), len(head.Sums))
+	f, err := st.openFile(fl.path())
 	if err != nil {
 		return err
 	}
@@ -100,6 +99,12 @@ Outer:
 					continue
 				}
 
+				// When the receiver updates the basis file in place, the
+				// blocks before our offset have already been overwritten.
+				if st.opts.Inplace && int64(i)*int64(head.BlockLength) < offset {
+					continue
+				}
+
 				l := int64(head.BlockLength)
 				if v := fi.Size() - offset; v < l {
 					l = v
@@ -224,14 +229,12 @@ func (st *sendTransfer) matched(h hash.Hash, ms *mapStruct, head rsync.SumHead,
 	// 	st.logger.Printf("transmit accumulated at offset=%d", offset)
 	// }
 
-	/* FIXME: this is not used
 	l := int64(0)
 	if !transmitAccumulated {
 		l = head.Sums[i].Len
 	}
-	*/
 
-	if err := st.sendToken(ms, i, st.lastMatch, n); err != nil {
+	if err := st.sendToken(ms, i, st.lastMatch, n, l); err != nil {
 		return fmt.Errorf("sendToken: %v", err)
 	}
 	// TODO: data_transfer += n;
@@ -0,0 +1,6 @@
+package rsyncd
+
+import "syscall"
+
+// oNoatime is added to the open(2) flags with --open-noatime.
+const oNoatime = syscall.O_NOATIME
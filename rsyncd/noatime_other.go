@@ -0,0 +1,6 @@
+//go:build !linux
+
+package rsyncd
+
+// O_NOATIME is Linux-specific, --open-noatime has no effect elsewhere.
+const oNoatime = 0
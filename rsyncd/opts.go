@@ -1,14 +1,18 @@
 package rsyncd
 
-import "github.com/DavidGamba/go-getoptions"
+import (
+	"github.com/DavidGamba/go-getoptions"
+	"github.com/gokrazy/rsync/internal/rsynctoken"
+)
 
 type Opts struct {
 	Gokrazy struct {
-		Config           string
-		Listen           string
-		MonitoringListen string
-		AnonSSHListen    string
-		ModuleMap        string
+		Config             string
+		Listen             string
+		MonitoringListen   string
+		AnonSSHListen      string
+		ModuleMap          string
+		PersistentSessions bool
 	}
 
 	Daemon           bool
@@ -24,7 +28,36 @@ type Opts struct {
 	Recurse          bool
 	IgnoreTimes      bool
 	DryRun           bool
+	Force            bool
+	FakeSuper        bool
+	Delete           bool
+	Existing         bool
+	IgnoreErrors     bool
+	Partial          bool
+	Inplace          bool
+	Sparse           bool
+	NumericIds       bool
+	BlockSize        int
+	Compress         bool
+	CompressLevel    int
+	BwLimit          int
+	Timeout          int
 	D                bool
+	FilesFrom        string
+	From0            bool
+	Chmod            string
+	FilesNewerThan   string
+	FilesOlderThan   string
+	OpenNoatime      bool
+
+	// RemoveSourceFiles removes each regular file from the module once the
+	// client acknowledged its receipt. When uploading, the client removes its
+	// files once we acknowledged their receipt.
+	RemoveSourceFiles bool
+
+	// PreserveFileflags transmits the inode flags of each file after its
+	// mode (--fileflags, like rsync’s fileflags patch).
+	PreserveFileflags bool
 }
 
 func NewGetOpt() (*Opts, *getoptions.GetOpt) {
@@ -41,9 +74,10 @@ func NewGetOpt() (*Opts, *getoptions.GetOpt) {
 	// gokr-rsyncd flags
 	opt.StringVar(&opts.Gokrazy.Config, "gokr.config", "", opt.Description("path to a config file (if unspecified, os.UserConfigDir()/gokr-rsyncd.toml is used)"))
 	opt.StringVar(&opts.Gokrazy.Listen, "gokr.listen", "", opt.Description("[host]:port listen address for the rsync daemon protocol"))
-	opt.StringVar(&opts.Gokrazy.MonitoringListen, "gokr.monitoring_listen", "", opt.Description("optional [host]:port listen address for a HTTP debug interface"))
+	opt.StringVar(&opts.Gokrazy.MonitoringListen, "gokr.monitoring_listen", "", opt.Description("optional [host]:port listen address for a HTTP debug interface (also serves /bwlimit to change the bandwidth limit)"))
 	opt.StringVar(&opts.Gokrazy.AnonSSHListen, "gokr.anonssh_listen", "", opt.Description("optional [host]:port listen address for the rsync daemon protocol via anonymous SSH"))
 	opt.StringVar(&opts.Gokrazy.ModuleMap, "gokr.modulemap", "", opt.Description("<modulename>=<path> pairs for quick setup of the server, without a config file"))
+	opt.BoolVar(&opts.Gokrazy.PersistentSessions, "gokr.persistent_sessions", false, opt.Description("allow clients to reuse their connection for multiple transfers (non-standard)"))
 
 	// rsync-compatible flags
 	opt.BoolVar(&opts.Daemon, "daemon", false, opt.Description("run as an rsync daemon"))
@@ -63,6 +97,30 @@ func NewGetOpt() (*Opts, *getoptions.GetOpt) {
 	// TODO: implement IgnoreTimes
 	opt.BoolVar(&opts.IgnoreTimes, "ignore-times", false, opt.Alias("I"))
 	opt.BoolVar(&opts.DryRun, "dry-run", false, opt.Alias("n"))
+	opt.BoolVar(&opts.Force, "force", false, opt.Description("force deletion of directories even if not empty"))
+	opt.BoolVar(&opts.FakeSuper, "fake-super", false, opt.Description("store/recover privileged attrs using xattrs"))
+	opt.BoolVar(&opts.Delete, "delete", false, opt.Description("delete extraneous files from dest dirs"))
+	opt.BoolVar(&opts.Existing, "existing", false, opt.Alias("ignore-non-existing"), opt.Description("skip creating new files on receiver"))
+	opt.BoolVar(&opts.IgnoreErrors, "ignore-errors", false, opt.Description("delete even if there are I/O errors"))
+	opt.BoolVar(&opts.Partial, "partial", false, opt.Description("keep partially transferred files"))
+	opt.BoolVar(&opts.Inplace, "inplace", false, opt.Description("update destination files in-place"))
+	opt.BoolVar(&opts.Sparse, "sparse", false, opt.Alias("S"), opt.Description("turn sequences of nulls into sparse blocks"))
+	opt.BoolVar(&opts.NumericIds, "numeric-ids", false, opt.Description("don't map uid/gid values by user/group name"))
+	opt.IntVar(&opts.BlockSize, "block-size", 0, opt.Alias("B"), opt.Description("force a fixed checksum block-size"))
+	opt.BoolVar(&opts.Compress, "compress", false, opt.Alias("z"), opt.Description("compress file data during the transfer"))
+	opt.IntVar(&opts.CompressLevel, "compress-level", rsynctoken.LevelNotSpecified, opt.Description("explicitly set compression level"))
+	opt.IntVar(&opts.BwLimit, "bwlimit", 0, opt.Description("limit socket I/O bandwidth (KiB/s)"))
+	opt.IntVar(&opts.Timeout, "timeout", 0, opt.Description("set I/O timeout in seconds"))
+	opt.StringVar(&opts.FilesFrom, "files-from", "", opt.Description("read list of source-file names from FILE"))
+	opt.BoolVar(&opts.From0, "from0", false, opt.Alias("0"), opt.Description("all *-from/filter files are delimited by 0s"))
+	opt.StringVar(&opts.Chmod, "chmod", "", opt.Description("affect file and/or directory permissions"))
+	opt.BoolVar(&opts.OpenNoatime, "open-noatime", false, opt.Description("avoid changing the atime on opened files"))
+	opt.BoolVar(&opts.PreserveFileflags, "fileflags", false, opt.Description("preserve file-flags (aka chflags)"))
+	opt.BoolVar(&opts.RemoveSourceFiles, "remove-source-files", false, opt.Alias("remove-sent-files"), opt.Description("sender removes synchronized files (non-dir)"))
+
+	// non-standard flags
+	opt.StringVar(&opts.FilesNewerThan, "files-newer-than", "", opt.Description("only send files modified after DATE (or within DURATION, e.g. 7d)"))
+	opt.StringVar(&opts.FilesOlderThan, "files-older-than", "", opt.Description("only send files modified before DATE (or more than DURATION ago, e.g. 7d)"))
 
 	return &opts, opt
 }
@@ -0,0 +1,135 @@
+package rsyncd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/receiver"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// handleConnReceiver receives files from the client into the module.
+//
+// rsync/main.c:do_server_recv
+func (s *Server) handleConnReceiver(mod Module, c *rsyncwire.Conn, mpx *rsyncwire.MultiplexWriter, paths []string, opts *Opts, seed int32) error {
+	if !mod.Writable {
+		return fmt.Errorf("module %q is read only", mod.Name)
+	}
+	if len(paths) != 1 {
+		return fmt.Errorf("invalid args: exactly one destination required, got %q", paths)
+	}
+	sub := mod.subpath(paths[0])
+	dest := filepath.Join(mod.Path, sub)
+	s.logger.Printf("receiving into %q", dest)
+
+	rt := &receiver.Transfer{
+		Opts: &receiver.TransferOpts{
+			DryRun:    opts.DryRun,
+			Force:     opts.Force,
+			FakeSuper: opts.FakeSuper || mod.FakeSuper,
+			Delete:    opts.Delete,
+			Existing:  opts.Existing,
+			Compress:  opts.Compress,
+			Umask:     receiver.ProcessUmask(),
+
+			IgnoreErrors: opts.IgnoreErrors,
+			Partial:      opts.Partial,
+			Inplace:      opts.Inplace,
+			Sparse:       opts.Sparse,
+			BlockSize:    int32(opts.BlockSize),
+
+			// The client (sender) removes each file we acknowledge.
+			RemoveSourceFiles: opts.RemoveSourceFiles,
+
+			// Like rsync without chroot, do not allow symlinks out of the
+			// module.
+			SafeLinks: true,
+
+			NumericIds: opts.NumericIds,
+
+			PreserveGid:      opts.PreserveGid,
+			PreserveUid:      opts.PreserveUid,
+			PreserveLinks:    opts.PreserveLinks,
+			PreservePerms:    opts.PreservePerms,
+			PreserveDevices:  opts.PreserveDevices,
+			PreserveSpecials: opts.PreserveSpecials,
+			PreserveTimes:    opts.PreserveTimes,
+
+			PreserveFileflags: opts.PreserveFileflags,
+		},
+		Dest: dest,
+		Conn: c,
+		Mux:  mpx,
+		Seed: seed,
+	}
+	if !opts.NumericIds {
+		rt.IDs = s.ids
+	}
+
+	// The module’s incoming chmod is applied after the client’s --chmod, so
+	// that the module setting takes precedence.
+	if opts.Chmod != "" {
+		modes, err := rsyncchmod.Parse(opts.Chmod)
+		if err != nil {
+			return err
+		}
+		rt.Chmod = append(rt.Chmod, modes...)
+	}
+	incoming, err := mod.chmod(mod.IncomingChmod)
+	if err != nil {
+		return err
+	}
+	rt.Chmod = append(rt.Chmod, incoming...)
+
+	// The sender only transmits its filter list when the receiver needs it,
+	// i.e. with --delete.
+	//
+	// rsync/exclude.c:recv_filter_list
+	if opts.Delete {
+		rt.Filters, err = readFilterList(c)
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("filter list read (%d rules)", len(rt.Filters.Rules()))
+	}
+
+	fileList, err := rt.ReceiveFileList()
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("received %d names", len(fileList))
+
+	// Like rsync, refuse uploads of files which the module’s filter rules
+	// exclude, instead of silently skipping them.
+	//
+	// rsync/flist.c:recv_file_entry
+	daemonFilters, err := s.moduleFilters(mod)
+	if err != nil {
+		return err
+	}
+	if daemonFilters != nil {
+		for _, f := range fileList {
+			isDir := f.Mode&rsync.S_IFMT == rsync.S_IFDIR
+			if excludedByModule(daemonFilters, path.Join(sub, f.Name), isDir) {
+				return fmt.Errorf("rejecting excluded file-list name: %s", f.Name)
+			}
+		}
+	}
+
+	if err := rt.Do(fileList); err != nil {
+		return err
+	}
+
+	// Unlike the sending server, the receiving server does not send
+	// statistics, just the final goodbye.
+	if err := c.WriteInt32(-1); err != nil {
+		return err
+	}
+
+	s.logger.Printf("handleConnReceiver done")
+
+	return nil
+}
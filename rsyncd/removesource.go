@@ -0,0 +1,67 @@
+package rsyncd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/gokrazy/rsync/internal/longpath"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+// handleMsg handles the messages which the client multiplexes into its output
+// with --remove-source-files.
+//
+// rsync/io.c:read_a_msg
+func (st *sendTransfer) handleMsg(tag uint8, payload []byte) error {
+	if tag != rsyncwire.MsgSuccess {
+		return fmt.Errorf("protocol error: unexpected message tag %d", tag)
+	}
+	if len(payload) != 4 {
+		return fmt.Errorf("protocol error: MSG_SUCCESS with %d bytes", len(payload))
+	}
+	return st.successfulSend(int32(binary.LittleEndian.Uint32(payload)))
+}
+
+// successfulSend removes the file with index idx, which the receiver
+// acknowledged. Files which changed since they were sent are kept, and
+// failures are logged but do not abort the transfer.
+//
+// rsync/sender.c:successful_send
+func (st *sendTransfer) successfulSend(idx int32) error {
+	if !st.opts.RemoveSourceFiles {
+		return nil
+	}
+	if st.fileList == nil || idx < 0 || int(idx) >= len(st.fileList.files) {
+		return fmt.Errorf("protocol error: MSG_SUCCESS for invalid index %d", idx)
+	}
+	f := &st.fileList.files[idx]
+	if !f.regular {
+		return nil
+	}
+	path, release, err := longpath.Resolve(f.path())
+	if err != nil {
+		st.logger.Printf("sender failed to re-lstat %s: %v", f.wpath(), err)
+		return nil
+	}
+	defer release()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			st.logger.Printf("sender failed to re-lstat %s: %v", f.wpath(), err)
+		}
+		return nil
+	}
+	if fi.Size() != f.size || fi.ModTime().Unix() != f.mtime {
+		st.logger.Printf("ERROR: Skipping sender remove for changed file: %s", f.wpath())
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		if !os.IsNotExist(err) {
+			st.logger.Printf("sender failed to remove %s: %v", f.wpath(), err)
+		}
+		return nil
+	}
+	st.logger.Printf("sender removed %s", f.wpath())
+	return nil
+}
@@ -2,16 +2,25 @@ package rsyncd
 
 import (
 	"bufio"
+	"compress/flate"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/idnames"
 	"github.com/gokrazy/rsync/internal/log"
+	"github.com/gokrazy/rsync/internal/rsyncchmod"
+	"github.com/gokrazy/rsync/internal/rsynccommon"
+	"github.com/gokrazy/rsync/internal/rsyncfilter"
+	"github.com/gokrazy/rsync/internal/rsynctoken"
 	"github.com/gokrazy/rsync/internal/rsyncwire"
 )
 
@@ -19,17 +28,129 @@ type sendTransfer struct {
 	// config
 	logger log.Logger
 	opts   *Opts
+	ids    idnames.Lookup // nil means idnames.System
 
 	// state
 	conn      *rsyncwire.Conn
 	seed      int32
 	lastMatch int64
+	tokens    *rsynctoken.Writer // non-nil with --compress
+	filters   *rsyncfilter.List
+	scope     *rsyncfilter.Scope // filters with per-directory rules
+
+	modRoot       string            // module path, for daemonFilters
+	daemonFilters *rsyncfilter.List // the module’s FilterFile rules, if any
+
+	fileList *fileList // sorted, for --remove-source-files
+
+	buf []byte // file data read buffer, reused across files
 }
 
 type Module struct {
 	Name string   `toml:"name"`
 	Path string   `toml:"path"`
 	ACL  []string `toml:"acl"`
+
+	// Writable allows clients to upload files into the module (like rsync’s
+	// “read only = no”). Modules are read-only by default. When namespacing,
+	// the daemon writes as user nobody, which hence needs write permission.
+	Writable bool `toml:"writable"`
+
+	// OutgoingChmod is a --chmod style mode specification (e.g. "Fo-w") which
+	// the daemon applies to the permissions of the files it sends. A client’s
+	// own --chmod is applied by the client on top of the permissions it
+	// receives, i.e. after OutgoingChmod.
+	OutgoingChmod string `toml:"outgoing_chmod"`
+
+	// IncomingChmod is a --chmod style mode specification which the daemon
+	// applies to the permissions of the files it receives. It is applied after
+	// the client’s --chmod, i.e. the module setting takes precedence.
+	IncomingChmod string `toml:"incoming_chmod"`
+
+	// FakeSuper stores privileged attributes (ownership, devices) of uploaded
+	// files in extended attributes, and sends the attributes stored there
+	// instead of the actual ones (like rsync’s “fake super = yes”).
+	FakeSuper bool `toml:"fake_super"`
+
+	// AuthUsers restricts the module to the listed users (wildcards are
+	// permitted), who need to authenticate with the password from
+	// SecretsFile (like rsync’s “auth users” and “secrets file”).
+	AuthUsers []string `toml:"auth_users"`
+
+	// SecretsFile contains user:password lines. Like with rsync’s “strict
+	// modes”, it must not be accessible by others.
+	SecretsFile string `toml:"secrets_file"`
+
+	// FilterFile contains filter rules (one per line, e.g. “- /private/”)
+	// which the daemon applies before the client’s rules, like rsync’s
+	// “filter” module parameter. The patterns match paths relative to the
+	// module, and excluded files can neither be downloaded nor uploaded.
+	FilterFile string `toml:"filter_file"`
+
+	// PreXferExec is a shell command which is run before each transfer, like
+	// rsync’s “pre-xfer exec”. If it fails, the transfer is refused. The
+	// command’s environment contains RSYNC_MODULE_NAME, RSYNC_MODULE_PATH,
+	// RSYNC_HOST_ADDR, RSYNC_USER_NAME, RSYNC_PID, RSYNC_REQUEST and the
+	// client’s arguments as RSYNC_ARG0, RSYNC_ARG1, etc.
+	//
+	// gokr-rsyncd refuses to start with exec hooks when it would run in a
+	// Linux mount namespace (i.e. when started as root), which contains no
+	// shell (/bin/sh).
+	PreXferExec string `toml:"pre_xfer_exec"`
+
+	// PostXferExec is a shell command which is run after each transfer, like
+	// rsync’s “post-xfer exec”. Instead of the request and arguments, its
+	// environment contains RSYNC_EXIT_STATUS and RSYNC_RAW_STATUS.
+	PostXferExec string `toml:"post_xfer_exec"`
+
+	// XferExecTimeout is the number of seconds after which PreXferExec and
+	// PostXferExec are killed (default: 60). The output of both commands is
+	// written to the daemon log.
+	XferExecTimeout int `toml:"xfer_exec_timeout"`
+
+	// MaxConnections limits the number of simultaneous connections to the
+	// module, like rsync’s “max connections” (0 means no limit). Connections
+	// are counted by locking a slot of LockFile (default: /var/run/rsyncd.lock),
+	// so that the limit also applies across daemon processes. Modules which
+	// share a lock file use distinct slots, i.e. their limits are independent.
+	// Only supported on Linux. When gokr-rsyncd runs in a mount namespace, it
+	// counts connections in a private lock file instead.
+	MaxConnections int    `toml:"max_connections"`
+	LockFile       string `toml:"lock_file"`
+
+	// MaxFiles limits the number of entries (files, directories, symlinks,
+	// …) in the file list of a transfer from the module (0 means no limit).
+	// Transfers of larger trees are rejected before any file data is sent,
+	// which protects the daemon from clients requesting enormous trees.
+	MaxFiles int `toml:"max_files"`
+}
+
+// maxFilterRuleLen is the longest filter rule accepted from the client.
+const maxFilterRuleLen = 64 * 1024
+
+// readFilterList reads the filter (exclusion) list sent by the client.
+//
+// rsync/exclude.c:recv_filter_list
+func readFilterList(c *rsyncwire.Conn) (*rsyncfilter.List, error) {
+	var filters rsyncfilter.List
+	for {
+		length, err := c.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		const exclusionListEnd = 0
+		if length == exclusionListEnd {
+			return &filters, nil
+		}
+		if length < 0 || length > maxFilterRuleLen {
+			return nil, fmt.Errorf("protocol error: invalid filter rule length %d", length)
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(c.Reader, buf); err != nil {
+			return nil, err
+		}
+		filters.Add(rsyncfilter.ParseWire(string(buf)))
+	}
 }
 
 // Option specifies the server options.
@@ -43,6 +164,17 @@ func (f serverOptionFunc) applyServer(s *Server) {
 	f(s)
 }
 
+// WithIDNames specifies how the server maps user and group ids to names and
+// back (unless the client requests --numeric-ids). The default is
+// idnames.System, i.e. the system’s user database, which is not reachable
+// after changing the root directory (chroot or mount namespace): read an
+// idnames.Table before doing so.
+func WithIDNames(ids idnames.Lookup) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.ids = ids
+	})
+}
+
 // WithLogger specifies the logger to use for the server.
 // It also sets the global logger used by the rsync package.
 func WithLogger(logger log.Logger) Option {
@@ -65,19 +197,33 @@ func NewServer(modules []Module, opts ...Option) (*Server, error) {
 	server := &Server{
 		logger:  log.Default(),
 		modules: modules,
+		ids:     idnames.System,
 	}
 
 	for _, opt := range opts {
 		opt.applyServer(server)
 	}
 
+	for _, mod := range modules {
+		if _, err := server.moduleFilters(mod); err != nil {
+			return nil, err
+		}
+	}
+
 	return server, nil
 }
 
 type Server struct {
 	logger log.Logger
 
-	modules []Module
+	modules            []Module
+	persistentSessions bool
+	bwlimit            rsyncwire.Rate
+	selectTimeout      time.Duration
+	ids                idnames.Lookup
+	secrets            Secrets // nil means secrets files are read on demand
+	filters            Filters // nil means filter files are read on demand
+	senderFilters      *rsyncfilter.List
 }
 
 func (s *Server) getModule(requestedModule string) (Module, error) {
@@ -104,11 +250,67 @@ func (s *Server) formatModuleList() string {
 	return list.String()
 }
 
+// file is the in-memory representation of a file list entry.
+//
+// To conserve RAM on large trees, neither the local path nor the wire path
+// are stored in full: the local root is shared between all files of the same
+// requested path, and the directory part of the wire path is interned, so
+// that all files of one directory share the same backing string. Only the
+// base name is stored per file.
 type file struct {
-	// TODO: store relative to the root to conserve RAM
-	path    string
-	wpath   string
+	root    string // local directory the wire path is relative to
+	dir     string // wire path of the parent directory, "" for top-level
+	name    string // base name
 	regular bool
+
+	// size and modification time (in seconds) as sent, to detect changes
+	// before removing the file (--remove-source-files)
+	size  int64
+	mtime int64
+}
+
+// wpath returns the path as transmitted over the wire.
+func (f *file) wpath() string {
+	if f.dir == "" {
+		return f.name
+	}
+	return f.dir + "/" + f.name
+}
+
+// path returns the local path of the file.
+func (f *file) path() string {
+	return filepath.Join(f.root, f.wpath())
+}
+
+// wpathLess reports whether a.wpath() sorts before b.wpath(), without
+// allocating the concatenated wire paths.
+func wpathLess(a, b *file) bool {
+	ap := [...]string{a.dir, "/", a.name}
+	bp := [...]string{b.dir, "/", b.name}
+	as, bs := ap[:], bp[:]
+	if a.dir == "" {
+		as = ap[2:]
+	}
+	if b.dir == "" {
+		bs = bp[2:]
+	}
+	var ai, aj, bi, bj int
+	for {
+		for ai < len(as) && aj == len(as[ai]) {
+			ai, aj = ai+1, 0
+		}
+		for bi < len(bs) && bj == len(bs[bi]) {
+			bi, bj = bi+1, 0
+		}
+		if ai == len(as) || bi == len(bs) {
+			return ai == len(as) && bi < len(bs)
+		}
+		if ca, cb := as[ai][aj], bs[bi][bj]; ca != cb {
+			return ca < cb
+		}
+		aj++
+		bj++
+	}
 }
 
 type fileList struct {
@@ -141,10 +343,21 @@ type countingWriter struct {
 	written int64
 }
 
+// Write writes all of p, even if the underlying connection returns short
+// writes without an error.
 func (w *countingWriter) Write(p []byte) (n int, err error) {
-	n, err = w.w.Write(p)
-	w.written += int64(n)
-	return n, err
+	for n < len(p) {
+		written, err := w.w.Write(p[n:])
+		n += written
+		w.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		if written == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
 }
 
 func CounterPair(r io.Reader, w io.Writer) (*countingReader, *countingWriter) {
@@ -204,29 +417,38 @@ func checkACL(acls []string, remoteAddr net.Addr) error {
 func (s *Server) HandleDaemonConn(ctx context.Context, conn io.ReadWriter, remoteAddr net.Addr) (err error) {
 	_ = ctx // not implemented. what would be the best thing to do? wrap conn's reader part with cancelable reader?
 
-	const terminationCommand = "@RSYNCD: OK\n"
 	crd := &countingReader{r: conn}
 	cwr := &countingWriter{w: conn}
 	rd := bufio.NewReader(crd)
 	// send server greeting
 
-	fmt.Fprintf(cwr, "@RSYNCD: %d\n", rsync.ProtocolVersion)
+	fmt.Fprintf(cwr, "%s\n", rsyncwire.Greeting{Protocol: rsync.ProtocolVersion})
+
+	clearDeadline := s.selectDeadline(conn)
 
 	// read client greeting
-	clientGreeting, err := rd.ReadString('\n')
+	line, err := readLine(rd)
 	if err != nil {
-		return err
+		return s.selectError(cwr, err)
 	}
-	if !strings.HasPrefix(clientGreeting, "@RSYNCD: ") {
-		return fmt.Errorf("invalid client greeting: got %q", clientGreeting)
+	clientGreeting, err := rsyncwire.ParseGreeting(line)
+	if err != nil {
+		fmt.Fprintf(cwr, "@ERROR: protocol startup error\n")
+		return fmt.Errorf("reading client greeting: %v", err)
+	}
+	// protocol negotiation: the client’s version can be newer (we then use
+	// ours), but not older than the oldest version we implement.
+	if clientGreeting.Protocol < 27 {
+		fmt.Fprintf(cwr, "@ERROR: protocol version mismatch: client version %d too old\n", clientGreeting.Protocol)
+		return fmt.Errorf("client protocol version %d too old", clientGreeting.Protocol)
 	}
-	// TODO: protocol negotiation
 
 	// read requested module(s), if any
-	requestedModule, err := rd.ReadString('\n')
+	requestedModule, err := readLine(rd)
 	if err != nil {
-		return err
+		return s.selectError(cwr, err)
 	}
+	clearDeadline()
 	requestedModule = strings.TrimSpace(requestedModule)
 	if requestedModule == "" || requestedModule == "#list" {
 		s.logger.Printf("client %v requested rsync module listing", remoteAddr)
@@ -234,10 +456,24 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn io.ReadWriter, remot
 		io.WriteString(cwr, "@RSYNCD: EXIT\n")
 		return nil
 	}
+	if requestedModule == sessionRequest {
+		return s.handleSession(rd, crd, cwr, remoteAddr)
+	}
+	return s.handleModuleRequest(rd, crd, cwr, remoteAddr, requestedModule, nil)
+}
+
+// handleModuleRequest handles the client’s request for requestedModule:
+// access control and authentication, the server arguments and finally the
+// transfer. Within a persistent session, sess carries the authentication
+// state across transfers.
+//
+// rsync/clientserver.c:rsync_module
+func (s *Server) handleModuleRequest(rd *bufio.Reader, crd *countingReader, cwr *countingWriter, remoteAddr net.Addr, requestedModule string, sess *session) error {
+	const terminationCommand = "@RSYNCD: OK\n"
 	s.logger.Printf("client %v requested rsync module %q", remoteAddr, requestedModule)
-	module, err := s.getModule(requestedModule)
+	module, err := s.getModule(moduleName(requestedModule))
 	if err != nil {
-		fmt.Fprintf(cwr, "@ERROR: Unknown module %q\n", requestedModule)
+		fmt.Fprintf(cwr, "@ERROR: Unknown module %q\n", moduleName(requestedModule))
 		return err
 	}
 
@@ -246,12 +482,50 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn io.ReadWriter, remot
 		return err
 	}
 
+	if module.MaxConnections > 0 {
+		release, err := module.claimConnection()
+		if err != nil {
+			if err == errMaxConnections {
+				fmt.Fprintf(cwr, "@ERROR: max connections (%d) reached -- try again later\n", module.MaxConnections)
+			} else {
+				fmt.Fprintf(cwr, "@ERROR: failed to open lock file\n")
+			}
+			return fmt.Errorf("module %q: %v", module.Name, err)
+		}
+		defer release()
+	}
+
+	var userName string
+	if module.authRequired() {
+		if user := s.reusableAuth(sess, module); user != nil {
+			s.logger.Printf("client %v: reusing session authentication of user %q", remoteAddr, user.name)
+			userName = user.name
+		} else {
+			user, err := s.authServer(module, rd, cwr)
+			if errors.Is(err, errAuthAbandoned) {
+				// Nobody is left to read an error message. Returning
+				// releases the connection slot (if any).
+				return err
+			}
+			if err != nil {
+				fmt.Fprintf(cwr, "@ERROR: auth failed on module %s\n", module.Name)
+				return err
+			}
+			s.logger.Printf("client %v authenticated as user %q", remoteAddr, user.name)
+			sess.authenticated(user)
+			userName = user.name
+		}
+	}
+
 	io.WriteString(cwr, terminationCommand)
 
 	// read requested flags
 	var flags []string
 	for {
-		flag, err := rd.ReadString('\n')
+		flag, err := readLine(rd)
+		if err == errLineTooLong {
+			return refuseTransfer(cwr, fmt.Errorf("server arg too long (limit: %d bytes)", maxLineLen))
+		}
 		if err != nil {
 			return err
 		}
@@ -260,6 +534,9 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn io.ReadWriter, remot
 		if flag == "" {
 			break
 		}
+		if len(flags) == maxServerArgs {
+			return refuseTransfer(cwr, fmt.Errorf("too many server args (limit: %d)", maxServerArgs))
+		}
 		flags = append(flags, flag)
 	}
 
@@ -267,46 +544,102 @@ func (s *Server) HandleDaemonConn(ctx context.Context, conn io.ReadWriter, remot
 	opts, opt := NewGetOpt()
 
 	//getoptions.Debug.SetOutput(os.Stderr)
-	remaining, err := opt.Parse(flags)
+	remaining, err := opt.Parse(rsynccommon.BlockSizeArgs(flags))
 	if err != nil {
-		err = fmt.Errorf("parsing server args: %v", err)
-
 		// terminate connection with an error about which flag is not supported
-		c := &rsyncwire.Conn{
-			Reader: rd,
-			Writer: cwr,
-		}
-
-		const errorSeed = 0xee
-		if err := c.WriteInt32(errorSeed); err != nil {
-			return err
-		}
-
-		// Switch to multiplexing protocol, but only for server-side transmissions.
-		// Transmissions received from the client are not multiplexed.
-		mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
-		mpx.WriteMsg(rsyncwire.MsgError, []byte(fmt.Sprintf("gokr-rsync [sender]: %v\n", err)))
-
-		return err
+		return refuseTransfer(cwr, fmt.Errorf("parsing server args: %v", err))
 	}
 	if opts.D {
 		opts.PreserveDevices = true
 		opts.PreserveSpecials = true
 	}
+	if opt.Called("block-size") {
+		if err := rsynccommon.CheckBlockSize(opts.BlockSize); err != nil {
+			return refuseTransfer(cwr, err)
+		}
+	}
+	if opts.RemoveSourceFiles && opts.Sender && !module.Writable {
+		// Removing files modifies the module, like an upload would.
+		return refuseTransfer(cwr, fmt.Errorf("--remove-source-files is not allowed: module %q is read only", module.Name))
+	}
+	if !opts.Server {
+		return refuseTransfer(cwr, fmt.Errorf("server args lack --server"))
+	}
 	s.logger.Printf("remaining: %q", remaining)
 	// remaining[0] is always "."
 	// remaining[1] is the first directory
 	if len(remaining) < 2 {
-		return fmt.Errorf("invalid args: at least one directory required")
+		return refuseTransfer(cwr, fmt.Errorf("invalid args: at least one directory required"))
 	}
 	if got, want := remaining[0], "."; got != want {
-		return fmt.Errorf("protocol error: got %q, expected %q", got, want)
+		return refuseTransfer(cwr, fmt.Errorf("protocol error: got %q, expected %q", got, want))
 	}
 	paths := remaining[1:]
 
-	// TODO: verify --sender is set and error out otherwise
+	env := xferExecEnv(module, remoteAddr, userName)
+	if module.PreXferExec != "" {
+		preEnv := preXferEnv(env, requestedModule, flags)
+		err := s.runXferExec(context.Background(), "pre-xfer exec", module.PreXferExec, preEnv, module.xferExecTimeout())
+		if err != nil {
+			s.logger.Printf("pre-xfer exec for module %q failed: %v", module.Name, err)
+			return refuseTransfer(cwr, fmt.Errorf("pre-xfer exec failed: %v", err))
+		}
+	}
+
+	err = s.HandleConn(module, rd, crd, cwr, paths, opts, false)
 
-	return s.HandleConn(module, rd, crd, cwr, paths, opts, false)
+	if module.PostXferExec != "" {
+		postEnv := postXferEnv(env, err)
+		if err := s.runXferExec(context.Background(), "post-xfer exec", module.PostXferExec, postEnv, module.xferExecTimeout()); err != nil {
+			s.logger.Printf("post-xfer exec for module %q failed: %v", module.Name, err)
+		}
+	}
+	return err
+}
+
+// Limits for the lines a client sends during the daemon protocol startup, in
+// particular for the server args, so that a client cannot make the daemon
+// buffer an unbounded amount of data.
+const (
+	maxLineLen    = 4096 + 1024 // rsync.h:BIGPATHBUFLEN
+	maxServerArgs = 1024
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine is like rd.ReadString('\n'), but returns errLineTooLong for lines
+// longer than maxLineLen.
+func readLine(rd *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := rd.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineLen {
+			return "", errLineTooLong
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// refuseTransfer terminates the connection with err after the client sent its
+// arguments, i.e. when the client already expects the binary protocol.
+func refuseTransfer(w io.Writer, err error) error {
+	c := &rsyncwire.Conn{Writer: w}
+
+	const errorSeed = 0xee
+	if err := c.WriteInt32(errorSeed); err != nil {
+		return err
+	}
+
+	// Switch to multiplexing protocol, but only for server-side transmissions.
+	// Transmissions received from the client are not multiplexed.
+	mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
+	mpx.WriteMsg(rsyncwire.MsgError, []byte(fmt.Sprintf("gokr-rsync [sender]: %v\n", err)))
+
+	return err
 }
 
 // handleConn is equivalent to rsync/main.c:start_server
@@ -322,6 +655,24 @@ func (s *Server) HandleConn(module Module, rd io.Reader, crd *countingReader, cw
 		Writer: cwr,
 	}
 
+	var idle *rsyncwire.IdleTimeout
+	if opts.Timeout > 0 {
+		idle = &rsyncwire.IdleTimeout{
+			Timeout: time.Duration(opts.Timeout) * time.Second,
+			Abort: func() {
+				for _, part := range []interface{}{crd.r, cwr.w} {
+					if c, ok := part.(io.Closer); ok {
+						c.Close()
+					}
+				}
+			},
+		}
+		c.Reader = idle.Reader(c.Reader)
+		c.Writer = idle.Writer(c.Writer)
+		idle.Start()
+		defer idle.Stop()
+	}
+
 	if negotiate {
 		remoteProtocol, err := c.ReadInt32()
 		if err != nil {
@@ -337,41 +688,113 @@ func (s *Server) HandleConn(module Module, rd io.Reader, crd *countingReader, cw
 		return err
 	}
 
+	// The bandwidth limit applies to the bytes on the wire, i.e. after
+	// compression and multiplexing. The daemon’s limit can change at any
+	// time (see SetBwLimit), so it is consulted even if the client did not
+	// request a limit.
+	c.Writer = &rsyncwire.BwLimitWriter{
+		Writer: c.Writer,
+		Limit:  opts.BwLimit,
+		Rate:   &s.bwlimit,
+		Idle:   idle,
+	}
+
 	// Switch to multiplexing protocol, but only for server-side transmissions.
 	// Transmissions received from the client are not multiplexed.
 	mpx := &rsyncwire.MultiplexWriter{Writer: c.Writer}
 	c.Writer = mpx
 	// If returning an error, send the error to the client for display, too:
+	role := "sender"
+	if !opts.Sender {
+		role = "receiver"
+	}
+	var bw *bufio.Writer // sender output buffer, flushed before errors
 	defer func() {
 		if err != nil {
-			mpx.WriteMsg(rsyncwire.MsgError, []byte(fmt.Sprintf("gokr-rsync [sender]: %v\n", err)))
+			if bw != nil {
+				bw.Flush()
+			}
+			mpx.WriteMsg(rsyncwire.MsgError, []byte(fmt.Sprintf("gokr-rsync [%s]: %v\n", role, err)))
 		}
 	}()
 
+	if !opts.Sender {
+		// The client is sending files to us.
+		return s.handleConnReceiver(module, c, mpx, paths, opts, sessionChecksumSeed)
+	}
+
+	// Coalesce the many small writes of the sender (e.g. the header of each
+	// file) into fewer multiplexed messages and system calls, which matters
+	// for transfers of many small files. The output is flushed whenever the
+	// sender waits for input.
+	bw = bufio.NewWriterSize(c.Writer, 32*1024)
+	c.Writer = bw
+
 	st := &sendTransfer{
 		logger: s.logger,
 		opts:   opts,
+		ids:    s.ids,
 		conn:   c,
 		seed:   sessionChecksumSeed,
 	}
+	st.daemonFilters, err = s.moduleFilters(module)
+	if err != nil {
+		return err
+	}
+	if opts.Compress {
+		level, ok, err := rsynctoken.Level("", opts.CompressLevel)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// The client asked for compression, so we need to send a
+			// compressed token stream, but without compressing.
+			level = flate.NoCompression
+		}
+		st.tokens = rsynctoken.NewWriter(c, level)
+	}
+
+	if opts.RemoveSourceFiles {
+		// The client acknowledges received files with MsgSuccess, so its
+		// output is multiplexed, too.
+		//
+		// rsync/main.c:start_server (need_messages_from_generator)
+		c.Reader = &rsyncwire.MultiplexReader{
+			Reader:  c.Reader,
+			Handler: st.handleMsg,
+		}
+	}
+	c.Reader = &rsyncwire.FlushReader{
+		Reader: c.Reader,
+		Writer: bw,
+	}
 
 	// receive the exclusion list (openrsync’s is always empty)
-	const exclusionListEnd = 0
-	got, err := c.ReadInt32()
+	st.filters, err = readFilterList(c)
 	if err != nil {
 		return err
 	}
-	if want := int32(exclusionListEnd); got != want {
-		return fmt.Errorf("protocol error: non-empty exclusion list received")
+	if s.senderFilters != nil {
+		st.filters = s.senderFilters
 	}
+	st.scope = rsyncfilter.NewScope(st.filters)
 
-	s.logger.Printf("exclusion list read")
+	s.logger.Printf("exclusion list read (%d rules)", len(st.filters.Rules()))
+
+	var filesFrom []string
+	if opts.FilesFrom != "" {
+		filesFrom, err = st.receiveFilesFrom(module, opts)
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("files-from list read (%d names)", len(filesFrom))
+	}
 
 	// “Update exchange” as per
 	// https://github.com/kristapsdz/openrsync/blob/master/rsync.5
 
 	// send file list
-	fileList, err := st.sendFileList(module, opts, paths)
+	fileList, err := st.sendFileList(module, opts, paths, filesFrom)
 	if err != nil {
 		return err
 	}
@@ -382,14 +805,22 @@ func (s *Server) HandleConn(module Module, rd io.Reader, crd *countingReader, cw
 	// same way!), otherwise our indices do not match what the client will
 	// request.
 	sort.Slice(fileList.files, func(i, j int) bool {
-		return fileList.files[i].wpath < fileList.files[j].wpath
+		return wpathLess(&fileList.files[i], &fileList.files[j])
 	})
+	st.fileList = fileList
 
 	if err := st.sendFiles(fileList); err != nil {
 		return err
 	}
 
-	// send statistics:
+	// send statistics, regardless of whether the client requested --stats:
+	// the client always reads them before sending the final goodbye. Only
+	// protocol 29 and newer would add the file list timings, and protocol 31
+	// and newer would precede the goodbye with an additional NDX_DONE
+	// exchange; neither applies to protocol 27.
+	//
+	// rsync/main.c:report
+	//
 	// total bytes read (from network connection)
 	if err := c.WriteInt64(crd.read); err != nil {
 		return err
@@ -452,6 +883,134 @@ func validateModule(mod Module) error {
 	if mod.Path == "" {
 		return fmt.Errorf("module %q has empty path", mod.Name)
 	}
+	if _, err := mod.chmod(mod.OutgoingChmod); err != nil {
+		return err
+	}
+	if _, err := mod.chmod(mod.IncomingChmod); err != nil {
+		return err
+	}
+	if mod.authRequired() && mod.SecretsFile == "" {
+		return fmt.Errorf("module %q has auth_users, but no secrets_file", mod.Name)
+	}
+	if mod.MaxConnections < 0 {
+		return fmt.Errorf("module %q has negative max_connections", mod.Name)
+	}
+	if mod.MaxFiles < 0 {
+		return fmt.Errorf("module %q has negative max_files", mod.Name)
+	}
+	if mod.MaxConnections > 0 && !connLimitSupported {
+		return fmt.Errorf("module %q: max_connections is not supported on this platform", mod.Name)
+	}
 
 	return nil
 }
+
+// chmod parses the specified chmod setting of the module. An empty setting
+// results in nil Modes, which leave modes unchanged.
+func (mod Module) chmod(spec string) (rsyncchmod.Modes, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	modes, err := rsyncchmod.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %v", mod.Name, err)
+	}
+	return modes, nil
+}
+
+// moduleName returns the module name of a module request line. Clients send
+// just the module name, but we also accept the module name followed by a
+// slash and an (ignored) path, as in “module/” or “module/sub/path”.
+func moduleName(requested string) string {
+	if idx := strings.IndexByte(requested, '/'); idx > -1 {
+		return requested[:idx]
+	}
+	return requested
+}
+
+// subpath returns the path within the module for a path argument sent by the
+// client. Like with rsync, path arguments start with the module name
+// (“module”, “module/” or “module/sub/path”), and cannot escape the module.
+// The empty string refers to the module directory itself.
+func (mod Module) subpath(requested string) string {
+	if requested == mod.Name || strings.HasPrefix(requested, mod.Name+"/") {
+		requested = strings.TrimPrefix(requested, mod.Name)
+	}
+	return sanitizePath(requested)
+}
+
+// Filters contains the parsed FilterFile rules of the modules, keyed by
+// module name.
+type Filters map[string]*rsyncfilter.List
+
+// LoadFilters reads the filter files of all modules, for use with
+// WithFilters.
+func LoadFilters(modules []Module) (Filters, error) {
+	filters := make(Filters)
+	for _, mod := range modules {
+		list, err := mod.filters()
+		if err != nil {
+			return nil, err
+		}
+		if list != nil {
+			filters[mod.Name] = list
+		}
+	}
+	return filters, nil
+}
+
+// WithFilters specifies the module filter rules (see LoadFilters) the server
+// uses. By default, the server reads the module’s filter file for each
+// transfer, which is not reachable after changing the root directory (chroot
+// or mount namespace): load the filters before doing so. Changes to the
+// filter files then require restarting the daemon.
+func WithFilters(filters Filters) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.filters = filters
+	})
+}
+
+// WithSenderFilters specifies the client’s filter rules for a server running
+// in the same process as the client (local transport), replacing the rules
+// read from the connection when sending. Unlike the wire format of protocol
+// 27, the rules may include dir-merge rules.
+func WithSenderFilters(filters *rsyncfilter.List) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.senderFilters = filters
+	})
+}
+
+// moduleFilters returns the rules of the module’s FilterFile, either as
+// loaded by LoadFilters or read from the file.
+func (s *Server) moduleFilters(mod Module) (*rsyncfilter.List, error) {
+	if s.filters != nil {
+		return s.filters[mod.Name], nil
+	}
+	return mod.filters()
+}
+
+// filters loads the rules of the module’s FilterFile. Without FilterFile, the
+// result is nil, which excludes nothing. The file is read for each transfer so
+// that changes take effect without restarting the daemon.
+func (mod Module) filters() (*rsyncfilter.List, error) {
+	if mod.FilterFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(mod.FilterFile)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %v", mod.Name, err)
+	}
+	defer f.Close()
+	rules, err := rsyncfilter.ReadRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("module %q: %s: %v", mod.Name, mod.FilterFile, err)
+	}
+	var list rsyncfilter.List
+	for _, rule := range rules {
+		if rule.Action == rsyncfilter.DirMerge {
+			return nil, fmt.Errorf("module %q: %s: dir-merge rules are not supported", mod.Name, mod.FilterFile)
+		}
+		list.Add(rule)
+	}
+	return &list, nil
+}
@@ -1,9 +1,14 @@
 package rsyncd_test
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"testing"
 	"time"
 
 	"github.com/gokrazy/rsync/rsyncd"
@@ -35,3 +40,192 @@ func ExampleNewServer() {
 
 	log.Println("gracefully exiting")
 }
+
+func TestModuleRequest(t *testing.T) {
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name: "interop",
+			Path: t.TempDir(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		requested string
+		want      string
+	}{
+		{"interop", "@RSYNCD: OK"},
+		{"interop/", "@RSYNCD: OK"},
+		{"interop/sub/", "@RSYNCD: OK"},
+		{"nonexistent", `@ERROR: Unknown module "nonexistent"`},
+		{"nonexistent/", `@ERROR: Unknown module "nonexistent"`},
+		{"nonexistent/sub/path", `@ERROR: Unknown module "nonexistent"`},
+		{"interoperability", `@ERROR: Unknown module "interoperability"`},
+	} {
+		t.Run(tt.requested, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				srv.HandleDaemonConn(context.Background(), server, client.LocalAddr())
+			}()
+
+			// net.Pipe is synchronous, so read the server greeting before
+			// sending the client greeting.
+			rd := bufio.NewReader(client)
+			if _, err := rd.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(client, "@RSYNCD: 27\n")
+			fmt.Fprintf(client, "%s\n", tt.requested)
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(line); got != tt.want {
+				t.Errorf("response to module request %q: got %q, want %q", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerArgLimits(t *testing.T) {
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name: "interop",
+			Path: t.TempDir(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tooMany := []string{"--server", "--sender"}
+	for i := 0; i < 2000; i++ {
+		tooMany = append(tooMany, "-r")
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "TooMany",
+			args: tooMany,
+			want: "too many server args",
+		},
+		{
+			name: "TooLong",
+			args: []string{"--server", "--sender", ".", "interop/" + strings.Repeat("x", 1024*1024)},
+			want: "server arg too long",
+		},
+		{
+			name: "Unknown",
+			args: []string{"--server", "--sender", "--no-such-option", ".", "interop/"},
+			want: "parsing server args",
+		},
+		{
+			name: "NotServer",
+			args: []string{"--sender", ".", "interop/"},
+			want: "server args lack --server",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				errc <- srv.HandleDaemonConn(context.Background(), server, client.LocalAddr())
+			}()
+
+			rd := bufio.NewReader(client)
+			if _, err := rd.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(client, "@RSYNCD: 27\n")
+			fmt.Fprintf(client, "interop\n")
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.TrimSpace(line), "@RSYNCD: OK"; got != want {
+				t.Fatalf("unexpected response to module request: got %q, want %q", got, want)
+			}
+
+			// The daemon stops reading once it rejects the args, so send them
+			// in the background.
+			go func() {
+				for _, arg := range tt.args {
+					if _, err := fmt.Fprintf(client, "%s\n", arg); err != nil {
+						return
+					}
+				}
+				fmt.Fprintf(client, "\n")
+			}()
+
+			// The rejection is sent as a multiplexed error message.
+			response, _ := io.ReadAll(rd)
+			if !strings.Contains(string(response), tt.want) {
+				t.Errorf("unexpected response: got %q, want error containing %q", response, tt.want)
+			}
+			if err := <-errc; err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("HandleDaemonConn: got err=%v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestModuleSelectionTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	srv, err := rsyncd.NewServer([]rsyncd.Module{
+		{
+			Name: "interop",
+			Path: t.TempDir(),
+		},
+	}, rsyncd.WithModuleSelectionTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, ln)
+
+	// The server starts the timeout around sending its greeting, so measure
+	// from before connecting.
+	start := time.Now()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Guard against the server never closing the connection.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	rd := bufio.NewReader(conn)
+	if _, err := rd.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stall instead of sending the client greeting and the module name.
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("connection closed after %v, before the timeout of %v", elapsed, timeout)
+	}
+	if got, want := strings.TrimSpace(line), "@ERROR: timeout waiting for module selection"; got != want {
+		t.Errorf("unexpected message: got %q, want %q", got, want)
+	}
+	if _, err := rd.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection not closed after the timeout: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package rsyncd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WithModuleSelectionTimeout disconnects clients which do not select a module
+// within timeout after the server greeting, so that idle (or half-open)
+// connections do not linger. 0 (the default) disables the timeout.
+//
+// The timeout is enforced using read deadlines, i.e. only for connections
+// which support them (net.Conn), not e.g. for rsync over SSH.
+func WithModuleSelectionTimeout(timeout time.Duration) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.selectTimeout = timeout
+	})
+}
+
+// selectDeadline sets the read deadline of conn for the client greeting and
+// the module selection and returns a function which clears the deadline.
+func (s *Server) selectDeadline(conn io.ReadWriter) (clear func()) {
+	dl, ok := conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok || s.selectTimeout == 0 {
+		return func() {}
+	}
+	dl.SetReadDeadline(time.Now().Add(s.selectTimeout))
+	return func() { dl.SetReadDeadline(time.Time{}) }
+}
+
+// selectError tells the client why the connection is closed if reading the
+// client greeting or the module selection failed because of the timeout.
+func (s *Server) selectError(w io.Writer, err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	fmt.Fprintf(w, "@ERROR: timeout waiting for module selection\n")
+	return fmt.Errorf("client did not select a module within %v", s.selectTimeout)
+}
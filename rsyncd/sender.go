@@ -8,7 +8,6 @@ import (
 
 	"github.com/gokrazy/rsync"
 	"github.com/gokrazy/rsync/internal/rsyncchecksum"
-	"github.com/gokrazy/rsync/internal/rsynccommon"
 	"github.com/mmcloughlin/md4"
 	"golang.org/x/sync/errgroup"
 )
@@ -48,41 +47,12 @@ func (st *sendTransfer) sendFiles(fileList *fileList) error {
 			return err
 		}
 
-		// The following quotes are citations from
-		// https://www.samba.org/~tridge/phd_thesis.pdf, section 3.2.6 The
-		// signature search algorithm (PDF page 64).
-
-		// rsync/match.c:build_hash_table
-		targets := make([]target, len(head.Sums))
-		tagTable := make(map[uint16]int) // TODO: or int32 more specifically?
-		{
-			// “The first step in the algorithm is to sort the received
-			// signatures by a 16 bit hash of the fast signature.”
-			for idx, sum := range head.Sums {
-				targets[idx] = target{
-					index: int32(idx),
-					tag:   rsyncchecksum.Tag(sum.Sum1),
-				}
-			}
-			sort.Slice(targets, func(i, j int) bool {
-				return targets[i].tag < targets[j].tag
-			})
-
-			// “A 16 bit index table is then formed which takes a 16 bit hash
-			// value and gives an index into the sorted signature table which
-			// points to the first entry in the table which has a matching
-			// hash.”
-			for idx := len(head.Sums) - 1; idx >= 0; idx-- {
-				tagTable[targets[idx].tag] = idx
-			}
-		}
-
 		st.lastMatch = 0
 		if len(head.Sums) == 0 {
 			// fast path: send the whole file
-			err = st.sendFile(fileIndex, fileList.files[fileIndex])
+			err = st.sendFile(head, fileIndex, fileList.files[fileIndex])
 		} else {
-			err = st.hashSearch(targets, tagTable, head, fileIndex, fileList.files[fileIndex])
+			err = st.matchFile(head, fileIndex, fileList.files[fileIndex])
 		}
 		if err != nil {
 			if _, ok := err.(*os.PathError); ok {
@@ -90,7 +60,7 @@ func (st *sendTransfer) sendFiles(fileList *fileList) error {
 				// proceed. Only starting with protocol 30, an I/O error flag is
 				// sent after the file transfer phase.
 				if os.IsNotExist(err) {
-					st.logger.Printf("file has vanished: %s", fileList.files[fileIndex].path)
+					st.logger.Printf("file has vanished: %s", fileList.files[fileIndex].path())
 				} else {
 					st.logger.Printf("sendFiles: %v", err)
 				}
@@ -109,6 +79,41 @@ func (st *sendTransfer) sendFiles(fileList *fileList) error {
 	return nil
 }
 
+// matchFile sends the differences between the file and the receiver’s copy,
+// of which head contains the block checksums.
+func (st *sendTransfer) matchFile(head rsync.SumHead, fileIndex int32, fl file) error {
+	// The following quotes are citations from
+	// https://www.samba.org/~tridge/phd_thesis.pdf, section 3.2.6 The
+	// signature search algorithm (PDF page 64).
+
+	// rsync/match.c:build_hash_table
+	targets := make([]target, len(head.Sums))
+	tagTable := make(map[uint16]int) // TODO: or int32 more specifically?
+	{
+		// “The first step in the algorithm is to sort the received
+		// signatures by a 16 bit hash of the fast signature.”
+		for idx, sum := range head.Sums {
+			targets[idx] = target{
+				index: int32(idx),
+				tag:   rsyncchecksum.Tag(sum.Sum1),
+			}
+		}
+		sort.Slice(targets, func(i, j int) bool {
+			return targets[i].tag < targets[j].tag
+		})
+
+		// “A 16 bit index table is then formed which takes a 16 bit hash
+		// value and gives an index into the sorted signature table which
+		// points to the first entry in the table which has a matching
+		// hash.”
+		for idx := len(head.Sums) - 1; idx >= 0; idx-- {
+			tagTable[targets[idx].tag] = idx
+		}
+	}
+
+	return st.hashSearch(targets, tagTable, head, fileIndex, fl)
+}
+
 // rsync/sender.c:receive_sums()
 func (st *sendTransfer) receiveSums() (rsync.SumHead, error) {
 	var head rsync.SumHead
@@ -145,12 +150,12 @@ func (st *sendTransfer) receiveSums() (rsync.SumHead, error) {
 	return head, nil
 }
 
-func (st *sendTransfer) sendFile(fileIndex int32, fl file) error {
+func (st *sendTransfer) sendFile(head rsync.SumHead, fileIndex int32, fl file) error {
 	// rsync/rsync.h defines chunkSize as 32 * 1024, but increasing it to 256K
 	// increases throughput with “tridge” rsync as client by 50 Mbit/s.
 	const chunkSize = 256 * 1024
 
-	f, err := os.Open(fl.path)
+	f, err := st.openFile(fl.path())
 	if err != nil {
 		return err
 	}
@@ -165,15 +170,20 @@ func (st *sendTransfer) sendFile(fileIndex int32, fl file) error {
 		return err
 	}
 
-	sh := rsynccommon.SumSizesSqroot(fi.Size())
-	// st.logger.Printf("sh = %+v", sh)
-	if err := sh.WriteTo(st.conn); err != nil {
+	// Like rsync, send back the (empty) sum head which the receiver sent.
+	if err := head.WriteTo(st.conn); err != nil {
 		return err
 	}
 
 	h := md4.New()
 	binary.Write(h, binary.LittleEndian, st.seed)
 
+	// Files which fit into a single chunk are hashed while sending them: for
+	// these, opening the file a second time and starting a goroutine costs
+	// more than the hashing itself, which dominates transfers of many small
+	// files.
+	hashInline := fi.Size() <= chunkSize
+
 	// Calculate the md4 hash in a goroutine.
 	//
 	// This allows an rsync connection to benefit from more than 1 core!
@@ -182,20 +192,25 @@ func (st *sendTransfer) sendFile(fileIndex int32, fl file) error {
 	// independently. This keeps the hot loop below focused on shoveling data
 	// into the network socket as quickly as possible.
 	var eg errgroup.Group
-	eg.Go(func() error {
-		f, err := os.Open(fl.path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		var buf [chunkSize]byte
-		if _, err := io.CopyBuffer(h, f, buf[:]); err != nil {
-			return err
-		}
-		return nil
-	})
+	if !hashInline {
+		eg.Go(func() error {
+			f, err := st.openFile(fl.path())
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			var buf [chunkSize]byte
+			if _, err := io.CopyBuffer(h, f, buf[:]); err != nil {
+				return err
+			}
+			return nil
+		})
+	}
 
-	buf := make([]byte, chunkSize)
+	if st.buf == nil {
+		st.buf = make([]byte, chunkSize)
+	}
+	buf := st.buf
 	for {
 		n, err := f.Read(buf)
 		if err != nil {
@@ -204,7 +219,20 @@ func (st *sendTransfer) sendFile(fileIndex int32, fl file) error {
 			}
 			return err
 		}
+		if n == 0 {
+			// A zero-length chunk would mark the end of the file.
+			continue
+		}
 		chunk := buf[:n]
+		if hashInline {
+			h.Write(chunk)
+		}
+		if st.tokens != nil {
+			if _, err := st.tokens.Write(chunk); err != nil {
+				return err
+			}
+			continue
+		}
 		// chunk size (“rawtok” variable in openrsync)
 		if err := st.conn.WriteInt32(int32(len(chunk))); err != nil {
 			return err
@@ -214,7 +242,11 @@ func (st *sendTransfer) sendFile(fileIndex int32, fl file) error {
 		}
 	}
 	// transfer finished:
-	if err := st.conn.WriteInt32(0); err != nil {
+	if st.tokens != nil {
+		if err := st.tokens.End(); err != nil {
+			return err
+		}
+	} else if err := st.conn.WriteInt32(0); err != nil {
 		return err
 	}
 
@@ -0,0 +1,87 @@
+package rsyncd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// sessionRequest is sent by the client instead of a module name to start a
+// persistent session, in which the connection is reused for multiple
+// transfers. This is a gokr-rsync extension of the rsync daemon protocol:
+// rsync (and gokr-rsyncd without WithPersistentSessions) reject the request
+// like an unknown module.
+//
+// Within a session, the client sends a module name (followed by the usual
+// exchange) for each transfer. Once a transfer is complete, the daemon waits
+// for the next module name. The session ends when the client closes the
+// connection. A client which authenticated for one module is not asked to
+// authenticate again for modules which accept the same user and password.
+const sessionRequest = "#session"
+
+// WithPersistentSessions allows clients to reuse their connection for
+// multiple transfers, see sessionRequest.
+func WithPersistentSessions(enabled bool) Option {
+	return serverOptionFunc(func(s *Server) {
+		s.persistentSessions = enabled
+	})
+}
+
+// session is the state of a persistent session. A nil *session is valid and
+// represents a regular (single transfer) connection.
+type session struct {
+	user *authUser // nil until the client authenticated
+}
+
+// reusableAuth returns the user the client authenticated as earlier in the
+// session, if the user is accepted by mod with the same password.
+func (s *Server) reusableAuth(sess *session, mod Module) *authUser {
+	if sess == nil || sess.user == nil {
+		return nil
+	}
+	if !mod.authorized(sess.user.name) {
+		return nil
+	}
+	secret, err := s.secret(mod, sess.user.name)
+	if err != nil || secret != sess.user.secret {
+		return nil
+	}
+	return sess.user
+}
+
+func (sess *session) authenticated(user *authUser) {
+	if sess == nil {
+		return
+	}
+	sess.user = user
+}
+
+func (s *Server) handleSession(rd *bufio.Reader, crd *countingReader, cwr *countingWriter, remoteAddr net.Addr) error {
+	if !s.persistentSessions {
+		fmt.Fprintf(cwr, "@ERROR: persistent sessions are not enabled\n")
+		return errors.New("client requested a persistent session, but persistent sessions are not enabled")
+	}
+	s.logger.Printf("client %v started a persistent session", remoteAddr)
+	io.WriteString(cwr, "@RSYNCD: SESSION\n")
+	sess := &session{}
+	for transfers := 0; ; transfers++ {
+		requestedModule, err := readLine(rd)
+		if err != nil {
+			if err == io.EOF && requestedModule == "" {
+				s.logger.Printf("client %v ended the session after %d transfers", remoteAddr, transfers)
+				return nil
+			}
+			return err
+		}
+		// Statistics are per transfer, not per connection.
+		crd.read = 0
+		cwr.written = 0
+		requestedModule = strings.TrimSpace(requestedModule)
+		if err := s.handleModuleRequest(rd, crd, cwr, remoteAddr, requestedModule, sess); err != nil {
+			return err
+		}
+	}
+}
@@ -2,7 +2,14 @@
 
 package rsyncd
 
-import "io/fs"
+import (
+	"errors"
+	"io/fs"
+)
+
+func fakeSuperStat(string, fs.FileInfo) (fs.FileInfo, error) {
+	return nil, errors.New("--fake-super is not supported on this platform")
+}
 
 func uidFromFileInfo(fs.FileInfo) (int32, bool) {
 	return 0, false
@@ -5,9 +5,78 @@ package rsyncd
 import (
 	"io/fs"
 	"syscall"
+
+	"github.com/gokrazy/rsync"
+	"github.com/gokrazy/rsync/internal/fakesuper"
+	"github.com/gokrazy/rsync/internal/longpath"
+	"golang.org/x/sys/unix"
 )
 
+// fakeSuperFileInfo is a fs.FileInfo whose mode, ownership and device number
+// are replaced by those stored in the %stat extended attribute.
+type fakeSuperFileInfo struct {
+	fs.FileInfo
+	stat fakesuper.Stat
+}
+
+func (fi *fakeSuperFileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.stat.Mode & 0o777)
+	switch fi.stat.Mode & rsync.S_IFMT {
+	case rsync.S_IFDIR:
+		mode |= fs.ModeDir
+	case rsync.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case rsync.S_IFBLK:
+		mode |= fs.ModeDevice
+	case rsync.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case rsync.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case rsync.S_IFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if fi.stat.Mode&syscall.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if fi.stat.Mode&syscall.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if fi.stat.Mode&syscall.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+func (fi *fakeSuperFileInfo) IsDir() bool { return fi.Mode().IsDir() }
+
+// fakeSuperStat returns info (the Lstat result for path), with the attributes
+// stored by --fake-super applied, if any.
+//
+// rsync/xattrs.c:x_lstat
+func fakeSuperStat(path string, info fs.FileInfo) (fs.FileInfo, error) {
+	if info.Mode().Type()&fs.ModeSymlink != 0 {
+		// Linux does not support user extended attributes on symlinks.
+		return info, nil
+	}
+	resolved, release, err := longpath.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	st, err := fakesuper.Get(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return info, nil
+	}
+	return &fakeSuperFileInfo{FileInfo: info, stat: *st}, nil
+}
+
 func uidFromFileInfo(info fs.FileInfo) (int32, bool) {
+	if fi, ok := info.(*fakeSuperFileInfo); ok {
+		return int32(fi.stat.Uid), true
+	}
 	st, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return 0, false
@@ -16,6 +85,9 @@ func uidFromFileInfo(info fs.FileInfo) (int32, bool) {
 }
 
 func gidFromFileInfo(info fs.FileInfo) (int32, bool) {
+	if fi, ok := info.(*fakeSuperFileInfo); ok {
+		return int32(fi.stat.Gid), true
+	}
 	st, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return 0, false
@@ -24,6 +96,9 @@ func gidFromFileInfo(info fs.FileInfo) (int32, bool) {
 }
 
 func rdevFromFileInfo(info fs.FileInfo) (int32, bool) {
+	if fi, ok := info.(*fakeSuperFileInfo); ok {
+		return int32(unix.Mkdev(fi.stat.Major, fi.stat.Minor)), true
+	}
 	st, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
 		return 0, false
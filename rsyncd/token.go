@@ -30,8 +30,36 @@ func (st *sendTransfer) simpleSendToken(ms *mapStruct, token int32, offset int64
 	return nil
 }
 
+// deflatedSendToken sends n bytes of literal data starting at offset,
+// followed by token, through the compressed token stream. toklen is the
+// length of the block referred to by token, which the compressor needs to
+// keep its history in sync with the receiver.
+//
+// rsync/token.c:send_deflated_token
+func (st *sendTransfer) deflatedSendToken(ms *mapStruct, token int32, offset int64, n int64, toklen int64) error {
+	for l := int64(0); l < n; {
+		n1 := int64(chunkSize)
+		if n-l < n1 {
+			n1 = n - l
+		}
+		if _, err := st.tokens.Write(ms.ptr(offset+l, int32(n1))); err != nil {
+			return err
+		}
+		l += n1
+	}
+	switch {
+	case token == -1:
+		return st.tokens.End()
+	case token >= 0:
+		return st.tokens.Token(token, ms.ptr(offset+n, int32(toklen)))
+	}
+	return nil
+}
+
 // rsync/token.c:send_token
-func (st *sendTransfer) sendToken(ms *mapStruct, i int32, offset int64, n int64) error {
-	// TODO(compression): send deflated token
+func (st *sendTransfer) sendToken(ms *mapStruct, i int32, offset int64, n int64, toklen int64) error {
+	if st.tokens != nil {
+		return st.deflatedSendToken(ms, i, offset, n, toklen)
+	}
 	return st.simpleSendToken(ms, i, offset, n)
 }
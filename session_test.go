@@ -0,0 +1,137 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (ln *countingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&ln.accepted, 1)
+	}
+	return conn, err
+}
+
+func sessionModules(t *testing.T) []rsyncd.Module {
+	tmp := t.TempDir()
+	secrets := filepath.Join(tmp, "secrets")
+	if err := ioutil.WriteFile(secrets, []byte("alice:s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var modules []rsyncd.Module
+	for _, name := range []string{"first", "second"} {
+		source := filepath.Join(tmp, name)
+		if err := os.MkdirAll(source, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(source, name+".txt"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modules = append(modules, rsyncd.Module{
+			Name:        name,
+			Path:        source,
+			AuthUsers:   []string{"alice"},
+			SecretsFile: secrets,
+		})
+	}
+	return modules
+}
+
+func TestPersistentSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cln := &countingListener{Listener: ln}
+	srv := rsynctest.New(t, sessionModules(t),
+		rsynctest.Listener(cln),
+		rsynctest.ServerOptions(rsyncd.WithPersistentSessions(true)))
+
+	sess, err := receivermaincmd.DialSession("localhost:" + srv.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	dest := t.TempDir()
+
+	// Only the first transfer has a password available: the second transfer
+	// must reuse the authentication of the session.
+	os.Setenv("RSYNC_PASSWORD", "s3cret")
+	defer os.Unsetenv("RSYNC_PASSWORD")
+	for _, name := range []string{"first", "second"} {
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"rsync://alice@localhost:" + srv.Port + "/" + name + "/",
+			dest + "/",
+		}
+		if _, err := sess.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+			t.Fatalf("transfer of module %q: %v", name, err)
+		}
+		os.Unsetenv("RSYNC_PASSWORD")
+
+		got, err := ioutil.ReadFile(filepath.Join(dest, name+".txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != name {
+			t.Errorf("%s.txt: got %q, want %q", name, got, name)
+		}
+	}
+
+	if got, want := atomic.LoadInt32(&cln.accepted), int32(1); got != want {
+		t.Errorf("daemon accepted %d connections, want %d", got, want)
+	}
+}
+
+func TestPersistentSessionAuthFailure(t *testing.T) {
+	srv := rsynctest.New(t, sessionModules(t),
+		rsynctest.ServerOptions(rsyncd.WithPersistentSessions(true)))
+
+	sess, err := receivermaincmd.DialSession("localhost:" + srv.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	os.Setenv("RSYNC_PASSWORD", "wrong")
+	defer os.Unsetenv("RSYNC_PASSWORD")
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://alice@localhost:" + srv.Port + "/first/",
+		t.TempDir() + "/",
+	}
+	if _, err := sess.Main(args, os.Stdin, os.Stdout, os.Stdout); err == nil {
+		t.Fatal("transfer unexpectedly succeeded with wrong password")
+	}
+}
+
+func TestPersistentSessionDisabled(t *testing.T) {
+	srv := rsynctest.New(t, sessionModules(t))
+
+	_, err := receivermaincmd.DialSession("localhost:" + srv.Port)
+	if err == nil {
+		t.Fatal("DialSession unexpectedly succeeded")
+	}
+	if !strings.Contains(err.Error(), "persistent sessions") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build linux || darwin
+
+package rsync_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+// TestSignalsDuringTransfer delivers signals while a transfer is running,
+// which interrupts system calls with EINTR, and verifies that the transfer
+// still completes.
+func TestSignalsDuringTransfer(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	for i := 0; i < 500; i++ {
+		fn := filepath.Join(source, "small", fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if os.Getuid() == 0 {
+		rsynctest.CreateDummyDeviceFiles(t, filepath.Join(source, "devices"))
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// Handle SIGUSR1 so that it does not terminate the test process.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer func() {
+		signal.Stop(sigs)
+		close(sigs) // no more signals are delivered, ends the loop below
+	}()
+	go func() {
+		for range sigs {
+		}
+	}()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--fake-super",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest + "/",
+	}
+	_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	close(done)
+	<-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rsynctest.DataFileMatches(filepath.Join(dest, "large-data-file"), headPattern, bodyPattern, endPattern); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		fn := filepath.Join("small", fmt.Sprintf("file%d", i))
+		if _, err := os.Stat(filepath.Join(dest, fn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
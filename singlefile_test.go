@@ -0,0 +1,180 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSingleFileSource(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "sub", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range []struct {
+		name  string
+		dest  string            // relative to the test’s temporary directory
+		dirs  []string          // existing directories
+		files []string          // existing files
+		want  map[string]string // contents of the temporary directory
+	}{
+		{
+			name: "ExistingDir",
+			dest: "dir",
+			dirs: []string{"dir"},
+			want: map[string]string{"dir/file": "content"},
+		},
+		{
+			name: "DirWithSlash",
+			dest: "dir/",
+			want: map[string]string{"dir/file": "content"},
+		},
+		{
+			name: "DestFile",
+			dest: "destfile",
+			want: map[string]string{"destfile": "content"},
+		},
+		{
+			name:  "ExistingDestFile",
+			dest:  "destfile",
+			files: []string{"destfile"},
+			want:  map[string]string{"destfile": "content"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.Mkdir(filepath.Join(tmp, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, fn := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The result is the same with and without recursion.
+			for _, flags := range []string{"-lptgoD", "-a"} {
+				args := []string{
+					"gokr-rsync",
+					flags,
+					"rsync://localhost:" + srv.Port + "/interop/sub/file",
+					tmp + "/" + tt.dest,
+				}
+				if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.want, treeContents(t, tmp)); diff != "" {
+					t.Errorf("%q: unexpected contents: diff (-want +got):\n%s", args, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestDestTrailingSlash(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	for fn, content := range map[string]string{
+		"dir/file": "in dir",
+		"a":        "a",
+		"b":        "b",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+	url := "rsync://localhost:" + srv.Port + "/interop/"
+
+	for _, tt := range []struct {
+		name    string
+		sources []string // relative to the module
+		dest    string   // relative to the test’s temporary directory
+		files   []string // existing files
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "FileToNewDir",
+			sources: []string{"a"},
+			dest:    "newdir/",
+			want:    map[string]string{"newdir/a": "a"},
+		},
+		{
+			name:    "FileToNewName",
+			sources: []string{"a"},
+			dest:    "newname",
+			want:    map[string]string{"newname": "a"},
+		},
+		{
+			name:    "DirToNewDir",
+			sources: []string{"dir"},
+			dest:    "newdir/",
+			want:    map[string]string{"newdir/dir/file": "in dir"},
+		},
+		{
+			name:    "DirToNewName",
+			sources: []string{"dir"},
+			dest:    "newname",
+			want:    map[string]string{"newname/dir/file": "in dir"},
+		},
+		{
+			name:    "MultipleFilesToNewName",
+			sources: []string{"a", "b"},
+			dest:    "newname",
+			want:    map[string]string{"newname/a": "a", "newname/b": "b"},
+		},
+		{
+			name:    "MultipleFilesToExistingFile",
+			sources: []string{"a", "b"},
+			dest:    "existing",
+			files:   []string{"existing"},
+			want:    map[string]string{"existing": "old"},
+			wantErr: "destination must be a directory",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			for _, fn := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := []string{"gokr-rsync", "-a"}
+			for _, src := range tt.sources {
+				args = append(args, url+src)
+			}
+			args = append(args, tmp+"/"+tt.dest)
+			_, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("%q: got err=%v, want error containing %q", args, err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, treeContents(t, tmp)); diff != "" {
+				t.Errorf("%q: unexpected contents: diff (-want +got):\n%s", args, diff)
+			}
+		})
+	}
+}
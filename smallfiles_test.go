@@ -0,0 +1,144 @@
+package rsync_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/google/go-cmp/cmp"
+)
+
+var smallFiles = flag.Int("small_files", 100000, "number of files for BenchmarkSmallFiles")
+
+// createSmallFiles creates a tree of n small files, 100 per directory.
+func createSmallFiles(tb testing.TB, source string, n int) {
+	tb.Helper()
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(source, fmt.Sprintf("dir%04d", i/100))
+		if i%100 == 0 {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		fn := filepath.Join(dir, fmt.Sprintf("file%03d", i%100))
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// treeContents returns the contents of all files below dir, keyed by their
+// relative name.
+func treeContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents[rel] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+// BenchmarkSmallFiles measures the files/s of downloading a tree of small
+// files. With the default 100k files, on a single-CPU Linux VM:
+//
+//	before the small files fast path: 1760, 1037, 1005 files/s
+//	with the small files fast path:   3352, 2977, 3670 files/s
+//
+// measured using go test -run '^$' -bench SmallFiles -benchtime=1x (3 runs),
+// before on the parent of the fast path commit (with this benchmark copied
+// over). The fast path creates temporary files next to their destination,
+// hashes small files while sending them and buffers the sender’s output.
+//
+// Stat and open are not switched to *at system calls: CPU profiles show that
+// the receiver’s time is spent creating, syncing and renaming files, while
+// lstat accounts for about 2%. The generator and receiver already run
+// concurrently, so the sender’s file requests are pipelined.
+func BenchmarkSmallFiles(b *testing.B) {
+	tmp := b.TempDir()
+	source := filepath.Join(tmp, "source")
+	createSmallFiles(b, source, *smallFiles)
+
+	srv := rsynctest.New(b, rsynctest.InteropModule(source))
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		dest := filepath.Join(tmp, fmt.Sprintf("dest%d", i))
+		args := []string{
+			"gokr-rsync",
+			"-a",
+			"rsync://localhost:" + srv.Port + "/interop/",
+			dest,
+		}
+		if _, err := receivermaincmd.Main(args, os.Stdin, ioutil.Discard, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(*smallFiles*b.N)/time.Since(start).Seconds(), "files/s")
+}
+
+func TestSmallFiles(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	createSmallFiles(t, source, 1000)
+
+	// Files around the sender’s chunk size (256 KiB), below which files are
+	// hashed while sending them.
+	for fn, size := range map[string]int{
+		"empty":       0,
+		"chunk":       256 * 1024,
+		"chunk-plus1": 256*1024 + 1,
+		"large":       1024*1024 + 17,
+	} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i % 251)
+		}
+		if err := ioutil.WriteFile(filepath.Join(source, fn), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range []struct {
+		name  string
+		extra []string
+	}{
+		{name: "Uncompressed"},
+		{name: "Compressed", extra: []string{"-z"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			args := append([]string{"gokr-rsync", "-a"}, tt.extra...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest)
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(treeContents(t, source), treeContents(t, dest)); diff != "" {
+				t.Fatalf("unexpected destination contents: diff (-source +dest):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"golang.org/x/sys/unix"
+)
+
+const mib = 1024 * 1024
+
+// seekData is lseek(2)’s SEEK_DATA, which golang.org/x/sys/unix lacks in the
+// version we use.
+const seekData = 3
+
+// requirePunchHole skips the test if the file system of dir does not support
+// punching holes.
+func requirePunchHole(t *testing.T, dir string) {
+	t.Helper()
+	f, err := ioutil.TempFile(dir, "punch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(mib); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, mib); err != nil {
+		t.Skipf("file system does not support punching holes: %v", err)
+	}
+}
+
+// isHole reports whether the range [off, off+length) of fn contains no data.
+func isHole(t *testing.T, fn string, off, length int64) bool {
+	t.Helper()
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := unix.Seek(int(f.Fd()), off, seekData)
+	if err == unix.ENXIO {
+		return true // no data after off
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data >= off+length
+}
+
+func TestSparse(t *testing.T) {
+	tmp := t.TempDir()
+	requirePunchHole(t, tmp)
+
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The new version consists of data, zeros, data and zeros (1 MiB each).
+	// The old version has data where the new version has zeros, except for
+	// the last MiB, which is a hole in both versions.
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 4*mib)
+	rnd.Read(old[:3*mib])
+	content := make([]byte, 4*mib)
+	copy(content[:mib], old[:mib])
+	copy(content[2*mib:3*mib], old[2*mib:3*mib])
+	copy(content[2*mib:], "changed")
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	for _, tt := range []struct {
+		desc        string
+		flags       []string
+		wantInplace bool
+	}{
+		{desc: "Sparse", flags: []string{"--sparse"}},
+		{desc: "InplaceSparse", flags: []string{"--inplace", "-S"}, wantInplace: true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			fn := filepath.Join(dest, "file")
+			if err := ioutil.WriteFile(fn, old[:3*mib], 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(fn, int64(len(old))); err != nil {
+				t.Fatal(err)
+			}
+			past := time.Now().Add(-1 * time.Hour)
+			if err := os.Chtimes(fn, past, past); err != nil {
+				t.Fatal(err)
+			}
+			if !isHole(t, fn, 3*mib, mib) {
+				t.Fatalf("setup: last MiB of %s is not a hole", fn)
+			}
+			before, err := os.Stat(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := append([]string{"gokr-rsync", "-a"}, tt.flags...)
+			args = append(args, "rsync://localhost:"+srv.Port+"/interop/", dest+"/")
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("%s differs from the source after the transfer", fn)
+			}
+			after, err := os.Stat(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := os.SameFile(before, after); got != tt.wantInplace {
+				t.Errorf("destination file updated in place = %v, want %v", got, tt.wantInplace)
+			}
+			if !isHole(t, fn, 1*mib, mib) {
+				t.Errorf("zeros at [1 MiB, 2 MiB) of %s are not a hole", fn)
+			}
+			if !isHole(t, fn, 3*mib, mib) {
+				t.Errorf("zeros at [3 MiB, 4 MiB) of %s are not a hole", fn)
+			}
+			if isHole(t, fn, 0, mib) || isHole(t, fn, 2*mib, mib) {
+				t.Errorf("data of %s is in a hole", fn)
+			}
+		})
+	}
+}
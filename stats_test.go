@@ -0,0 +1,169 @@
+package rsync_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestStatsPhaseTimings(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+	// A differing file in the destination makes the receiver generate
+	// checksums for a delta transfer.
+	rsynctest.WriteLargeDataFile(t, dest, headPattern, []byte{0xcc}, endPattern)
+	old := time.Now().Add(-1 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dest, "large-data-file"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	var stdout bytes.Buffer
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--info=stats2",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	start := time.Now()
+	stats, err := receivermaincmd.Main(args, os.Stdin, &stdout, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	output := stdout.String()
+	t.Logf("output:\n%s", output)
+	for _, want := range []string{
+		"File list transfer time: ",
+		"Checksum generation time: ",
+		"Data transfer time: ",
+		"Finalize time: ",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("stats output does not contain %q", want)
+		}
+	}
+
+	timings := stats.Timings
+	for name, d := range map[string]time.Duration{
+		"file list": timings.FileList,
+		"checksum":  timings.Checksum,
+		"transfer":  timings.Transfer,
+		"finalize":  timings.Finalize,
+	} {
+		if d < 0 {
+			t.Errorf("%s phase duration is negative: %v", name, d)
+		}
+	}
+	if timings.Checksum == 0 {
+		t.Errorf("checksum phase duration unexpectedly zero")
+	}
+
+	// The phases cover the entire transfer, except for establishing the
+	// connection, which takes a negligible amount of time on localhost.
+	total := timings.Total()
+	if total > elapsed {
+		t.Errorf("phase timings sum (%v) exceeds elapsed time (%v)", total, elapsed)
+	}
+	tolerance := elapsed / 10
+	if min := 50 * time.Millisecond; tolerance < min {
+		tolerance = min
+	}
+	if diff := elapsed - total; diff > tolerance {
+		t.Errorf("phase timings sum (%v) differs from elapsed time (%v) by more than %v", total, elapsed, tolerance)
+	}
+}
+
+// TestInteropStats verifies that the statistics exchange at the end of a
+// transfer leaves the connection in sync with stock rsync, regardless of
+// whether --stats was requested.
+func TestInteropStats(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := filepath.Join(tmp, "upload")
+	if err := os.MkdirAll(upload, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name: "interop",
+			Path: source,
+		},
+		{
+			Name:     "upload",
+			Path:     upload,
+			Writable: true,
+		},
+	})
+
+	for _, direction := range []string{"Download", "Upload"} {
+		for _, stats := range []bool{false, true} {
+			name := direction
+			if stats {
+				name += "/Stats"
+			} else {
+				name += "/NoStats"
+			}
+			t.Run(name, func(t *testing.T) {
+				args := []string{"--archive", "--port=" + srv.Port}
+				if stats {
+					args = append(args, "--stats")
+				}
+				if direction == "Download" {
+					args = append(args, "rsync://localhost/interop/", t.TempDir()+"/")
+				} else {
+					sub := strings.ReplaceAll(name, "/", "-")
+					args = append(args, source+"/", "rsync://localhost/upload/"+sub+"/")
+				}
+
+				// A desynchronized connection typically hangs, so bound
+				// the runtime instead of relying on the test timeout.
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				var stdout, stderr bytes.Buffer
+				rsync := exec.CommandContext(ctx, "rsync", args...)
+				rsync.Stdout = &stdout
+				rsync.Stderr = &stderr
+				if err := rsync.Run(); err != nil {
+					t.Fatalf("%v: %v\nstderr:\n%s", rsync.Args, err, stderr.String())
+				}
+				if stderr.Len() > 0 {
+					t.Errorf("rsync unexpectedly printed to stderr:\n%s", stderr.String())
+				}
+				const totals = "Total bytes sent"
+				if got := strings.Contains(stdout.String(), totals); got != stats {
+					t.Errorf("stdout contains %q = %v, want %v:\n%s", totals, got, stats, stdout.String())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux || darwin
+
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"golang.org/x/sys/unix"
+)
+
+func TestSymlinkModTime(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(source, "target")
+	if err := ioutil.WriteFile(target, []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(source, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatal(err)
+	}
+
+	// The symlink and its target have different modification times.
+	targetTime := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(target, targetTime, targetTime); err != nil {
+		t.Fatal(err)
+	}
+	linkTime := targetTime.Add(-24 * time.Hour)
+	ts := unix.NsecToTimespec(linkTime.UnixNano())
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, link, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-rtl",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for fn, want := range map[string]time.Time{
+		"link":   linkTime,
+		"target": targetTime,
+	} {
+		st, err := os.Lstat(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.ModTime(); !got.Equal(want) {
+			t.Errorf("%s: unexpected modification time: got %v, want %v", fn, got, want)
+		}
+	}
+}
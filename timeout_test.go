@@ -0,0 +1,105 @@
+package rsync_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/internal/rsyncwire"
+)
+
+func TestTimeoutWithBwLimit(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 3*1024)
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// At 1 KiB/s, the transfer takes a few seconds, most of which the sender
+	// spends sleeping to honor the limit.
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--bwlimit=1",
+		"--timeout=1",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dest, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("unexpected file contents after transfer")
+	}
+}
+
+func TestTimeoutStalledServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Accept the module request and the args, then stall instead of
+		// sending the checksum seed.
+		fmt.Fprintf(conn, "@RSYNCD: 27\n")
+		rd := bufio.NewReader(conn)
+		rd.ReadString('\n') // client greeting
+		rd.ReadString('\n') // module
+		fmt.Fprintf(conn, "@RSYNCD: OK\n")
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil || strings.TrimSpace(line) == "" {
+				break
+			}
+		}
+		// Wait for the client to give up.
+		rd.ReadString('\n')
+	}()
+
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--timeout=1",
+		"rsync://localhost:" + port + "/interop/",
+		t.TempDir(),
+	}
+	start := time.Now()
+	_, err = receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout)
+	if !errors.Is(err, rsyncwire.ErrTimeout) {
+		t.Fatalf("Main: got err=%v, want %v", err, rsyncwire.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("timeout took %v, want about 1s", elapsed)
+	}
+}
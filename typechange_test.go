@@ -0,0 +1,178 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+type entryType int
+
+const (
+	typeFile entryType = iota
+	typeDir
+	typeSymlink
+)
+
+func (et entryType) String() string {
+	return [...]string{"file", "directory", "symlink"}[et]
+}
+
+func createEntry(t *testing.T, fn string, et entryType) {
+	t.Helper()
+	switch et {
+	case typeFile:
+		if err := ioutil.WriteFile(fn, []byte("file contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	case typeDir:
+		// Create a non-empty directory
+		if err := os.MkdirAll(fn, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(fn, "child"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	case typeSymlink:
+		if err := os.Symlink("target", fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func typeOf(t *testing.T, fn string) entryType {
+	t.Helper()
+	st, err := os.Lstat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case st.IsDir():
+		return typeDir
+	case st.Mode()&os.ModeSymlink != 0:
+		return typeSymlink
+	default:
+		return typeFile
+	}
+}
+
+func TestTypeChange(t *testing.T) {
+	for _, tt := range []struct {
+		dest, source entryType
+	}{
+		{dest: typeFile, source: typeDir},
+		{dest: typeDir, source: typeFile},
+		{dest: typeFile, source: typeSymlink},
+		{dest: typeSymlink, source: typeFile},
+		{dest: typeDir, source: typeSymlink},
+		{dest: typeSymlink, source: typeDir},
+	} {
+		t.Run(tt.dest.String()+"→"+tt.source.String(), func(t *testing.T) {
+			tmp := t.TempDir()
+			source := filepath.Join(tmp, "source")
+			dest := filepath.Join(tmp, "dest")
+			for _, dir := range []string{source, dest} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			createEntry(t, filepath.Join(source, "entry"), tt.source)
+			createEntry(t, filepath.Join(dest, "entry"), tt.dest)
+
+			srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+			args := []string{
+				"gokr-rsync",
+				"-a",
+				"--force",
+				"rsync://localhost:" + srv.Port + "/interop/",
+				dest,
+			}
+			if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := typeOf(t, filepath.Join(dest, "entry")), tt.source; got != want {
+				t.Fatalf("unexpected destination type: got %v, want %v", got, want)
+			}
+			if tt.source == typeFile {
+				b, err := ioutil.ReadFile(filepath.Join(dest, "entry"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := string(b), "file contents"; got != want {
+					t.Fatalf("unexpected file contents: got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTypeChangeWithoutForce(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createEntry(t, filepath.Join(source, "entry"), typeFile)
+	createEntry(t, filepath.Join(dest, "entry"), typeDir)
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without --force, non-empty directories must not be deleted:
+	if got, want := typeOf(t, filepath.Join(dest, "entry")), typeDir; got != want {
+		t.Fatalf("unexpected destination type: got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "entry", "child")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypeChangeWithDelete(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+	for _, dir := range []string{source, dest} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createEntry(t, filepath.Join(source, "entry"), typeFile)
+	createEntry(t, filepath.Join(dest, "entry"), typeDir)
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	// Like rsync, --delete implies deleting non-empty directories when
+	// replacing them (without --force):
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"--delete",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := typeOf(t, filepath.Join(dest, "entry")), typeFile; got != want {
+		t.Fatalf("unexpected destination type: got %v, want %v", got, want)
+	}
+}
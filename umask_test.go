@@ -0,0 +1,91 @@
+//go:build linux || darwin
+
+package rsync_test
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+)
+
+func TestUmaskWithoutPerms(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	for fn, perm := range map[string]fs.FileMode{
+		"file":         0666,
+		"exec":         0777,
+		"setuid":       0755 | fs.ModeSetuid,
+		"sub/file":     0644,
+		"existing":     0666,
+		"sub/deep/dir": fs.ModeDir | 0777,
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if perm.IsDir() {
+			if err := os.Mkdir(fn, 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fn, perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// existing files keep their permissions
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "existing"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, rsynctest.InteropModule(source))
+
+	old := syscall.Umask(0027)
+	defer syscall.Umask(old)
+
+	// -r and -t, but not -p
+	args := []string{
+		"gokr-rsync",
+		"-rt",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+
+	for fn, want := range map[string]fs.FileMode{
+		"file":         0640,
+		"exec":         0750,
+		"setuid":       0750,
+		"sub":          fs.ModeDir | 0750,
+		"sub/file":     0640,
+		"sub/deep":     fs.ModeDir | 0750,
+		"sub/deep/dir": fs.ModeDir | 0750,
+		"existing":     0600,
+	} {
+		st, err := os.Stat(filepath.Join(dest, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := st.Mode() & (fs.ModeDir | fs.ModePerm | fs.ModeSetuid); got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", fn, got, want)
+		}
+	}
+}
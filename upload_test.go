@@ -0,0 +1,149 @@
+package rsync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestInteropUpload(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	// create files in source to be uploaded
+	for _, fn := range []string{
+		"hello",
+		"subdir/nested",
+		"subdir/deeper/file",
+	} {
+		fn = filepath.Join(source, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello", filepath.Join(source, "link_to_hello")); err != nil {
+		t.Fatal(err)
+	}
+	headPattern := []byte{0x11}
+	bodyPattern := []byte{0xbb}
+	endPattern := []byte{0xee}
+	rsynctest.WriteLargeDataFile(t, source, headPattern, bodyPattern, endPattern)
+
+	// start a server to upload to
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:     "interop",
+			Path:     dest,
+			Writable: true,
+		},
+	})
+
+	// upload source into the module
+	rsync := exec.Command("rsync", //"/home/michael/src/openrsync/openrsync",
+		//		"--debug=all4",
+		"--archive",
+		"-v", "-v", "-v", "-v",
+		"--port="+srv.Port,
+		source+"/",
+		"rsync://localhost/interop/")
+	rsync.Stdout = os.Stdout
+	rsync.Stderr = os.Stderr
+	if err := rsync.Run(); err != nil {
+		t.Fatalf("%v: %v", rsync.Args, err)
+	}
+
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(path, source)
+		destInfo, err := os.Lstat(filepath.Join(dest, rel))
+		if err != nil {
+			return err
+		}
+		if got, want := destInfo.Mode(), info.Mode(); got != want {
+			t.Errorf("%s: unexpected mode: got %v, want %v", rel, got, want)
+		}
+		if info.Mode().IsRegular() {
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dest, rel))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: unexpected file contents", rel)
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filepath.Join(dest, rel))
+			if err != nil {
+				return err
+			}
+			if got, want := target, "hello"; got != want {
+				t.Errorf("%s: unexpected symlink target: got %q, want %q", rel, got, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInteropUploadReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	dest := filepath.Join(tmp, "dest")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// modules are read-only unless configured otherwise
+	srv := rsynctest.New(t, rsynctest.InteropModule(dest))
+
+	var buf bytes.Buffer
+	rsync := exec.Command("rsync", //"/home/michael/src/openrsync/openrsync",
+		"--archive",
+		"--port="+srv.Port,
+		source+"/",
+		"rsync://localhost/interop/")
+	rsync.Stdout = &buf
+	rsync.Stderr = &buf
+	if err := rsync.Run(); err == nil {
+		t.Fatalf("rsync unexpectedly succeeded uploading into a read-only module")
+	}
+	output := buf.String()
+	if want := "read only"; !strings.Contains(output, want) {
+		t.Fatalf("rsync output unexpectedly did not contain %q:\n%s", want, output)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "hello")); !os.IsNotExist(err) {
+		t.Fatalf("file unexpectedly uploaded into read-only module (stat: %v)", err)
+	}
+}
@@ -0,0 +1,101 @@
+package rsync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/rsync/internal/receivermaincmd"
+	"github.com/gokrazy/rsync/internal/rsynctest"
+	"github.com/gokrazy/rsync/rsyncd"
+)
+
+func TestXferExecTimeout(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:            "interop",
+			Path:            source,
+			PreXferExec:     "sleep 30",
+			XferExecTimeout: 1,
+		},
+	})
+
+	dest := filepath.Join(tmp, "dest")
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	start := time.Now()
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err == nil {
+		t.Fatalf("rsync unexpectedly succeeded despite hanging pre-xfer exec")
+	}
+	if elapsed := time.Since(start); elapsed > 15*time.Second {
+		t.Errorf("transfer failed after %v, want the pre-xfer exec to be killed after 1s", elapsed)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file")); !os.IsNotExist(err) {
+		t.Errorf("file unexpectedly transferred despite failing pre-xfer exec (err=%v)", err)
+	}
+}
+
+func TestPostXferExec(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status := filepath.Join(tmp, "status")
+
+	srv := rsynctest.New(t, []rsyncd.Module{
+		{
+			Name:         "interop",
+			Path:         source,
+			PreXferExec:  "test \"$RSYNC_MODULE_NAME\" = interop",
+			PostXferExec: "echo \"$RSYNC_EXIT_STATUS\" > " + status,
+		},
+	})
+
+	dest := filepath.Join(tmp, "dest")
+	args := []string{
+		"gokr-rsync",
+		"-a",
+		"rsync://localhost:" + srv.Port + "/interop/",
+		dest,
+	}
+	if _, err := receivermaincmd.Main(args, os.Stdin, os.Stdout, os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The post-xfer exec runs after the server finished the transfer, which
+	// might be after the client returned.
+	var got string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b, err := ioutil.ReadFile(status)
+		if err == nil && strings.HasSuffix(string(b), "\n") {
+			got = strings.TrimSpace(string(b))
+			break
+		}
+	}
+	if want := "0"; got != want {
+		t.Errorf("RSYNC_EXIT_STATUS: got %q, want %q", got, want)
+	}
+}